@@ -0,0 +1,307 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultAbuseThreshold is how many failed or rejected requests a client may
+	// make within the window before it is banned; override with
+	// FILECONVERTER_ABUSE_THRESHOLD, where 0 disables abuse detection.
+	defaultAbuseThreshold = 20
+	// defaultAbuseWindow is the period failures are counted over; override with
+	// FILECONVERTER_ABUSE_WINDOW.
+	defaultAbuseWindow = 10 * time.Minute
+	// defaultAbuseBan is how long a banned client is refused; override with
+	// FILECONVERTER_ABUSE_BAN.
+	defaultAbuseBan = 15 * time.Minute
+	// maxAbuseEvents bounds the in-memory list of bans; older events are dropped.
+	maxAbuseEvents = 1000
+)
+
+// abuseStatuses are the response statuses that count against a client: invalid,
+// unauthorised and oversized requests, and failed conversions. Server errors are
+// the server's fault and don't count. Of the 404s, only lookups of unknown file
+// IDs, short codes and workspaces count (see notFound); a browser asking for
+// /favicon.ico does not.
+var abuseStatuses = map[int]bool{
+	http.StatusBadRequest:            true,
+	http.StatusUnauthorized:          true,
+	http.StatusForbidden:             true,
+	http.StatusRequestEntityTooLarge: true,
+	http.StatusUnsupportedMediaType:  true,
+	http.StatusUnprocessableEntity:   true,
+}
+
+// abuseRecord tracks the recent failures of one client.
+type abuseRecord struct {
+	failures    []time.Time // Within the window, oldest first
+	bannedUntil time.Time
+}
+
+// abuseEvent records a client being banned.
+type abuseEvent struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"` // "ip:<address>" or "key:<API key id>"
+	Failures int       `json:"failures"`
+	Until    time.Time `json:"until"`
+	Reason   string    `json:"reason"` // Status of the request that tipped the balance
+}
+
+// abuseGuard temporarily bans clients, by address and by API key, that keep
+// sending invalid or oversized requests or failing conversions.
+type abuseGuard struct {
+	threshold int
+	window    time.Duration
+	banFor    time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*abuseRecord
+	events  []abuseEvent
+}
+
+// newAbuseGuard configures abuse detection from the environment.
+func newAbuseGuard() *abuseGuard {
+	return &abuseGuard{
+		threshold: envInt("FILECONVERTER_ABUSE_THRESHOLD", defaultAbuseThreshold),
+		window:    envDuration("FILECONVERTER_ABUSE_WINDOW", defaultAbuseWindow),
+		banFor:    envDuration("FILECONVERTER_ABUSE_BAN", defaultAbuseBan),
+		clients:   make(map[string]*abuseRecord),
+	}
+}
+
+// enabled reports whether clients are tracked at all.
+func (g *abuseGuard) enabled() bool {
+	return g.threshold > 0
+}
+
+// bannedUntil returns when the latest ban on any of the identities ends, or the
+// zero time if none of them is banned.
+func (g *abuseGuard) bannedUntil(now time.Time, identities ...string) time.Time {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var until time.Time
+	for _, id := range identities {
+		if rec, ok := g.clients[id]; ok && rec.bannedUntil.After(now) && rec.bannedUntil.After(until) {
+			until = rec.bannedUntil
+		}
+	}
+	return until
+}
+
+// countFailure counts a failed request against the identities, banning those
+// that cross the threshold.
+func (g *abuseGuard) countFailure(now time.Time, reason string, identities ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, id := range identities {
+		rec, ok := g.clients[id]
+		if !ok {
+			rec = &abuseRecord{}
+			g.clients[id] = rec
+		}
+		rec.prune(now.Add(-g.window))
+		rec.failures = append(rec.failures, now)
+		if len(rec.failures) < g.threshold || rec.bannedUntil.After(now) {
+			continue
+		}
+
+		rec.bannedUntil = now.Add(g.banFor)
+		event := abuseEvent{Time: now, Client: id, Failures: len(rec.failures), Until: rec.bannedUntil, Reason: reason}
+		log.Printf("Abuse: banned %s until %s after %d failed requests within %v (last: %s)",
+			id, rec.bannedUntil.Format(time.RFC3339), event.Failures, g.window, reason)
+		g.events = append(g.events, event)
+		if len(g.events) > maxAbuseEvents {
+			g.events = g.events[len(g.events)-maxAbuseEvents:]
+		}
+	}
+}
+
+// prune drops failures that happened before since.
+func (rec *abuseRecord) prune(since time.Time) {
+	i := 0
+	for i < len(rec.failures) && rec.failures[i].Before(since) {
+		i++
+	}
+	rec.failures = rec.failures[i:]
+}
+
+// cleanup forgets clients with no recent failures and no active ban.
+func (g *abuseGuard) cleanup(now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for id, rec := range g.clients {
+		rec.prune(now.Add(-g.window))
+		if len(rec.failures) == 0 && !rec.bannedUntil.After(now) {
+			delete(g.clients, id)
+		}
+	}
+}
+
+// unban lifts the ban on a client and clears its failures. It reports whether
+// the client was banned.
+func (g *abuseGuard) unban(id string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	rec, ok := g.clients[id]
+	if !ok || !rec.bannedUntil.After(time.Now()) {
+		return false
+	}
+	delete(g.clients, id)
+	return true
+}
+
+// abuseClient summarises a tracked client for the admin API.
+type abuseClient struct {
+	Client      string     `json:"client"`
+	Failures    int        `json:"failures"` // Within the window
+	BannedUntil *time.Time `json:"bannedUntil,omitempty"`
+}
+
+// stats returns the tracked clients, most failures first, and the ban events,
+// oldest first.
+func (g *abuseGuard) stats(now time.Time) ([]abuseClient, []abuseEvent) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	clients := make([]abuseClient, 0, len(g.clients))
+	for id, rec := range g.clients {
+		rec.prune(now.Add(-g.window))
+		c := abuseClient{Client: id, Failures: len(rec.failures)}
+		if rec.bannedUntil.After(now) {
+			until := rec.bannedUntil
+			c.BannedUntil = &until
+		}
+		clients = append(clients, c)
+	}
+	slices.SortFunc(clients, func(a, b abuseClient) int {
+		if a.Failures != b.Failures {
+			return b.Failures - a.Failures
+		}
+		return strings.Compare(a.Client, b.Client)
+	})
+	return clients, append([]abuseEvent{}, g.events...)
+}
+
+// statusRecorder remembers the status a handler responded with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	miss   bool // The handler looked up something that doesn't exist
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, so streamed
+// responses can still be flushed.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// notFound answers a lookup of an unknown file ID, short code or workspace with
+// 404, and marks it so the abuse guard counts it against the client: guessing
+// IDs is how they would be enumerated.
+func notFound(w http.ResponseWriter, msg string) {
+	for rw := w; ; {
+		if sr, ok := rw.(*statusRecorder); ok {
+			sr.miss = true
+			break
+		}
+		u, ok := rw.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			break
+		}
+		rw = u.Unwrap()
+	}
+	http.Error(w, msg, http.StatusNotFound)
+}
+
+// requestIdentities returns the identities a request counts against: its client
+// address and, if it carries a valid one, its API key.
+func requestIdentities(r *http.Request) []string {
+	identities := []string{"ip:" + clientIP(r).String()}
+	secret := r.Header.Get("X-API-Key")
+	if secret == "" {
+		secret, _ = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if secret != "" {
+		if id, ok := keys.lookupAPIKey(secret); ok {
+			identities = append(identities, "key:"+id)
+		}
+	}
+	return identities
+}
+
+// middleware refuses banned clients with 429 and counts failed requests,
+// including the bodies limitBody refuses as too large.
+func (g *abuseGuard) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identities := requestIdentities(r)
+		now := time.Now()
+		if until := g.bannedUntil(now, identities...); !until.IsZero() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(until.Sub(now)/time.Second)+1))
+			http.Error(w, "Too many failed requests; try again later", http.StatusTooManyRequests)
+			return
+		}
+
+		sr := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sr, r)
+		if abuseStatuses[sr.status] || sr.miss && sr.status == http.StatusNotFound {
+			g.countFailure(time.Now(), strconv.Itoa(sr.status)+" from "+r.URL.Path, identities...)
+		}
+	})
+}
+
+// handleAdminAbuse reports the clients with recent failures, active bans and the
+// ban history.
+func handleAdminAbuse(fs *FileStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		clients, events := fs.abuse.stats(time.Now())
+		banned := 0
+		for _, c := range clients {
+			if c.BannedUntil != nil {
+				banned++
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"enabled":   fs.abuse.enabled(),
+			"threshold": fs.abuse.threshold,
+			"window":    fs.abuse.window.String(),
+			"banFor":    fs.abuse.banFor.String(),
+			"banned":    banned,
+			"clients":   clients,
+			"events":    events,
+		})
+	}
+}
+
+// handleAdminUnban lifts the ban on the client named in the path, such as
+// "ip:203.0.113.7" or "key:team-a".
+func handleAdminUnban(fs *FileStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := r.PathValue("client")
+		if !fs.abuse.unban(client) {
+			http.Error(w, "Client is not banned", http.StatusNotFound)
+			return
+		}
+		fs.recordAudit(auditEntry{Action: "unban", Reason: client, Remote: r.RemoteAddr})
+		writeJSON(w, http.StatusOK, map[string]any{"unbanned": client})
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// fileTokenHeader is the request header that may carry a file's share or owner
+// token instead of the "token" query parameter.
+const fileTokenHeader = "X-File-Token"
+
+// errHeldFile is returned when deleting a file under legal hold.
+var errHeldFile = errors.New("file is under legal hold and cannot be deleted")
+
+// File access levels granted by a file's tokens.
+const (
+	accessNone  = iota
+	accessShare // May download the file and read its info
+	accessOwner // May also delete or reconvert it
+)
+
+// fileTokens issues the pair of tokens handed out when a file is created: the
+// share token goes into download links, the owner token is returned once and only
+// its hash is kept.
+func fileTokens() (share, owner string, err error) {
+	if share, err = generateID(); err != nil {
+		return "", "", err
+	}
+	if owner, err = generateID(); err != nil {
+		return "", "", err
+	}
+	return share, owner, nil
+}
+
+// hashOwnerToken hashes an owner token for storage.
+func hashOwnerToken(token string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(token))
+}
+
+// requestFileToken returns the file token a request carries.
+func requestFileToken(r *http.Request) string {
+	if token := r.Header.Get(fileTokenHeader); token != "" {
+		return token
+	}
+	return r.URL.Query().Get("token")
+}
+
+// access reports what a token entitles its bearer to do with the file.
+func (meta *FileMetadata) access(token string) int {
+	if token == "" {
+		return accessNone
+	}
+	if hash := hashOwnerToken(token); subtle.ConstantTimeCompare(hash[:], meta.OwnerTokenHash[:]) == 1 {
+		return accessOwner
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(meta.ShareToken)) == 1 {
+		return accessShare
+	}
+	return accessNone
+}
+
+// authorizeFile looks up a file and checks that the request's token grants at
+// least the wanted access, answering the request itself if not. The token of the
+// workspace a file belongs to grants owner access.
+func authorizeFile(fs *FileStore, w http.ResponseWriter, r *http.Request, fileID string, want int) (*FileMetadata, bool) {
+	meta, err := fs.GetFileInfo(fileID)
+	if err != nil {
+		notFound(w, err.Error())
+		return nil, false
+	}
+	token := requestFileToken(r)
+	if meta.access(token) < want && !fs.workspaceGrants(meta, token) {
+		http.Error(w, "A valid file token is required", http.StatusForbidden)
+		return nil, false
+	}
+	return meta, true
+}
+
+// setJobHeaders identifies a job in response headers, with the share token needed
+// to look it up, so clients can inspect jobs whose response was an error.
+func setJobHeaders(w http.ResponseWriter, meta *FileMetadata) {
+	w.Header().Set("X-Job-Id", meta.ID)
+	w.Header().Set("X-Job-Token", meta.ShareToken)
+}
+
+// DeleteFile removes a file before it expires, unless it is under legal hold.
+// With an undo window the file goes to the trash instead, and the time it will
+// be purged is returned; otherwise it is removed at once and the time is zero.
+func (fs *FileStore) DeleteFile(fileID string) (time.Time, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	now := time.Now()
+	meta, exists := fs.files[fileID]
+	if !exists || meta.expired(now) {
+		return time.Time{}, fmt.Errorf("file not found or expired")
+	}
+	if meta.Hold != nil {
+		return time.Time{}, errHeldFile
+	}
+	if fs.undoWindow > 0 {
+		return fs.trashFile(meta, now), nil
+	}
+	fs.deleteFileInternal(fileID)
+	return time.Time{}, nil
+}
+
+// handleDeleteFile deletes a file on behalf of its owner.
+func handleDeleteFile(fs *FileStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fileID := r.PathValue("id")
+		if _, ok := authorizeFile(fs, w, r, fileID, accessOwner); !ok {
+			return
+		}
+		purgeAt, err := fs.DeleteFile(fileID)
+		if errors.Is(err, errHeldFile) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		log.Printf("File %s deleted by its owner", fileID)
+		body := map[string]any{"deleted": fileID}
+		if !purgeAt.IsZero() {
+			body["restorableUntil"] = purgeAt // POST .../restore with the owner token undoes it
+		}
+		writeJSON(w, http.StatusOK, body)
+	}
+}
+
+// handleReconvert converts a stored file to another format on behalf of its
+// owner, storing the result as a new file with its own tokens, in the source's
+// workspace if it has one. It takes the same "targetFormat" and option form values
+// as an upload. The file is streamed from storage, and archives and large tables
+// are converted file to file as they are on upload.
+func handleReconvert(fs *FileStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fileID := r.PathValue("id")
+		if _, ok := authorizeFile(fs, w, r, fileID, accessOwner); !ok {
+			return
+		}
+		meta, content, err := fs.OpenFile(fileID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		defer content.Close()
+
+		targetFormat := r.FormValue("targetFormat")
+		head := make([]byte, 512)
+		n, _ := content.ReadAt(head, 0)
+		fileType, sourceExt := DetectFileType(head[:n], meta.ConvertedName)
+		opts, err := parseConversionOptions(r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid conversion options: %v", err), http.StatusBadRequest)
+			return
+		}
+		if !conversionSupported(fileType, sourceExt, targetFormat, opts) {
+			http.Error(w, fmt.Sprintf("Conversion from %s to %s is not supported", sourceExt, targetFormat), http.StatusBadRequest)
+			return
+		}
+		attrs, err := parseJobAttributes(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if attrs.Tags == nil {
+			attrs.Tags = meta.Tags
+		}
+		if attrs.Workspace == "" {
+			attrs.Workspace = meta.Workspace // Outputs of a workspace's files stay in it
+		}
+		attrs.Moderation, attrs.moderated = meta.Moderation, true
+		if err := attrs.Receipt.addInput(meta.ConvertedName, io.NewSectionReader(content, 0, meta.Size)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		attrs.Report = &ConversionReport{}
+		opts.Report = attrs.Report
+
+		converted, err := fs.reconvert(r.Context(), meta, content, fileType, sourceExt, targetFormat, opts, attrs)
+		if converted != nil {
+			setJobHeaders(w, converted) // Lets clients look up traces of failed jobs
+		}
+		if err != nil {
+			log.Printf("Error reconverting file %s: %v", fileID, err)
+			http.Error(w, fmt.Sprintf("Error processing file: %v", err), errorStatus(err))
+			return
+		}
+		writeUploadResponse(w, r, converted)
+	}
+}
+
+// reconvert converts the stored file meta describes, read from content, and
+// stores the result, recording a failed job if the conversion fails.
+func (fs *FileStore) reconvert(ctx context.Context, meta *FileMetadata, content fileContent, fileType FileType, sourceExt, targetFormat string, opts ConversionOptions, attrs jobAttributes) (*FileMetadata, error) {
+	input := io.NewSectionReader(content, 0, meta.Size)
+	switch {
+	case fileType == FileTypeArchive:
+		return fs.addArchive(ctx, input, meta.ConvertedName, meta.Size, sourceExt, targetFormat, opts, attrs)
+	case streamsTable(sourceExt, targetFormat):
+		return fs.addStreamedTable(ctx, input, meta.ConvertedName, meta.Size, sourceExt, targetFormat, opts, attrs)
+	}
+
+	data, release, err := readAllPooled(input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file content: %w", err)
+	}
+	defer release()
+	converted, name, err := performConversion(ctx, data, meta.ConvertedName, targetFormat, opts)
+	if err != nil {
+		err = fmt.Errorf("conversion failed: %w", err)
+		failed, recErr := fs.recordFailure(meta.ConvertedName, err, attrs)
+		if recErr != nil {
+			log.Printf("Error recording failed job: %v", recErr)
+		}
+		return failed, err
+	}
+	if sameStart(converted, data) {
+		converted = bytes.Clone(converted) // Has to outlive the pooled buffer
+	}
+	attrs.postHooked = true
+	return fs.storeFile(ctx, meta.ConvertedName, name, getContentTypeForExtension(strings.TrimPrefix(filepath.Ext(name), ".")), converted, attrs)
+}
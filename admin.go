@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// adminToken is the bearer token guarding the admin API, from
+// FILECONVERTER_ADMIN_TOKEN. The admin API is disabled while it is empty.
+var adminToken string
+
+// requireAdmin only lets requests through that carry the admin bearer token.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			http.Error(w, "Admin API is disabled", http.StatusNotFound)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// ListFiles returns copies of the metadata of all live files accepted by keep,
+// oldest first.
+func (fs *FileStore) ListFiles(keep func(*FileMetadata) bool) []FileMetadata {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	now := time.Now()
+	var files []FileMetadata
+	for _, meta := range fs.files {
+		if meta.expired(now) || !keep(meta) {
+			continue
+		}
+		files = append(files, *meta)
+	}
+	slices.SortFunc(files, func(a, b FileMetadata) int {
+		return a.UploadTime.Compare(b.UploadTime)
+	})
+	return files
+}
+
+// handleAdminListFiles lists stored files. Repeated tag=key=value parameters
+// keep files carrying all of the given tags, status keeps files in that state and
+// held=true keeps files under legal hold.
+func handleAdminListFiles(fs *FileStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		want := make(map[string]string)
+		for _, field := range query["tag"] {
+			key, value, err := parseTag(field)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid tag filter: %v", err), http.StatusBadRequest)
+				return
+			}
+			want[key] = value
+		}
+		status := query.Get("status")
+		heldOnly := query.Get("held") == "true"
+
+		files := fs.ListFiles(func(meta *FileMetadata) bool {
+			return (status == "" || meta.Status == status) && (!heldOnly || meta.Hold != nil) && meta.hasTags(want)
+		})
+		list := make([]map[string]any, 0, len(files))
+		for i := range files {
+			list = append(list, fileInfo(r, &files[i]))
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"files": list, "count": len(list)})
+	}
+}
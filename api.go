@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// apiVersion is the current API version. It prefixes the versioned routes and is
+// reported in every JSON response so clients can tell which contract they got.
+const apiVersion = "v1"
+
+// apiPrefix is the path prefix of the versioned routes.
+const apiPrefix = "/" + apiVersion
+
+// legacyRoutes maps the original unversioned routes to their /v1 successors. The
+// legacy paths keep working but are marked deprecated in their response headers.
+var legacyRoutes = map[string]string{
+	"/upload":           apiPrefix + "/upload",
+	"/download/":        apiPrefix + "/files/",
+	"/montage":          apiPrefix + "/montage",
+	"/generate/qr":      apiPrefix + "/generate/qr",
+	"/generate/barcode": apiPrefix + "/generate/barcode",
+	"/screenshot":       apiPrefix + "/screenshot",
+}
+
+// registerRoutes sets up the versioned API, the deprecated legacy routes and the web UI.
+func registerRoutes(mux *http.ServeMux, fs *FileStore) {
+	// Serve static HTML page
+	mux.HandleFunc("/", withSecurityHeaders(uiContentSecurityPolicy, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		// To make this runnable: save the HTML page as 'index.html' in the
+		// directory the server is started from.
+		issueCSRFToken(w, r)
+		http.ServeFile(w, r, "index.html")
+	}))
+
+	// Requests that create files need a CSRF token when sent from the web UI and an
+	// API key once keys are configured, honour Idempotency-Key so retries are safe,
+	// and are refused in maintenance mode or while the store holds too many files.
+	// In single-shot mode the result is handed back directly, as the store won't
+	// outlive the request.
+	results := loadResultStore()
+	creates := func(next http.HandlerFunc) http.HandlerFunc {
+		if singleShot {
+			next = deliverResult(fs, results, next)
+		}
+		return requireCSRFToken(requireAPIKey(acceptsWrites(fs, hasFileCapacity(fs, idempotent(fs, next)))))
+	}
+	handlers := map[string]http.HandlerFunc{
+		"/upload":           creates(handleUpload(fs)),
+		"/download/":        withSecurityHeaders(downloadContentSecurityPolicy, handleDownload(fs)),
+		"/montage":          creates(handleMontage(fs)),
+		"/generate/qr":      creates(handleGenerate(fs, "qrcode", parseQRRequest)),
+		"/generate/barcode": creates(handleGenerate(fs, "barcode", parseBarcodeRequest)),
+		"/screenshot":       creates(handleScreenshot(fs)),
+		"/diff":             creates(handleDiff(fs)),
+	}
+
+	mux.HandleFunc("POST "+apiPrefix+"/upload", handlers["/upload"])
+	mux.HandleFunc("GET "+apiPrefix+"/files/{id}", handlers["/download/"])
+	mux.HandleFunc("GET "+apiPrefix+"/files/{id}/info", requireAPIKey(handleFileInfo(fs)))
+	mux.HandleFunc("GET "+apiPrefix+"/files/{id}/parts", requireAPIKey(handleFileParts(fs)))
+	mux.HandleFunc("GET "+apiPrefix+"/files/{id}/torrent", requireAPIKey(handleFileTorrent(fs)))
+	mux.HandleFunc("GET "+apiPrefix+"/files/{id}/contents", requireAPIKey(handleFileContents(fs)))
+	mux.HandleFunc("GET "+apiPrefix+"/c/{code}", handleShortCode(fs))
+	mux.HandleFunc("DELETE "+apiPrefix+"/files/{id}", requireCSRFToken(requireAPIKey(handleDeleteFile(fs))))
+	mux.HandleFunc("POST "+apiPrefix+"/files/{id}/restore", requireCSRFToken(requireAPIKey(handleRestoreFile(fs))))
+	mux.HandleFunc("POST "+apiPrefix+"/files/{id}/convert", creates(handleReconvert(fs)))
+	mux.HandleFunc("POST "+apiPrefix+"/montage", handlers["/montage"])
+	mux.HandleFunc("POST "+apiPrefix+"/archives/merge", creates(handleArchiveMerge(fs)))
+	mux.HandleFunc("POST "+apiPrefix+"/workspaces", requireCSRFToken(requireAPIKey(acceptsWrites(fs, hasFileCapacity(fs, handleCreateWorkspace(fs))))))
+	mux.HandleFunc("GET "+apiPrefix+"/workspaces/{ws}", requireAPIKey(handleWorkspaceInfo(fs)))
+	mux.HandleFunc("DELETE "+apiPrefix+"/workspaces/{ws}", requireCSRFToken(requireAPIKey(handleDeleteWorkspace(fs))))
+	mux.HandleFunc("POST "+apiPrefix+"/workspaces/{ws}/files", creates(inWorkspace(fs, handleUpload(fs))))
+	mux.HandleFunc("POST "+apiPrefix+"/workspaces/{ws}/files/{id}/convert", creates(inWorkspace(fs, handleReconvert(fs))))
+	mux.HandleFunc("GET "+apiPrefix+"/workspaces/{ws}/download", requireAPIKey(handleWorkspaceDownload(fs)))
+	mux.HandleFunc("POST "+apiPrefix+"/generate/qr", handlers["/generate/qr"])
+	mux.HandleFunc("POST "+apiPrefix+"/generate/barcode", handlers["/generate/barcode"])
+	mux.HandleFunc("POST "+apiPrefix+"/screenshot", handlers["/screenshot"])
+	mux.HandleFunc("POST "+apiPrefix+"/diff", handlers["/diff"])
+	mux.HandleFunc("POST "+apiPrefix+"/verify", requireCSRFToken(requireAPIKey(handleVerifyPDF())))
+	mux.HandleFunc("POST "+apiPrefix+"/transcode-stream", requireCSRFToken(requireAPIKey(acceptsWrites(fs, handleTranscodeStream()))))
+	mux.HandleFunc("GET "+apiPrefix+"/receipts/keys", handleReceiptKeys())
+
+	mux.HandleFunc("GET /healthz", handleHealthz(fs))
+
+	mux.HandleFunc("GET "+apiPrefix+"/admin/files", requireAdmin(handleAdminListFiles(fs)))
+	mux.HandleFunc("POST "+apiPrefix+"/admin/files/{id}/hold", requireAdmin(handleAdminHold(fs, true)))
+	mux.HandleFunc("DELETE "+apiPrefix+"/admin/files/{id}/hold", requireAdmin(handleAdminHold(fs, false)))
+	mux.HandleFunc("GET "+apiPrefix+"/admin/audit", requireAdmin(handleAdminAudit(fs)))
+	mux.HandleFunc(apiPrefix+"/admin/maintenance", requireAdmin(handleAdminMaintenance(fs)))
+	mux.HandleFunc(apiPrefix+"/admin/keys", requireAdmin(handleAdminKeys(fs)))
+	mux.HandleFunc("DELETE "+apiPrefix+"/admin/keys/{id}", requireAdmin(handleAdminRetireKey(fs)))
+	mux.HandleFunc("GET "+apiPrefix+"/admin/moderation", requireAdmin(handleAdminModerationQueue(fs)))
+	mux.HandleFunc("POST "+apiPrefix+"/admin/moderation/{id}", requireAdmin(handleAdminModerationReview(fs)))
+	mux.HandleFunc("GET "+apiPrefix+"/admin/abuse", requireAdmin(handleAdminAbuse(fs)))
+	mux.HandleFunc("DELETE "+apiPrefix+"/admin/abuse/bans/{client}", requireAdmin(handleAdminUnban(fs)))
+
+	for path, successor := range legacyRoutes {
+		mux.HandleFunc(path, deprecatedRoute(handlers[path], successor))
+	}
+}
+
+// deprecatedRoute wraps a legacy handler so responses announce the route's
+// deprecation and point at its versioned successor.
+func deprecatedRoute(next http.HandlerFunc, successor string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+successor+">; rel=\"successor-version\"")
+		next(w, r)
+	}
+}
+
+// isVersionedRequest reports whether the request came in through a /v1 route.
+func isVersionedRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, apiPrefix+"/")
+}
+
+// downloadURL returns the download path for a file, matching the API flavour the
+// client used so legacy clients keep receiving legacy URLs. The path carries the
+// file's share token, so it can be handed out without granting deletion. With URL signing
+// enabled the link is signed until the file expires; links to held files are
+// signed for another fileExpiryDuration.
+func downloadURL(r *http.Request, meta *FileMetadata) string {
+	path := "/download/" + meta.ID
+	if isVersionedRequest(r) {
+		path = apiPrefix + "/files/" + meta.ID
+	}
+	path += "?token=" + meta.ShareToken
+	expires := meta.ExpiryTime
+	if meta.Hold != nil {
+		expires = time.Now().Add(fileExpiryDuration)
+	}
+	return signDownloadPath(path, meta.ID, expires)
+}
+
+// writeJSON sends body as a JSON response with the given status, adding the API version.
+func writeJSON(w http.ResponseWriter, status int, body map[string]any) {
+	body["version"] = apiVersion
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Error encoding response: %v", err)
+		// Client already received the status, too late to send error code
+	}
+}
+
+// handleFileInfo returns the job record of a stored file without downloading it:
+// its metadata, status and the traces of the external commands that were run. It
+// needs the file's share or owner token.
+func handleFileInfo(fs *FileStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		meta, ok := authorizeFile(fs, w, r, r.PathValue("id"), accessShare)
+		if !ok {
+			return
+		}
+
+		writeJSON(w, http.StatusOK, fileInfo(r, meta))
+	}
+}
+
+// fileInfo describes a job record for JSON responses.
+func fileInfo(r *http.Request, meta *FileMetadata) map[string]any {
+	commands := meta.Commands
+	if commands == nil {
+		commands = []CommandTrace{}
+	}
+	tags := meta.Tags
+	if tags == nil {
+		tags = map[string]string{}
+	}
+	info := map[string]any{
+		"fileId":       meta.ID,
+		"fileName":     meta.ConvertedName,
+		"originalName": meta.OriginalName,
+		"contentType":  meta.ContentType,
+		"size":         meta.Size,
+		"uploadTime":   meta.UploadTime.Format(time.RFC3339),
+		"expiryTime":   meta.ExpiryTime.Format(time.RFC3339),
+		"status":       meta.Status,
+		"commands":     commands,
+		"tags":         tags,
+	}
+	if meta.Hold != nil {
+		info["hold"] = meta.Hold
+	}
+	if meta.Workspace != "" {
+		info["workspace"] = meta.Workspace
+	}
+	if meta.Status == jobCompleted && downloadParts.offered(meta.Size) {
+		info["partsUrl"] = apiPrefix + "/files/" + meta.ID + "/parts"
+	}
+	if meta.Status == jobCompleted && torrentOutput.offered(meta.Size) {
+		info["torrentUrl"] = apiPrefix + "/files/" + meta.ID + "/torrent"
+	}
+	if meta.Moderation != nil {
+		info["moderation"] = meta.Moderation
+	}
+	if meta.Redactions != nil {
+		info["redactions"] = meta.Redactions
+	}
+	if meta.Language != nil {
+		info["language"] = meta.Language
+	}
+	if meta.Intermediates != nil {
+		info["intermediates"] = meta.Intermediates
+	}
+	if meta.ShortCode != "" {
+		info["shortCode"] = meta.ShortCode
+		info["shortUrl"] = shortURL(meta.ShortCode)
+	}
+	if meta.Status == jobFailed {
+		info["error"] = meta.Error
+	} else {
+		info["downloadUrl"] = downloadURL(r, meta)
+	}
+	return info
+}
@@ -0,0 +1,916 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/nwaples/rardecode"
+)
+
+// Archives are converted from file to file, entry by entry, so neither the
+// archive nor any entry is ever held in memory. archive/zip switches to Zip64
+// records on its own when an entry or the archive passes 4 GB or the archive has
+// more than 65535 entries, and archive/tar switches to PAX headers for entries
+// beyond what the classic format can describe.
+
+// cleanEntryName turns an archive entry name into a relative slash-separated
+// path with no ".." elements.
+func cleanEntryName(name string) (string, error) {
+	clean := path.Clean("/" + strings.ReplaceAll(name, `\`, "/"))
+	if clean == "/" {
+		return "", fmt.Errorf("archive entry %q has no name", name)
+	}
+	return clean[1:], nil
+}
+
+// safeEntryPath resolves an archive entry name inside dir, refusing names that
+// would escape it ("zip slip").
+func safeEntryPath(dir, name string) (string, error) {
+	clean, err := cleanEntryName(name)
+	if err != nil {
+		return "", err
+	}
+	p := filepath.Join(dir, filepath.FromSlash(clean))
+	if !strings.HasPrefix(p, filepath.Clean(dir)+string(filepath.Separator)) {
+		return "", fmt.Errorf("archive entry %q escapes the extraction directory", name)
+	}
+	return p, nil
+}
+
+// writeEntry streams one archive entry to p, creating its parent directories.
+func writeEntry(p string, mode os.FileMode, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm()|0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// extractZip streams every entry of a zip file into dir.
+func extractZip(src, dir string) error {
+	zr, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	registerZipDecompressors(&zr.Reader)
+	budget, err := archiveExpansion.newExpansionBudget(src)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range zr.File {
+		p, err := safeEntryPath(dir, entry.Name)
+		if err != nil {
+			return err
+		}
+		if entry.FileInfo().IsDir() {
+			if err := os.MkdirAll(p, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if !entry.Mode().IsRegular() {
+			continue // Symlinks and devices are not carried over
+		}
+		if err := budget.declare(int64(entry.UncompressedSize64)); err != nil {
+			return err
+		}
+		rc, err := entry.Open()
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", entry.Name, err)
+		}
+		err = writeEntry(p, entry.Mode(), budget.reader(rc))
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("failed to extract %s: %w", entry.Name, err)
+		}
+	}
+	return nil
+}
+
+// extractTar streams every entry of a tar file into dir.
+func extractTar(src, dir string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	budget, err := archiveExpansion.newExpansionBudget(src)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		p, err := safeEntryPath(dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(p, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := budget.declare(hdr.Size); err != nil {
+				return err
+			}
+			if err := writeEntry(p, hdr.FileInfo().Mode(), budget.reader(tr)); err != nil {
+				return fmt.Errorf("failed to extract %s: %w", hdr.Name, err)
+			}
+		}
+	}
+}
+
+// archiveInputError marks errors from reading a damaged zip or tar file as
+// ErrInputCorrupt.
+func archiveInputError(err error) error {
+	if errors.Is(err, zip.ErrFormat) || errors.Is(err, zip.ErrChecksum) || errors.Is(err, tar.ErrHeader) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %w", ErrInputCorrupt, err)
+	}
+	return err
+}
+
+// rar5Signature starts every RAR5 archive, which are left to unrar.
+var rar5Signature = []byte("Rar!\x1a\x07\x01\x00")
+
+// rarMarker starts every volume of a RAR4 or RAR5 archive.
+var rarMarker = []byte("Rar!\x1a\x07")
+
+// rarNeedsUnrar reports whether a RAR archive is beyond extractRarEntries: RAR5,
+// or a volume of a multi-volume set, which it cannot follow.
+func rarNeedsUnrar(src string) bool {
+	f, err := os.Open(src)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, 12)
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+	if bytes.HasPrefix(head, rar5Signature) {
+		return true
+	}
+	// RAR4: a 7-byte marker, then the main header whose flags at offset 10 have
+	// bit 0 set in volumes.
+	return n == len(head) && head[9] == 0x73 && head[10]&0x01 != 0
+}
+
+// findUnrar locates the unrar tool, preferring FILECONVERTER_UNRAR_PATH.
+func findUnrar() (string, error) {
+	if p := os.Getenv("FILECONVERTER_UNRAR_PATH"); p != "" {
+		return p, nil
+	}
+	p, err := exec.LookPath("unrar")
+	if err != nil {
+		return "", &ToolMissingError{Tool: "unrar", Purpose: "extracting RAR5 and multi-volume archives"}
+	}
+	return p, nil
+}
+
+// extractRar extracts a RAR archive into dir, using unrar where rardecode falls
+// short. For a multi-volume set, src is the first volume and the others must sit
+// next to it.
+func extractRar(ctx context.Context, src, dir string, report *ConversionReport) error {
+	if !rarNeedsUnrar(src) {
+		err := extractRarEntries(src, dir)
+		if err == nil || errors.Is(err, ErrArchiveTooLarge) {
+			return err
+		}
+		if _, lookErr := findUnrar(); lookErr != nil {
+			return err
+		}
+		log.Printf("Extracting %s failed (%v), retrying with unrar", filepath.Base(src), err)
+	}
+	unrar, err := findUnrar()
+	if err != nil {
+		return err
+	}
+	// -p- never prompts for a password; unrar skips entries that would escape dir
+	// and extraction is walked again anyway, leaving out links.
+	err = archiveExpansion.watchExtraction(ctx, rarVolumesOf(src), dir, func(ctx context.Context) error {
+		_, err := runCommand(report, exec.CommandContext(ctx, unrar, "x", "-y", "-o+", "-p-", "-idq", src, dir+string(filepath.Separator)))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("unrar failed: %w", err)
+	}
+	return nil
+}
+
+// extractRarEntries streams every entry of a single-volume RAR archive into dir.
+func extractRarEntries(src, dir string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	budget, err := archiveExpansion.newExpansionBudget(src)
+	if err != nil {
+		return err
+	}
+
+	rr, err := rardecode.NewReader(f, "")
+	if err != nil {
+		return err
+	}
+	for {
+		hdr, err := rr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		p, err := safeEntryPath(dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		if hdr.IsDir {
+			if err := os.MkdirAll(p, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if !hdr.Mode().IsRegular() {
+			continue // Symlinks are not carried over
+		}
+		if !hdr.UnKnownSize {
+			if err := budget.declare(hdr.UnPackedSize); err != nil {
+				return err
+			}
+		}
+		if err := writeEntry(p, hdr.Mode(), budget.reader(rr)); err != nil {
+			return fmt.Errorf("failed to extract %s: %w", hdr.Name, err)
+		}
+	}
+}
+
+// rarVolumesOf returns src and the volumes of its set that sit next to it.
+func rarVolumesOf(src string) []string {
+	m := rarVolumePattern.FindStringSubmatch(filepath.Base(src))
+	if m == nil {
+		return []string{src}
+	}
+	volumes := []string{src}
+	siblings, _ := os.ReadDir(filepath.Dir(src))
+	for _, sibling := range siblings {
+		s := rarVolumePattern.FindStringSubmatch(sibling.Name())
+		if s != nil && s[1] == m[1] && sibling.Name() != filepath.Base(src) {
+			volumes = append(volumes, filepath.Join(filepath.Dir(src), sibling.Name()))
+		}
+	}
+	return volumes
+}
+
+// rarVolumePattern matches the names of volumes in a multi-volume RAR set:
+// "name.part1.rar", "name.part01.rar", or "name.rar" followed by "name.r00",
+// "name.r01" and so on.
+var rarVolumePattern = regexp.MustCompile(`(?i)^(.+?)(?:\.part(\d+)\.rar|\.r(\d\d)|\.rar)$`)
+
+// isRarVolumeUpload reports whether a batch upload is meant as a multi-volume
+// RAR set: every file is named like a volume or starts like a RAR archive.
+// rarVolumeSet then checks that the names make up one set.
+func isRarVolumeUpload(headers []*multipart.FileHeader) bool {
+	for _, header := range headers {
+		if rarVolumePattern.MatchString(header.Filename) {
+			continue
+		}
+		f, err := header.Open()
+		if err != nil {
+			return false
+		}
+		head := make([]byte, len(rarMarker))
+		_, err = io.ReadFull(f, head)
+		f.Close()
+		if err != nil || !bytes.Equal(head, rarMarker) {
+			return false
+		}
+	}
+	return true
+}
+
+// rarVolumeSet checks that the names of a batch upload form one multi-volume RAR
+// set and returns the name of its first volume and of the set.
+func rarVolumeSet(names []string) (first, base string, err error) {
+	seen := make(map[int]bool)
+	for _, name := range names {
+		m := rarVolumePattern.FindStringSubmatch(name)
+		if m == nil {
+			return "", "", fmt.Errorf("%s is not a RAR volume", name)
+		}
+		if base == "" {
+			base = m[1]
+		} else if !strings.EqualFold(base, m[1]) {
+			return "", "", fmt.Errorf("%s is not part of the %s volume set", name, base)
+		}
+		index := volumeIndex(m)
+		if seen[index] {
+			return "", "", fmt.Errorf("volume %s was uploaded twice", name)
+		}
+		seen[index] = true
+		if first == "" || index < volumeIndex(rarVolumePattern.FindStringSubmatch(first)) {
+			first = name
+		}
+	}
+	return first, base, nil
+}
+
+// volumeIndex returns the position of a RAR volume in its set from its name as
+// matched by rarVolumePattern; name.rar comes before name.r00.
+func volumeIndex(m []string) int {
+	index := 0
+	if m[2] != "" {
+		fmt.Sscan(m[2], &index)
+	} else if m[3] != "" {
+		fmt.Sscan(m[3], &index)
+		index++
+	}
+	return index
+}
+
+// extractArchive extracts the archive at src into dir.
+func extractArchive(ctx context.Context, src, dir, sourceExt string, report *ConversionReport) error {
+	switch sourceExt {
+	case "zip":
+		return extractZip(src, dir)
+	case "tar":
+		return extractTar(src, dir)
+	case "rar":
+		return extractRar(ctx, src, dir, report)
+	case "iso", "img", "dmg":
+		return extractDiskImage(ctx, src, dir, report)
+	default:
+		return fmt.Errorf("%w: %s archives", ErrUnsupportedConversion, sourceExt)
+	}
+}
+
+// archiveEntry is a file or directory listed from an archive.
+type archiveEntry struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	Dir  bool   `json:"dir,omitempty"`
+}
+
+// listArchive lists the entries of an archive of the given size without
+// extracting it. Zip and tar archives are read in place; RAR archives and disk
+// images are listed by 7-Zip, so they are first copied into a working directory.
+func listArchive(ctx context.Context, content io.ReaderAt, size int64, sourceExt string, report *ConversionReport) ([]archiveEntry, error) {
+	switch sourceExt {
+	case "zip":
+		zr, err := zip.NewReader(content, size)
+		if err != nil {
+			return nil, err
+		}
+		entries := make([]archiveEntry, 0, len(zr.File))
+		for _, entry := range zr.File {
+			entries = append(entries, archiveEntry{Name: entry.Name, Size: int64(entry.UncompressedSize64), Dir: entry.FileInfo().IsDir()})
+		}
+		return entries, nil
+	case "tar":
+		entries := []archiveEntry{}
+		tr := tar.NewReader(io.NewSectionReader(content, 0, size))
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return entries, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, archiveEntry{Name: hdr.Name, Size: hdr.Size, Dir: hdr.Typeflag == tar.TypeDir})
+		}
+	case "rar", "iso", "img", "dmg":
+		wd, err := newJobWorkdir()
+		if err != nil {
+			return nil, err
+		}
+		defer wd.cleanup()
+		src := wd.path("input." + sourceExt)
+		f, err := os.Create(src)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write temporary input file: %w", err)
+		}
+		_, err = io.Copy(f, io.NewSectionReader(content, 0, size))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to write temporary input file: %w", err)
+		}
+		// 7-Zip reads every RAR version, so it lists RAR archives as well
+		return listDiskImage(ctx, src, report)
+	default:
+		return nil, fmt.Errorf("%w: %s archives", ErrUnsupportedConversion, sourceExt)
+	}
+}
+
+// handleFileContents lists the entries of a stored archive or disk image, so
+// users can check what it holds before converting it. The file is read in place
+// rather than loaded whole, since archives are often the largest files stored.
+func handleFileContents(fs *FileStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fileID := r.PathValue("id")
+		if _, ok := authorizeFile(fs, w, r, fileID, accessShare); !ok {
+			return
+		}
+		meta, content, err := fs.OpenFile(fileID)
+		if errors.Is(err, errNotReviewed) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		defer content.Close()
+		head := make([]byte, 512)
+		n, err := content.ReadAt(head, 0)
+		if err != nil && err != io.EOF {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fileType, sourceExt := DetectFileType(head[:n], meta.ConvertedName)
+		if fileType != FileTypeArchive {
+			http.Error(w, "File is not an archive or disk image", http.StatusBadRequest)
+			return
+		}
+
+		var entries []archiveEntry
+		err = runConvertStage(r.Context(), ConversionOptions{Deadlines: conversionDeadlines}, func(ctx context.Context) (err error) {
+			entries, err = listArchive(ctx, content, meta.Size, sourceExt, nil)
+			return err
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Could not list archive: %v", err), http.StatusUnprocessableEntity)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"fileId": meta.ID, "entries": entries})
+	}
+}
+
+// walkEntries calls fn with the slash-separated name of every directory and
+// regular file below dir, parents first.
+func walkEntries(dir string, fn func(name string, p string, info os.FileInfo) error) error {
+	return filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(rel), p, info)
+	})
+}
+
+// createZip writes the contents of dir to a new zip file at dst.
+func createZip(dir, dst string, opts ConversionOptions) error {
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	zw, method, err := newZipWriter(out, opts)
+	if err != nil {
+		return err
+	}
+	err = walkEntries(dir, func(name, p string, info os.FileInfo) error {
+		hdr, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if info.IsDir() {
+			hdr.Name += "/"
+			_, err = zw.CreateHeader(hdr)
+			return err
+		}
+		hdr.Method = zipEntryMethod(name, method)
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		return copyFileTo(w, p)
+	})
+	if err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// createTar writes the contents of dir to a new tar file at dst.
+func createTar(dir, dst string, opts ConversionOptions) error {
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	cw, err := newTarOutput(out, opts)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(cw)
+	err = walkEntries(dir, func(name, p string, info os.FileInfo) error {
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		return copyFileTo(tw, p)
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// copyFileTo streams the file at p into w.
+func copyFileTo(w io.Writer, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// createArchive writes the contents of dir to a new archive at dst.
+func createArchive(dir, dst, targetFormat string, opts ConversionOptions) error {
+	switch targetFormat {
+	case "zip":
+		return createZip(dir, dst, opts)
+	case "tar":
+		return createTar(dir, dst, opts)
+	case "rar":
+		return fmt.Errorf("%w: creating RAR archives requires licensing, since RAR is a proprietary format", ErrUnsupportedConversion)
+	default:
+		return fmt.Errorf("%w to %s", ErrUnsupportedConversion, targetFormat)
+	}
+}
+
+// transcodeZipToTar copies the entries of a zip file into a new tar file at dst
+// one by one, without extracting them.
+func transcodeZipToTar(src, dst string, opts ConversionOptions) error {
+	zr, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	registerZipDecompressors(&zr.Reader)
+	budget, err := archiveExpansion.newExpansionBudget(src)
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	cw, err := newTarOutput(out, opts)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(cw)
+	for _, entry := range zr.File {
+		info := entry.FileInfo()
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			continue // Symlinks and devices are not carried over
+		}
+		name, err := cleanEntryName(entry.Name)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if info.IsDir() {
+			hdr.Name += "/"
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			continue
+		}
+		hdr.Size = int64(entry.UncompressedSize64)
+		if err := budget.declare(hdr.Size); err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		rc, err := entry.Open()
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", entry.Name, err)
+		}
+		_, err = io.Copy(tw, budget.reader(rc))
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("failed to copy %s: %w", entry.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// transcodeTarToZip copies the entries of a tar file into a new zip file at dst
+// one by one, reading the tar file once from start to end.
+func transcodeTarToZip(src, dst string, opts ConversionOptions) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	budget, err := archiveExpansion.newExpansionBudget(src)
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	tr := tar.NewReader(in)
+	zw, method, err := newZipWriter(out, opts)
+	if err != nil {
+		return err
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeDir && hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name, err := cleanEntryName(hdr.Name)
+		if err != nil {
+			return err
+		}
+		zh, err := zip.FileInfoHeader(hdr.FileInfo())
+		if err != nil {
+			return err
+		}
+		zh.Name = name
+		if hdr.Typeflag == tar.TypeDir {
+			zh.Name += "/"
+			if _, err := zw.CreateHeader(zh); err != nil {
+				return err
+			}
+			continue
+		}
+		zh.Method = zipEntryMethod(name, method)
+		if err := budget.declare(hdr.Size); err != nil {
+			return err
+		}
+		w, err := zw.CreateHeader(zh)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, budget.reader(tr)); err != nil {
+			return fmt.Errorf("failed to copy %s: %w", hdr.Name, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// convertArchiveFile converts the archive at input to targetFormat inside the
+// job's working directory and returns the path of the result. zip and tar are
+// converted into each other entry by entry; other archives are extracted first.
+func convertArchiveFile(ctx context.Context, wd *jobWorkdir, input, outputFilename, sourceExt, targetFormat string, opts ConversionOptions) (string, error) {
+	output := wd.path(strings.TrimSuffix(outputFilename, "."+targetFormat) + "." + archiveExtension(targetFormat, opts))
+	switch {
+	case sourceExt == "zip" && targetFormat == "tar":
+		if err := transcodeZipToTar(input, output, opts); err != nil {
+			return "", fmt.Errorf("failed to convert archive: %w", archiveInputError(err))
+		}
+		return output, nil
+	case sourceExt == "tar" && targetFormat == "zip":
+		if err := transcodeTarToZip(input, output, opts); err != nil {
+			return "", fmt.Errorf("failed to convert archive: %w", archiveInputError(err))
+		}
+		return output, nil
+	}
+
+	extractDir := wd.path("extract")
+	if err := os.MkdirAll(extractDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create temporary extraction directory: %w", err)
+	}
+	if err := extractArchive(ctx, input, extractDir, sourceExt, opts.Report); err != nil {
+		return "", fmt.Errorf("failed to extract archive: %w", archiveInputError(err))
+	}
+
+	if err := createArchive(extractDir, output, targetFormat, opts); err != nil {
+		return "", fmt.Errorf("failed to create archive: %w", err)
+	}
+	return output, nil
+}
+
+// writeUploadTo streams an uploaded file to p.
+func writeUploadTo(p string, file io.Reader) error {
+	out, err := os.Create(p)
+	if err != nil {
+		return fmt.Errorf("failed to write temporary input file: %w", err)
+	}
+	_, err = io.Copy(out, file)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read file content: %w", err)
+	}
+	return nil
+}
+
+// addArchive converts an archive of the given name and size, uploaded or stored,
+// without reading it into memory: it is streamed to the job's working directory,
+// converted file to file, and the result moved into storage.
+func (fs *FileStore) addArchive(ctx context.Context, file io.Reader, name string, size int64, sourceExt, targetFormat string, opts ConversionOptions, attrs jobAttributes) (*FileMetadata, error) {
+	release, err := tempSpace.reserve(estimateTempSpace(FileTypeArchive, targetFormat, int(size)))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	wd, err := newJobWorkdir()
+	if err != nil {
+		return nil, err
+	}
+	defer wd.cleanup()
+
+	input := wd.path("input." + sourceExt)
+	if err := writeUploadTo(input, file); err != nil {
+		return nil, err
+	}
+	outputFilename := strings.TrimSuffix(name, filepath.Ext(name)) + "." + targetFormat
+	return fs.storeConvertedArchive(ctx, wd, []string{input}, name, outputFilename, sourceExt, targetFormat, opts, attrs)
+}
+
+// addArchiveVolumes converts a multi-volume RAR set uploaded in one batch, whose
+// first volume and set name come from rarVolumeSet. The volumes are written side by side under their own names, which is how unrar
+// finds the volumes following the first.
+func (fs *FileStore) addArchiveVolumes(ctx context.Context, headers []*multipart.FileHeader, first, base, targetFormat string, opts ConversionOptions, attrs jobAttributes) (*FileMetadata, error) {
+	release, err := tempSpace.reserve(estimateTempSpace(FileTypeArchive, targetFormat, uploadsSize(headers)))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	wd, err := newJobWorkdir()
+	if err != nil {
+		return nil, err
+	}
+	defer wd.cleanup()
+
+	inputs := []string{wd.path(filepath.Base(first))}
+	for _, header := range headers {
+		f, err := header.Open()
+		if err != nil {
+			return nil, fmt.Errorf("failed to open uploaded file %s: %w", header.Filename, err)
+		}
+		p := wd.path(filepath.Base(header.Filename))
+		err = writeUploadTo(p, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if header.Filename != first {
+			inputs = append(inputs, p)
+		}
+	}
+	return fs.storeConvertedArchive(ctx, wd, inputs, first, base+"."+targetFormat, "rar", targetFormat, opts, attrs)
+}
+
+// moderateArchive runs the configured moderation on the images and videos in
+// the archive at src. Zip and tar conversions never unpack their input, so it
+// is extracted into the job's working directory just for this.
+func (fs *FileStore) moderateArchive(ctx context.Context, wd *jobWorkdir, src, originalName, sourceExt string, opts ConversionOptions, attrs *jobAttributes) (*FileMetadata, error) {
+	if fs.moderator == nil || attrs.moderated {
+		return nil, nil
+	}
+	dir := wd.path("moderation")
+	defer os.RemoveAll(dir)
+	err := runConvertStage(ctx, opts, func(ctx context.Context) error {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create temporary extraction directory: %w", err)
+		}
+		if err := extractArchive(ctx, src, dir, sourceExt, opts.Report); err != nil {
+			return fmt.Errorf("failed to extract archive: %w", archiveInputError(err))
+		}
+		return nil
+	})
+	if err != nil {
+		err = fmt.Errorf("conversion failed: %w", err)
+		meta, recErr := fs.recordFailure(originalName, err, *attrs)
+		if recErr != nil {
+			log.Printf("Error recording failed job: %v", recErr)
+		}
+		return meta, err
+	}
+	return fs.moderateTree(ctx, dir, attrs)
+}
+
+// storeConvertedArchive converts the archive at inputs[0] and stores the result,
+// recording a failed job if the conversion fails. Any further inputs are the
+// volumes following it, which the pre hook sees as well.
+func (fs *FileStore) storeConvertedArchive(ctx context.Context, wd *jobWorkdir, inputs []string, originalName, outputFilename, sourceExt, targetFormat string, opts ConversionOptions, attrs jobAttributes) (*FileMetadata, error) {
+	if meta, err := fs.moderateArchive(ctx, wd, inputs[0], originalName, sourceExt, opts, &attrs); err != nil {
+		return meta, err
+	}
+	var err error
+	for i, input := range inputs {
+		name := originalName
+		if i > 0 {
+			name = filepath.Base(input)
+		}
+		if err = hookInputFile(ctx, name, targetFormat, input, opts.Report); err != nil {
+			break
+		}
+	}
+	var output string
+	if err == nil {
+		err = runConvertStage(ctx, opts, func(ctx context.Context) (err error) {
+			output, err = convertArchiveFile(ctx, wd, inputs[0], outputFilename, sourceExt, targetFormat, opts)
+			return err
+		})
+	}
+	if err != nil {
+		err = fmt.Errorf("conversion failed: %w", err)
+		meta, recErr := fs.recordFailure(originalName, err, attrs)
+		if recErr != nil {
+			log.Printf("Error recording failed job: %v", recErr)
+		}
+		return meta, err
+	}
+	name := filepath.Base(output)
+	return fs.storeFileFromPath(ctx, originalName, name, getContentTypeForExtension(strings.TrimPrefix(filepath.Ext(name), ".")), output, attrs)
+}
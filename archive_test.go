@@ -0,0 +1,204 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// withArchiveLimits sets the archive expansion limits for the rest of the test.
+func withArchiveLimits(t *testing.T, limits archiveLimits) {
+	t.Helper()
+	saved := archiveExpansion
+	archiveExpansion = limits
+	t.Cleanup(func() { archiveExpansion = saved })
+}
+
+// writeTestZip writes a zip file at p with the entries fill adds, compressed
+// with Zstandard, which is fast enough to produce gigabytes in a test.
+func writeTestZip(t *testing.T, p string, fill func(zw *zip.Writer) error) {
+	t.Helper()
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	zw.RegisterCompressor(zipMethodZstd, func(w io.Writer) (io.WriteCloser, error) {
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+	})
+	if err := fill(zw); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// zeros is an endless stream of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// roundTripArchive converts the zip at src to tar and back to a zip written
+// with opts, and returns the entries of the final zip.
+func roundTripArchive(t *testing.T, src string, opts ConversionOptions) []*zip.File {
+	t.Helper()
+	dir := t.TempDir()
+	tarPath, zipPath := filepath.Join(dir, "out.tar"), filepath.Join(dir, "out.zip")
+	if err := transcodeZipToTar(src, tarPath, ConversionOptions{}); err != nil {
+		t.Fatalf("zip to tar: %v", err)
+	}
+	if err := transcodeTarToZip(tarPath, zipPath, opts); err != nil {
+		t.Fatalf("tar to zip: %v", err)
+	}
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		t.Fatalf("reading converted zip: %v", err)
+	}
+	t.Cleanup(func() { zr.Close() })
+	registerZipDecompressors(&zr.Reader)
+	return zr.File
+}
+
+// TestArchiveManyEntries converts an archive with more entries than a zip file
+// can count without Zip64 records.
+func TestArchiveManyEntries(t *testing.T) {
+	const entries = 70000
+	src := filepath.Join(t.TempDir(), "many.zip")
+	writeTestZip(t, src, func(zw *zip.Writer) error {
+		for i := range entries {
+			if _, err := zw.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("d%d/f%d.txt", i/1000, i), Method: zip.Store}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	files := roundTripArchive(t, src, ConversionOptions{ArchiveLevel: "store"})
+	if len(files) != entries {
+		t.Fatalf("converted archive has %d entries, want %d", len(files), entries)
+	}
+	if files[entries-1].Name != fmt.Sprintf("d%d/f%d.txt", (entries-1)/1000, entries-1) {
+		t.Errorf("last entry is %s", files[entries-1].Name)
+	}
+}
+
+// TestArchiveLargeEntry converts an archive with an entry past 4 GB, which
+// neither a classic zip nor a classic tar header can describe.
+func TestArchiveLargeEntry(t *testing.T) {
+	if testing.Short() {
+		t.Skip("writes over 4 GB of temporary files")
+	}
+	withArchiveLimits(t, archiveLimits{})
+	const size = 4<<30 + 1<<20
+	src := filepath.Join(t.TempDir(), "large.zip")
+	writeTestZip(t, src, func(zw *zip.Writer) error {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: "large.bin", Method: zipMethodZstd})
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(w, zeros{}, size)
+		return err
+	})
+
+	files := roundTripArchive(t, src, ConversionOptions{ArchiveMethod: "zstd", ArchiveLevel: "fastest"})
+	if len(files) != 1 || files[0].UncompressedSize64 != size {
+		t.Fatalf("converted archive has %d entries, the first of %d bytes; want one of %d", len(files), files[0].UncompressedSize64, size)
+	}
+	rc, err := files[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	n, err := io.Copy(io.Discard, rc)
+	if err != nil || n != size {
+		t.Fatalf("read %d bytes of the converted entry (%v), want %d", n, err, size)
+	}
+}
+
+// TestArchiveExpansionLimit checks that reading stops once an archive expands
+// past its limit, whether it is extracted or converted.
+func TestArchiveExpansionLimit(t *testing.T) {
+	withArchiveLimits(t, archiveLimits{MaxExpanded: 1 << 20})
+	dir := t.TempDir()
+	src := filepath.Join(dir, "bomb.zip")
+	writeTestZip(t, src, func(zw *zip.Writer) error {
+		for i := range 3 {
+			w, err := zw.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("part%d.bin", i), Method: zipMethodZstd})
+			if err != nil {
+				return err
+			}
+			if _, err := io.CopyN(w, zeros{}, 512<<10); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	tarPath := filepath.Join(dir, "bomb.tar")
+	out, err := os.Create(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(out)
+	if err := tw.WriteHeader(&tar.Header{Name: "big.bin", Mode: 0644, Size: 2 << 20}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.CopyN(tw, zeros{}, 2<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+
+	for name, convert := range map[string]func() error{
+		"extract zip": func() error { return extractZip(src, filepath.Join(dir, "zip")) },
+		"extract tar": func() error { return extractTar(tarPath, filepath.Join(dir, "tar")) },
+		"zip to tar":  func() error { return transcodeZipToTar(src, filepath.Join(dir, "out.tar"), ConversionOptions{}) },
+		"tar to zip":  func() error { return transcodeTarToZip(tarPath, filepath.Join(dir, "out.zip"), ConversionOptions{}) },
+	} {
+		if err := convert(); !errors.Is(err, ErrArchiveTooLarge) {
+			t.Errorf("%s: got %v, want ErrArchiveTooLarge", name, err)
+		}
+	}
+}
+
+// TestExtractionToolLimit checks that an external extraction tool is stopped
+// once what it writes passes the archive's limit.
+func TestExtractionToolLimit(t *testing.T) {
+	withArchiveLimits(t, archiveLimits{MaxExpanded: 1 << 20})
+	dir := t.TempDir()
+	src := filepath.Join(dir, "bomb.iso")
+	if err := os.WriteFile(src, []byte("bomb"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out")
+	if err := os.Mkdir(out, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	err := archiveExpansion.watchExtraction(context.Background(), []string{src}, out, func(ctx context.Context) error {
+		// A tool that never stops writing
+		_, err := runCommand(nil, exec.CommandContext(ctx, "sh", "-c", `exec cat /dev/zero > "$1"`, "sh", filepath.Join(out, "zeros")))
+		return err
+	})
+	if !errors.Is(err, ErrArchiveTooLarge) {
+		t.Fatalf("got %v, want ErrArchiveTooLarge", err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// Archives can be crafted to expand to far more than they weigh ("zip bombs"),
+// and the sizes their headers declare can't be trusted. So the bytes actually
+// read from the entries of zip, tar and RAR files are counted, and reading stops
+// once they pass the size the archive may expand to. Where unrar or 7-Zip does
+// the unpacking, the directory it writes to is measured instead, and the tool is
+// killed once that passes the same size.
+
+const (
+	// defaultArchiveMaxExpandedMB caps the total size of an archive's entries;
+	// override with FILECONVERTER_ARCHIVE_MAX_EXPANDED_MB.
+	defaultArchiveMaxExpandedMB = 16 << 10
+	// defaultArchiveMaxRatio caps how many times its own size an archive may
+	// expand to; override with FILECONVERTER_ARCHIVE_MAX_RATIO.
+	defaultArchiveMaxRatio = 100
+	// archiveRatioFloor is what any archive may expand to whatever its ratio, so
+	// small archives of highly compressible text aren't refused.
+	archiveRatioFloor = 64 << 20
+	// extractionPollInterval is how often the output of unrar and 7-Zip is
+	// measured; they may write one interval's worth past the limit.
+	extractionPollInterval = 100 * time.Millisecond
+)
+
+// archiveLimits bounds how far an archive may expand.
+type archiveLimits struct {
+	MaxExpanded int64 // Bytes all entries of an archive may add up to; 0 for no cap
+	MaxRatio    int64 // Times its size an archive may expand to, above archiveRatioFloor; 0 for no cap
+}
+
+// archiveExpansion are the limits archives are read under.
+var archiveExpansion = archiveLimits{MaxExpanded: defaultArchiveMaxExpandedMB << 20, MaxRatio: defaultArchiveMaxRatio}
+
+// loadArchiveLimits reads the limits from FILECONVERTER_ARCHIVE_MAX_EXPANDED_MB
+// and FILECONVERTER_ARCHIVE_MAX_RATIO.
+func loadArchiveLimits() archiveLimits {
+	return archiveLimits{
+		MaxExpanded: int64(envInt("FILECONVERTER_ARCHIVE_MAX_EXPANDED_MB", defaultArchiveMaxExpandedMB)) << 20,
+		MaxRatio:    int64(envInt("FILECONVERTER_ARCHIVE_MAX_RATIO", defaultArchiveMaxRatio)),
+	}
+}
+
+// expansionBudget counts the bytes read from the entries of one archive against
+// what it may expand to.
+type expansionBudget struct {
+	limit int64 // 0 for no limit
+	read  int64
+}
+
+// newExpansionBudget returns the budget for reading the archive at srcs, which
+// are several files for a multi-volume set.
+func (l archiveLimits) newExpansionBudget(srcs ...string) (*expansionBudget, error) {
+	var size int64
+	for _, src := range srcs {
+		info, err := os.Stat(src)
+		if err != nil {
+			return nil, err
+		}
+		size += info.Size()
+	}
+	limit := l.MaxExpanded
+	if l.MaxRatio > 0 {
+		byRatio := max(size*l.MaxRatio, archiveRatioFloor)
+		if limit == 0 || byRatio < limit {
+			limit = byRatio
+		}
+	}
+	return &expansionBudget{limit: limit}, nil
+}
+
+// declare fails early if an entry's declared size alone would overrun the
+// budget. The entry is still counted as it is read.
+func (b *expansionBudget) declare(size int64) error {
+	if b.limit > 0 && b.read+size > b.limit {
+		return b.exceeded()
+	}
+	return nil
+}
+
+// reader counts what is read through r against the budget.
+func (b *expansionBudget) reader(r io.Reader) io.Reader {
+	return &budgetReader{r: r, budget: b}
+}
+
+func (b *expansionBudget) exceeded() error {
+	return fmt.Errorf("%w: its entries add up to more than %s", ErrArchiveTooLarge, megabytes(b.limit))
+}
+
+// budgetReader is an entry being read under an expansionBudget.
+type budgetReader struct {
+	r      io.Reader
+	budget *expansionBudget
+}
+
+func (br *budgetReader) Read(p []byte) (int, error) {
+	n, err := br.r.Read(p)
+	br.budget.read += int64(n)
+	if br.budget.limit > 0 && br.budget.read > br.budget.limit {
+		return n, br.budget.exceeded()
+	}
+	return n, err
+}
+
+// watchExtraction runs extract, which unpacks the archive at srcs into dir with
+// an external tool, and cancels the context it runs the tool under once the
+// files in dir add up to more than the archive may expand to.
+func (l archiveLimits) watchExtraction(ctx context.Context, srcs []string, dir string, extract func(ctx context.Context) error) error {
+	budget, err := l.newExpansionBudget(srcs...)
+	if err != nil {
+		return err
+	}
+	if budget.limit == 0 {
+		return extract(ctx)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var over atomic.Bool
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(extractionPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if treeSize(dir) > budget.limit {
+					over.Store(true)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	err = extract(ctx)
+	close(done)
+	<-stopped
+	if over.Load() || treeSize(dir) > budget.limit {
+		return budget.exceeded()
+	}
+	return err
+}
+
+// treeSize adds up the sizes of the regular files under dir. Files that vanish
+// while it walks are skipped.
+func treeSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxMergeFiles caps how many uploads one merge request may combine.
+const maxMergeFiles = 100
+
+// How a merge resolves an entry whose path is already taken.
+const (
+	conflictRename    = "rename"    // Keep both, numbering the newcomer: "a (1).txt"
+	conflictSkip      = "skip"      // Keep what came first
+	conflictOverwrite = "overwrite" // Keep what came last
+)
+
+// mergeTree moves the contents of src into dst, resolving path conflicts with
+// the given policy, and returns how many conflicts it met.
+func mergeTree(src, dst, policy string) (int, error) {
+	conflicts := 0
+	err := filepath.WalkDir(src, func(p string, d os.DirEntry, err error) error {
+		if err != nil || p == src {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		existing, statErr := os.Lstat(target)
+		if os.IsNotExist(statErr) {
+			if err := os.Rename(p, target); err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if statErr != nil {
+			return statErr
+		}
+		if d.IsDir() && existing.IsDir() {
+			return nil // Merge the directories' contents
+		}
+
+		conflicts++
+		switch policy {
+		case conflictSkip:
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		case conflictOverwrite:
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		default:
+			target = freeName(target)
+		}
+		if err := os.Rename(p, target); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return conflicts, err
+}
+
+// freeName returns p, or p numbered like "name (1).ext" if it is taken.
+func freeName(p string) string {
+	ext := filepath.Ext(p)
+	base := strings.TrimSuffix(p, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, i, ext)
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+// stageMergeUpload puts one upload of a merge into dir: archives and disk images
+// are extracted, any other file is added as it is.
+func (fs *FileStore) stageMergeUpload(ctx context.Context, wd *jobWorkdir, header *multipart.FileHeader, dir, format string, opts ConversionOptions, attrs *jobAttributes) error {
+	f, err := header.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open uploaded file %s: %w", header.Filename, err)
+	}
+	defer f.Close()
+	name := filepath.Base(header.Filename)
+
+	fileType, sourceExt := sniffFileType(f, name)
+	if fileType != FileTypeArchive {
+		if fs.moderator != nil {
+			data, release, err := readAllPooled(f)
+			if err != nil {
+				return fmt.Errorf("failed to read uploaded file %s: %w", name, err)
+			}
+			_, err = fs.moderateUpload(ctx, name, data, attrs)
+			release()
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			f.Seek(0, 0)
+		}
+		staged := filepath.Join(dir, name)
+		if err := writeUploadTo(staged, f); err != nil {
+			return err
+		}
+		if err := hookInputFile(ctx, name, format, staged, attrs.Report); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		return nil
+	}
+
+	input := wd.artifact(sourceExt)
+	if err := writeUploadTo(input, f); err != nil {
+		return err
+	}
+	defer os.Remove(input)
+	if err := hookInputFile(ctx, name, format, input, attrs.Report); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	err = runConvertStage(ctx, opts, func(ctx context.Context) error {
+		return extractArchive(ctx, input, dir, sourceExt, attrs.Report)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to extract %s: %w", name, archiveInputError(err))
+	}
+	if _, err := fs.moderateTree(ctx, dir, attrs); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// handleArchiveMerge merges several uploaded archives, and loose files, into one
+// archive. Uploads are merged in order, so the first archive acts as the one the
+// others are appended to. Form values: "format" (zip or tar, default zip),
+// "conflict" (rename, skip or overwrite, default rename), "name" for the output
+// file, and the compression options of archive conversions.
+func handleArchiveMerge(fs *FileStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		releaseSpool, err := tempSpace.reserveSpooling(r)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		defer releaseSpool()
+		if err := r.ParseMultipartForm(multipartMemory); err != nil {
+			log.Printf("Error parsing multipart form: %v", err)
+			http.Error(w, fmt.Sprintf("Could not parse multipart form: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		format := strings.ToLower(r.FormValue("format"))
+		if format == "" {
+			format = "zip"
+		}
+		if format != "zip" && format != "tar" {
+			http.Error(w, fmt.Sprintf("Unsupported archive format %q (use zip or tar)", format), http.StatusBadRequest)
+			return
+		}
+		policy := strings.ToLower(r.FormValue("conflict"))
+		if policy == "" {
+			policy = conflictRename
+		}
+		if policy != conflictRename && policy != conflictSkip && policy != conflictOverwrite {
+			http.Error(w, fmt.Sprintf("Unknown conflict policy %q (use rename, skip or overwrite)", policy), http.StatusBadRequest)
+			return
+		}
+
+		opts := ConversionOptions{Deadlines: conversionDeadlines}
+		if err := parseArchiveOptions(r, &opts); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid archive options: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		attrs, err := parseJobAttributes(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		attrs.Report = &ConversionReport{}
+		opts.Report = attrs.Report
+
+		var headers []*multipart.FileHeader
+		if r.MultipartForm != nil {
+			headers = r.MultipartForm.File["files"]
+		}
+		if len(headers) == 0 {
+			http.Error(w, `no files provided in form field "files"`, http.StatusBadRequest)
+			return
+		}
+		if len(headers) > maxMergeFiles {
+			http.Error(w, fmt.Sprintf("Too many files: at most %d are allowed", maxMergeFiles), http.StatusBadRequest)
+			return
+		}
+
+		name := filepath.Base(r.FormValue("name"))
+		if name == "." || name == string(filepath.Separator) {
+			name = strings.TrimSuffix(filepath.Base(headers[0].Filename), filepath.Ext(headers[0].Filename))
+		}
+		name = strings.TrimSuffix(name, "."+format) + "." + archiveExtension(format, opts)
+
+		release, err := tempSpace.reserve(estimateTempSpace(FileTypeArchive, format, uploadsSize(headers)))
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		defer release()
+		wd, err := newJobWorkdir()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer wd.cleanup()
+
+		merged := wd.path("merged")
+		if err := os.Mkdir(merged, 0755); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		conflicts := 0
+		for i, header := range headers {
+			staged := wd.path(fmt.Sprintf("upload%d", i))
+			if err := os.Mkdir(staged, 0755); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if err := fs.stageMergeUpload(r.Context(), wd, header, staged, format, opts, &attrs); err != nil {
+				log.Printf("Error staging %s for merge: %v", header.Filename, err)
+				http.Error(w, err.Error(), errorStatus(err))
+				return
+			}
+			n, err := mergeTree(staged, merged, policy)
+			if err != nil {
+				log.Printf("Error merging %s: %v", header.Filename, err)
+				http.Error(w, fmt.Sprintf("Error merging %s: %v", header.Filename, err), errorStatus(err))
+				return
+			}
+			conflicts += n
+		}
+
+		output := wd.path(name)
+		if err := createArchive(merged, output, format, opts); err != nil {
+			log.Printf("Error creating merged archive: %v", err)
+			http.Error(w, fmt.Sprintf("Error creating archive: %v", err), errorStatus(err))
+			return
+		}
+		meta, err := fs.storeFileFromPath(r.Context(), fmt.Sprintf("%d files", len(headers)), name, getContentTypeForExtension(strings.TrimPrefix(filepath.Ext(name), ".")), output, attrs)
+		if err != nil {
+			log.Printf("Error storing merged archive: %v", err)
+			http.Error(w, fmt.Sprintf("Error processing file: %v", err), errorStatus(err))
+			return
+		}
+		if conflicts > 0 {
+			log.Printf("Merged %d files into %s, resolving %d conflicts by %s", len(headers), meta.ID, conflicts, policy)
+		}
+
+		w.Header().Set("X-Merge-Conflicts", fmt.Sprint(conflicts))
+		writeUploadResponse(w, r, meta)
+	}
+}
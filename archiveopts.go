@@ -0,0 +1,219 @@
+package main
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// zipMethodZstd is the zip compression method ID of Zstandard (APPNOTE 4.4.5).
+const zipMethodZstd uint16 = 93
+
+// Compression levels accepted for archive outputs, from none to smallest output.
+var archiveLevels = []string{"store", "fastest", "default", "better", "max"}
+
+// compressedExtensions lists file types that are compressed already. Zip entries
+// of these types are stored as they are, since compressing them again only costs
+// time and often makes them bigger.
+var compressedExtensions = map[string]bool{
+	"jpg": true, "jpeg": true, "png": true, "gif": true, "webp": true,
+	"mp3": true, "aac": true, "ogg": true, "flac": true, "m4a": true,
+	"mp4": true, "mov": true, "mkv": true, "webm": true, "avi": true,
+	"zip": true, "gz": true, "tgz": true, "bz2": true, "xz": true, "zst": true, "7z": true, "rar": true,
+	"docx": true, "xlsx": true, "pptx": true,
+}
+
+// parseArchiveOptions reads the compression, compressionLevel and solid form
+// values into opts. Which methods are available depends on the output format
+// and is checked when the archive is written.
+func parseArchiveOptions(r *http.Request, opts *ConversionOptions) error {
+	opts.ArchiveMethod = strings.ToLower(strings.TrimSpace(r.FormValue("compression")))
+	switch opts.ArchiveMethod {
+	case "", "deflate", "gzip", "zstd", "xz", "lzma":
+	default:
+		return fmt.Errorf("unknown compression %q (use deflate, zstd, gzip, xz or lzma)", opts.ArchiveMethod)
+	}
+
+	opts.ArchiveLevel = strings.ToLower(strings.TrimSpace(r.FormValue("compressionLevel")))
+	if opts.ArchiveLevel == "" {
+		opts.ArchiveLevel = "default"
+	}
+	valid := false
+	for _, level := range archiveLevels {
+		valid = valid || level == opts.ArchiveLevel
+	}
+	if !valid {
+		return fmt.Errorf("unknown compressionLevel %q (use %s)", opts.ArchiveLevel, strings.Join(archiveLevels, ", "))
+	}
+
+	if v := r.FormValue("solid"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid solid %q: must be true or false", v)
+		}
+		opts.ArchiveSolid = b
+	}
+	return nil
+}
+
+// flateLevel maps an archive level to a deflate/gzip level.
+func flateLevel(level string) int {
+	switch level {
+	case "fastest":
+		return flate.BestSpeed
+	case "better":
+		return 7
+	case "max":
+		return flate.BestCompression
+	default:
+		return flate.DefaultCompression
+	}
+}
+
+// zstdLevel maps an archive level to a Zstandard encoder level.
+func zstdLevel(level string) zstd.EncoderLevel {
+	switch level {
+	case "fastest":
+		return zstd.SpeedFastest
+	case "better":
+		return zstd.SpeedBetterCompression
+	case "max":
+		return zstd.SpeedBestCompression
+	default:
+		return zstd.SpeedDefault
+	}
+}
+
+// xzDictCap maps an archive level to an xz dictionary size; larger dictionaries
+// find more repetition at the cost of memory.
+func xzDictCap(level string) int {
+	switch level {
+	case "fastest":
+		return 1 << 20
+	case "better":
+		return 32 << 20
+	case "max":
+		return 64 << 20
+	default:
+		return 8 << 20
+	}
+}
+
+// tarCompression returns the compression applied to a whole tar stream, or ""
+// for a plain tar file.
+func tarCompression(opts ConversionOptions) string {
+	if opts.ArchiveLevel == "store" {
+		return ""
+	}
+	switch opts.ArchiveMethod {
+	case "deflate", "gzip":
+		return "gzip"
+	case "lzma":
+		return "xz" // xz is LZMA2 in a container
+	default:
+		return opts.ArchiveMethod
+	}
+}
+
+// archiveExtension returns the file extension of an archive written with opts,
+// such as "tar.zst" for a Zstandard-compressed tar file.
+func archiveExtension(format string, opts ConversionOptions) string {
+	if format != "tar" {
+		return format
+	}
+	switch tarCompression(opts) {
+	case "gzip":
+		return "tar.gz"
+	case "zstd":
+		return "tar.zst"
+	case "xz":
+		return "tar.xz"
+	default:
+		return "tar"
+	}
+}
+
+// newZipWriter creates a zip writer set up for opts and returns it with the
+// compression method for its entries. Zip compresses entries one by one, so it
+// cannot write solid archives.
+func newZipWriter(out io.Writer, opts ConversionOptions) (*zip.Writer, uint16, error) {
+	if opts.ArchiveSolid {
+		return nil, 0, fmt.Errorf("zip archives cannot be solid; use tar with a compression method")
+	}
+	zw := zip.NewWriter(out)
+	level := opts.ArchiveLevel
+	method := zip.Deflate
+	switch opts.ArchiveMethod {
+	case "", "deflate":
+		zw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, flateLevel(level))
+		})
+	case "zstd":
+		method = zipMethodZstd
+		zw.RegisterCompressor(zipMethodZstd, func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(zstdLevel(level)), zstd.WithEncoderConcurrency(1))
+		})
+	default:
+		return nil, 0, fmt.Errorf("zip archives support deflate and zstd compression, not %s", opts.ArchiveMethod)
+	}
+	if level == "store" {
+		method = zip.Store
+	}
+	return zw, method, nil
+}
+
+// zipEntryMethod returns the compression method for a zip entry, storing files
+// that are compressed already.
+func zipEntryMethod(name string, method uint16) uint16 {
+	if compressedExtensions[strings.TrimPrefix(strings.ToLower(filepath.Ext(name)), ".")] {
+		return zip.Store
+	}
+	return method
+}
+
+// registerZipDecompressors lets r read entries compressed with the methods zip
+// outputs may use beyond deflate.
+func registerZipDecompressors(r *zip.Reader) {
+	r.RegisterDecompressor(zipMethodZstd, func(in io.Reader) io.ReadCloser {
+		// NewReader only fails on invalid options
+		dec, _ := zstd.NewReader(in, zstd.WithDecoderConcurrency(1))
+		return dec.IOReadCloser()
+	})
+}
+
+// nopWriteCloser adds a no-op Close to a writer.
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// newTarOutput wraps out in the compression opts ask for. Compressing the tar
+// stream as a whole makes it a solid archive, which is smaller than zip for many
+// small similar files but has to be decompressed from the start to reach any
+// entry. The returned writer must be closed before out.
+func newTarOutput(out io.Writer, opts ConversionOptions) (io.WriteCloser, error) {
+	level := opts.ArchiveLevel
+	switch tarCompression(opts) {
+	case "":
+		if opts.ArchiveSolid {
+			return nil, fmt.Errorf("a solid tar archive needs a compression method")
+		}
+		return nopWriteCloser{out}, nil
+	case "gzip":
+		return gzip.NewWriterLevel(out, flateLevel(level))
+	case "zstd":
+		return zstd.NewWriter(out, zstd.WithEncoderLevel(zstdLevel(level)))
+	case "xz":
+		return xz.WriterConfig{DictCap: xzDictCap(level)}.NewWriter(out)
+	default:
+		return nil, fmt.Errorf("tar archives support gzip, zstd and xz compression, not %s", opts.ArchiveMethod)
+	}
+}
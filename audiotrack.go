@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxAudioTrackTitle caps the length of an extra audio track's title.
+const maxAudioTrackTitle = 100
+
+// audioTrackKinds maps the kinds of extra audio tracks to their default title
+// and the FFmpeg disposition players use to tell them apart.
+var audioTrackKinds = map[string]struct{ title, disposition string }{
+	"description": {"Audio description", "visual_impaired"},
+	"commentary":  {"Commentary", "comment"},
+}
+
+// iso639Pattern matches the three-letter ISO 639-2 codes containers store as a
+// track's language.
+var iso639Pattern = regexp.MustCompile(`^[a-z]{3}$`)
+
+// audioTrack is an uploaded audio file muxed into video output as an extra,
+// labelled track next to the video's own audio.
+type audioTrack struct {
+	name     string
+	data     []byte
+	ext      string
+	kind     string // One of audioTrackKinds
+	language string // ISO 639-2 code; empty leaves it unset
+	title    string
+}
+
+// parseAudioTrackOptions reads the audioTrack file and the audioTrackKind,
+// audioTrackLanguage and audioTrackTitle form values into opts.
+func parseAudioTrackOptions(r *http.Request, opts *ConversionOptions) error {
+	var headers []string
+	if r.MultipartForm != nil {
+		for _, h := range r.MultipartForm.File["audioTrack"] {
+			headers = append(headers, h.Filename)
+		}
+	}
+	if len(headers) == 0 {
+		for _, field := range []string{"audioTrackKind", "audioTrackLanguage", "audioTrackTitle"} {
+			if r.FormValue(field) != "" {
+				return fmt.Errorf("%s needs an audioTrack file", field)
+			}
+		}
+		return nil
+	}
+	if len(headers) > 1 {
+		return fmt.Errorf("only one audioTrack file may be given")
+	}
+
+	f, err := r.MultipartForm.File["audioTrack"][0].Open()
+	if err != nil {
+		return fmt.Errorf("failed to open audioTrack: %w", err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("failed to read audioTrack: %w", err)
+	}
+	track, err := newAudioTrack(headers[0], data, r.FormValue("audioTrackKind"), r.FormValue("audioTrackLanguage"), r.FormValue("audioTrackTitle"))
+	if err != nil {
+		return err
+	}
+	opts.AudioTrack = track
+	return nil
+}
+
+// newAudioTrack checks an extra audio track and its labels. The kind defaults
+// to description, and the title to the kind's.
+func newAudioTrack(name string, data []byte, kind, language, title string) (*audioTrack, error) {
+	fileType, ext := DetectFileType(data, name)
+	if fileType != FileTypeAudio {
+		return nil, fmt.Errorf("audioTrack %s is not an audio file", name)
+	}
+
+	kind = strings.ToLower(strings.TrimSpace(kind))
+	if kind == "" {
+		kind = "description"
+	}
+	k, ok := audioTrackKinds[kind]
+	if !ok {
+		return nil, fmt.Errorf("invalid audioTrackKind %q (use description or commentary)", kind)
+	}
+	language = strings.ToLower(strings.TrimSpace(language))
+	if language != "" && !iso639Pattern.MatchString(language) {
+		return nil, fmt.Errorf("invalid audioTrackLanguage %q: expected a three-letter ISO 639-2 code such as eng or deu", language)
+	}
+	title = strings.TrimSpace(title)
+	if title == "" {
+		title = k.title
+	}
+	if len(title) > maxAudioTrackTitle {
+		return nil, fmt.Errorf("audioTrackTitle is too long: at most %d characters are allowed", maxAudioTrackTitle)
+	}
+	return &audioTrack{name: name, data: data, ext: ext, kind: kind, language: language, title: title}, nil
+}
+
+// muxArgs writes the track into the job's working directory and returns the
+// FFmpeg input arguments that read it and the output arguments that add it
+// after the video's own audio streams, which are counted with ffprobe.
+func (t *audioTrack) muxArgs(ctx context.Context, wd *jobWorkdir, videoPath string, report *ConversionReport) (inputs, options []string, err error) {
+	if _, err := exec.LookPath("ffprobe"); err != nil {
+		return nil, nil, &ToolMissingError{Tool: "ffprobe", Purpose: "adding an audio track"}
+	}
+	output, err := runCommand(report, exec.CommandContext(ctx, "ffprobe", "-v", "error", "-select_streams", "a",
+		"-show_entries", "stream=index", "-of", "csv=p=0", videoPath))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read the video's audio streams: %s - %w", string(output), err)
+	}
+	existing := len(strings.Fields(string(output)))
+
+	path := wd.artifact(t.ext)
+	if err := os.WriteFile(path, t.data, 0644); err != nil {
+		return nil, nil, fmt.Errorf("failed to write audio track: %w", err)
+	}
+	stream := "a:" + strconv.Itoa(existing)
+	options = []string{
+		"-map", "0:v?", "-map", "0:a?", "-map", "1:a:0",
+		"-metadata:s:" + stream, "title=" + t.title,
+		"-disposition:" + stream, audioTrackKinds[t.kind].disposition,
+	}
+	if t.language != "" {
+		options = append(options, "-metadata:s:"+stream, "language="+t.language)
+	}
+	return []string{"-i", path}, options, nil
+}
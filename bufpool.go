@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"io"
+	"sync"
+
+	"github.com/disintegration/imaging"
+)
+
+// maxPooledBuffer is the largest buffer returned to the pool. Occasional huge
+// uploads would otherwise keep their memory pinned for as long as the pool lives.
+const maxPooledBuffer = 64 << 20
+
+// bufferPool holds scratch buffers for reading uploads and encoding images, which
+// otherwise allocate (and regrow) multi-megabyte buffers on every request.
+var bufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// getBuffer takes an empty buffer from the pool; return it with putBuffer.
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putBuffer returns a buffer to the pool. Its contents must no longer be referenced.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	bufferPool.Put(buf)
+}
+
+// readAllPooled reads r to the end like io.ReadAll, into a pooled buffer instead
+// of a fresh one. The data is only valid until release is called; anything kept
+// beyond it must be copied out.
+func readAllPooled(r io.Reader) (data []byte, release func(), err error) {
+	buf := getBuffer()
+	if _, err := buf.ReadFrom(r); err != nil {
+		putBuffer(buf)
+		return nil, nil, err
+	}
+	var once sync.Once
+	return buf.Bytes(), func() { once.Do(func() { putBuffer(buf) }) }, nil
+}
+
+// sameStart reports whether a and b start at the same byte, as the output of a
+// conversion that returned its input unchanged does.
+func sameStart(a, b []byte) bool {
+	return len(a) > 0 && len(b) > 0 && &a[0] == &b[0]
+}
+
+// encodeImagePooled encodes img through a pooled buffer and returns a copy of the result.
+func encodeImagePooled(img image.Image, format imaging.Format, opts ...imaging.EncodeOption) ([]byte, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := imaging.Encode(buf, img, format, opts...); err != nil {
+		return nil, err
+	}
+	return bytes.Clone(buf.Bytes()), nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// BenchmarkReadAll compares reading uploads with io.ReadAll, which grows a
+// fresh buffer for each, with reading them into pooled buffers.
+func BenchmarkReadAll(b *testing.B) {
+	for _, size := range []int{64 << 10, 1 << 20, 16 << 20} {
+		content := bytes.Repeat([]byte("x"), size)
+		b.Run(fmt.Sprintf("ReadAll/%dKB", size>>10), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for range b.N {
+				if _, err := io.ReadAll(bytes.NewReader(content)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("Pooled/%dKB", size>>10), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for range b.N {
+				_, release, err := readAllPooled(bytes.NewReader(content))
+				if err != nil {
+					b.Fatal(err)
+				}
+				release()
+			}
+		})
+	}
+}
+
+// BenchmarkEncodeImage measures encoding images through a pooled buffer.
+func BenchmarkEncodeImage(b *testing.B) {
+	img, err := decodeAnyImage(benchPNG(b, 512))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for range b.N {
+		if _, err := encodeImagePooled(img, imaging.JPEG); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
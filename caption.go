@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goitalic"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// maxCaptionLength is the longest caption accepted, in bytes.
+const maxCaptionLength = 500
+
+// captionFonts are the TrueType fonts bundled with the binary for captions.
+var captionFonts = map[string][]byte{
+	"regular": goregular.TTF,
+	"bold":    gobold.TTF,
+	"italic":  goitalic.TTF,
+	"mono":    gomono.TTF,
+}
+
+// captionFontSize returns the configured caption size, or one relative to the frame height.
+func captionFontSize(opts ConversionOptions, frameHeight int) int {
+	if opts.CaptionSize > 0 {
+		return opts.CaptionSize
+	}
+	return max(12, frameHeight/12)
+}
+
+// drawCaption renders opts.Caption onto a copy of img, word-wrapped to the image width.
+func drawCaption(img image.Image, opts ConversionOptions) (image.Image, error) {
+	if opts.Caption == "" {
+		return img, nil
+	}
+
+	parsed, err := opentype.Parse(captionFonts[opts.CaptionFont])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse caption font: %w", err)
+	}
+	bounds := img.Bounds()
+	size := captionFontSize(opts, bounds.Dy())
+	face, err := opentype.NewFace(parsed, &opentype.FaceOptions{Size: float64(size), DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load caption font: %w", err)
+	}
+	defer face.Close()
+
+	margin := size / 2
+	lines := wrapCaption(face, opts.Caption, bounds.Dx()-2*margin)
+	metrics := face.Metrics()
+	lineHeight := metrics.Height.Ceil()
+	blockHeight := lineHeight * len(lines)
+
+	var top int
+	switch opts.CaptionPosition {
+	case "top":
+		top = margin
+	case "center":
+		top = (bounds.Dy() - blockHeight) / 2
+	default:
+		top = bounds.Dy() - blockHeight - margin
+	}
+
+	canvas := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(canvas, canvas.Bounds(), img, bounds.Min, draw.Src)
+
+	outline := max(1, size/18)
+	for i, line := range lines {
+		width := font.MeasureString(face, line).Ceil()
+		x := (bounds.Dx() - width) / 2
+		y := top + i*lineHeight + metrics.Ascent.Ceil()
+
+		// Stamp a black outline first, then the text itself on top.
+		d := &font.Drawer{Dst: canvas, Src: image.Black, Face: face}
+		for dx := -outline; dx <= outline; dx++ {
+			for dy := -outline; dy <= outline; dy++ {
+				if dx == 0 && dy == 0 {
+					continue
+				}
+				d.Dot = fixed.P(x+dx, y+dy)
+				d.DrawString(line)
+			}
+		}
+		d.Src = image.NewUniform(opts.CaptionColor)
+		d.Dot = fixed.P(x, y)
+		d.DrawString(line)
+	}
+	return canvas, nil
+}
+
+// wrapCaption splits text into lines no wider than maxWidth pixels, breaking on
+// spaces and honouring explicit newlines. Single words wider than the limit get their own line.
+func wrapCaption(face font.Face, text string, maxWidth int) []string {
+	var lines []string
+	for _, paragraph := range strings.Split(text, "\n") {
+		var current string
+		for _, word := range strings.Fields(paragraph) {
+			candidate := word
+			if current != "" {
+				candidate = current + " " + word
+			}
+			if current != "" && font.MeasureString(face, candidate).Ceil() > maxWidth {
+				lines = append(lines, current)
+				current = word
+			} else {
+				current = candidate
+			}
+		}
+		lines = append(lines, current)
+	}
+	return lines
+}
+
+// captionFilter writes the caption text and font into tempDir and returns an
+// FFmpeg drawtext filter referencing them, plus a function removing those files.
+// Going through files avoids having to escape user-supplied text for the filter graph syntax.
+func captionFilter(opts ConversionOptions, tempDir string) (string, func(), error) {
+	fontPath := filepath.Join(tempDir, "caption_font_"+opts.CaptionFont+".ttf")
+	textPath := filepath.Join(tempDir, "caption_text.txt")
+	cleanup := func() {
+		os.Remove(fontPath)
+		os.Remove(textPath)
+	}
+
+	if err := os.WriteFile(fontPath, captionFonts[opts.CaptionFont], 0644); err != nil {
+		return "", cleanup, fmt.Errorf("failed to write caption font: %w", err)
+	}
+	if err := os.WriteFile(textPath, []byte(opts.Caption), 0644); err != nil {
+		return "", cleanup, fmt.Errorf("failed to write caption text: %w", err)
+	}
+
+	size := "h/12"
+	if opts.CaptionSize > 0 {
+		size = fmt.Sprintf("%d", opts.CaptionSize)
+	}
+
+	var y string
+	switch opts.CaptionPosition {
+	case "top":
+		y = "text_h/2"
+	case "center":
+		y = "(h-text_h)/2"
+	default:
+		y = "h-text_h*3/2"
+	}
+
+	c := opts.CaptionColor
+	return fmt.Sprintf("drawtext=fontfile='%s':textfile='%s':fontsize=%s:fontcolor=0x%02x%02x%02x@%.2f:borderw=2:bordercolor=black:x=(w-text_w)/2:y=%s",
+		escapeFilterPath(fontPath), escapeFilterPath(textPath), size, c.R, c.G, c.B, float64(c.A)/255, y), cleanup, nil
+}
+
+// escapeFilterPath escapes a path for use inside a quoted FFmpeg filter option.
+func escapeFilterPath(p string) string {
+	p = strings.ReplaceAll(p, `\`, `\\`)
+	p = strings.ReplaceAll(p, `'`, `'\''`)
+	return strings.ReplaceAll(p, ":", `\:`)
+}
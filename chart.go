@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	chart "github.com/wcharczuk/go-chart/v2"
+)
+
+// renderChart draws a chart from CSV/JSON data and encodes it as PNG or SVG.
+func renderChart(ctx context.Context, inputFileBytes []byte, outputFilename, sourceExt, targetFormat string, opts ConversionOptions) ([]byte, string, error) {
+	t, err := readTable(inputFileBytes, sourceExt, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(t.Rows) == 0 {
+		return nil, "", fmt.Errorf("no data rows to chart")
+	}
+
+	labelCol, valueCols, err := chartColumns(t, opts)
+	if err != nil {
+		return nil, "", err
+	}
+
+	labels := make([]string, len(t.Rows))
+	for i, row := range t.Rows {
+		labels[i] = row[labelCol]
+	}
+
+	var renderable interface {
+		Render(rp chart.RendererProvider, w io.Writer) error
+	}
+	switch opts.ChartType {
+	case "bar", "pie":
+		// Bar and pie charts show a single value per label.
+		if len(valueCols) > 1 {
+			return nil, "", fmt.Errorf("%s charts support a single value column, got %d", opts.ChartType, len(valueCols))
+		}
+		values := make([]chart.Value, 0, len(t.Rows))
+		for i, row := range t.Rows {
+			v, ok := parseCellFloat(row[valueCols[0]])
+			if !ok {
+				continue
+			}
+			values = append(values, chart.Value{Label: labels[i], Value: v})
+		}
+		if opts.ChartType == "bar" {
+			renderable = chart.BarChart{Title: opts.ChartTitle, Width: opts.ChartWidth, Height: opts.ChartHeight, Bars: values}
+		} else {
+			renderable = chart.PieChart{Title: opts.ChartTitle, Width: opts.ChartWidth, Height: opts.ChartHeight, Values: values}
+		}
+	default:
+		renderable = lineChart(t, labels, valueCols, opts)
+	}
+
+	rp := chart.PNG
+	if targetFormat == "svg" {
+		rp = chart.SVG
+	}
+	var buf bytes.Buffer
+	if err := renderable.Render(rp, &buf); err != nil {
+		return nil, "", fmt.Errorf("failed to render chart: %w", err)
+	}
+	return buf.Bytes(), outputFilename, nil
+}
+
+// lineChart builds a line chart with one series per value column. Labels are placed
+// as x-axis ticks so categorical x values (dates, names) keep their order.
+func lineChart(t *table, labels []string, valueCols []int, opts ConversionOptions) *chart.Chart {
+	c := &chart.Chart{Title: opts.ChartTitle, Width: opts.ChartWidth, Height: opts.ChartHeight}
+	if opts.ChartTitle != "" {
+		// Leave room so the title doesn't overlap the plot area.
+		c.Background = chart.Style{Padding: chart.Box{Top: 50, Left: 20, Right: 20, Bottom: 20}}
+	}
+
+	// Thin out tick labels so they stay readable on long series.
+	step := max(1, len(labels)/20)
+	for i := 0; i < len(labels); i += step {
+		c.XAxis.Ticks = append(c.XAxis.Ticks, chart.Tick{Value: float64(i), Label: labels[i]})
+	}
+
+	for _, col := range valueCols {
+		series := chart.ContinuousSeries{Name: t.Columns[col]}
+		for i, row := range t.Rows {
+			if v, ok := parseCellFloat(row[col]); ok {
+				series.XValues = append(series.XValues, float64(i))
+				series.YValues = append(series.YValues, v)
+			}
+		}
+		c.Series = append(c.Series, series)
+	}
+	if len(valueCols) > 1 {
+		c.Elements = []chart.Renderable{chart.Legend(c)}
+	}
+	return c
+}
+
+// chartColumns resolves the label and value columns from the options, defaulting to
+// the first column for labels and every mostly-numeric remaining column for values.
+func chartColumns(t *table, opts ConversionOptions) (int, []int, error) {
+	labelCol := 0
+	if opts.ChartX != "" {
+		if labelCol = t.columnIndex(opts.ChartX); labelCol < 0 {
+			return 0, nil, fmt.Errorf("column %q not found", opts.ChartX)
+		}
+	}
+
+	var valueCols []int
+	if len(opts.ChartY) > 0 {
+		for _, name := range opts.ChartY {
+			idx := t.columnIndex(name)
+			if idx < 0 {
+				return 0, nil, fmt.Errorf("column %q not found", name)
+			}
+			valueCols = append(valueCols, idx)
+		}
+		return labelCol, valueCols, nil
+	}
+
+	for i := range t.Columns {
+		if i == labelCol {
+			continue
+		}
+		numeric := 0
+		for _, row := range t.Rows {
+			if _, ok := parseCellFloat(row[i]); ok {
+				numeric++
+			}
+		}
+		if numeric*2 > len(t.Rows) {
+			valueCols = append(valueCols, i)
+		}
+	}
+	if len(valueCols) == 0 {
+		return 0, nil, fmt.Errorf("no numeric columns found to chart; use chartY to pick columns")
+	}
+	if opts.ChartType != "line" {
+		valueCols = valueCols[:1]
+	}
+	return labelCol, valueCols, nil
+}
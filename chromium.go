@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/netip"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// chromiumStartTimeout is how long to wait for the browser to expose its DevTools endpoint.
+	chromiumStartTimeout = 15 * time.Second
+	// chromiumPageTimeout bounds page loading and rendering.
+	chromiumPageTimeout = 60 * time.Second
+	// maxScreenshotHeight caps full-page captures of very long pages.
+	maxScreenshotHeight = 16384
+)
+
+// documentURL is the address uploaded HTML is served to the browser from. It is
+// never resolved: the browser's request for it is answered with the document.
+// Unlike a file:// URL, its origin gives the document's scripts no access to
+// local files.
+const documentURL = "http://document.invalid/"
+
+// chromiumCandidates are the executable names tried when looking for a headless browser.
+var chromiumCandidates = []string{"chromium", "chromium-browser", "google-chrome", "google-chrome-stable", "headless-shell"}
+
+// findChromium locates a Chromium-based browser, preferring FILECONVERTER_CHROMIUM_PATH.
+func findChromium() (string, error) {
+	if p := os.Getenv("FILECONVERTER_CHROMIUM_PATH"); p != "" {
+		return p, nil
+	}
+	for _, name := range chromiumCandidates {
+		if p, err := exec.LookPath(name); err == nil {
+			return p, nil
+		}
+	}
+	return "", &ToolMissingError{Tool: "Chromium", Purpose: "this conversion"}
+}
+
+// chromiumSession is a headless browser process driven over the DevTools protocol.
+// Every request its page makes is paused until the session lets it through, so
+// a page, however it was loaded, only reaches public hosts.
+type chromiumSession struct {
+	ctx       context.Context
+	cmd       *exec.Cmd
+	report    *ConversionReport
+	started   time.Time
+	stderr    bytes.Buffer
+	dataDir   string
+	conn      *websocket.Conn
+	nextID    int
+	sessionID string       // Flattened session of the page target
+	events    []cdpMessage // Events received while waiting for command responses
+
+	document []byte           // HTML served at documentURL, if rendering an uploaded document
+	hosts    map[string]error // Result of checking each host the page requested
+	blocked  error            // Set once the page reached an internal address anyway
+}
+
+// cdpMessage is a DevTools protocol message (command response or event).
+type cdpMessage struct {
+	ID        int             `json:"id,omitempty"`
+	Method    string          `json:"method,omitempty"`
+	SessionID string          `json:"sessionId,omitempty"`
+	Params    json.RawMessage `json:"params,omitempty"`
+	Result    json.RawMessage `json:"result,omitempty"`
+	Error     *struct {
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+// startChromium launches a headless browser and attaches to a fresh page. The
+// browser is killed when ctx ends, and its process is traced in report once the
+// session is closed.
+func startChromium(ctx context.Context, report *ConversionReport) (*chromiumSession, error) {
+	bin, err := findChromium()
+	if err != nil {
+		return nil, err
+	}
+
+	dataDir, err := os.MkdirTemp("", "fileconverter-chromium-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create browser profile directory: %w", err)
+	}
+
+	// Popups and out-of-process iframes would load outside the page's request
+	// interception, so neither is allowed
+	args := []string{"--headless=new", "--disable-gpu", "--hide-scrollbars", "--mute-audio",
+		"--no-first-run", "--remote-debugging-port=0", "--user-data-dir=" + dataDir,
+		"--block-new-web-contents", "--disable-site-isolation-trials", "--disable-features=IsolateOrigins,site-per-process"}
+	if os.Geteuid() == 0 {
+		args = append(args, "--no-sandbox") // Chromium refuses to run its sandbox as root
+	}
+	s := &chromiumSession{ctx: ctx, cmd: exec.CommandContext(ctx, bin, append(args, "about:blank")...), report: report, dataDir: dataDir, hosts: map[string]error{}}
+	s.cmd.Stderr = &s.stderr
+	s.started = time.Now()
+	if err := s.cmd.Start(); err != nil {
+		report.addCommand(newCommandTrace(s.cmd, 0, nil, err))
+		os.RemoveAll(dataDir)
+		return nil, fmt.Errorf("failed to start Chromium: %w", err)
+	}
+
+	wsURL, err := waitForDevTools(ctx, dataDir)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	if s.conn, err = websocket.Dial(wsURL, "", "http://localhost/"); err != nil {
+		s.close()
+		return nil, fmt.Errorf("failed to connect to Chromium DevTools: %w", err)
+	}
+	s.conn.MaxPayloadBytes = 512 << 20 // Screenshots of long pages are large
+
+	var target struct {
+		TargetID string `json:"targetId"`
+	}
+	if err := s.call("Target.createTarget", map[string]any{"url": "about:blank"}, &target); err != nil {
+		s.close()
+		return nil, err
+	}
+	var attached struct {
+		SessionID string `json:"sessionId"`
+	}
+	if err := s.call("Target.attachToTarget", map[string]any{"targetId": target.TargetID, "flatten": true}, &attached); err != nil {
+		s.close()
+		return nil, err
+	}
+	s.sessionID = attached.SessionID
+
+	if err := s.call("Fetch.enable", map[string]any{"patterns": []any{map[string]any{"urlPattern": "*"}}}, nil); err != nil {
+		s.close()
+		return nil, err
+	}
+	if err := s.call("Network.enable", map[string]any{}, nil); err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// waitForDevTools waits for Chromium to write its DevTools port file and returns the browser websocket URL.
+func waitForDevTools(ctx context.Context, dataDir string) (string, error) {
+	deadline := time.Now().Add(chromiumStartTimeout)
+	for time.Now().Before(deadline) && ctx.Err() == nil {
+		f, err := os.Open(filepath.Join(dataDir, "DevToolsActivePort"))
+		if err == nil {
+			sc := bufio.NewScanner(f)
+			var lines []string
+			for sc.Scan() {
+				lines = append(lines, strings.TrimSpace(sc.Text()))
+			}
+			f.Close()
+			if len(lines) >= 2 {
+				return "ws://127.0.0.1:" + lines[0] + lines[1], nil
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("%w waiting for Chromium to start", ErrTimeout)
+}
+
+// call sends a DevTools command to the page session (or the browser if no session
+// is attached yet) and decodes its result into out.
+func (s *chromiumSession) call(method string, params any, out any) error {
+	s.conn.SetDeadline(time.Now().Add(chromiumPageTimeout))
+	id, err := s.send(method, params)
+	if err != nil {
+		return err
+	}
+	for {
+		var resp cdpMessage
+		if err := websocket.JSON.Receive(s.conn, &resp); err != nil {
+			return fmt.Errorf("failed to receive %s response: %w", method, timeoutError(err))
+		}
+		if resp.ID != id {
+			if resp.Method != "" {
+				if handled, err := s.handleEvent(resp); err != nil {
+					return err
+				} else if !handled {
+					s.events = append(s.events, resp)
+				}
+			}
+			continue
+		}
+		if resp.Error != nil {
+			return fmt.Errorf("%s failed: %s", method, resp.Error.Message)
+		}
+		if out != nil {
+			return json.Unmarshal(resp.Result, out)
+		}
+		return nil
+	}
+}
+
+// send sends a DevTools command without waiting for its response, which the
+// receive loops then skip, and returns its id.
+func (s *chromiumSession) send(method string, params any) (int, error) {
+	s.nextID++
+	msg := map[string]any{"id": s.nextID, "method": method, "params": params}
+	if s.sessionID != "" {
+		msg["sessionId"] = s.sessionID
+	}
+	if err := websocket.JSON.Send(s.conn, msg); err != nil {
+		return 0, fmt.Errorf("failed to send %s: %w", method, err)
+	}
+	return s.nextID, nil
+}
+
+// handleEvent answers the page's paused requests and watches the addresses its
+// responses come from, reporting whether ev was one of the events it handles.
+func (s *chromiumSession) handleEvent(ev cdpMessage) (bool, error) {
+	switch {
+	case ev.Method == "Fetch.requestPaused":
+		var paused struct {
+			RequestID string `json:"requestId"`
+			Request   struct {
+				URL string `json:"url"`
+			} `json:"request"`
+		}
+		if err := json.Unmarshal(ev.Params, &paused); err != nil {
+			return true, fmt.Errorf("invalid %s event: %w", ev.Method, err)
+		}
+		return true, s.answerRequest(paused.RequestID, paused.Request.URL)
+	case ev.Method == "Network.responseReceived":
+		// The browser resolves hosts itself, and a host may resolve to a public
+		// address when checked and to an internal one when fetched
+		var received struct {
+			Response struct {
+				URL             string `json:"url"`
+				RemoteIPAddress string `json:"remoteIPAddress"`
+			} `json:"response"`
+		}
+		if err := json.Unmarshal(ev.Params, &received); err != nil {
+			return true, fmt.Errorf("invalid %s event: %w", ev.Method, err)
+		}
+		ip, err := netip.ParseAddr(strings.Trim(received.Response.RemoteIPAddress, "[]"))
+		if err == nil && internalAddress(ip) && !privateURLsAllowed() && s.blocked == nil {
+			s.blocked = fmt.Errorf("the page loaded %s from an internal address", received.Response.URL)
+		}
+		return true, nil
+	case ev.Method == "Network.webSocketCreated":
+		// WebSocket connections are not paused like other requests
+		var created struct {
+			URL string `json:"url"`
+		}
+		if err := json.Unmarshal(ev.Params, &created); err != nil {
+			return true, fmt.Errorf("invalid %s event: %w", ev.Method, err)
+		}
+		if err := s.checkURL(created.URL); err != nil && s.blocked == nil {
+			s.blocked = fmt.Errorf("the page opened a WebSocket to %s: %w", created.URL, err)
+		}
+		return true, nil
+	case strings.HasPrefix(ev.Method, "Network."):
+		return true, nil // Not waited for, so not kept
+	}
+	return false, nil
+}
+
+// answerRequest lets a paused request through if the page may make it, serves
+// the uploaded document at documentURL, and fails every other request.
+func (s *chromiumSession) answerRequest(requestID, rawURL string) error {
+	if s.document != nil && rawURL == documentURL {
+		_, err := s.send("Fetch.fulfillRequest", map[string]any{
+			"requestId":       requestID,
+			"responseCode":    200,
+			"responseHeaders": []any{map[string]any{"name": "Content-Type", "value": "text/html"}},
+			"body":            base64.StdEncoding.EncodeToString(s.document),
+		})
+		return err
+	}
+	if err := s.checkURL(rawURL); err != nil {
+		log.Printf("Blocked browser request for %s: %v", rawURL, err)
+		_, err := s.send("Fetch.failRequest", map[string]any{"requestId": requestID, "errorReason": "BlockedByClient"})
+		return err
+	}
+	_, err := s.send("Fetch.continueRequest", map[string]any{"requestId": requestID})
+	return err
+}
+
+// checkURL decides whether the page may load a URL: data and blob URLs, which
+// don't leave the browser, and http(s) and WebSocket URLs of public hosts. Local
+// files are never allowed.
+func (s *chromiumSession) checkURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL")
+	}
+	switch u.Scheme {
+	case "data", "blob":
+		return nil
+	case "http", "https", "ws", "wss":
+		host := u.Hostname()
+		err, checked := s.hosts[host]
+		if !checked {
+			err = checkPublicHost(s.ctx, host)
+			s.hosts[host] = err
+		}
+		return err
+	default:
+		return fmt.Errorf("%s URLs cannot be loaded", u.Scheme)
+	}
+}
+
+// waitEvent blocks until the page session emits the named event.
+func (s *chromiumSession) waitEvent(method string) error {
+	for i, ev := range s.events {
+		if ev.Method == method && ev.SessionID == s.sessionID {
+			s.events = append(s.events[:i], s.events[i+1:]...)
+			return nil
+		}
+	}
+
+	s.conn.SetDeadline(time.Now().Add(chromiumPageTimeout))
+	for {
+		var ev cdpMessage
+		if err := websocket.JSON.Receive(s.conn, &ev); err != nil {
+			return fmt.Errorf("failed waiting for %s: %w", method, timeoutError(err))
+		}
+		if handled, err := s.handleEvent(ev); err != nil {
+			return err
+		} else if handled {
+			continue
+		}
+		if ev.Method == method && ev.SessionID == s.sessionID {
+			return nil
+		}
+	}
+}
+
+// load navigates the page to url at the given viewport and waits for the load event.
+func (s *chromiumSession) load(url string, width, height int, scale float64) error {
+	if err := s.call("Page.enable", map[string]any{}, nil); err != nil {
+		return err
+	}
+	if err := s.setViewport(width, height, scale); err != nil {
+		return err
+	}
+	var nav struct {
+		ErrorText string `json:"errorText"`
+	}
+	if err := s.call("Page.navigate", map[string]any{"url": url}, &nav); err != nil {
+		return err
+	}
+	if nav.ErrorText != "" {
+		return fmt.Errorf("failed to load page: %s", nav.ErrorText)
+	}
+	return s.waitEvent("Page.loadEventFired")
+}
+
+// setViewport overrides the page's viewport size and device scale factor.
+func (s *chromiumSession) setViewport(width, height int, scale float64) error {
+	return s.call("Emulation.setDeviceMetricsOverride", map[string]any{
+		"width": width, "height": height, "deviceScaleFactor": scale, "mobile": false,
+	}, nil)
+}
+
+// screenshot captures the page as png or jpeg; with fullPage the viewport is grown
+// to the document height first so the whole page is captured.
+func (s *chromiumSession) screenshot(format string, width int, scale float64, fullPage bool) ([]byte, error) {
+	if fullPage {
+		var metrics struct {
+			CSSContentSize struct {
+				Height float64 `json:"height"`
+			} `json:"cssContentSize"`
+		}
+		if err := s.call("Page.getLayoutMetrics", map[string]any{}, &metrics); err != nil {
+			return nil, err
+		}
+		height := min(max(int(metrics.CSSContentSize.Height), 1), maxScreenshotHeight)
+		if err := s.setViewport(width, height, scale); err != nil {
+			return nil, err
+		}
+	}
+
+	params := map[string]any{"format": format, "captureBeyondViewport": fullPage}
+	if format == "jpeg" {
+		params["quality"] = 90
+	}
+	var shot struct {
+		Data string `json:"data"`
+	}
+	if err := s.call("Page.captureScreenshot", params, &shot); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(shot.Data)
+}
+
+// printPDF renders the loaded page to PDF.
+func (s *chromiumSession) printPDF() ([]byte, error) {
+	var pdf struct {
+		Data string `json:"data"`
+	}
+	if err := s.call("Page.printToPDF", map[string]any{"printBackground": true, "preferCSSPageSize": true}, &pdf); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(pdf.Data)
+}
+
+// evaluate runs a JavaScript expression in the page and decodes its value into out.
+func (s *chromiumSession) evaluate(expression string, out any) error {
+	var res struct {
+		Result struct {
+			Value json.RawMessage `json:"value"`
+		} `json:"result"`
+		ExceptionDetails *struct {
+			Text      string `json:"text"`
+			Exception struct {
+				Description string `json:"description"`
+			} `json:"exception"`
+		} `json:"exceptionDetails"`
+	}
+	if err := s.call("Runtime.evaluate", map[string]any{"expression": expression, "returnByValue": true}, &res); err != nil {
+		return err
+	}
+	if e := res.ExceptionDetails; e != nil {
+		if e.Exception.Description != "" {
+			return fmt.Errorf("script failed: %s", e.Exception.Description)
+		}
+		return fmt.Errorf("script failed: %s", e.Text)
+	}
+	return json.Unmarshal(res.Result.Value, out)
+}
+
+// close shuts the browser down, records its trace and removes its temporary profile.
+// The browser is killed rather than exiting by itself, so its exit code isn't meaningful.
+func (s *chromiumSession) close() {
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	if s.cmd.Process != nil {
+		s.cmd.Process.Kill()
+		s.cmd.Wait()
+		s.report.addCommand(newCommandTrace(s.cmd, time.Since(s.started), s.stderr.Bytes(), nil))
+	}
+	os.RemoveAll(s.dataDir)
+}
+
+// renderPage loads url in headless Chromium and renders it to png, jpg or pdf.
+func renderPage(ctx context.Context, url, targetFormat string, opts ConversionOptions) ([]byte, error) {
+	return renderInChromium(ctx, url, nil, targetFormat, opts)
+}
+
+// renderHTML renders an HTML document to png, jpg or pdf in headless Chromium,
+// which gets it from documentURL.
+func renderHTML(ctx context.Context, html []byte, targetFormat string, opts ConversionOptions) ([]byte, error) {
+	return renderInChromium(ctx, documentURL, html, targetFormat, opts)
+}
+
+// renderInChromium loads url, serving document at documentURL, and renders the
+// page. Output of a page that reached an internal address is discarded.
+func renderInChromium(ctx context.Context, url string, document []byte, targetFormat string, opts ConversionOptions) ([]byte, error) {
+	s, err := startChromium(ctx, opts.Report)
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+	s.document = document
+
+	if err := s.load(url, opts.ViewportWidth, opts.ViewportHeight, opts.ScaleFactor); err != nil {
+		return nil, err
+	}
+	out, err := s.render(targetFormat, opts)
+	if err == nil && s.blocked != nil {
+		return nil, s.blocked
+	}
+	return out, err
+}
+
+// render captures the loaded page as png, jpg or pdf.
+func (s *chromiumSession) render(targetFormat string, opts ConversionOptions) ([]byte, error) {
+	switch targetFormat {
+	case "pdf":
+		if opts.Redact != nil {
+			if err := s.redact(opts.Redact, opts.Report); err != nil {
+				return nil, err
+			}
+		}
+		return s.printPDF()
+	case "jpg", "jpeg":
+		return s.screenshot("jpeg", opts.ViewportWidth, opts.ScaleFactor, opts.FullPage)
+	default:
+		return s.screenshot("png", opts.ViewportWidth, opts.ScaleFactor, opts.FullPage)
+	}
+}
+
+// convertHTMLWithChromium renders an uploaded HTML document to png, jpg or pdf.
+func convertHTMLWithChromium(ctx context.Context, inputFileBytes []byte, outputFilename, targetFormat string, opts ConversionOptions) ([]byte, string, error) {
+	out, err := renderHTML(ctx, inputFileBytes, targetFormat, opts)
+	if err != nil {
+		return nil, "", fmt.Errorf("HTML rendering failed: %w", err)
+	}
+	return out, outputFilename, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+)
+
+// optionFlags collects repeated -opt name=value flags.
+type optionFlags url.Values
+
+func (o optionFlags) String() string { return url.Values(o).Encode() }
+
+func (o optionFlags) Set(v string) error {
+	name, value, ok := strings.Cut(v, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("option %q must look like name=value", v)
+	}
+	url.Values(o).Add(name, value)
+	return nil
+}
+
+// runConvertCommand converts a single file without starting the server:
+//
+//	fileconverter convert -from png -to webp < a.png > a.webp
+//	fileconverter convert -to pdf -o report.pdf report.docx
+//
+// Input is read from the named file, or from standard input when none or "-" is
+// given; the result goes to -o or standard output, so the command fits in shell
+// pipelines. Conversion options are passed as -opt name=value, using the same
+// names as the upload form. Logs go to standard error.
+func runConvertCommand(args []string) error {
+	flags := flag.NewFlagSet("convert", flag.ContinueOnError)
+	from := flags.String("from", "", "source format; required when the input has no extension, e.g. on standard input")
+	to := flags.String("to", "", "target format (required)")
+	output := flags.String("o", "-", "output file, or - for standard output")
+	options := optionFlags{}
+	flags.Var(options, "opt", "conversion option as name=value, may be repeated (e.g. -opt aspect=16:9)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *to == "" {
+		return fmt.Errorf("-to is required")
+	}
+	if flags.NArg() > 1 {
+		return fmt.Errorf("at most one input file may be given")
+	}
+
+	// Converters go by the file name's extension, so give standard input one.
+	input := flags.Arg(0)
+	name := filepath.Base(input)
+	if input == "" || input == "-" {
+		name = "stdin"
+	}
+	if *from != "" {
+		name = strings.TrimSuffix(name, filepath.Ext(name)) + "." + strings.TrimPrefix(strings.ToLower(*from), ".")
+	} else if filepath.Ext(name) == "" {
+		return fmt.Errorf("-from is required when the input has no extension")
+	}
+
+	signer, err := loadPDFSigner()
+	if err != nil {
+		return err
+	}
+	pdfSigning = signer
+	if textTranslator, err = loadTranslator(); err != nil {
+		return err
+	}
+	if conversionHooks, err = loadHooks(); err != nil {
+		return err
+	}
+	conversionDeadlines = loadStageDeadlines()
+	tempSpace = loadTempSpaceBudget()
+	archiveExpansion = loadArchiveLimits()
+	if intermediateImage, err = loadImageIntermediate(); err != nil {
+		return err
+	}
+	// -opt audioTrack names a file, so it is read here rather than from a form
+	values := url.Values(options)
+	trackPath := values.Get("audioTrack")
+	trackKind, trackLanguage, trackTitle := values.Get("audioTrackKind"), values.Get("audioTrackLanguage"), values.Get("audioTrackTitle")
+	if trackPath != "" {
+		for _, field := range []string{"audioTrack", "audioTrackKind", "audioTrackLanguage", "audioTrackTitle"} {
+			values.Del(field)
+		}
+	}
+	opts, err := parseConversionOptions(&http.Request{Form: values})
+	if err != nil {
+		return fmt.Errorf("invalid conversion options: %w", err)
+	}
+	if trackPath != "" {
+		data, err := os.ReadFile(trackPath)
+		if err != nil {
+			return fmt.Errorf("failed to read audio track: %w", err)
+		}
+		if opts.AudioTrack, err = newAudioTrack(filepath.Base(trackPath), data, trackKind, trackLanguage, trackTitle); err != nil {
+			return fmt.Errorf("invalid conversion options: %w", err)
+		}
+	}
+	opts.Report = &ConversionReport{}
+
+	// Interrupting the command stops the tools it runs and cleans up after them
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	in := os.Stdin
+	if input != "" && input != "-" {
+		if in, err = os.Open(input); err != nil {
+			return fmt.Errorf("failed to read input: %w", err)
+		}
+		defer in.Close()
+	}
+
+	// Tables are converted row by row, so inputs of any size fit in a pipeline;
+	// hooks need the whole file though
+	if sourceExt := strings.TrimPrefix(strings.ToLower(filepath.Ext(name)), "."); streamsTable(sourceExt, strings.ToLower(*to)) && !conversionHooks.enabled() {
+		return convertTableToOutput(ctx, in, *output, sourceExt, strings.ToLower(*to), opts)
+	}
+
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return fmt.Errorf("failed to read input: %w", err)
+	}
+	converted, _, err := performConversion(ctx, data, name, strings.ToLower(*to), opts)
+	if err != nil {
+		return fmt.Errorf("conversion failed: %w", err)
+	}
+	for _, c := range opts.Report.Redactions() {
+		fmt.Fprintf(os.Stderr, "Redacted %d matches of %s %q\n", c.Matches, c.Kind, c.Rule)
+	}
+	for _, step := range opts.Report.Intermediates() {
+		quality := "lossless"
+		if !step.Lossless {
+			quality = "lossy"
+		}
+		fmt.Fprintf(os.Stderr, "Passed through a %s %s intermediate for %s\n", quality, step.Format, step.Into)
+	}
+	if lang := opts.Report.Language(); lang != nil {
+		fmt.Fprintf(os.Stderr, "Detected language %s (confidence %.2f)\n", lang.Detected, lang.Confidence)
+		if lang.TranslatedTo != "" {
+			fmt.Fprintf(os.Stderr, "Translated %d texts to %s\n", lang.Segments, lang.TranslatedTo)
+		}
+	}
+
+	if *output == "-" {
+		_, err = os.Stdout.Write(converted)
+	} else {
+		err = os.WriteFile(*output, converted, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+	return nil
+}
+
+// convertTableToOutput streams a table conversion to the -o destination.
+func convertTableToOutput(ctx context.Context, in io.Reader, output, sourceExt, targetFormat string, opts ConversionOptions) error {
+	out := os.Stdout
+	if output != "-" {
+		f, err := os.Create(output)
+		if err != nil {
+			return fmt.Errorf("failed to write output: %w", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	err := runConvertStage(ctx, opts, func(ctx context.Context) error {
+		return convertTableStream(ctx, in, out, sourceExt, targetFormat, opts)
+	})
+	if err != nil {
+		if out != os.Stdout {
+			os.Remove(output) // Do not leave a truncated table behind
+		}
+		return fmt.Errorf("conversion failed: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+	return nil
+}
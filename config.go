@@ -0,0 +1,53 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// envDuration reads a duration such as "24h" or "90s" from an environment
+// variable, falling back to def when it is unset or invalid.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Printf("Warning: ignoring invalid %s=%q, using %v", name, v, def)
+		return def
+	}
+	return d
+}
+
+// envInt reads a non-negative integer from an environment variable, falling back
+// to def when it is unset or invalid.
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Printf("Warning: ignoring invalid %s=%q, using %d", name, v, def)
+		return def
+	}
+	return n
+}
+
+// envFloat reads a non-negative number from an environment variable, falling
+// back to def when it is unset or invalid.
+func envFloat(name string, def float64) float64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		log.Printf("Warning: ignoring invalid %s=%q, using %v", name, v, def)
+		return def
+	}
+	return f
+}
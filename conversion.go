@@ -2,17 +2,19 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"image"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/disintegration/imaging"
-	"github.com/mholt/archiver/v3"
 	"github.com/srwiley/oksvg"
 	"github.com/srwiley/rasterx"
 	_ "golang.org/x/image/tiff" // Import TIFF decoder
@@ -27,6 +29,7 @@ const (
 	FileTypeVideo   FileType = "video"
 	FileTypeDoc     FileType = "document"
 	FileTypeArchive FileType = "archive"
+	FileTypeData    FileType = "data"
 	FileTypeOther   FileType = "other"
 )
 
@@ -40,7 +43,7 @@ var ConversionMap = map[FileType]map[string][]string{
 		"webp": {"jpg", "png", "gif", "bmp", "tiff"},
 		"bmp":  {"jpg", "png", "gif", "webp", "tiff"},
 		"tiff": {"jpg", "png", "gif", "webp", "bmp"},
-		"svg":  {"png", "jpg"},
+		"svg":  {"png", "jpg", "webp"},
 	},
 	FileTypeAudio: {
 		"mp3":  {"wav", "ogg", "flac", "aac", "wma"},
@@ -59,21 +62,37 @@ var ConversionMap = map[FileType]map[string][]string{
 		"flv":  {"mp4", "avi", "mov", "webm", "mkv", "mp3", "wav", "ogg", "flac", "aac"},
 	},
 	FileTypeDoc: {
-		"docx": {"pdf", "txt", "html", "md"},
-		"doc":  {"pdf", "txt", "html", "md"},
-		"pdf":  {"txt", "html", "md"},
-		"txt":  {"pdf", "html", "md"},
-		"html": {"pdf", "txt", "md"},
-		"md":   {"html", "txt", "pdf"},
-		"pptx": {"pdf"},
-		"ppt":  {"pdf"},
-		"xlsx": {"csv", "pdf"},
-		"xls":  {"csv", "pdf"},
+		"docx":   {"pdf", "txt", "html", "md"},
+		"doc":    {"pdf", "txt", "html", "md"},
+		"pdf":    {"txt", "html", "md"},
+		"txt":    {"pdf", "html", "md"},
+		"html":   {"pdf", "txt", "md", "png", "jpg"},
+		"md":     {"html", "txt", "pdf"},
+		"srt":    {"txt"},
+		"pptx":   {"pdf"},
+		"ppt":    {"pdf"},
+		"xlsx":   {"csv", "pdf", "json"},
+		"xls":    {"csv", "pdf"},
+		"csv":    {"png", "svg", "sqlite", "parquet", "json", "xlsx", "pdf"},
+		"json":   {"png", "svg", "parquet", "csv", "xlsx", "pdf"},
+		"log":    {"csv", "json"},
+		"jsonl":  {"csv", "json"},
+		"ndjson": {"csv", "json"},
 	},
 	FileTypeArchive: {
 		"zip": {"tar"},
 		"tar": {"zip"},
 		"rar": {"zip", "tar"},
+		"iso": {"zip", "tar"},
+		"img": {"zip", "tar"},
+		"dmg": {"zip", "tar"},
+	},
+	FileTypeData: {
+		"sqlite":  {"csv", "json", "xlsx"},
+		"sqlite3": {"csv", "json", "xlsx"},
+		"db":      {"csv", "json", "xlsx"},
+		"parquet": {"csv", "json"},
+		"avro":    {"json"},
 	},
 }
 
@@ -89,6 +108,12 @@ func DetectFileType(fileBytes []byte, filename string) (FileType, string) {
 	contentType := http.DetectContentType(fileBytes)
 
 	// Determine file type based on content type and extension
+	if ext == "svg" && isSVG(fileBytes) {
+		return FileTypeImage, ext // Sniffed as XML text otherwise
+	}
+	if contentType == "application/zip" && (ext == "docx" || ext == "xlsx" || ext == "pptx") {
+		return FileTypeDoc, ext // Office Open XML documents are zip files
+	}
 	if strings.HasPrefix(contentType, "image/") {
 		return FileTypeImage, ext
 	} else if strings.HasPrefix(contentType, "audio/") {
@@ -114,10 +139,12 @@ func DetectFileType(fileBytes []byte, filename string) (FileType, string) {
 		return FileTypeAudio, ext
 	case "mp4", "avi", "mov", "webm", "mkv", "flv":
 		return FileTypeVideo, ext
-	case "pdf", "doc", "docx", "txt", "html", "md", "ppt", "pptx", "xls", "xlsx", "csv":
+	case "pdf", "doc", "docx", "txt", "html", "md", "srt", "ppt", "pptx", "xls", "xlsx", "csv", "json", "log", "jsonl", "ndjson":
 		return FileTypeDoc, ext
-	case "zip", "tar", "rar":
+	case "zip", "tar", "rar", "iso", "img", "dmg":
 		return FileTypeArchive, ext
+	case "sqlite", "sqlite3", "db", "parquet", "avro":
+		return FileTypeData, ext
 	}
 
 	return FileTypeOther, ext
@@ -133,8 +160,19 @@ func GetSupportedConversionFormats(fileType FileType, extension string) []string
 	return []string{}
 }
 
-// performConversion handles file conversion based on file type and target format
-func performConversion(inputFileBytes []byte, originalFilename string, targetFormat string) ([]byte, string, error) {
+// conversionSupported reports whether a file can be converted to targetFormat
+// with the given options. Translation alone keeps the document's format.
+func conversionSupported(fileType FileType, sourceExt, targetFormat string, opts ConversionOptions) bool {
+	if sourceExt == targetFormat && opts.TranslateTo != "" && translatableFormats[sourceExt] {
+		return true
+	}
+	return slices.Contains(GetSupportedConversionFormats(fileType, sourceExt), targetFormat)
+}
+
+// performConversion handles file conversion based on file type and target format.
+// It stops when ctx ends, bounds its stages by opts.Deadlines, and reserves the
+// temporary disk space it is expected to need before converting.
+func performConversion(ctx context.Context, inputFileBytes []byte, originalFilename string, targetFormat string, opts ConversionOptions) ([]byte, string, error) {
 	log.Printf("Converting file: %s to target format: %s", originalFilename, targetFormat)
 
 	// Detect file type
@@ -145,126 +183,176 @@ func performConversion(inputFileBytes []byte, originalFilename string, targetFor
 	outputFilename := baseName + "." + targetFormat
 
 	// Check if conversion is supported
-	supported := false
-	if formatMap, ok := ConversionMap[fileType]; ok {
-		if formats, ok := formatMap[sourceExt]; ok {
-			// Check if targetFormat is in the list of supported formats
-			for _, format := range formats {
-				if format == targetFormat {
-					supported = true
-					break
-				}
-			}
-		}
+	if !conversionSupported(fileType, sourceExt, targetFormat, opts) {
+		return nil, "", fmt.Errorf("%w from %s to %s", ErrUnsupportedConversion, sourceExt, targetFormat)
+	}
+	if opts.Sign && targetFormat != "pdf" {
+		return nil, "", fmt.Errorf("%w: only PDF output can be signed", ErrUnsupportedConversion)
+	}
+	if opts.Redact != nil && (fileType != FileTypeDoc || targetFormat != "pdf") {
+		return nil, "", fmt.Errorf("%w: redaction only applies to documents converted to PDF", ErrUnsupportedConversion)
+	}
+	if opts.AudioTrack != nil && fileType != FileTypeVideo {
+		return nil, "", fmt.Errorf("%w: an audio track can only be added to a video", ErrUnsupportedConversion)
+	}
+	if (opts.DetectLanguage || opts.TranslateTo != "") && !translatableFormats[sourceExt] {
+		return nil, "", fmt.Errorf("%w: language detection and translation only apply to txt, md, html and srt files", ErrUnsupportedConversion)
 	}
 
-	if !supported {
-		return nil, "", fmt.Errorf("conversion from %s to %s is not supported", sourceExt, targetFormat)
+	// Deployments may validate the input and post-process the output (see hooks.go)
+	event := hookEvent{Stage: hookPre, FileName: originalFilename, FileType: fileType, SourceFormat: sourceExt, TargetFormat: targetFormat}
+	inputFileBytes, err := conversionHooks.runStage(ctx, opts.Deadlines.Hook, event, inputFileBytes, opts.Report)
+	if err != nil {
+		return nil, "", err
+	}
+	release, err := tempSpace.reserve(estimateTempSpace(fileType, targetFormat, len(inputFileBytes)))
+	if err != nil {
+		return nil, "", err
+	}
+	defer release()
+	var converted []byte
+	var name string
+	err = runConvertStage(ctx, opts, func(ctx context.Context) (err error) {
+		converted, name, err = convertByType(ctx, fileType, inputFileBytes, outputFilename, sourceExt, targetFormat, opts)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	event.Stage, event.OutputName = hookPost, name
+	if converted, err = conversionHooks.runStage(ctx, opts.Deadlines.Hook, event, converted, opts.Report); err != nil {
+		return nil, "", err
+	}
+	if !opts.Sign {
+		return converted, name, nil
 	}
+	if converted, err = pdfSigning.sign(converted, opts); err != nil {
+		return nil, "", fmt.Errorf("failed to sign PDF: %w", err)
+	}
+	return converted, name, nil
+}
 
-	// Perform conversion based on file type
+// convertByType runs the converter for a file type.
+func convertByType(ctx context.Context, fileType FileType, inputFileBytes []byte, outputFilename, sourceExt, targetFormat string, opts ConversionOptions) ([]byte, string, error) {
 	switch fileType {
 	case FileTypeImage:
-		return convertImage(inputFileBytes, outputFilename, targetFormat)
+		return convertImage(ctx, inputFileBytes, outputFilename, targetFormat, opts)
 	case FileTypeAudio:
-		return convertAudio(inputFileBytes, outputFilename, sourceExt, targetFormat)
+		return convertAudio(ctx, inputFileBytes, outputFilename, sourceExt, targetFormat, opts)
 	case FileTypeVideo:
-		return convertVideo(inputFileBytes, outputFilename, sourceExt, targetFormat)
+		return convertVideo(ctx, inputFileBytes, outputFilename, sourceExt, targetFormat, opts)
 	case FileTypeDoc:
-		return convertDocument(inputFileBytes, outputFilename, sourceExt, targetFormat)
+		return convertDocument(ctx, inputFileBytes, outputFilename, sourceExt, targetFormat, opts)
 	case FileTypeArchive:
-		return convertArchive(inputFileBytes, outputFilename, sourceExt, targetFormat)
+		return convertArchive(ctx, inputFileBytes, outputFilename, sourceExt, targetFormat, opts)
+	case FileTypeData:
+		return convertData(ctx, inputFileBytes, outputFilename, sourceExt, targetFormat, opts)
 	default:
-		return nil, "", fmt.Errorf("unsupported file type for conversion")
+		return nil, "", fmt.Errorf("%w: unknown file type", ErrUnsupportedConversion)
 	}
 }
 
 // convertImage converts image files using the imaging library
-func convertImage(inputFileBytes []byte, outputFilename, targetFormat string) ([]byte, string, error) {
+func convertImage(ctx context.Context, inputFileBytes []byte, outputFilename, targetFormat string, opts ConversionOptions) ([]byte, string, error) {
+	// Handle SVG to raster format conversion
+	if strings.HasSuffix(strings.ToLower(outputFilename), ".svg") {
+		return nil, "", fmt.Errorf("%w to SVG", ErrUnsupportedConversion)
+	}
+	if isSVG(inputFileBytes) {
+		return convertSVGToRaster(ctx, inputFileBytes, outputFilename, targetFormat, opts)
+	}
+
 	// Read the image
 	src, _, err := image.Decode(bytes.NewReader(inputFileBytes))
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to decode image: %w", err)
+		return nil, "", fmt.Errorf("%w: failed to decode image: %w", ErrInputCorrupt, err)
 	}
 
-	// Create a temporary file for the output
-	tempDir := os.TempDir()
-	tempOutputPath := filepath.Join(tempDir, outputFilename)
-
-	// Handle SVG to raster format conversion
-	if strings.HasSuffix(strings.ToLower(outputFilename), ".svg") {
-		return nil, "", fmt.Errorf("conversion to SVG is not supported")
-	} else if strings.HasSuffix(strings.ToLower(outputFilename), ".png") ||
-		strings.HasSuffix(strings.ToLower(outputFilename), ".jpg") ||
-		strings.HasSuffix(strings.ToLower(outputFilename), ".jpeg") {
-
-		// Check if input is SVG
-		if bytes.HasPrefix(inputFileBytes, []byte("<?xml")) || bytes.HasPrefix(inputFileBytes, []byte("<svg")) {
-			// Convert SVG to PNG/JPG
-			return convertSVGToRaster(inputFileBytes, outputFilename, targetFormat)
-		}
+	// Convert the image using imaging, applying crop options first
+	img, err := applyImageOptions(imaging.Clone(src), opts)
+	if err != nil {
+		return nil, "", err
 	}
+	return encodeConvertedImage(ctx, img, outputFilename, targetFormat, opts)
+}
 
-	// Convert the image using imaging
-	img := imaging.Clone(src)
-
-	// For WebP format, we need to use a different approach since imaging doesn't support WebP encoding
-	if targetFormat == "webp" {
-		// For WebP, we'll use FFmpeg as a fallback since imaging doesn't support WebP encoding
-		// First save as PNG temporarily
-		tempPngPath := filepath.Join(tempDir, "temp_for_webp.png")
-		err = imaging.Save(img, tempPngPath)
-		if err != nil {
-			return nil, "", fmt.Errorf("failed to save intermediate image: %w", err)
-		}
-
-		// Check if FFmpeg is installed
-		_, err := exec.LookPath("ffmpeg")
+// encodeConvertedImage encodes img as targetFormat, in memory with the imaging
+// library or, for WebP, which it can't encode, with FFmpeg.
+func encodeConvertedImage(ctx context.Context, img image.Image, outputFilename, targetFormat string, opts ConversionOptions) ([]byte, string, error) {
+	if targetFormat != "webp" {
+		outputBytes, err := encodeImageByName(img, outputFilename)
 		if err != nil {
-			os.Remove(tempPngPath) // Clean up the temporary PNG
-			return nil, "", fmt.Errorf("WebP conversion requires FFmpeg which is not installed or not in PATH")
+			return nil, "", err
 		}
+		return outputBytes, outputFilename, nil
+	}
 
-		// Use FFmpeg to convert PNG to WebP with proper parameters
-		cmd := exec.Command("ffmpeg", "-i", tempPngPath, "-c:v", "libwebp", "-quality", "80", "-y", tempOutputPath)
-		output, err := cmd.CombinedOutput()
-
-		// Clean up the temporary PNG
-		os.Remove(tempPngPath)
+	// Check if FFmpeg is installed
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		return nil, "", &ToolMissingError{Tool: "FFmpeg", Purpose: "WebP conversion"}
+	}
 
-		if err != nil {
-			return nil, "", fmt.Errorf("WebP conversion failed: %s - %w", string(output), err)
-		}
-	} else {
-		// For other formats, use imaging library
-		err = imaging.Save(img, tempOutputPath)
-		if err != nil {
-			return nil, "", fmt.Errorf("failed to save converted image: %w", err)
-		}
+	wd, err := newJobWorkdir()
+	if err != nil {
+		return nil, "", err
+	}
+	defer wd.cleanup()
+	tempOutputPath := wd.path(outputFilename)
+
+	// Stream the image to FFmpeg in the intermediate format over a pipe rather
+	// than through an intermediate file
+	im := intermediateImage
+	opts.Report.addIntermediate(IntermediateStep{Format: im.name, Lossless: im.lossless, Into: "WebP encoding"})
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-f", im.demuxer, "-i", "pipe:0", "-c:v", "libwebp", "-quality", "80", "-y", tempOutputPath)
+	output, err := runCommandWithInput(opts.Report, cmd, func(w io.Writer) error {
+		return imaging.Encode(w, img, im.format)
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("WebP conversion failed: %s - %w", string(output), err)
 	}
 
 	// Read the converted file
-	outputBytes, err := os.ReadFile(tempOutputPath)
+	outputBytes, err := wd.readOutput(tempOutputPath)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to read converted image: %w", err)
+		return nil, "", err
 	}
-
-	// Clean up
-	os.Remove(tempOutputPath)
-
 	return outputBytes, outputFilename, nil
 }
 
-// convertSVGToRaster converts SVG to raster formats like PNG or JPG
-func convertSVGToRaster(inputFileBytes []byte, outputFilename, _ string) ([]byte, string, error) {
-	// Create a temporary file for the output
-	tempDir := os.TempDir()
-	tempOutputPath := filepath.Join(tempDir, outputFilename)
+// encodeImageByName encodes img in the format implied by the file name's extension.
+func encodeImageByName(img image.Image, filename string) ([]byte, error) {
+	format, err := imaging.FormatFromFilename(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save converted image: %w", err)
+	}
+	data, err := encodeImagePooled(img, format)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save converted image: %w", err)
+	}
+	return data, nil
+}
+
+// convertSVGToRaster converts SVG to raster formats like PNG, JPG or WebP
+func convertSVGToRaster(ctx context.Context, inputFileBytes []byte, outputFilename, targetFormat string, opts ConversionOptions) ([]byte, string, error) {
+	rgba, err := rasterizeSVG(inputFileBytes)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Apply crop options to the rasterized image
+	img, err := applyImageOptions(rgba, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	return encodeConvertedImage(ctx, img, outputFilename, targetFormat, opts)
+}
 
+// rasterizeSVG renders SVG content onto a fixed-size RGBA canvas
+func rasterizeSVG(inputFileBytes []byte) (*image.RGBA, error) {
 	// Parse SVG
 	icon, err := oksvg.ReadIconStream(bytes.NewReader(inputFileBytes))
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to parse SVG: %w", err)
+		return nil, fmt.Errorf("%w: failed to parse SVG: %w", ErrInputCorrupt, err)
 	}
 
 	// Set size
@@ -278,59 +366,109 @@ func convertSVGToRaster(inputFileBytes []byte, outputFilename, _ string) ([]byte
 	raster := rasterx.NewDasher(int(width), int(height), scanner)
 	icon.Draw(raster, 1.0)
 
-	// Save the image
-	err = imaging.Save(rgba, tempOutputPath)
-	if err != nil {
-		return nil, "", fmt.Errorf("failed to save converted image: %w", err)
-	}
+	return rgba, nil
+}
 
-	// Read the converted file
-	outputBytes, err := os.ReadFile(tempOutputPath)
+// isSVG reports whether the content looks like an SVG document
+func isSVG(inputFileBytes []byte) bool {
+	return bytes.HasPrefix(inputFileBytes, []byte("<?xml")) || bytes.HasPrefix(inputFileBytes, []byte("<svg"))
+}
+
+// decodeAnyImage decodes raster images and rasterizes SVG content
+func decodeAnyImage(inputFileBytes []byte) (image.Image, error) {
+	if isSVG(inputFileBytes) {
+		return rasterizeSVG(inputFileBytes)
+	}
+	img, _, err := image.Decode(bytes.NewReader(inputFileBytes))
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to read converted image: %w", err)
+		return nil, fmt.Errorf("%w: failed to decode image: %w", ErrInputCorrupt, err)
 	}
-
-	// Clean up
-	os.Remove(tempOutputPath)
-
-	return outputBytes, outputFilename, nil
+	return img, nil
 }
 
 // convertAudio converts audio files using FFmpeg
-func convertAudio(inputFileBytes []byte, outputFilename, sourceExt, targetFormat string) ([]byte, string, error) {
-	return convertMediaWithFFmpeg(inputFileBytes, outputFilename, sourceExt, targetFormat, "audio")
+func convertAudio(ctx context.Context, inputFileBytes []byte, outputFilename, sourceExt, targetFormat string, opts ConversionOptions) ([]byte, string, error) {
+	return convertMediaWithFFmpeg(ctx, inputFileBytes, outputFilename, sourceExt, targetFormat, "audio", opts)
 }
 
 // convertVideo converts video files using FFmpeg
-func convertVideo(inputFileBytes []byte, outputFilename, sourceExt, targetFormat string) ([]byte, string, error) {
+func convertVideo(ctx context.Context, inputFileBytes []byte, outputFilename, sourceExt, targetFormat string, opts ConversionOptions) ([]byte, string, error) {
 	mediaType := "video"
 	if targetFormat == "mp3" || targetFormat == "wav" || targetFormat == "ogg" || targetFormat == "flac" || targetFormat == "aac" {
 		mediaType = "audio" // Audio extraction from video
 	}
-	return convertMediaWithFFmpeg(inputFileBytes, outputFilename, sourceExt, targetFormat, mediaType)
+	return convertMediaWithFFmpeg(ctx, inputFileBytes, outputFilename, sourceExt, targetFormat, mediaType, opts)
 }
 
 // convertMediaWithFFmpeg uses FFmpeg to convert audio and video files
-func convertMediaWithFFmpeg(inputFileBytes []byte, outputFilename, sourceExt, _ string, mediaType string) ([]byte, string, error) {
+func convertMediaWithFFmpeg(ctx context.Context, inputFileBytes []byte, outputFilename, sourceExt, targetFormat string, mediaType string, opts ConversionOptions) ([]byte, string, error) {
 	// Check if FFmpeg is installed
 	_, err := exec.LookPath("ffmpeg")
 	if err != nil {
-		return nil, "", fmt.Errorf("FFmpeg is not installed or not in PATH")
+		return nil, "", &ToolMissingError{Tool: "FFmpeg"}
 	}
 
 	// Create temporary files for input and output
-	tempDir := os.TempDir()
-	tempInputPath := filepath.Join(tempDir, "input."+sourceExt)
-	tempOutputPath := filepath.Join(tempDir, outputFilename)
+	wd, err := newJobWorkdir()
+	if err != nil {
+		return nil, "", err
+	}
+	defer wd.cleanup()
+	tempInputPath, err := wd.writeInput(sourceExt, inputFileBytes)
+	if err != nil {
+		return nil, "", err
+	}
+	tempOutputPath := wd.path(outputFilename)
 
-	// Write input file
-	if err := os.WriteFile(tempInputPath, inputFileBytes, 0644); err != nil {
-		return nil, "", fmt.Errorf("failed to write temporary input file: %w", err)
+	if opts.AudioTrack != nil && mediaType == "audio" {
+		return nil, "", fmt.Errorf("%w: an audio track can only be added to video output", ErrUnsupportedConversion)
+	}
+
+	// Built-in encoding arguments, plus those derived from the request options
+	base := mediaBaseArgs(sourceExt, mediaType)
+	var extraInputs, options []string
+	if mediaType == "video" {
+		if opts.Caption != "" {
+			filter, cleanup, err := captionFilter(opts, wd.dir)
+			defer cleanup()
+			if err != nil {
+				return nil, "", err
+			}
+			options = append(options, "-vf", filter)
+		}
+		if opts.AudioTrack != nil {
+			if targetFormat == "flv" {
+				return nil, "", fmt.Errorf("%w: flv holds a single audio track; pick another format to add one", ErrUnsupportedConversion)
+			}
+			inputs, mapping, err := opts.AudioTrack.muxArgs(ctx, wd, tempInputPath, opts.Report)
+			if err != nil {
+				return nil, "", err
+			}
+			extraInputs = inputs
+			options = append(options, mapping...)
+		}
 	}
 
-	// Prepare FFmpeg command
-	var cmd *exec.Cmd
+	// Operators can override or extend the arguments per pair (see ffmpegTemplates)
+	cmd := exec.CommandContext(ctx, "ffmpeg", ffmpegArgs(sourceExt, targetFormat, tempInputPath, tempOutputPath, extraInputs, base, options)...)
 
+	// Execute FFmpeg
+	output, err := runCommand(opts.Report, cmd)
+	if err != nil {
+		return nil, "", fmt.Errorf("FFmpeg conversion failed: %s - %w", string(output), err)
+	}
+
+	// Read the converted file
+	outputBytes, err := wd.readOutput(tempOutputPath)
+	if err != nil {
+		return nil, "", err
+	}
+	return outputBytes, outputFilename, nil
+}
+
+// mediaBaseArgs returns the built-in FFmpeg encoding arguments for converting a
+// file of sourceExt to audio or video.
+func mediaBaseArgs(sourceExt, mediaType string) []string {
 	// Handle different conversion scenarios
 	if mediaType == "audio" && (strings.HasPrefix(sourceExt, "mp4") ||
 		strings.HasPrefix(sourceExt, "avi") ||
@@ -339,91 +477,161 @@ func convertMediaWithFFmpeg(inputFileBytes []byte, outputFilename, sourceExt, _
 		strings.HasPrefix(sourceExt, "mkv") ||
 		strings.HasPrefix(sourceExt, "flv")) {
 		// Extract audio from video
-		cmd = exec.Command("ffmpeg", "-i", tempInputPath, "-vn", "-acodec", "copy", tempOutputPath)
+		return []string{"-vn", "-acodec", "copy"}
 	} else if mediaType == "audio" {
 		// Audio conversion with quality options
 		bitrate := "192k" // Default bitrate
-		cmd = exec.Command("ffmpeg", "-i", tempInputPath, "-ab", bitrate, tempOutputPath)
-	} else {
-		// Video conversion with quality options
-		resolution := "1280x720" // Default resolution (720p)
-		cmd = exec.Command("ffmpeg", "-i", tempInputPath, "-s", resolution, tempOutputPath)
+		return []string{"-ab", bitrate}
 	}
+	// Video conversion with quality options
+	resolution := "1280x720" // Default resolution (720p)
+	return []string{"-s", resolution}
+}
 
-	// Execute FFmpeg
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return nil, "", fmt.Errorf("FFmpeg conversion failed: %s - %w", string(output), err)
+// convertDocument converts document files using external tools
+func convertDocument(ctx context.Context, inputFileBytes []byte, outputFilename, sourceExt, targetFormat string, opts ConversionOptions) ([]byte, string, error) {
+	// Text is translated before it is converted, so every output is translated
+	if opts.DetectLanguage || opts.TranslateTo != "" {
+		var err error
+		if inputFileBytes, err = processLanguage(ctx, inputFileBytes, sourceExt, opts); err != nil {
+			return nil, "", err
+		}
+		if sourceExt == targetFormat {
+			return inputFileBytes, outputFilename, nil
+		}
 	}
 
-	// Read the converted file
-	outputBytes, err := os.ReadFile(tempOutputPath)
-	if err != nil {
-		return nil, "", fmt.Errorf("failed to read converted file: %w", err)
+	// Charts are rendered in memory from tabular data
+	if (sourceExt == "csv" || sourceExt == "json") && (targetFormat == "png" || targetFormat == "svg") {
+		return renderChart(ctx, inputFileBytes, outputFilename, sourceExt, targetFormat, opts)
 	}
 
-	// Clean up
-	os.Remove(tempInputPath)
-	os.Remove(tempOutputPath)
+	// CSV can be imported into a fresh SQLite database
+	if sourceExt == "csv" && targetFormat == "sqlite" {
+		return convertCSVToSQLite(ctx, inputFileBytes, outputFilename, opts)
+	}
 
-	return outputBytes, outputFilename, nil
-}
+	// Tables are laid out as HTML pages and printed
+	if (sourceExt == "csv" || sourceExt == "json" || sourceExt == "xlsx") && targetFormat == "pdf" {
+		return convertTableToPDF(ctx, inputFileBytes, outputFilename, sourceExt, opts)
+	}
 
-// convertDocument converts document files using external tools
-func convertDocument(inputFileBytes []byte, outputFilename, sourceExt, targetFormat string) ([]byte, string, error) {
-	// Create temporary files for input and output
-	tempDir := os.TempDir()
-	tempInputPath := filepath.Join(tempDir, "input."+sourceExt)
-	tempOutputPath := filepath.Join(tempDir, outputFilename)
+	// CSV, JSON records and XLSX sheets are converted into each other in memory
+	if (sourceExt == "csv" || sourceExt == "json" || sourceExt == "xlsx") && (targetFormat == "csv" || targetFormat == "json" || targetFormat == "xlsx") {
+		return convertTable(ctx, inputFileBytes, outputFilename, sourceExt, targetFormat, opts)
+	}
 
-	// Write input file
-	if err := os.WriteFile(tempInputPath, inputFileBytes, 0644); err != nil {
-		return nil, "", fmt.Errorf("failed to write temporary input file: %w", err)
+	// Log files are parsed line by line into tables
+	if (sourceExt == "log" || sourceExt == "jsonl" || sourceExt == "ndjson") && (targetFormat == "csv" || targetFormat == "json") {
+		return convertLog(ctx, inputFileBytes, outputFilename, sourceExt, targetFormat, opts)
 	}
 
-	// Handle Markdown conversions
-	if sourceExt == "md" && (targetFormat == "html" || targetFormat == "txt") {
-		return convertMarkdown(tempInputPath, tempOutputPath, targetFormat)
+	// CSV and JSON records can be written as columnar parquet
+	if (sourceExt == "csv" || sourceExt == "json") && targetFormat == "parquet" {
+		return convertTableToParquet(ctx, inputFileBytes, outputFilename, sourceExt, opts)
 	}
 
-	// For text to PDF conversion, we can use a simple approach
-	if sourceExt == "txt" && targetFormat == "pdf" {
-		// Check if wkhtmltopdf is installed (a common tool for HTML/text to PDF conversion)
-		_, err := exec.LookPath("wkhtmltopdf")
-		if err != nil {
-			os.Remove(tempInputPath)
-			return nil, "", fmt.Errorf("PDF conversion requires wkhtmltopdf which is not installed or not in PATH")
-		}
+	// Markdown and HTML are reduced to plain text in memory
+	if sourceExt == "md" && targetFormat == "txt" {
+		return convertMarkdownToText(ctx, inputFileBytes, outputFilename, opts)
+	}
+	if sourceExt == "html" && targetFormat == "txt" {
+		return convertHTMLToText(ctx, inputFileBytes, outputFilename, opts)
+	}
+	if sourceExt == "srt" && targetFormat == "txt" {
+		return convertSubtitlesToText(ctx, inputFileBytes, outputFilename)
+	}
 
-		// Use wkhtmltopdf to convert text to PDF
-		cmd := exec.Command("wkhtmltopdf", tempInputPath, tempOutputPath)
-		output, err := cmd.CombinedOutput()
+	// HTML is rendered by headless Chromium, which gives screenshots and faithful PDFs
+	if sourceExt == "html" && (targetFormat == "png" || targetFormat == "jpg" || targetFormat == "pdf") {
+		return convertHTMLWithChromium(ctx, inputFileBytes, outputFilename, targetFormat, opts)
+	}
 
-		// Clean up the temporary input file
-		os.Remove(tempInputPath)
+	// Create temporary files for input and output
+	wd, err := newJobWorkdir()
+	if err != nil {
+		return nil, "", err
+	}
+	defer wd.cleanup()
+	tempInputPath, err := wd.writeInput(sourceExt, inputFileBytes)
+	if err != nil {
+		return nil, "", err
+	}
 
-		if err != nil {
-			return nil, "", fmt.Errorf("PDF conversion failed: %s - %w", string(output), err)
+	var stages []conversionStage
+	switch {
+	case sourceExt == "md" && targetFormat == "html":
+		stages = []conversionStage{markdownToHTMLStage()}
+	case sourceExt == "md" && targetFormat == "pdf":
+		// Chained: render the Markdown to HTML, then print that with Chromium
+		stages = []conversionStage{markdownToHTMLStage(), chromiumStage("pdf", opts)}
+	case sourceExt == "txt" && targetFormat == "pdf":
+		// Check if wkhtmltopdf is installed (a common tool for HTML/text to PDF conversion)
+		if _, err := exec.LookPath("wkhtmltopdf"); err != nil {
+			return nil, "", &ToolMissingError{Tool: "wkhtmltopdf", Purpose: "PDF conversion"}
 		}
-	} else {
+		if opts.Redact != nil {
+			if len(opts.Redact.boxes) > 0 {
+				return nil, "", fmt.Errorf("%w: redaction boxes need a document rendered by Chromium, such as html or md", ErrUnsupportedConversion)
+			}
+			if err := os.WriteFile(tempInputPath, opts.Redact.redactText(inputFileBytes, opts.Report), 0644); err != nil {
+				return nil, "", fmt.Errorf("failed to write redacted input: %w", err)
+			}
+		}
+		stages = []conversionStage{commandStage("PDF conversion", "pdf", opts.Report, "wkhtmltopdf")}
+	default:
 		// For other document conversions, we would need more specialized tools
-		os.Remove(tempInputPath)
-		return nil, "", fmt.Errorf("document conversion from %s to %s is not implemented yet", sourceExt, targetFormat)
+		return nil, "", fmt.Errorf("%w: document conversion from %s to %s is not implemented yet", ErrUnsupportedConversion, sourceExt, targetFormat)
+	}
+
+	outputPath, err := wd.runPipeline(ctx, opts.Report, tempInputPath, stages...)
+	if err != nil {
+		return nil, "", err
 	}
 
 	// Read the converted file
-	outputBytes, err := os.ReadFile(tempOutputPath)
+	outputBytes, err := wd.readOutput(outputPath)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to read converted document: %w", err)
+		return nil, "", err
 	}
+	return outputBytes, outputFilename, nil
+}
 
-	// Clean up
-	os.Remove(tempOutputPath)
+// markdownToHTMLStage is a pipeline stage rendering a Markdown file to HTML.
+func markdownToHTMLStage() conversionStage {
+	return conversionStage{name: "Markdown rendering", ext: "html", run: func(_ context.Context, in, out string) error {
+		_, _, err := convertMarkdown(in, out, "html")
+		return err
+	}}
+}
 
-	return outputBytes, outputFilename, nil
+// chromiumStage is a pipeline stage rendering an HTML file with headless Chromium.
+func chromiumStage(targetFormat string, opts ConversionOptions) conversionStage {
+	return conversionStage{name: "HTML rendering", ext: targetFormat, run: func(ctx context.Context, in, out string) error {
+		html, err := os.ReadFile(in)
+		if err != nil {
+			return fmt.Errorf("failed to read HTML: %w", err)
+		}
+		data, err := renderHTML(ctx, html, targetFormat, opts)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(out, data, 0644)
+	}}
+}
+
+// commandStage is a pipeline stage running "binary <in> <out>".
+func commandStage(name, ext string, report *ConversionReport, binary string) conversionStage {
+	return conversionStage{name: name, ext: ext, run: func(ctx context.Context, in, out string) error {
+		output, err := runCommand(report, exec.CommandContext(ctx, binary, in, out))
+		if err != nil {
+			return fmt.Errorf("%s - %w", string(output), err)
+		}
+		return nil
+	}}
 }
 
-// convertMarkdown converts Markdown to HTML or TXT
+// convertMarkdown converts Markdown to HTML
 func convertMarkdown(inputPath, outputPath, targetFormat string) ([]byte, string, error) {
 	// Read the markdown content
 	mdContent, err := os.ReadFile(inputPath)
@@ -455,11 +663,8 @@ func convertMarkdown(inputPath, outputPath, targetFormat string) ([]byte, string
 		}
 		htmlContent += "</body></html>"
 		outputContent = []byte(htmlContent)
-	} else if targetFormat == "txt" {
-		// Markdown to plain text (just strip markdown syntax)
-		outputContent = mdContent
 	} else {
-		return nil, "", fmt.Errorf("unsupported markdown conversion to %s", targetFormat)
+		return nil, "", fmt.Errorf("%w: markdown to %s", ErrUnsupportedConversion, targetFormat)
 	}
 
 	// Write the output
@@ -467,9 +672,6 @@ func convertMarkdown(inputPath, outputPath, targetFormat string) ([]byte, string
 		return nil, "", fmt.Errorf("failed to write converted file: %w", err)
 	}
 
-	// Clean up the input file
-	os.Remove(inputPath)
-
 	// Read the converted file
 	outputBytes, err := os.ReadFile(outputPath)
 	if err != nil {
@@ -482,74 +684,39 @@ func convertMarkdown(inputPath, outputPath, targetFormat string) ([]byte, string
 	return outputBytes, outputFilename, nil
 }
 
-// convertArchive handles archive operations (compression/extraction)
-func convertArchive(inputFileBytes []byte, outputFilename, sourceExt, targetFormat string) ([]byte, string, error) {
-	// Create temporary files for input and output
-	tempDir := os.TempDir()
-	tempInputPath := filepath.Join(tempDir, "input."+sourceExt)
-	tempOutputPath := filepath.Join(tempDir, outputFilename)
-
-	// Write input file
-	if err := os.WriteFile(tempInputPath, inputFileBytes, 0644); err != nil {
-		return nil, "", fmt.Errorf("failed to write temporary input file: %w", err)
-	}
-
-	// Create a temporary directory for extraction
-	tempExtractDir := filepath.Join(tempDir, "extract_"+filepath.Base(tempInputPath))
-	if err := os.MkdirAll(tempExtractDir, 0755); err != nil {
-		os.Remove(tempInputPath)
-		return nil, "", fmt.Errorf("failed to create temporary extraction directory: %w", err)
-	}
-
-	// Handle archive conversion
-	var err error
-
-	// First extract the source archive
+// convertData converts binary data formats (databases) into tabular outputs
+func convertData(ctx context.Context, inputFileBytes []byte, outputFilename, sourceExt, targetFormat string, opts ConversionOptions) ([]byte, string, error) {
 	switch sourceExt {
-	case "zip":
-		err = archiver.Unarchive(tempInputPath, tempExtractDir)
-	case "tar":
-		err = archiver.Unarchive(tempInputPath, tempExtractDir)
-	case "rar":
-		err = archiver.Unarchive(tempInputPath, tempExtractDir)
+	case "sqlite", "sqlite3", "db":
+		return convertSQLite(ctx, inputFileBytes, outputFilename, targetFormat, opts)
+	case "parquet":
+		return convertParquet(ctx, inputFileBytes, outputFilename, targetFormat, opts)
+	case "avro":
+		return convertAvro(ctx, inputFileBytes, outputFilename, targetFormat, opts)
 	default:
-		err = fmt.Errorf("unsupported archive format: %s", sourceExt)
+		return nil, "", fmt.Errorf("%w: data conversion from %s to %s is not implemented yet", ErrUnsupportedConversion, sourceExt, targetFormat)
 	}
+}
 
+// convertArchive handles archive operations (compression/extraction)
+func convertArchive(ctx context.Context, inputFileBytes []byte, outputFilename, sourceExt, targetFormat string, opts ConversionOptions) ([]byte, string, error) {
+	wd, err := newJobWorkdir()
 	if err != nil {
-		os.Remove(tempInputPath)
-		os.RemoveAll(tempExtractDir)
-		return nil, "", fmt.Errorf("failed to extract archive: %w", err)
-	}
-
-	// Then create the target archive
-	switch targetFormat {
-	case "zip":
-		err = archiver.Archive([]string{tempExtractDir}, tempOutputPath)
-	case "tar":
-		err = archiver.Archive([]string{tempExtractDir}, tempOutputPath)
-	case "rar":
-		err = fmt.Errorf("creating RAR archives is not supported: RAR is a proprietary format that requires licensing")
-	default:
-		err = fmt.Errorf("unsupported archive format: %s", targetFormat)
+		return nil, "", err
 	}
-
-	// Clean up the input file and extraction directory
-	os.Remove(tempInputPath)
-	os.RemoveAll(tempExtractDir)
-
+	defer wd.cleanup()
+	tempInputPath, err := wd.writeInput(sourceExt, inputFileBytes)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to create archive: %w", err)
+		return nil, "", err
 	}
 
-	// Read the converted file
-	outputBytes, err := os.ReadFile(tempOutputPath)
+	tempOutputPath, err := convertArchiveFile(ctx, wd, tempInputPath, outputFilename, sourceExt, targetFormat, opts)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to read converted archive: %w", err)
+		return nil, "", err
 	}
-
-	// Clean up
-	os.Remove(tempOutputPath)
-
-	return outputBytes, outputFilename, nil
+	outputBytes, err := wd.readOutput(tempOutputPath)
+	if err != nil {
+		return nil, "", err
+	}
+	return outputBytes, filepath.Base(tempOutputPath), nil
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	// csrfCookieName is the cookie carrying the web UI's upload token.
+	csrfCookieName = "fileconverter_csrf"
+	// csrfHeader is the request header the web UI echoes the token in; form posts
+	// may send it in a csrfField form value instead.
+	csrfHeader = "X-CSRF-Token"
+	csrfField  = "csrfToken"
+)
+
+// csrfSecret signs upload tokens so a cookie planted by another site can't pass
+// as one of ours. It is generated at startup: tokens issued before a restart stop
+// working and the UI picks up a new one when reloaded.
+var csrfSecret = func() []byte {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("Fatal: failed to generate CSRF secret: %v", err)
+	}
+	return b
+}()
+
+// csrfSignature computes the signature part of an upload token.
+func csrfSignature(nonce string) string {
+	mac := hmac.New(sha256.New, csrfSecret)
+	mac.Write([]byte(nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validCSRFToken reports whether token was issued by this server.
+func validCSRFToken(token string) bool {
+	nonce, sig, ok := strings.Cut(token, ".")
+	return ok && nonce != "" && hmac.Equal([]byte(sig), []byte(csrfSignature(nonce)))
+}
+
+// issueCSRFToken gives the browser an upload token in a cookie, keeping a valid
+// one it already has. The cookie is readable by the page's scripts, which send it
+// back in the X-CSRF-Token header.
+func issueCSRFToken(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(csrfCookieName); err == nil && validCSRFToken(c.Value) {
+		return
+	}
+	nonce, err := generateID()
+	if err != nil {
+		log.Printf("Error generating CSRF token: %v", err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    nonce + "." + csrfSignature(nonce),
+		Path:     "/",
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// hasAPICredentials reports whether a request authenticates with an API key
+// header rather than anything a browser would attach on its own.
+func hasAPICredentials(r *http.Request) bool {
+	return r.Header.Get("X-API-Key") != "" || strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// requireCSRFToken protects form posts from the web UI against cross-site request
+// forgery. Requests made from a browser, told apart by the upload token cookie or
+// the Sec-Fetch-Site header browsers add, must echo the cookie's token. Requests
+// carrying an API key, and plain API clients, are exempt.
+func requireCSRFToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(csrfCookieName)
+		site := r.Header.Get("Sec-Fetch-Site")
+		fromBrowser := err == nil || (site != "" && site != "none")
+		if !fromBrowser || hasAPICredentials(r) {
+			next(w, r)
+			return
+		}
+
+		token := r.Header.Get(csrfHeader)
+		if token == "" {
+			token = r.FormValue(csrfField)
+		}
+		if err != nil || !validCSRFToken(cookie.Value) || !hmac.Equal([]byte(token), []byte(cookie.Value)) {
+			log.Printf("Refused %s %s from %s: missing or invalid CSRF token", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "Missing or invalid CSRF token; reload the page and try again", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
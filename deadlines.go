@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// defaultHookDeadline bounds each hook call; override with
+	// FILECONVERTER_HOOK_TIMEOUT.
+	defaultHookDeadline = 60 * time.Second
+	// defaultConvertDeadline bounds each conversion, leaving room for long video
+	// transcodes; override with FILECONVERTER_CONVERT_TIMEOUT.
+	defaultConvertDeadline = 30 * time.Minute
+)
+
+// StageDeadlines bounds how long each stage of a conversion may take, on top of
+// whatever deadline the caller's context carries. A zero duration leaves the
+// stage bounded by the context alone.
+type StageDeadlines struct {
+	Hook    time.Duration // Each of the pre- and post-conversion hooks
+	Convert time.Duration // The conversion itself, including any tools it runs
+}
+
+// conversionDeadlines are the stage deadlines the server and CLI give conversions.
+var conversionDeadlines = StageDeadlines{Hook: defaultHookDeadline, Convert: defaultConvertDeadline}
+
+// loadStageDeadlines reads the stage deadlines from FILECONVERTER_HOOK_TIMEOUT
+// and FILECONVERTER_CONVERT_TIMEOUT, e.g. "30s" or "10m". Setting the latter to
+// "0" leaves conversions bounded only by their client.
+func loadStageDeadlines() StageDeadlines {
+	return StageDeadlines{
+		Hook:    envDuration("FILECONVERTER_HOOK_TIMEOUT", defaultHookDeadline),
+		Convert: envDuration("FILECONVERTER_CONVERT_TIMEOUT", defaultConvertDeadline),
+	}
+}
+
+// withStageDeadline derives the context of a stage from ctx, bounded by d if it
+// is not zero.
+func withStageDeadline(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// stageError explains the failure of a stage whose context has ended, since the
+// error the stage returns is then usually just a killed process or a closed
+// connection. Errors of stages that are still live are returned as they are.
+func stageError(ctx context.Context, stage string, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return fmt.Errorf("%s %w", stage, ErrTimeout)
+	case context.Canceled:
+		return fmt.Errorf("%s was canceled: %w", stage, context.Canceled)
+	}
+	return err
+}
+
+// runConvertStage runs convert bounded by the conversion deadline of opts.
+func runConvertStage(ctx context.Context, opts ConversionOptions, convert func(ctx context.Context) error) error {
+	ctx, cancel := withStageDeadline(ctx, opts.Deadlines.Convert)
+	defer cancel()
+	if err := convert(ctx); err != nil {
+		return stageError(ctx, "conversion", err)
+	}
+	return nil
+}
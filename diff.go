@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// maxDiffLines caps the lines of each compared document, as matching takes time
+// that grows with the square of the lines in the worst case.
+const maxDiffLines = 20000
+
+// maxDiffLineWords caps the words matched within a changed line, for the same
+// reason; longer lines are shown as replaced whole.
+const maxDiffLineWords = 2000
+
+// diffWordPattern splits changed lines into words, runs of white space and
+// single other characters, the units changes within a line are shown in.
+var diffWordPattern = regexp.MustCompile(`[\p{L}\p{N}_]+|\s+|.`)
+
+// diffPageStyle lays out the side-by-side view and the tracked-changes PDF.
+const diffPageStyle = `@page { margin: 12mm }
+body { font: 9pt sans-serif; margin: 0 }
+h1 { font-size: 11pt; margin: 0 0 8px }
+table { border-collapse: collapse; width: 100%; table-layout: fixed }
+th { background: #eee; text-align: start; padding: 2px 6px }
+td { padding: 1px 6px; vertical-align: top; white-space: pre-wrap; overflow-wrap: anywhere; font-family: monospace }
+td.ln { width: 3em; color: #888; text-align: end; user-select: none }
+tr.hunk td { background: #f4f4f4; color: #666 }
+td.old { background: #fff0f0 }
+td.new { background: #f0fff0 }
+p.line { margin: 0; white-space: pre-wrap; overflow-wrap: anywhere; min-height: 1em }
+del { background: #ffd0d0; color: #a00; text-decoration: line-through }
+ins { background: #d0ffd0; color: #060; text-decoration: underline }`
+
+// diffFormats lists the outputs of POST /diff with their file extensions.
+var diffFormats = map[string]string{"unified": "diff", "html": "html", "pdf": "pdf"}
+
+// handleDiff compares two text-like documents, uploaded as the two files of the
+// "files" field, and stores the comparison: a unified diff, an HTML side-by-side
+// view or a PDF marking deletions and insertions the way tracked changes do.
+// Markdown and HTML are reduced to their text first, as they are for txt output.
+func handleDiff(fs *FileStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		releaseSpool, err := tempSpace.reserveSpooling(r)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		defer releaseSpool()
+		if err := r.ParseMultipartForm(multipartMemory); err != nil {
+			log.Printf("Error parsing multipart form: %v", err)
+			http.Error(w, fmt.Sprintf("Could not parse multipart form: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		format := strings.ToLower(r.FormValue("format"))
+		if format == "" {
+			format = "unified"
+		}
+		ext, ok := diffFormats[format]
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unsupported diff format %q (use unified, html or pdf)", format), http.StatusBadRequest)
+			return
+		}
+		context := 3
+		if v := r.FormValue("context"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 || n > 100 {
+				http.Error(w, fmt.Sprintf("Invalid context %q: must be between 0 and 100", v), http.StatusBadRequest)
+				return
+			}
+			context = n
+		}
+
+		attrs, err := parseJobAttributes(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		attrs.Report = &ConversionReport{}
+
+		files, release, err := readUploadedFiles(r, "files")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer release()
+		if len(files) != 2 {
+			http.Error(w, fmt.Sprintf("Expected 2 files to compare, got %d", len(files)), http.StatusBadRequest)
+			return
+		}
+		// Documents other than text are converted to text first, and PDF output is
+		// rendered in Chromium
+		space := estimateTempSpace(FileTypeDoc, ext, len(files[0].Data)+len(files[1].Data))
+		if format == "pdf" {
+			space += chromiumTempSpace
+		}
+		releaseSpace, err := tempSpace.reserve(space)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		defer releaseSpace()
+
+		var texts [2][]string
+		for i, f := range files {
+			if meta, err := fs.moderateUpload(r.Context(), f.Name, f.Data, &attrs); err != nil {
+				if meta != nil {
+					setJobHeaders(w, meta)
+				}
+				http.Error(w, fmt.Sprintf("Document %s: %v", f.Name, err), http.StatusUnprocessableEntity)
+				return
+			}
+			if f.Data, err = hookInput(r.Context(), f.Name, ext, f.Data, attrs.Report); err != nil {
+				http.Error(w, fmt.Sprintf("Document %s: %v", f.Name, err), errorStatus(err))
+				return
+			}
+			if texts[i], err = documentLines(r.Context(), f.Name, f.Data); err != nil {
+				http.Error(w, fmt.Sprintf("Document %s: %v", f.Name, err), http.StatusUnprocessableEntity)
+				return
+			}
+		}
+
+		d := documentDiff{oldName: files[0].Name, newName: files[1].Name, old: texts[0], new: texts[1], context: context}
+		data, err := d.render(r.Context(), format, ConversionOptions{Report: attrs.Report})
+		if err != nil {
+			log.Printf("Error comparing documents: %v", err)
+			http.Error(w, fmt.Sprintf("Error comparing documents: %v", err), errorStatus(err))
+			return
+		}
+
+		name := strings.TrimSuffix(filepath.Base(files[1].Name), filepath.Ext(files[1].Name)) + "-diff." + ext
+		meta, err := fs.storeFile(r.Context(), files[0].Name+" vs "+files[1].Name, name, getContentTypeForExtension(ext), data, attrs)
+		if err != nil {
+			log.Printf("Error storing diff: %v", err)
+			http.Error(w, fmt.Sprintf("Error processing file: %v", err), errorStatus(err))
+			return
+		}
+
+		writeUploadResponse(w, r, meta)
+	}
+}
+
+// documentLines returns the lines of text of a document: Markdown and HTML are
+// reduced to plain text, other files must be UTF-8 text already.
+func documentLines(ctx context.Context, name string, data []byte) ([]string, error) {
+	var err error
+	switch strings.ToLower(strings.TrimPrefix(filepath.Ext(name), ".")) {
+	case "md":
+		data, _, err = convertMarkdownToText(ctx, data, name, ConversionOptions{})
+	case "html", "htm":
+		data, _, err = convertHTMLToText(ctx, data, name, ConversionOptions{})
+	default:
+		if !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0 {
+			return nil, fmt.Errorf("not a text document; convert it to txt, md or html first")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	lines := difflib.SplitLines(strings.TrimSuffix(text, "\n"))
+	if len(lines) > maxDiffLines {
+		return nil, fmt.Errorf("too long to compare: at most %d lines are allowed", maxDiffLines)
+	}
+	return lines, nil
+}
+
+// documentDiff compares two documents given as lines that end in "\n".
+type documentDiff struct {
+	oldName, newName string
+	old, new         []string
+	context          int // Unchanged lines shown around each change
+}
+
+// render writes the comparison as a unified diff, html or pdf.
+func (d documentDiff) render(ctx context.Context, format string, opts ConversionOptions) ([]byte, error) {
+	switch format {
+	case "unified":
+		out, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A: d.old, B: d.new, FromFile: d.oldName, ToFile: d.newName, Context: d.context,
+		})
+		return []byte(out), err
+	case "html":
+		return d.sideBySide(), nil
+	case "pdf":
+		wd, err := newJobWorkdir()
+		if err != nil {
+			return nil, err
+		}
+		defer wd.cleanup()
+		page, err := wd.writeInput("html", d.trackedChanges())
+		if err != nil {
+			return nil, err
+		}
+		output, err := wd.runPipeline(ctx, opts.Report, page, chromiumStage("pdf", opts))
+		if err != nil {
+			return nil, err
+		}
+		return wd.readOutput(output)
+	default:
+		return nil, fmt.Errorf("unsupported diff format %q", format)
+	}
+}
+
+// matcher matches the lines of the documents. Frequent lines such as blank ones
+// are matched like any other, unlike in difflib's default heuristic.
+func (d documentDiff) matcher() *difflib.SequenceMatcher {
+	return difflib.NewMatcherWithJunk(d.old, d.new, false, nil)
+}
+
+// page starts an HTML page titled after the compared documents.
+func (d documentDiff) page(b *bytes.Buffer) {
+	title := html.EscapeString(d.oldName + " → " + d.newName)
+	fmt.Fprintf(b, "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>%s</title>\n<style>\n%s\n</style></head>\n<body><h1>%s</h1>\n", title, diffPageStyle, title)
+}
+
+// sideBySide lays the documents out in two columns, the changed lines shaded
+// and the changes within them marked. Unchanged stretches longer than the
+// context are cut short.
+func (d documentDiff) sideBySide() []byte {
+	var b bytes.Buffer
+	d.page(&b)
+	fmt.Fprintf(&b, "<table><colgroup><col style=\"width:3em\"><col><col style=\"width:3em\"><col></colgroup>\n<thead><tr><th></th><th>%s</th><th></th><th>%s</th></tr></thead>\n<tbody>\n",
+		html.EscapeString(d.oldName), html.EscapeString(d.newName))
+
+	// row writes a line of each document; i or j is -1 where a side has none
+	row := func(i int, oldCell string, j int, newCell string, changed bool) {
+		b.WriteString("<tr>")
+		for _, side := range []struct {
+			n           int
+			cell, class string
+		}{{i, oldCell, "old"}, {j, newCell, "new"}} {
+			if side.n < 0 {
+				b.WriteString(`<td class="ln"></td><td></td>`)
+				continue
+			}
+			if changed {
+				fmt.Fprintf(&b, `<td class="ln">%d</td><td class="%s">%s</td>`, side.n+1, side.class, side.cell)
+			} else {
+				fmt.Fprintf(&b, `<td class="ln">%d</td><td>%s</td>`, side.n+1, side.cell)
+			}
+		}
+		b.WriteString("</tr>\n")
+	}
+
+	for _, group := range d.matcher().GetGroupedOpCodes(d.context) {
+		first, last := group[0], group[len(group)-1]
+		fmt.Fprintf(&b, "<tr class=\"hunk\"><td></td><td>Lines %d–%d</td><td></td><td>Lines %d–%d</td></tr>\n", first.I1+1, last.I2, first.J1+1, last.J2)
+		for _, op := range group {
+			switch op.Tag {
+			case 'e':
+				for k := 0; k < op.I2-op.I1; k++ {
+					text := html.EscapeString(strings.TrimSuffix(d.old[op.I1+k], "\n"))
+					row(op.I1+k, text, op.J1+k, text, false)
+				}
+			default:
+				n := max(op.I2-op.I1, op.J2-op.J1)
+				for k := 0; k < n; k++ {
+					i, j := op.I1+k, op.J1+k
+					var oldLine, newLine string
+					if i < op.I2 {
+						oldLine = d.old[i]
+					} else {
+						i = -1
+					}
+					if j < op.J2 {
+						newLine = d.new[j]
+					} else {
+						j = -1
+					}
+					oldCell, newCell := markWords(strings.TrimSuffix(oldLine, "\n"), strings.TrimSuffix(newLine, "\n"))
+					row(i, oldCell, j, newCell, true)
+				}
+			}
+		}
+	}
+	b.WriteString("</tbody></table></body></html>\n")
+	return b.Bytes()
+}
+
+// trackedChanges lays out the new document in full with the old one's text
+// merged in, deleted text struck through and inserted text underlined.
+func (d documentDiff) trackedChanges() []byte {
+	var b bytes.Buffer
+	d.page(&b)
+	line := func(s string) {
+		b.WriteString(`<p class="line">` + s + "</p>\n")
+	}
+	for _, op := range d.matcher().GetOpCodes() {
+		switch op.Tag {
+		case 'e':
+			for _, l := range d.new[op.J1:op.J2] {
+				line(html.EscapeString(strings.TrimSuffix(l, "\n")))
+			}
+		case 'd':
+			for _, l := range d.old[op.I1:op.I2] {
+				line("<del>" + html.EscapeString(strings.TrimSuffix(l, "\n")) + "</del>")
+			}
+		case 'i':
+			for _, l := range d.new[op.J1:op.J2] {
+				line("<ins>" + html.EscapeString(strings.TrimSuffix(l, "\n")) + "</ins>")
+			}
+		case 'r':
+			// Paired lines show their word changes; the rest are whole deletions or insertions
+			n := max(op.I2-op.I1, op.J2-op.J1)
+			for k := 0; k < n; k++ {
+				switch {
+				case op.I1+k >= op.I2:
+					line("<ins>" + html.EscapeString(strings.TrimSuffix(d.new[op.J1+k], "\n")) + "</ins>")
+				case op.J1+k >= op.J2:
+					line("<del>" + html.EscapeString(strings.TrimSuffix(d.old[op.I1+k], "\n")) + "</del>")
+				default:
+					line(mergeWords(strings.TrimSuffix(d.old[op.I1+k], "\n"), strings.TrimSuffix(d.new[op.J1+k], "\n")))
+				}
+			}
+		}
+	}
+	b.WriteString("</body></html>\n")
+	return b.Bytes()
+}
+
+// wordOpCodes matches the words of two lines. Lines of more than
+// maxDiffLineWords words are not split, and one replaces the other.
+func wordOpCodes(oldLine, newLine string) ([]string, []string, []difflib.OpCode) {
+	a := diffWordPattern.FindAllString(oldLine, maxDiffLineWords+1)
+	b := diffWordPattern.FindAllString(newLine, maxDiffLineWords+1)
+	if len(a) > maxDiffLineWords || len(b) > maxDiffLineWords {
+		return []string{oldLine}, []string{newLine}, []difflib.OpCode{{Tag: 'r', I1: 0, I2: 1, J1: 0, J2: 1}}
+	}
+	return a, b, difflib.NewMatcherWithJunk(a, b, false, nil).GetOpCodes()
+}
+
+// markWords returns two changed lines as HTML, with the words only the old one
+// has in <del> and those only the new one has in <ins>.
+func markWords(oldLine, newLine string) (string, string) {
+	a, b, ops := wordOpCodes(oldLine, newLine)
+	var oldHTML, newHTML strings.Builder
+	for _, op := range ops {
+		oldText := html.EscapeString(strings.Join(a[op.I1:op.I2], ""))
+		newText := html.EscapeString(strings.Join(b[op.J1:op.J2], ""))
+		if op.Tag == 'e' {
+			oldHTML.WriteString(oldText)
+			newHTML.WriteString(newText)
+			continue
+		}
+		if oldText != "" {
+			oldHTML.WriteString("<del>" + oldText + "</del>")
+		}
+		if newText != "" {
+			newHTML.WriteString("<ins>" + newText + "</ins>")
+		}
+	}
+	return oldHTML.String(), newHTML.String()
+}
+
+// mergeWords returns the new line as HTML with the old one's words merged in,
+// as <del> before the <ins> that replaces them.
+func mergeWords(oldLine, newLine string) string {
+	a, b, ops := wordOpCodes(oldLine, newLine)
+	var out strings.Builder
+	for _, op := range ops {
+		if op.Tag == 'e' {
+			out.WriteString(html.EscapeString(strings.Join(b[op.J1:op.J2], "")))
+			continue
+		}
+		if op.I2 > op.I1 {
+			out.WriteString("<del>" + html.EscapeString(strings.Join(a[op.I1:op.I2], "")) + "</del>")
+		}
+		if op.J2 > op.J1 {
+			out.WriteString("<ins>" + html.EscapeString(strings.Join(b[op.J1:op.J2], "")) + "</ins>")
+		}
+	}
+	return out.String()
+}
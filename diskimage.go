@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Disk images (iso, img, dmg) are read like archives with 7-Zip, which knows
+// ISO 9660 with Joliet and UDF, FAT, NTFS and ext file systems, and Apple disk
+// images with HFS+. Partitioned images come out as one image per partition.
+
+// sevenZipCandidates are the executable names tried when looking for 7-Zip. 7za
+// is left out as it cannot read disk images.
+var sevenZipCandidates = []string{"7z", "7zz"}
+
+// findSevenZip locates 7-Zip, preferring FILECONVERTER_7Z_PATH.
+func findSevenZip() (string, error) {
+	if p := os.Getenv("FILECONVERTER_7Z_PATH"); p != "" {
+		return p, nil
+	}
+	for _, name := range sevenZipCandidates {
+		if p, err := exec.LookPath(name); err == nil {
+			return p, nil
+		}
+	}
+	return "", &ToolMissingError{Tool: "7-Zip", Purpose: "converting disk images"}
+}
+
+// extractDiskImage extracts the files of a disk image into dir.
+func extractDiskImage(ctx context.Context, src, dir string, report *ConversionReport) error {
+	sevenZip, err := findSevenZip()
+	if err != nil {
+		return err
+	}
+	// -p- never prompts for a password; 7-Zip refuses entries that would escape
+	// dir and extraction is walked again anyway, leaving out links.
+	err = archiveExpansion.watchExtraction(ctx, []string{src}, dir, func(ctx context.Context) error {
+		_, err := runCommand(report, exec.CommandContext(ctx, sevenZip, "x", "-y", "-bd", "-p-", "-o"+dir, src))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("7-Zip failed: %w", err)
+	}
+	return nil
+}
+
+// listDiskImage lists the files of a disk image from 7-Zip's technical listing,
+// where every entry is a block of "Key = value" lines.
+func listDiskImage(ctx context.Context, src string, report *ConversionReport) ([]archiveEntry, error) {
+	sevenZip, err := findSevenZip()
+	if err != nil {
+		return nil, err
+	}
+	out, err := runCommand(report, exec.CommandContext(ctx, sevenZip, "l", "-slt", "-bd", "-p-", src))
+	if err != nil {
+		return nil, fmt.Errorf("7-Zip failed: %w", err)
+	}
+
+	var entries []archiveEntry
+	var entry *archiveEntry
+	inEntries := false // Entries follow a line of dashes after the archive's own block
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "----------") {
+			inEntries = true
+			continue
+		}
+		if !inEntries {
+			continue
+		}
+		key, value, ok := strings.Cut(line, " = ")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "Path":
+			entries = append(entries, archiveEntry{Name: strings.ReplaceAll(value, `\`, "/")})
+			entry = &entries[len(entries)-1]
+		case "Size":
+			if entry != nil {
+				entry.Size, _ = strconv.ParseInt(value, 10, 64)
+			}
+		case "Folder":
+			if entry != nil {
+				entry.Dir = value == "+"
+			}
+		}
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// diskFreeBytes is not implemented on this platform.
+func diskFreeBytes(dir string) (int64, error) {
+	return 0, errors.New("not supported on this platform")
+}
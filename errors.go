@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Errors conversions fail with, wrapped with context. Callers branch on them
+// with errors.Is rather than by parsing messages; errorStatus maps them to
+// HTTP statuses.
+var (
+	// ErrUnsupportedConversion means the source format can't be converted to the
+	// target format, or the requested options don't apply to the pair.
+	ErrUnsupportedConversion = errors.New("unsupported conversion")
+	// ErrToolMissing means an external program the conversion needs is not
+	// installed; errors.As with a *ToolMissingError tells which.
+	ErrToolMissing = errors.New("required tool is not installed")
+	// ErrInputCorrupt means the input could not be read as its format.
+	ErrInputCorrupt = errors.New("corrupt input")
+	// ErrArchiveTooLarge means an archive expands to more than it may; see
+	// archiveLimits.
+	ErrArchiveTooLarge = errors.New("archive expands too far")
+	// ErrTimeout means the conversion, or a service it called, took too long.
+	ErrTimeout = errors.New("timed out")
+	// ErrInsufficientSpace means there isn't enough temporary disk space for
+	// the conversion; see tempSpaceBudget.
+	ErrInsufficientSpace = errors.New("not enough temporary disk space")
+)
+
+// ToolMissingError reports an external program that is not installed or not
+// in PATH. It matches ErrToolMissing.
+type ToolMissingError struct {
+	Tool    string // Name of the program, e.g. FFmpeg
+	Purpose string // What needs it, e.g. "WebP conversion"; may be empty
+}
+
+func (e *ToolMissingError) Error() string {
+	if e.Purpose == "" {
+		return e.Tool + " is not installed or not in PATH"
+	}
+	return e.Purpose + " requires " + e.Tool + " which is not installed or not in PATH"
+}
+
+func (e *ToolMissingError) Is(target error) bool {
+	return target == ErrToolMissing
+}
+
+// isTimeout reports whether err comes from a deadline passing, such as a
+// network read or an HTTP client timeout.
+func isTimeout(err error) bool {
+	var t interface{ Timeout() bool }
+	return errors.As(err, &t) && t.Timeout()
+}
+
+// timeoutError marks err as ErrTimeout if it comes from a deadline passing.
+func timeoutError(err error) error {
+	if isTimeout(err) {
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+	return err
+}
+
+// errorStatus is the response status for an error from converting or storing a
+// file: the client's fault for unsupported or unreadable input, the server's
+// for missing tools, timeouts, a full store and a full disk.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrUnsupportedConversion):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrInputCorrupt), errors.Is(err, ErrArchiveTooLarge), errors.Is(err, errModerationRejected), errors.Is(err, errHookRejected):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, ErrToolMissing), errors.Is(err, errStoreFull):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrInsufficientSpace):
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
+
+// failureMessage describes why a job failed by the kind of error alone, for the
+// job record that clients can read. The error itself may carry tool output and
+// temporary paths, so it is only logged.
+func failureMessage(err error) string {
+	switch {
+	case errors.Is(err, ErrUnsupportedConversion):
+		return "unsupported conversion"
+	case errors.Is(err, ErrInputCorrupt):
+		return "the input could not be read as its format"
+	case errors.Is(err, ErrArchiveTooLarge):
+		return "the archive expands beyond the size allowed"
+	case errors.Is(err, errModerationRejected):
+		return "rejected by content moderation"
+	case errors.Is(err, errHookRejected):
+		return "rejected by a hook"
+	case errors.Is(err, ErrTimeout):
+		return "the conversion timed out"
+	case errors.Is(err, ErrToolMissing):
+		return "a tool the conversion needs is not installed"
+	case errors.Is(err, ErrInsufficientSpace):
+		return "not enough temporary disk space"
+	}
+	return "the conversion failed"
+}
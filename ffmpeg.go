@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// ffmpegTemplate overrides the FFmpeg arguments used for a source→target pair.
+// Exactly one of Args and Extra is set.
+type ffmpegTemplate struct {
+	// Args replaces the whole argument list. The placeholders {input} and {output}
+	// expand to the file paths, and a standalone {options} argument expands to the
+	// arguments derived from the request's options (such as a caption filter).
+	Args []string `json:"args,omitempty"`
+	// Extra keeps the built-in arguments and adds these just before the output path.
+	Extra []string `json:"extra,omitempty"`
+}
+
+// ffmpegTemplates holds the operator-configured templates, keyed "source:target".
+// Either side may be "*" to match any format; the most specific match wins.
+var ffmpegTemplates = map[string]ffmpegTemplate{}
+
+// loadFFmpegTemplates reads templates from a JSON file of the form
+//
+//	{"mp4:webm": {"args": ["-i", "{input}", "-c:v", "libvpx-vp9", "{options}", "{output}"]},
+//	 "*:mp3":    {"extra": ["-q:a", "2"]}}
+func loadFFmpegTemplates(path string) (map[string]ffmpegTemplate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read FFmpeg templates: %w", err)
+	}
+	var templates map[string]ffmpegTemplate
+	if err := json.Unmarshal(data, &templates); err != nil {
+		return nil, fmt.Errorf("failed to parse FFmpeg templates: %w", err)
+	}
+
+	for key, t := range templates {
+		src, target, ok := strings.Cut(key, ":")
+		if !ok || src == "" || target == "" {
+			return nil, fmt.Errorf("FFmpeg template key %q must look like source:target", key)
+		}
+		if (len(t.Args) == 0) == (len(t.Extra) == 0) {
+			return nil, fmt.Errorf("FFmpeg template %q must set exactly one of args and extra", key)
+		}
+		if len(t.Args) > 0 {
+			joined := strings.Join(t.Args, " ")
+			if !strings.Contains(joined, "{input}") || !strings.Contains(joined, "{output}") {
+				return nil, fmt.Errorf("FFmpeg template %q must use both {input} and {output}", key)
+			}
+		}
+	}
+	return templates, nil
+}
+
+// lookupFFmpegTemplate finds the template for a pair, preferring an exact match
+// over "source:*", then "*:target", then "*:*".
+func lookupFFmpegTemplate(sourceExt, targetFormat string) (ffmpegTemplate, bool) {
+	for _, key := range []string{sourceExt + ":" + targetFormat, sourceExt + ":*", "*:" + targetFormat, "*:*"} {
+		if t, ok := ffmpegTemplates[key]; ok {
+			return t, true
+		}
+	}
+	return ffmpegTemplate{}, false
+}
+
+// ffmpegArgs builds the FFmpeg argument list for a conversion. extraInputs are
+// further "-i path" arguments read after the input, base the built-in encoding
+// arguments for the pair and options the ones derived from request options; a
+// configured template may replace or extend them. Templates get the extra
+// inputs right after a standalone {input} argument.
+func ffmpegArgs(sourceExt, targetFormat, inputPath, outputPath string, extraInputs, base, options []string) []string {
+	builtin := slices.Concat([]string{"-i", inputPath}, extraInputs, base, options)
+
+	t, ok := lookupFFmpegTemplate(sourceExt, targetFormat)
+	switch {
+	case !ok:
+		return append(builtin, outputPath)
+	case len(t.Extra) > 0:
+		return slices.Concat(builtin, t.Extra, []string{outputPath})
+	}
+
+	args := make([]string, 0, len(t.Args)+len(options))
+	for _, arg := range t.Args {
+		if arg == "{options}" {
+			args = append(args, options...)
+			continue
+		}
+		if arg == "{input}" {
+			args = append(append(args, inputPath), extraInputs...)
+			continue
+		}
+		arg = strings.ReplaceAll(arg, "{input}", inputPath)
+		arg = strings.ReplaceAll(arg, "{output}", outputPath)
+		args = append(args, arg)
+	}
+	return args
+}
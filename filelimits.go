@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// errStoreFull is returned when storing a file would exceed a file count limit.
+var errStoreFull = errors.New("too many files are stored; try again later")
+
+// errTooManyWorkspaces is returned when starting a workspace would exceed the
+// limit on live workspaces.
+var errTooManyWorkspaces = errors.New("too many workspaces are open; try again later")
+
+// defaultMaxWorkspaces caps live workspaces unless FILECONVERTER_MAX_WORKSPACES
+// says otherwise. Each costs memory until it expires even if no file is ever
+// added to it.
+const defaultMaxWorkspaces = 10000
+
+// purgeInterval is how often reserveFileSlot purges expired files at most, since
+// each purge walks every stored file.
+const purgeInterval = 10 * time.Second
+
+// fileLimits caps the number of stored files regardless of their size, since
+// millions of tiny files degrade the metadata map and the filesystem within any
+// byte budget. Zero means unlimited.
+type fileLimits struct {
+	Soft     int `json:"soft,omitempty"`     // Beyond this, expired files are purged on stores, every purgeInterval at most, and a warning logged
+	Hard     int `json:"hard,omitempty"`     // New files are refused at this many stored files
+	DiskHard int `json:"diskHard,omitempty"` // New files are refused once this many are on disk and RAM is full
+
+	Workspaces int `json:"workspaces,omitempty"` // New workspaces are refused at this many live ones
+}
+
+// loadFileLimits reads FILECONVERTER_SOFT_MAX_FILES, FILECONVERTER_MAX_FILES,
+// FILECONVERTER_MAX_DISK_FILES and FILECONVERTER_MAX_WORKSPACES.
+func loadFileLimits() fileLimits {
+	return fileLimits{
+		Soft:     envInt("FILECONVERTER_SOFT_MAX_FILES", 0),
+		Hard:     envInt("FILECONVERTER_MAX_FILES", 0),
+		DiskHard: envInt("FILECONVERTER_MAX_DISK_FILES", 0),
+
+		Workspaces: envInt("FILECONVERTER_MAX_WORKSPACES", defaultMaxWorkspaces),
+	}
+}
+
+// removeExpired deletes every expired file and purges the trash.
+// This function expects the lock to be already held.
+func (fs *FileStore) removeExpired(now time.Time) {
+	for id, meta := range fs.files {
+		if meta.expired(now) {
+			log.Printf("Cleaning up expired file: %s (%s)", id, meta.OriginalName)
+			fs.deleteFileInternal(id)
+		}
+	}
+	fs.purgeTrash(now)
+}
+
+// reserveFileSlot checks the file count limits before a new file, or failed job
+// record, is stored. Once the soft limit is reached it purges expired files first
+// so the map doesn't wait for the next cleanup to shrink, though no more often
+// than every purgeInterval.
+// This function expects the lock to be already held.
+func (fs *FileStore) reserveFileSlot(toDisk bool) error {
+	if fs.limits.Soft > 0 && len(fs.files) >= fs.limits.Soft && fs.purgeExpired() {
+		if len(fs.files) >= fs.limits.Soft {
+			log.Printf("Warning: %d files stored, at or above the soft limit of %d", len(fs.files), fs.limits.Soft)
+		}
+	}
+	if fs.limits.Hard > 0 && len(fs.files) >= fs.limits.Hard {
+		fs.purgeExpired()
+		if len(fs.files) >= fs.limits.Hard {
+			return errStoreFull
+		}
+	}
+	if toDisk && fs.limits.DiskHard > 0 && fs.diskFiles >= fs.limits.DiskHard {
+		return errStoreFull
+	}
+	return nil
+}
+
+// purgeExpired removes expired files unless that was done within the last
+// purgeInterval, and reports whether it did.
+// This function expects the lock to be already held.
+func (fs *FileStore) purgeExpired() bool {
+	now := time.Now()
+	if now.Sub(fs.lastPurged) < purgeInterval {
+		return false
+	}
+	fs.lastPurged = now
+	fs.removeExpired(now)
+	return true
+}
+
+// atFileLimit reports whether the store is at its hard file count limit.
+func (fs *FileStore) atFileLimit() bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.reserveFileSlot(false) != nil
+}
+
+// hasFileCapacity refuses requests with 503 while the store is at its file
+// count limit, before any conversion work is done.
+func hasFileCapacity(fs *FileStore, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if fs.atFileLimit() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(cleanupInterval/time.Second)))
+			http.Error(w, errStoreFull.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/textproto"
+	"sync/atomic"
+	"testing"
+)
+
+// newBenchStore returns a FileStore on a temporary disk path, with logging
+// silenced for the benchmark since every stored file is logged.
+func newBenchStore(b *testing.B) *FileStore {
+	b.Helper()
+	out := log.Writer()
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(out) })
+	return NewFileStore(b.TempDir())
+}
+
+// benchFile is an uploaded file held in memory.
+type benchFile struct{ *bytes.Reader }
+
+func (benchFile) Close() error { return nil }
+
+// benchUpload wraps content as an uploaded file.
+func benchUpload(name string, content []byte) (multipart.File, *multipart.FileHeader) {
+	header := &multipart.FileHeader{Filename: name, Size: int64(len(content)), Header: textproto.MIMEHeader{}}
+	return benchFile{bytes.NewReader(content)}, header
+}
+
+// benchPNG encodes a size by size PNG with a gradient, so it compresses like a
+// photo more than like a flat fill.
+func benchPNG(b *testing.B, size int) []byte {
+	b.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), uint8(x ^ y), 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		b.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// forget drops a stored file, so a benchmark's memory use doesn't grow with b.N.
+func (fs *FileStore) forget(fileID string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.deleteFileInternal(fileID)
+}
+
+// BenchmarkAddFile measures storing uploads that need no conversion.
+func BenchmarkAddFile(b *testing.B) {
+	for _, size := range []int{4 << 10, 1 << 20, 16 << 20} {
+		b.Run(fmt.Sprintf("%dKB", size>>10), func(b *testing.B) {
+			fs := newBenchStore(b)
+			content := bytes.Repeat([]byte("x"), size)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for range b.N {
+				file, header := benchUpload("data.bin", content)
+				meta, err := fs.AddFile(context.Background(), file, header, "", ConversionOptions{}, jobAttributes{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				fs.forget(meta.ID)
+			}
+		})
+	}
+}
+
+// BenchmarkGetFile measures downloads of a stored file from many goroutines at
+// once, which contend for the store's lock.
+func BenchmarkGetFile(b *testing.B) {
+	for _, size := range []int{4 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("%dKB", size>>10), func(b *testing.B) {
+			fs := newBenchStore(b)
+			meta, err := fs.storeFile(context.Background(), "data.bin", "data.bin", "application/octet-stream", bytes.Repeat([]byte("x"), size), jobAttributes{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, _, err := fs.GetFile(meta.ID); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkImageConversion measures the latency of converting a PNG to JPEG by
+// the image's dimensions.
+func BenchmarkImageConversion(b *testing.B) {
+	newBenchStore(b) // Silences logging
+	for _, size := range []int{256, 1024, 4096} {
+		b.Run(fmt.Sprintf("%dpx", size), func(b *testing.B) {
+			input := benchPNG(b, size)
+			b.SetBytes(int64(len(input)))
+			b.ReportAllocs()
+			for range b.N {
+				if _, _, err := performConversion(context.Background(), input, "image.png", "jpg", ConversionOptions{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkMixedWorkload runs uploads with and without conversion and downloads
+// side by side from many goroutines, as a busy server does.
+func BenchmarkMixedWorkload(b *testing.B) {
+	fs := newBenchStore(b)
+	picture := benchPNG(b, 512)
+	data := bytes.Repeat([]byte("x"), 256<<10)
+	stored, err := fs.storeFile(context.Background(), "data.bin", "data.bin", "application/octet-stream", data, jobAttributes{})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var n atomic.Int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			var meta *FileMetadata
+			var err error
+			switch n.Add(1) % 4 {
+			case 0:
+				file, header := benchUpload("image.png", picture)
+				meta, err = fs.AddFile(context.Background(), file, header, "jpg", ConversionOptions{}, jobAttributes{})
+			case 1:
+				file, header := benchUpload("data.bin", data)
+				meta, err = fs.AddFile(context.Background(), file, header, "", ConversionOptions{}, jobAttributes{})
+			default:
+				_, _, err = fs.GetFile(stored.ID)
+			}
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			if meta != nil {
+				fs.forget(meta.ID)
+			}
+		}
+	})
+}
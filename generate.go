@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/code128"
+	"github.com/boombuler/barcode/code39"
+	"github.com/boombuler/barcode/code93"
+	"github.com/boombuler/barcode/datamatrix"
+	"github.com/boombuler/barcode/ean"
+	"github.com/boombuler/barcode/pdf417"
+	"github.com/boombuler/barcode/qr"
+	"github.com/disintegration/imaging"
+)
+
+const (
+	// maxGeneratedCodeText is the longest payload accepted for a generated code.
+	maxGeneratedCodeText = 2048
+	// maxGeneratedCodeSize caps the pixel dimensions of generated codes.
+	maxGeneratedCodeSize = 4096
+)
+
+// qrErrorCorrection maps the errorCorrection option to QR error correction levels.
+var qrErrorCorrection = map[string]qr.ErrorCorrectionLevel{
+	"L": qr.L, "M": qr.M, "Q": qr.Q, "H": qr.H,
+}
+
+// barcodeEncoders maps the type option to barcode encoders.
+var barcodeEncoders = map[string]func(text string) (barcode.Barcode, error){
+	"code128": func(text string) (barcode.Barcode, error) { return code128.Encode(text) },
+	"code39":  func(text string) (barcode.Barcode, error) { return code39.Encode(text, true, true) },
+	"code93":  func(text string) (barcode.Barcode, error) { return code93.Encode(text, true, true) },
+	"ean":     func(text string) (barcode.Barcode, error) { return ean.Encode(text) },
+	"datamatrix": func(text string) (barcode.Barcode, error) {
+		return datamatrix.Encode(text)
+	},
+	"pdf417": func(text string) (barcode.Barcode, error) { return pdf417.Encode(text, 2) },
+}
+
+// generatedCode is an encoded code plus how it should be rendered.
+type generatedCode struct {
+	code          barcode.Barcode
+	width, height int // Output size in pixels (points for PDF)
+	margin        int // Quiet zone in modules around the code
+	format        string
+}
+
+// parseGenerateFormat reads and validates the output format option.
+func parseGenerateFormat(r *http.Request) (string, error) {
+	format := strings.ToLower(r.FormValue("format"))
+	if format == "" {
+		format = "png"
+	}
+	if format != "png" && format != "svg" && format != "pdf" {
+		return "", fmt.Errorf("unsupported output format %q (use png, svg or pdf)", format)
+	}
+	return format, nil
+}
+
+// parseGenerateSize reads an optional pixel dimension from the form.
+func parseGenerateSize(r *http.Request, field string, def int) (int, error) {
+	v := r.FormValue(field)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 16 || n > maxGeneratedCodeSize {
+		return 0, fmt.Errorf("invalid %s %q: must be between 16 and %d", field, v, maxGeneratedCodeSize)
+	}
+	return n, nil
+}
+
+// parseGenerateText reads the payload to encode.
+func parseGenerateText(r *http.Request) (string, error) {
+	text := r.FormValue("text")
+	if text == "" {
+		return "", fmt.Errorf("text is required")
+	}
+	if len(text) > maxGeneratedCodeText {
+		return "", fmt.Errorf("text is too long: at most %d bytes are allowed", maxGeneratedCodeText)
+	}
+	return text, nil
+}
+
+// parseQRRequest builds a QR code from the request's form values.
+func parseQRRequest(r *http.Request) (*generatedCode, error) {
+	text, err := parseGenerateText(r)
+	if err != nil {
+		return nil, err
+	}
+	format, err := parseGenerateFormat(r)
+	if err != nil {
+		return nil, err
+	}
+	size, err := parseGenerateSize(r, "size", 256)
+	if err != nil {
+		return nil, err
+	}
+
+	level := strings.ToUpper(r.FormValue("errorCorrection"))
+	if level == "" {
+		level = "M"
+	}
+	ecl, ok := qrErrorCorrection[level]
+	if !ok {
+		return nil, fmt.Errorf("invalid error correction level %q (use L, M, Q or H)", level)
+	}
+
+	code, err := qr.Encode(text, ecl, qr.Auto)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode QR code: %w", err)
+	}
+	return &generatedCode{code: code, width: size, height: size, margin: 4, format: format}, nil
+}
+
+// parseBarcodeRequest builds a linear or 2D barcode from the request's form values.
+func parseBarcodeRequest(r *http.Request) (*generatedCode, error) {
+	text, err := parseGenerateText(r)
+	if err != nil {
+		return nil, err
+	}
+	format, err := parseGenerateFormat(r)
+	if err != nil {
+		return nil, err
+	}
+
+	kind := strings.ToLower(r.FormValue("type"))
+	if kind == "" {
+		kind = "code128"
+	}
+	encode, ok := barcodeEncoders[kind]
+	if !ok {
+		return nil, fmt.Errorf("unsupported barcode type %q", kind)
+	}
+	code, err := encode(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s barcode: %w", kind, err)
+	}
+
+	width, err := parseGenerateSize(r, "width", 400)
+	if err != nil {
+		return nil, err
+	}
+	height, err := parseGenerateSize(r, "height", 120)
+	if err != nil {
+		return nil, err
+	}
+	return &generatedCode{code: code, width: width, height: height, margin: 2, format: format}, nil
+}
+
+// render encodes the code in its output format.
+func (g *generatedCode) render() ([]byte, error) {
+	switch g.format {
+	case "svg":
+		return g.renderSVG(), nil
+	case "pdf":
+		return g.renderPDF(), nil
+	default:
+		return g.renderPNG()
+	}
+}
+
+// modules returns the dark module rectangles of the code in module units, offset by the
+// quiet zone, along with the total size in modules. Runs of dark modules on a row are
+// merged so 1D codes become one rectangle per bar.
+func (g *generatedCode) modules() ([]image.Rectangle, int, int) {
+	b := g.code.Bounds()
+	var rects []image.Rectangle
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if !isDarkModule(g.code.At(x, y)) {
+				continue
+			}
+			start := x
+			for x+1 < b.Max.X && isDarkModule(g.code.At(x+1, y)) {
+				x++
+			}
+			rects = append(rects, image.Rect(start-b.Min.X+g.margin, y-b.Min.Y+g.margin, x+1-b.Min.X+g.margin, y+1-b.Min.Y+g.margin))
+		}
+	}
+	return rects, b.Dx() + 2*g.margin, b.Dy() + 2*g.margin
+}
+
+// isDarkModule reports whether a barcode pixel is a dark (ink) module.
+func isDarkModule(c color.Color) bool {
+	gray := color.GrayModel.Convert(c).(color.Gray)
+	return gray.Y < 128
+}
+
+// renderPNG rasterizes the code at the requested size with a white quiet zone.
+func (g *generatedCode) renderPNG() ([]byte, error) {
+	rects, cols, rows := g.modules()
+	canvas := imaging.New(cols, rows, color.White)
+	for _, rect := range rects {
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				canvas.Set(x, y, color.Black)
+			}
+		}
+	}
+	// Nearest-neighbour keeps module edges crisp at any scale.
+	scaled := imaging.Resize(canvas, g.width, g.height, imaging.NearestNeighbor)
+
+	data, err := encodeImagePooled(scaled, imaging.PNG)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode PNG: %w", err)
+	}
+	return data, nil
+}
+
+// renderSVG emits the code as scalable vector rectangles.
+func (g *generatedCode) renderSVG() []byte {
+	rects, cols, rows := g.modules()
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" preserveAspectRatio="none" shape-rendering="crispEdges">`, g.width, g.height, cols, rows)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, cols, rows)
+	for _, r := range rects {
+		fmt.Fprintf(&buf, "M%d %dh%dv%dh-%dz", r.Min.X, r.Min.Y, r.Dx(), r.Dy(), r.Dx())
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes()
+}
+
+// renderPDF emits a single-page PDF drawing the code with vector rectangles.
+func (g *generatedCode) renderPDF() []byte {
+	rects, cols, rows := g.modules()
+	sx, sy := float64(g.width)/float64(cols), float64(g.height)/float64(rows)
+
+	var content bytes.Buffer
+	content.WriteString("0 g\n")
+	for _, r := range rects {
+		// PDF's origin is bottom-left, so flip the y axis.
+		fmt.Fprintf(&content, "%.3f %.3f %.3f %.3f re\n", float64(r.Min.X)*sx, float64(rows-r.Max.Y)*sy, float64(r.Dx())*sx, float64(r.Dy())*sy)
+	}
+	content.WriteString("f\n")
+
+	var doc pdfDocument
+	contentObj := doc.addStream("", content.Bytes())
+	doc.addPage(g.width, g.height, "", contentObj)
+	return doc.bytes()
+}
+
+// handleGenerate serves the code generation endpoints; parse builds the code to render.
+func handleGenerate(fs *FileStore, name string, parse func(r *http.Request) (*generatedCode, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		code, err := parse(r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid %s request: %v", name, err), http.StatusBadRequest)
+			return
+		}
+
+		attrs, err := parseJobAttributes(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		data, err := code.render()
+		if err != nil {
+			log.Printf("Error rendering %s: %v", name, err)
+			http.Error(w, fmt.Sprintf("Error rendering %s: %v", name, err), http.StatusInternalServerError)
+			return
+		}
+
+		meta, err := fs.storeFile(r.Context(), name, name+"."+code.format, getContentTypeForExtension(code.format), data, attrs)
+		if err != nil {
+			log.Printf("Error storing %s: %v", name, err)
+			http.Error(w, fmt.Sprintf("Error processing file: %v", err), errorStatus(err))
+			return
+		}
+
+		writeUploadResponse(w, r, meta)
+	}
+}
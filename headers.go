@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Content security policies, before frame-ancestors is appended. The web UI
+// pulls Tailwind from its CDN and uses inline styles and scripts; downloads are
+// sandboxed so converted HTML or SVG opened in the browser can't run scripts.
+const (
+	uiContentSecurityPolicy       = "default-src 'self'; script-src 'self' 'unsafe-inline' https://cdn.tailwindcss.com; style-src 'self' 'unsafe-inline'; img-src 'self' data: blob:; base-uri 'none'; form-action 'self'"
+	downloadContentSecurityPolicy = "default-src 'none'; img-src 'self' data:; media-src 'self'; style-src 'unsafe-inline'; sandbox"
+)
+
+// frameAncestors lists the origins allowed to embed the UI and downloads in
+// frames, from the space- or comma-separated FILECONVERTER_FRAME_ANCESTORS (e.g.
+// "https://app.example.com 'self'"). Framing is refused while it is empty.
+var frameAncestors []string
+
+// parseFrameAncestors splits a list of CSP frame-ancestors sources.
+func parseFrameAncestors(list string) []string {
+	return strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ' ' })
+}
+
+// withSecurityHeaders sets the content security policy and the usual hardening
+// headers on responses of next. X-Frame-Options can't express a list of origins,
+// so it is only sent while framing is refused outright.
+func withSecurityHeaders(policy string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		if len(frameAncestors) == 0 {
+			h.Set("Content-Security-Policy", policy+"; frame-ancestors 'none'")
+			h.Set("X-Frame-Options", "DENY")
+		} else {
+			h.Set("Content-Security-Policy", policy+"; frame-ancestors "+strings.Join(frameAncestors, " "))
+		}
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Referrer-Policy", "no-referrer") // Signed download links must not leak
+		next(w, r)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// maxAuditEntries bounds the in-memory audit trail; older entries are dropped.
+const maxAuditEntries = 1000
+
+// errNotHeld is returned when releasing a file that is not under hold.
+var errNotHeld = errors.New("file is not under hold")
+
+// legalHold exempts a file from expiry until an admin releases it.
+type legalHold struct {
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+// auditEntry records an administrative action, usually on a file.
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	FileID string    `json:"fileId,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	Remote string    `json:"remote"` // Address the admin request came from
+}
+
+// expired reports whether a file has outlived its expiry time and is neither
+// held nor awaiting moderation review.
+func (meta *FileMetadata) expired(now time.Time) bool {
+	return meta.Hold == nil && !meta.awaitingReview() && now.After(meta.ExpiryTime)
+}
+
+// addAudit appends to the audit trail and mirrors the entry to the log.
+// This function expects the lock to be already held.
+func (fs *FileStore) addAudit(entry auditEntry) {
+	log.Printf("Audit: %s on file %s from %s (reason: %q)", entry.Action, entry.FileID, entry.Remote, entry.Reason)
+	fs.audit = append(fs.audit, entry)
+	if len(fs.audit) > maxAuditEntries {
+		fs.audit = fs.audit[len(fs.audit)-maxAuditEntries:]
+	}
+}
+
+// recordAudit timestamps an entry and appends it to the audit trail.
+func (fs *FileStore) recordAudit(entry auditEntry) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	entry.Time = time.Now()
+	fs.addAudit(entry)
+}
+
+// AuditLog returns a copy of the audit trail, oldest first.
+func (fs *FileStore) AuditLog() []auditEntry {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return append([]auditEntry(nil), fs.audit...)
+}
+
+// SetHold places a file under legal hold or, with held false, releases it. A
+// released file whose expiry time has passed is removed by the next cleanup.
+func (fs *FileStore) SetHold(fileID string, held bool, reason, remote string) (*FileMetadata, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	meta, exists := fs.files[fileID]
+	if !exists || meta.expired(time.Now()) {
+		return nil, fmt.Errorf("file not found or expired")
+	}
+
+	entry := auditEntry{Time: time.Now(), FileID: fileID, Reason: reason, Remote: remote}
+	if held {
+		entry.Action = "hold"
+		meta.Hold = &legalHold{Reason: reason, Since: entry.Time}
+	} else {
+		if meta.Hold == nil {
+			return nil, errNotHeld
+		}
+		entry.Action = "unhold"
+		meta.Hold = nil
+	}
+	fs.addAudit(entry)
+
+	info := *meta
+	return &info, nil
+}
+
+// handleAdminHold places (POST) or releases (DELETE) a legal hold on a file.
+// An optional "reason" form value is stored in the audit trail.
+func handleAdminHold(fs *FileStore, held bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		meta, err := fs.SetHold(r.PathValue("id"), held, r.FormValue("reason"), r.RemoteAddr)
+		if errors.Is(err, errNotHeld) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, fileInfo(r, meta))
+	}
+}
+
+// handleAdminAudit lists the audit trail.
+func handleAdminAudit(fs *FileStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entries := fs.AuditLog()
+		if entries == nil {
+			entries = []auditEntry{}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"entries": entries})
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// errHookRejected is returned when a hook refuses a conversion.
+var errHookRejected = errors.New("conversion was rejected by a hook")
+
+// Hook stages.
+const (
+	hookPre  = "pre"  // Before converting, with the input
+	hookPost = "post" // After converting, with the output, before it is signed and stored
+)
+
+// hookEvent is what hooks are told about a job, e.g.
+// {"stage":"pre","fileName":"a.docx","sourceFormat":"docx","targetFormat":"pdf",...}.
+type hookEvent struct {
+	Stage        string   `json:"stage"`
+	FileName     string   `json:"fileName"`
+	FileType     FileType `json:"fileType"`
+	SourceFormat string   `json:"sourceFormat"`
+	TargetFormat string   `json:"targetFormat"`
+	OutputName   string   `json:"outputName,omitempty"` // Set after converting
+	Size         int64    `json:"size"`                 // Of the file the stage is about
+	SHA256       string   `json:"sha256"`               // Hex-encoded, of the same file
+	Path         string   `json:"path,omitempty"`       // Command hooks only; see commandHook
+}
+
+// hookResponse is what hooks may answer with, e.g. {"reject":true,"reason":"too
+// many pages"}. An empty answer lets the job go on.
+type hookResponse struct {
+	Reject bool   `json:"reject"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// hook is a deployment-specific step run around conversions, for validation,
+// notification or post-processing.
+type hook interface {
+	// run calls the hook with the stage's file, returning its answer and the file,
+	// which the hook may have changed. It gives up when ctx ends.
+	run(ctx context.Context, event hookEvent, data []byte, report *ConversionReport) (hookResponse, []byte, error)
+	// runFile is run for a file on disk, which the hook may rewrite in place.
+	runFile(ctx context.Context, event hookEvent, path string, report *ConversionReport) (hookResponse, error)
+}
+
+// hookSet holds the configured hooks; either may be nil.
+type hookSet struct {
+	pre, post hook
+}
+
+// conversionHooks are the hooks run by performConversion, and for jobs that
+// don't convert through it, on their inputs and as their outputs are stored.
+var conversionHooks hookSet
+
+// httpHook posts the event to a URL, such as a notification or policy service.
+// It sees the job's metadata but not its content.
+type httpHook struct {
+	url    string
+	client *http.Client
+}
+
+func (h *httpHook) run(ctx context.Context, event hookEvent, data []byte, report *ConversionReport) (hookResponse, []byte, error) {
+	out, err := h.runFile(ctx, event, "", report)
+	return out, data, err
+}
+
+func (h *httpHook) runFile(ctx context.Context, event hookEvent, _ string, _ *ConversionReport) (hookResponse, error) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return hookResponse{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return hookResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return hookResponse{}, fmt.Errorf("%s hook request failed: %w", event.Stage, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return hookResponse{}, fmt.Errorf("%s hook answered %s", event.Stage, resp.Status)
+	}
+
+	answer, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return hookResponse{}, fmt.Errorf("failed to read %s hook response: %w", event.Stage, err)
+	}
+	return parseHookResponse(event.Stage, answer)
+}
+
+// commandHook runs a local program with the event on its standard input and
+// reads its answer from standard output. The stage's file is written to the path
+// given in the event; the program may rewrite it in place to post-process it.
+type commandHook struct {
+	binary string
+	args   []string
+}
+
+func (h *commandHook) run(ctx context.Context, event hookEvent, data []byte, report *ConversionReport) (hookResponse, []byte, error) {
+	wd, err := newJobWorkdir()
+	if err != nil {
+		return hookResponse{}, nil, err
+	}
+	defer wd.cleanup()
+	name := event.FileName
+	if event.Stage == hookPost {
+		name = event.OutputName
+	}
+	ext := fileFormat(name)
+	if ext == "" {
+		ext = "bin"
+	}
+	path, err := wd.writeInput(ext, data)
+	if err != nil {
+		return hookResponse{}, nil, err
+	}
+	out, err := h.runFile(ctx, event, path, report)
+	if err != nil || out.Reject {
+		return out, nil, err
+	}
+	if data, err = wd.readOutput(path); err != nil {
+		return hookResponse{}, nil, err
+	}
+	return out, data, nil
+}
+
+func (h *commandHook) runFile(ctx context.Context, event hookEvent, path string, report *ConversionReport) (hookResponse, error) {
+	event.Path = path
+	body, err := json.Marshal(event)
+	if err != nil {
+		return hookResponse{}, err
+	}
+
+	cmd := exec.CommandContext(ctx, h.binary, h.args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = bytes.NewReader(body), &stdout, &stderr
+	start := time.Now()
+	err = cmd.Run()
+	report.addCommand(newCommandTrace(cmd, time.Since(start), stderr.Bytes(), err))
+	if err != nil {
+		return hookResponse{}, fmt.Errorf("%s hook command failed: %w", event.Stage, err)
+	}
+	return parseHookResponse(event.Stage, stdout.Bytes())
+}
+
+// parseHookResponse decodes a hook's answer; an empty one lets the job go on.
+func parseHookResponse(stage string, answer []byte) (hookResponse, error) {
+	var out hookResponse
+	if len(bytes.TrimSpace(answer)) == 0 {
+		return out, nil
+	}
+	if err := json.Unmarshal(answer, &out); err != nil {
+		return hookResponse{}, fmt.Errorf("invalid %s hook response: %w", stage, err)
+	}
+	return out, nil
+}
+
+// loadHooks configures the hooks from FILECONVERTER_PRE_HOOK_URL or
+// FILECONVERTER_PRE_HOOK_COMMAND and their POST counterparts, e.g.
+// FILECONVERTER_POST_HOOK_COMMAND="/opt/hooks/watermark --strict".
+func loadHooks() (hookSet, error) {
+	pre, err := loadHook("PRE")
+	if err != nil {
+		return hookSet{}, err
+	}
+	post, err := loadHook("POST")
+	if err != nil {
+		return hookSet{}, err
+	}
+	return hookSet{pre: pre, post: post}, nil
+}
+
+// loadHook configures the hook of one stage. It returns nil when none is set.
+func loadHook(stage string) (hook, error) {
+	urlVar, commandVar := "FILECONVERTER_"+stage+"_HOOK_URL", "FILECONVERTER_"+stage+"_HOOK_COMMAND"
+	url, command := os.Getenv(urlVar), os.Getenv(commandVar)
+	switch {
+	case url != "" && command != "":
+		return nil, fmt.Errorf("set only one of %s and %s", urlVar, commandVar)
+	case url != "":
+		return &httpHook{url: url, client: &http.Client{}}, nil
+	case command != "":
+		fields := strings.Fields(command)
+		return &commandHook{binary: fields[0], args: fields[1:]}, nil
+	}
+	return nil, nil
+}
+
+// enabled reports whether any hook is configured.
+func (hs hookSet) enabled() bool {
+	return hs.pre != nil || hs.post != nil
+}
+
+// runStage runs the hook of a stage, if one is configured, on the stage's file
+// and returns the file as the hook left it. The call is bounded by deadline. A
+// rejection is returned as an error wrapping errHookRejected.
+func (hs hookSet) runStage(ctx context.Context, deadline time.Duration, event hookEvent, data []byte, report *ConversionReport) ([]byte, error) {
+	h := hs.pre
+	if event.Stage == hookPost {
+		h = hs.post
+	}
+	if h == nil {
+		return data, nil
+	}
+	sum := sha256.Sum256(data)
+	event.Size, event.SHA256 = int64(len(data)), hex.EncodeToString(sum[:])
+	ctx, cancel := withStageDeadline(ctx, deadline)
+	defer cancel()
+	resp, data, err := h.run(ctx, event, data, report)
+	if err != nil {
+		return nil, stageError(ctx, event.Stage+" hook", err)
+	}
+	if err := resp.rejection(); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// runStageFile is runStage for a file on disk, which the hook may rewrite in
+// place, so large files don't have to be read into memory.
+func (hs hookSet) runStageFile(ctx context.Context, deadline time.Duration, event hookEvent, path string, report *ConversionReport) error {
+	h := hs.pre
+	if event.Stage == hookPost {
+		h = hs.post
+	}
+	if h == nil {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to read file for %s hook: %w", event.Stage, err)
+	}
+	sum := sha256.New()
+	event.Size, err = io.Copy(sum, f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read file for %s hook: %w", event.Stage, err)
+	}
+	event.SHA256 = hex.EncodeToString(sum.Sum(nil))
+	ctx, cancel := withStageDeadline(ctx, deadline)
+	defer cancel()
+	resp, err := h.runFile(ctx, event, path, report)
+	if err != nil {
+		return stageError(ctx, event.Stage+" hook", err)
+	}
+	return resp.rejection()
+}
+
+// rejection returns the error wrapping errHookRejected that a rejecting answer
+// stands for, or nil.
+func (resp hookResponse) rejection() error {
+	switch {
+	case !resp.Reject:
+		return nil
+	case resp.Reason == "":
+		return errHookRejected
+	}
+	return fmt.Errorf("%w: %s", errHookRejected, resp.Reason)
+}
+
+// Jobs that don't convert through performConversion, such as montages, diffs,
+// screenshots and archive merges, run the pre hook on each uploaded input with
+// the helpers below, and storeFile and storeFileFromPath run the post hook on
+// every output they store unless performConversion already did.
+
+// inputHookEvent describes an uploaded input of a job to the pre hook.
+func inputHookEvent(name, targetFormat string, head []byte) hookEvent {
+	fileType, ext := DetectFileType(head, name)
+	return hookEvent{Stage: hookPre, FileName: name, FileType: fileType, SourceFormat: ext, TargetFormat: targetFormat}
+}
+
+// outputHookEvent describes a job's output to the post hook.
+func outputHookEvent(originalName, outputName string, head []byte) hookEvent {
+	fileType, ext := DetectFileType(head, outputName)
+	return hookEvent{Stage: hookPost, FileName: originalName, FileType: fileType, SourceFormat: fileFormat(originalName), TargetFormat: ext, OutputName: outputName}
+}
+
+// hookInput runs the pre hook on an uploaded input held in memory, returning it
+// as the hook left it.
+func hookInput(ctx context.Context, name, targetFormat string, data []byte, report *ConversionReport) ([]byte, error) {
+	if conversionHooks.pre == nil {
+		return data, nil
+	}
+	return conversionHooks.runStage(ctx, conversionDeadlines.Hook, inputHookEvent(name, targetFormat, data), data, report)
+}
+
+// hookInputFile runs the pre hook on an uploaded input written to path.
+func hookInputFile(ctx context.Context, name, targetFormat, path string, report *ConversionReport) error {
+	if conversionHooks.pre == nil {
+		return nil
+	}
+	return conversionHooks.runStageFile(ctx, conversionDeadlines.Hook, inputHookEvent(name, targetFormat, fileHead(path)), path, report)
+}
+
+// fileHead returns the first bytes of a file, enough to sniff its type, or
+// nothing if it can't be read.
+func fileHead(path string) []byte {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	return head[:n]
+}
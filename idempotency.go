@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"mime/multipart"
+	"net/http"
+	"slices"
+	"time"
+)
+
+const (
+	// idempotencyHeader is the request header clients set to make a POST safe to retry.
+	idempotencyHeader = "Idempotency-Key"
+	// defaultIdempotencyWindow is how long a key's response is replayed at most;
+	// override with FILECONVERTER_IDEMPOTENCY_WINDOW. A response is never replayed
+	// after the file it describes is gone.
+	defaultIdempotencyWindow = 24 * time.Hour
+	// maxIdempotencyKeyLength bounds the keys clients may send.
+	maxIdempotencyKeyLength = 255
+)
+
+// idempotencyRecord is the outcome of a request made with an idempotency key.
+// Records are kept in memory only, so they are lost when the server restarts.
+type idempotencyRecord struct {
+	fingerprint [sha256.Size]byte // Hash of the request's form, to catch reused keys
+	done        bool              // False while the original request is still running
+	status      int
+	contentType string
+	body        []byte
+	fileID      string // File the response describes, if any
+	expiry      time.Time
+}
+
+// liveLocked reports whether a record may still be replayed: its window hasn't
+// passed and the file its response names hasn't expired or been deleted.
+// This function expects the lock to be already held.
+func (fs *FileStore) liveLocked(rec *idempotencyRecord, now time.Time) bool {
+	if now.After(rec.expiry) {
+		return false
+	}
+	if rec.fileID == "" {
+		return true
+	}
+	meta, ok := fs.files[rec.fileID]
+	return ok && !meta.expired(now)
+}
+
+// reserveIdempotencyKey claims key for a new request. If the key is already known
+// the existing record is returned instead and nothing is reserved.
+func (fs *FileStore) reserveIdempotencyKey(key string) (*idempotencyRecord, bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if rec, ok := fs.idempotency[key]; ok && fs.liveLocked(rec, time.Now()) {
+		copied := *rec
+		return &copied, false
+	}
+	fs.idempotency[key] = &idempotencyRecord{expiry: time.Now().Add(fs.idempotencyWindow)}
+	return nil, true
+}
+
+// completeIdempotencyKey stores the response of a reserved key so retries replay it.
+func (fs *FileStore) completeIdempotencyKey(key string, rec idempotencyRecord) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	rec.done = true
+	rec.expiry = time.Now().Add(fs.idempotencyWindow)
+	fs.idempotency[key] = &rec
+}
+
+// releaseIdempotencyKey forgets a reserved key, letting the client retry with it.
+func (fs *FileStore) releaseIdempotencyKey(key string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	delete(fs.idempotency, key)
+}
+
+// cleanupIdempotencyKeys drops records that can no longer be replayed.
+// This function expects the lock to be already held.
+func (fs *FileStore) cleanupIdempotencyKeys(now time.Time) {
+	for key, rec := range fs.idempotency {
+		if !fs.liveLocked(rec, now) {
+			delete(fs.idempotency, key)
+		}
+	}
+}
+
+// responseRecorder captures what a handler writes so it can be stored for replay.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	rr.status = status
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController and notFound reach the underlying writer.
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	rr.body.Write(b)
+	return rr.ResponseWriter.Write(b)
+}
+
+// idempotent makes a POST handler honour the Idempotency-Key header: the first
+// successful response for a key is kept and replayed for repeats while the file
+// it created is still stored, up to the window, so a client retrying after a
+// network error doesn't convert twice.
+// Keys are scoped to the route and API key, failed requests don't consume their key, and a
+// key reused with a different request is rejected.
+func idempotent(fs *FileStore, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyHeader)
+		if key == "" || r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+		scoped := r.URL.Path + " " + apiKeyID(r) + " " + key
+
+		if rec, reserved := fs.reserveIdempotencyKey(scoped); !reserved {
+			replayIdempotentResponse(w, r, rec)
+			return
+		}
+
+		rr := &responseRecorder{ResponseWriter: w}
+		next(rr, r)
+
+		if rr.status < 200 || rr.status > 299 {
+			fs.releaseIdempotencyKey(scoped)
+			return
+		}
+		var created struct {
+			FileID string `json:"fileId"`
+		}
+		json.Unmarshal(rr.body.Bytes(), &created)
+		fs.completeIdempotencyKey(scoped, idempotencyRecord{
+			fingerprint: requestFingerprint(r),
+			status:      rr.status,
+			contentType: rr.Header().Get("Content-Type"),
+			body:        rr.body.Bytes(),
+			fileID:      created.FileID,
+		})
+	}
+}
+
+// requestFingerprint hashes the form values and uploaded files of a request. It
+// works on the parsed form rather than the raw body because clients usually pick
+// a new multipart boundary when they retry.
+func requestFingerprint(r *http.Request) [sha256.Size]byte {
+	if r.MultipartForm == nil && r.PostForm == nil {
+		if err := r.ParseMultipartForm(multipartMemory); err == http.ErrNotMultipart {
+			r.ParseForm()
+		}
+	}
+
+	values := r.PostForm
+	var files map[string][]*multipart.FileHeader
+	if r.MultipartForm != nil {
+		values, files = r.MultipartForm.Value, r.MultipartForm.File
+	}
+
+	hash := sha256.New()
+	for _, name := range slices.Sorted(maps.Keys(values)) {
+		fmt.Fprintf(hash, "value %q %q\n", name, values[name])
+	}
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		for _, header := range files[name] {
+			fmt.Fprintf(hash, "file %q %q %d\n", name, header.Filename, header.Size)
+			if f, err := header.Open(); err == nil {
+				io.Copy(hash, f)
+				f.Close()
+			}
+		}
+	}
+
+	var sum [sha256.Size]byte
+	copy(sum[:], hash.Sum(nil))
+	return sum
+}
+
+// replayIdempotentResponse answers a repeated key with the stored response, after
+// checking that the retry carries the same form values and files as the original.
+func replayIdempotentResponse(w http.ResponseWriter, r *http.Request, rec *idempotencyRecord) {
+	if !rec.done {
+		http.Error(w, "A request with this Idempotency-Key is still being processed", http.StatusConflict)
+		return
+	}
+
+	if requestFingerprint(r) != rec.fingerprint {
+		http.Error(w, "Idempotency-Key was already used for a different request", http.StatusUnprocessableEntity)
+		return
+	}
+
+	log.Printf("Replaying response for repeated Idempotency-Key on %s", r.URL.Path)
+	w.Header().Set("Idempotent-Replayed", "true")
+	if rec.contentType != "" {
+		w.Header().Set("Content-Type", rec.contentType)
+	}
+	w.WriteHeader(rec.status)
+	w.Write(rec.body)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// smartCropAnalysisSize is the longest edge images are scaled to before smart-crop analysis.
+// Scoring a thumbnail is much cheaper and gives practically the same crop window.
+const smartCropAnalysisSize = 256
+
+// applyImageOptions applies the image-related conversion options (crop, aspect ratio, caption) to img.
+func applyImageOptions(img image.Image, opts ConversionOptions) (image.Image, error) {
+	if opts.Crop != nil {
+		if !opts.Crop.In(img.Bounds().Sub(img.Bounds().Min)) {
+			return nil, fmt.Errorf("crop rectangle %v is outside the image bounds %v", *opts.Crop, img.Bounds().Size())
+		}
+		img = imaging.Crop(img, opts.Crop.Add(img.Bounds().Min))
+	}
+
+	if opts.AspectW > 0 && opts.AspectH > 0 {
+		img = cropToAspect(img, opts.AspectW, opts.AspectH, opts.Gravity)
+	}
+
+	// Captions go on last so they are laid out against the final frame.
+	return drawCaption(img, opts)
+}
+
+// cropToAspect crops img to the largest rectangle with the given aspect ratio,
+// positioned according to gravity.
+func cropToAspect(img image.Image, aspectW, aspectH int, gravity string) image.Image {
+	size := img.Bounds().Size()
+	cropW, cropH := size.X, size.X*aspectH/aspectW
+	if cropH > size.Y {
+		cropW, cropH = size.Y*aspectW/aspectH, size.Y
+	}
+	if cropW <= 0 || cropH <= 0 || (cropW == size.X && cropH == size.Y) {
+		return img
+	}
+
+	switch gravity {
+	case "entropy", "attention":
+		offset := smartCropOffset(img, cropW, cropH, gravity)
+		var rect image.Rectangle
+		if cropW < size.X {
+			rect = image.Rect(offset, 0, offset+cropW, cropH)
+		} else {
+			rect = image.Rect(0, offset, cropW, offset+cropH)
+		}
+		return imaging.Crop(img, rect.Add(img.Bounds().Min))
+	default:
+		return imaging.CropAnchor(img, cropW, cropH, gravityAnchors[gravity])
+	}
+}
+
+// gravityAnchors maps compass gravities to imaging anchors.
+var gravityAnchors = map[string]imaging.Anchor{
+	"center":    imaging.Center,
+	"north":     imaging.Top,
+	"south":     imaging.Bottom,
+	"east":      imaging.Right,
+	"west":      imaging.Left,
+	"northeast": imaging.TopRight,
+	"northwest": imaging.TopLeft,
+	"southeast": imaging.BottomRight,
+	"southwest": imaging.BottomLeft,
+}
+
+// smartCropOffset finds the offset (in source pixels, along the axis being cropped)
+// of the crop window that scores best for the given strategy. Because the crop
+// always keeps one full dimension, the search is one-dimensional.
+func smartCropOffset(img image.Image, cropW, cropH int, strategy string) int {
+	size := img.Bounds().Size()
+	small := imaging.Fit(img, smartCropAnalysisSize, smartCropAnalysisSize, imaging.Box)
+	scale := float64(small.Bounds().Dx()) / float64(size.X)
+
+	horizontal := cropW < size.X
+	var full, window int
+	if horizontal {
+		full, window = small.Bounds().Dx(), int(math.Round(float64(cropW)*scale))
+	} else {
+		full, window = small.Bounds().Dy(), int(math.Round(float64(cropH)*scale))
+	}
+	if window <= 0 || window >= full {
+		return 0
+	}
+
+	var best int
+	if strategy == "entropy" {
+		best = bestEntropyWindow(small, window, horizontal)
+	} else {
+		best = bestAttentionWindow(small, window, horizontal)
+	}
+
+	offset := int(math.Round(float64(best) / scale))
+	limit := size.X - cropW
+	if !horizontal {
+		limit = size.Y - cropH
+	}
+	return max(0, min(offset, limit))
+}
+
+// luminance returns the 0-255 luma value of the pixel at (x, y) of an NRGBA image.
+func luminance(img *image.NRGBA, x, y int) uint8 {
+	i := img.PixOffset(x, y)
+	r, g, b := float64(img.Pix[i]), float64(img.Pix[i+1]), float64(img.Pix[i+2])
+	return uint8(0.299*r + 0.587*g + 0.114*b)
+}
+
+// bestEntropyWindow returns the window start with the highest luminance histogram entropy,
+// which favours detailed regions over flat backgrounds.
+func bestEntropyWindow(img *image.NRGBA, window int, horizontal bool) int {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	full := h
+	if horizontal {
+		full = w
+	}
+
+	bestStart, bestScore := 0, -1.0
+	for start := 0; start+window <= full; start++ {
+		x0, x1, y0, y1 := 0, w, start, start+window
+		if horizontal {
+			x0, x1, y0, y1 = start, start+window, 0, h
+		}
+
+		var hist [256]int
+		total := 0
+		for y := y0; y < y1; y++ {
+			for x := x0; x < x1; x++ {
+				hist[luminance(img, x, y)]++
+				total++
+			}
+		}
+
+		entropy := 0.0
+		for _, count := range hist {
+			if count == 0 {
+				continue
+			}
+			p := float64(count) / float64(total)
+			entropy -= p * math.Log2(p)
+		}
+		if entropy > bestScore {
+			bestStart, bestScore = start, entropy
+		}
+	}
+	return bestStart
+}
+
+// bestAttentionWindow returns the window start with the most "interesting" content,
+// scored as a saliency approximation: edge strength plus colour saturation per pixel.
+func bestAttentionWindow(img *image.NRGBA, window int, horizontal bool) int {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	full := h
+	if horizontal {
+		full = w
+	}
+
+	// Accumulate per-line saliency along the crop axis.
+	lines := make([]float64, full)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			l := float64(luminance(img, x, y))
+			var edge float64
+			if x > 0 && y > 0 && x < w-1 && y < h-1 {
+				edge = math.Abs(4*l -
+					float64(luminance(img, x-1, y)) - float64(luminance(img, x+1, y)) -
+					float64(luminance(img, x, y-1)) - float64(luminance(img, x, y+1)))
+			}
+
+			i := img.PixOffset(x, y)
+			r, g, b := float64(img.Pix[i]), float64(img.Pix[i+1]), float64(img.Pix[i+2])
+			saturation := math.Max(r, math.Max(g, b)) - math.Min(r, math.Min(g, b))
+
+			pos := y
+			if horizontal {
+				pos = x
+			}
+			lines[pos] += edge + 0.5*saturation
+		}
+	}
+
+	// Slide the window over the per-line scores.
+	score := 0.0
+	for i := 0; i < window; i++ {
+		score += lines[i]
+	}
+	bestStart, bestScore := 0, score
+	for start := 1; start+window <= full; start++ {
+		score += lines[start+window-1] - lines[start-1]
+		if score > bestScore {
+			bestStart, bestScore = start, score
+		}
+	}
+	return bestStart
+}
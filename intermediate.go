@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Some conversions are chained: the output of one step is the input of the next,
+// such as SVG rasterized to PNG and then encoded to WebP by FFmpeg. The format in
+// between is an intermediate; a lossy one degrades the result before the final
+// encoding does, so lossless ones are used unless the operator decides otherwise.
+
+// imageIntermediate is a format images are handed to external encoders in.
+type imageIntermediate struct {
+	name     string
+	format   imaging.Format
+	demuxer  string // FFmpeg's demuxer reading the format from a pipe
+	lossless bool
+}
+
+// imageIntermediates are the formats FILECONVERTER_IMAGE_INTERMEDIATE may name.
+var imageIntermediates = map[string]imageIntermediate{
+	"png":  {name: "png", format: imaging.PNG, demuxer: "png_pipe", lossless: true},
+	"tiff": {name: "tiff", format: imaging.TIFF, demuxer: "tiff_pipe", lossless: true},
+	"bmp":  {name: "bmp", format: imaging.BMP, demuxer: "bmp_pipe", lossless: true},
+	"jpg":  {name: "jpg", format: imaging.JPEG, demuxer: "jpeg_pipe"}, // Smaller and faster, but lossy
+}
+
+// intermediateImage is the configured image intermediate.
+var intermediateImage = imageIntermediates["png"]
+
+// loadImageIntermediate reads the image intermediate from
+// FILECONVERTER_IMAGE_INTERMEDIATE, which defaults to png.
+func loadImageIntermediate() (imageIntermediate, error) {
+	name := strings.ToLower(os.Getenv("FILECONVERTER_IMAGE_INTERMEDIATE"))
+	if name == "" {
+		return imageIntermediates["png"], nil
+	}
+	if name == "jpeg" {
+		name = "jpg"
+	}
+	im, ok := imageIntermediates[name]
+	if !ok {
+		return imageIntermediate{}, fmt.Errorf("FILECONVERTER_IMAGE_INTERMEDIATE must be one of png, tiff, bmp or jpg, not %q", name)
+	}
+	return im, nil
+}
+
+// IntermediateStep records a format a chained conversion passed through, so
+// quality-sensitive users can audit the chain.
+type IntermediateStep struct {
+	Format   string `json:"format"`   // e.g. png or html
+	Lossless bool   `json:"lossless"` // Whether converting into it kept every detail
+	Into     string `json:"into"`     // The step that read it, e.g. "WebP encoding"
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// trustedProxies are the reverse proxies whose X-Forwarded-For headers are
+// believed, from FILECONVERTER_TRUSTED_PROXIES.
+var trustedProxies []netip.Prefix
+
+// clientIP returns the address of the client that made the request. Behind
+// trusted proxies it is the last X-Forwarded-For hop not added by one of them.
+func clientIP(r *http.Request) netip.Addr {
+	addr, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}
+	}
+	ip := addr.Addr().Unmap()
+	if !inPrefixes(ip, trustedProxies) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break // A garbled header can't be trusted any further
+		}
+		ip = hop.Unmap()
+		if !inPrefixes(ip, trustedProxies) {
+			break
+		}
+	}
+	return ip
+}
+
+// inPrefixes reports whether ip lies in any of the prefixes.
+func inPrefixes(ip netip.Addr, prefixes []netip.Prefix) bool {
+	for _, p := range prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePrefixes parses a comma-separated list of CIDRs or single addresses.
+func parsePrefixes(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q: %w", entry, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", entry, err)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// parseCountries parses a comma-separated list of ISO 3166 country codes.
+func parseCountries(list string) map[string]bool {
+	countries := make(map[string]bool)
+	for _, code := range strings.Split(list, ",") {
+		if code = strings.ToUpper(strings.TrimSpace(code)); code != "" {
+			countries[code] = true
+		}
+	}
+	return countries
+}
+
+// ipFilter admits or refuses clients by address and, with a GeoIP database, by
+// country. Denials win over allowances.
+type ipFilter struct {
+	allow []netip.Prefix // If set, only these clients are admitted
+	deny  []netip.Prefix
+
+	geo              *geoip2.Reader
+	blockedCountries map[string]bool
+	allowedCountries map[string]bool // If set, clients in other or unknown countries are refused
+}
+
+// loadIPFilter configures the filter from FILECONVERTER_ALLOW_CIDRS,
+// FILECONVERTER_DENY_CIDRS and, for country blocking, FILECONVERTER_GEOIP_DB (a
+// MaxMind country database) with FILECONVERTER_BLOCKED_COUNTRIES or
+// FILECONVERTER_ALLOWED_COUNTRIES. It returns nil when nothing is configured.
+func loadIPFilter() (*ipFilter, error) {
+	f := &ipFilter{
+		blockedCountries: parseCountries(os.Getenv("FILECONVERTER_BLOCKED_COUNTRIES")),
+		allowedCountries: parseCountries(os.Getenv("FILECONVERTER_ALLOWED_COUNTRIES")),
+	}
+	var err error
+	if f.allow, err = parsePrefixes(os.Getenv("FILECONVERTER_ALLOW_CIDRS")); err != nil {
+		return nil, fmt.Errorf("FILECONVERTER_ALLOW_CIDRS: %w", err)
+	}
+	if f.deny, err = parsePrefixes(os.Getenv("FILECONVERTER_DENY_CIDRS")); err != nil {
+		return nil, fmt.Errorf("FILECONVERTER_DENY_CIDRS: %w", err)
+	}
+
+	countryRules := len(f.blockedCountries) > 0 || len(f.allowedCountries) > 0
+	if path := os.Getenv("FILECONVERTER_GEOIP_DB"); path != "" {
+		if f.geo, err = geoip2.Open(path); err != nil {
+			return nil, fmt.Errorf("failed to open GeoIP database: %w", err)
+		}
+	} else if countryRules {
+		return nil, fmt.Errorf("country blocking requires FILECONVERTER_GEOIP_DB")
+	}
+
+	if len(f.allow) == 0 && len(f.deny) == 0 && !countryRules {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// admits reports whether a client may use the service, and if not, why.
+func (f *ipFilter) admits(ip netip.Addr) (bool, string) {
+	if !ip.IsValid() {
+		return false, "unknown client address"
+	}
+	if inPrefixes(ip, f.deny) {
+		return false, "address is denied"
+	}
+	if len(f.allow) > 0 && !inPrefixes(ip, f.allow) {
+		return false, "address is not allowed"
+	}
+	if f.geo == nil || (len(f.blockedCountries) == 0 && len(f.allowedCountries) == 0) {
+		return true, ""
+	}
+
+	code := ""
+	if country, err := f.geo.Country(net.IP(ip.AsSlice())); err == nil {
+		code = country.Country.IsoCode
+	}
+	if f.blockedCountries[code] {
+		return false, "country " + code + " is blocked"
+	}
+	if len(f.allowedCountries) > 0 && !f.allowedCountries[code] {
+		return false, "country " + code + " is not allowed"
+	}
+	return true, ""
+}
+
+// middleware refuses filtered clients with 403 before any handler reads the body.
+func (f *ipFilter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if ok, reason := f.admits(ip); !ok {
+			log.Printf("Refused request from %s to %s: %s", ip, r.URL.Path, reason)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
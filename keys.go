@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of managed keys.
+const (
+	keyKindAPI     = "api"     // Authenticates clients creating files
+	keyKindSigning = "signing" // Signs download URLs
+)
+
+// keyIDPattern restricts key identifiers, which appear in signed URLs and logs.
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// errLastKey is returned when retiring a key would switch its protection off.
+var errLastKey = errors.New("cannot retire the last key of its kind; configure a replacement first")
+
+// managedKey is an API key or URL signing secret, known by its identifier.
+type managedKey struct {
+	ID      string    `json:"id"`
+	Kind    string    `json:"kind"`
+	Created time.Time `json:"created"`
+
+	secret []byte
+}
+
+// keyring holds the active keys. Several keys of a kind may be active at once so
+// they can be rotated without downtime: add the new key everywhere, move clients
+// over, then retire the old one. Links signed with a retired key stop working.
+type keyring struct {
+	mu   sync.RWMutex
+	keys []managedKey // Oldest first; the newest signing key signs new URLs
+}
+
+// keys is the server's keyring. API keys are required, and download URLs signed,
+// only once at least one key of that kind is configured.
+var keys = &keyring{}
+
+// add activates a key.
+func (kr *keyring) add(kind, id string, secret []byte) error {
+	if kind != keyKindAPI && kind != keyKindSigning {
+		return fmt.Errorf("unknown key kind %q (use %s or %s)", kind, keyKindAPI, keyKindSigning)
+	}
+	if !keyIDPattern.MatchString(id) {
+		return fmt.Errorf("key id %q must be 1-64 letters, digits or _.-", id)
+	}
+	if len(secret) < 16 {
+		return fmt.Errorf("secret of key %q must be at least 16 bytes", id)
+	}
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	for _, k := range kr.keys {
+		if k.ID == id {
+			return fmt.Errorf("a key with id %q already exists", id)
+		}
+	}
+	kr.keys = append(kr.keys, managedKey{ID: id, Kind: kind, Created: time.Now(), secret: secret})
+	return nil
+}
+
+// retire deactivates a key, refusing to retire the last one of its kind.
+func (kr *keyring) retire(id string) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	for i, k := range kr.keys {
+		if k.ID != id {
+			continue
+		}
+		if kr.countLocked(k.Kind) == 1 {
+			return errLastKey
+		}
+		kr.keys = append(kr.keys[:i:i], kr.keys[i+1:]...)
+		return nil
+	}
+	return fmt.Errorf("no key with id %q", id)
+}
+
+// countLocked counts the active keys of a kind; the lock must be held.
+func (kr *keyring) countLocked(kind string) int {
+	n := 0
+	for _, k := range kr.keys {
+		if k.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+// enabled reports whether any key of the kind is active.
+func (kr *keyring) enabled(kind string) bool {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.countLocked(kind) > 0
+}
+
+// list returns the active keys without their secrets.
+func (kr *keyring) list() []managedKey {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	list := make([]managedKey, len(kr.keys))
+	for i, k := range kr.keys {
+		k.secret = nil
+		list[i] = k
+	}
+	return list
+}
+
+// lookupAPIKey returns the id of the API key with the given secret.
+func (kr *keyring) lookupAPIKey(secret string) (string, bool) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	for _, k := range kr.keys {
+		if k.Kind == keyKindAPI && subtle.ConstantTimeCompare(k.secret, []byte(secret)) == 1 {
+			return k.ID, true
+		}
+	}
+	return "", false
+}
+
+// signingKey returns the newest signing key.
+func (kr *keyring) signingKey() (managedKey, bool) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	for i := len(kr.keys) - 1; i >= 0; i-- {
+		if kr.keys[i].Kind == keyKindSigning {
+			return kr.keys[i], true
+		}
+	}
+	return managedKey{}, false
+}
+
+// signingSecret returns the secret of the active signing key with the given id.
+func (kr *keyring) signingSecret(id string) ([]byte, bool) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	for _, k := range kr.keys {
+		if k.Kind == keyKindSigning && k.ID == id {
+			return k.secret, true
+		}
+	}
+	return nil, false
+}
+
+// loadKeys adds keys of a kind from a comma-separated "id:secret,id:secret" list,
+// as given in FILECONVERTER_API_KEYS and FILECONVERTER_SIGNING_KEYS. List the
+// newest signing key last.
+func (kr *keyring) loadKeys(kind, list string) error {
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, secret, ok := strings.Cut(entry, ":")
+		if !ok {
+			return fmt.Errorf("%s key %q must look like id:secret", kind, entry)
+		}
+		if err := kr.add(kind, id, []byte(secret)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signature computes the signature of a download URL for a file.
+func signature(secret []byte, fileID string, expires int64) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%d", fileID, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signDownloadPath adds signature parameters valid until expires to a download
+// path, if URL signing is enabled.
+func signDownloadPath(path, fileID string, expires time.Time) string {
+	key, ok := keys.signingKey()
+	if !ok {
+		return path
+	}
+	q := url.Values{}
+	q.Set("kid", key.ID)
+	q.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	q.Set("sig", signature(key.secret, fileID, expires.Unix()))
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return path + sep + q.Encode()
+}
+
+// verifyDownloadSignature checks a download request's signature parameters. It
+// accepts any active signing key, so links stay valid while keys are rotated.
+func verifyDownloadSignature(r *http.Request, fileID string) error {
+	if !keys.enabled(keyKindSigning) {
+		return nil
+	}
+	q := r.URL.Query()
+	secret, ok := keys.signingSecret(q.Get("kid"))
+	if !ok {
+		return fmt.Errorf("download link is not signed or its key was retired")
+	}
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return fmt.Errorf("download link has expired")
+	}
+	if !hmac.Equal([]byte(q.Get("sig")), []byte(signature(secret, fileID, expires))) {
+		return fmt.Errorf("download link signature is invalid")
+	}
+	return nil
+}
+
+// apiKeyContextKey is the request context key holding the caller's API key id.
+type apiKeyContextKey struct{}
+
+// apiKeyID returns the id of the API key the request was made with, if any.
+func apiKeyID(r *http.Request) string {
+	id, _ := r.Context().Value(apiKeyContextKey{}).(string)
+	return id
+}
+
+// requireAPIKey lets only requests with a valid API key through, once API keys
+// are configured. Clients send the key as "Authorization: Bearer <key>" or in an
+// X-API-Key header.
+func requireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !keys.enabled(keyKindAPI) {
+			next(w, r)
+			return
+		}
+		secret := r.Header.Get("X-API-Key")
+		if secret == "" {
+			secret, _ = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		}
+		id, ok := keys.lookupAPIKey(secret)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			http.Error(w, "A valid API key is required", http.StatusUnauthorized)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, id)))
+	}
+}
+
+// handleAdminKeys lists the active keys (GET) or adds one (POST). POST takes a
+// "kind" and optional "id" and "secret" form values; missing ones are generated
+// and the secret is returned once.
+func handleAdminKeys(fs *FileStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			writeJSON(w, http.StatusOK, map[string]any{"keys": keys.list()})
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// The id is public, in signed URLs and logs, so it is generated apart
+		// from the secret rather than cut from it
+		kind, id, secret := r.FormValue("kind"), r.FormValue("id"), r.FormValue("secret")
+		var err error
+		if id == "" {
+			if id, err = generateID(); err != nil {
+				http.Error(w, fmt.Sprintf("Error generating key id: %v", err), http.StatusInternalServerError)
+				return
+			}
+			id = id[:8]
+		}
+		if secret == "" {
+			if secret, err = generateID(); err != nil {
+				http.Error(w, fmt.Sprintf("Error generating key: %v", err), http.StatusInternalServerError)
+				return
+			}
+		}
+		if err = keys.add(kind, id, []byte(secret)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fs.recordAudit(auditEntry{Action: "key added", Reason: kind + " key " + id, Remote: r.RemoteAddr})
+		writeJSON(w, http.StatusCreated, map[string]any{"id": id, "kind": kind, "secret": secret})
+	}
+}
+
+// handleAdminRetireKey retires the key named in the path.
+func handleAdminRetireKey(fs *FileStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if err := keys.retire(id); errors.Is(err, errLastKey) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		fs.recordAudit(auditEntry{Action: "key retired", Reason: "key " + id, Remote: r.RemoteAddr})
+		writeJSON(w, http.StatusOK, map[string]any{"retired": id})
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// maxDetectionText is how much of a document's text language detection reads.
+const maxDetectionText = 64 << 10
+
+// minDetectionHits is the fewest common words a language needs among the text's
+// words to be reported for a text in Latin or Cyrillic script.
+const minDetectionHits = 3
+
+// languageStopwords are frequent short words of the languages told apart by
+// vocabulary; each language is scored by how many of the text's words it has.
+var languageStopwords = map[string][]string{
+	"en": {"the", "and", "of", "to", "is", "in", "that", "it", "for", "with", "was", "on", "are", "this", "be", "you", "not", "have", "but", "from"},
+	"de": {"der", "die", "und", "das", "ist", "nicht", "ich", "zu", "den", "mit", "sich", "des", "auf", "für", "ein", "eine", "auch", "es", "dem", "wir"},
+	"fr": {"le", "la", "les", "et", "des", "est", "une", "que", "pour", "dans", "qui", "pas", "sur", "au", "du", "avec", "ce", "il", "sont", "nous"},
+	"es": {"el", "la", "los", "las", "y", "que", "es", "en", "del", "por", "con", "una", "para", "se", "no", "lo", "como", "más", "pero", "su"},
+	"it": {"il", "di", "che", "e", "la", "per", "non", "sono", "una", "del", "con", "gli", "della", "le", "si", "anche", "come", "ma", "questo", "è"},
+	"pt": {"o", "os", "e", "que", "do", "da", "em", "não", "uma", "para", "com", "se", "dos", "das", "no", "na", "por", "mais", "como", "é"},
+	"nl": {"de", "het", "een", "en", "van", "is", "dat", "niet", "op", "te", "zijn", "met", "voor", "ik", "je", "ook", "maar", "aan", "er", "wordt"},
+	"sv": {"och", "att", "det", "som", "är", "en", "på", "för", "av", "med", "inte", "till", "den", "jag", "har", "om", "ett", "var", "men", "kan"},
+	"da": {"og", "at", "det", "er", "en", "til", "på", "som", "med", "for", "af", "ikke", "den", "de", "har", "jeg", "et", "var", "men", "kan"},
+	"nb": {"og", "at", "det", "er", "en", "til", "på", "som", "med", "for", "av", "ikke", "den", "jeg", "har", "et", "var", "men", "kan", "også"},
+	"fi": {"ja", "on", "ei", "se", "että", "hän", "oli", "ole", "mutta", "kun", "niin", "myös", "tai", "kuin", "ovat", "tämä", "joka", "mitä", "sen", "vain"},
+	"pl": {"i", "w", "nie", "na", "się", "z", "do", "to", "że", "jest", "jak", "co", "ale", "po", "tak", "za", "od", "jego", "przez", "są"},
+	"cs": {"a", "se", "na", "je", "že", "v", "to", "ve", "jsem", "s", "z", "o", "jako", "ale", "by", "pro", "tak", "jsou", "jeho", "není"},
+	"tr": {"ve", "bir", "bu", "da", "de", "için", "ile", "çok", "ne", "ama", "gibi", "daha", "olan", "var", "değil", "mi", "her", "kadar", "sonra", "ben"},
+	"ru": {"и", "в", "не", "на", "что", "с", "по", "это", "как", "он", "к", "но", "из", "у", "за", "от", "так", "же", "все", "было"},
+	"uk": {"і", "в", "на", "не", "що", "та", "з", "до", "як", "це", "у", "й", "за", "від", "але", "є", "для", "його", "так", "було"},
+	"bg": {"и", "на", "да", "се", "в", "не", "за", "от", "че", "е", "с", "по", "са", "като", "това", "ще", "но", "към", "има", "му"},
+}
+
+// stopwordLanguages maps each stop word to the languages that have it.
+var stopwordLanguages = func() map[string][]string {
+	m := map[string][]string{}
+	for lang, words := range languageStopwords {
+		for _, w := range words {
+			m[w] = append(m[w], lang)
+		}
+	}
+	return m
+}()
+
+// languageGuess is the language detected in a document's text.
+type languageGuess struct {
+	Language   string  // ISO 639-1 code, or "und" when undetermined
+	Confidence float64 // Between 0 and 1
+}
+
+// detectLanguage guesses the language of text. Scripts used by a single
+// language, such as Hangul or Greek, decide it outright; Han characters mean
+// Japanese once kana appear among them. Texts in Latin or Cyrillic script are
+// told apart by their most common words.
+func detectLanguage(text string) languageGuess {
+	if len(text) > maxDetectionText {
+		text = text[:maxDetectionText]
+	}
+
+	scripts := map[string]int{}
+	letters := 0
+	var persian, urdu int
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		switch {
+		case unicode.Is(unicode.Latin, r):
+			scripts["latin"]++
+		case unicode.Is(unicode.Cyrillic, r):
+			scripts["cyrillic"]++
+		case unicode.Is(unicode.Hiragana, r), unicode.Is(unicode.Katakana, r):
+			scripts["ja"]++
+		case unicode.Is(unicode.Han, r):
+			scripts["han"]++
+		case unicode.Is(unicode.Hangul, r):
+			scripts["ko"]++
+		case unicode.Is(unicode.Greek, r):
+			scripts["el"]++
+		case unicode.Is(unicode.Hebrew, r):
+			scripts["he"]++
+		case unicode.Is(unicode.Arabic, r):
+			scripts["ar"]++
+			switch r {
+			case 'پ', 'چ', 'ژ', 'گ', 'ی':
+				persian++
+			case 'ٹ', 'ڈ', 'ڑ', 'ں', 'ے':
+				urdu++
+			}
+		case unicode.Is(unicode.Thai, r):
+			scripts["th"]++
+		case unicode.Is(unicode.Devanagari, r):
+			scripts["hi"]++
+		}
+	}
+	if letters == 0 {
+		return languageGuess{Language: "und"}
+	}
+
+	// Kana only ever make up part of Japanese text, so count Han along with them
+	if scripts["ja"] > 0 {
+		scripts["ja"] += scripts["han"]
+		delete(scripts, "han")
+	}
+	script, count := "", 0
+	for s, n := range scripts {
+		if n > count || n == count && s < script {
+			script, count = s, n
+		}
+	}
+	share := round2(float64(count) / float64(letters))
+	switch script {
+	case "latin", "cyrillic":
+		return detectByStopwords(text, script, share)
+	case "han":
+		return languageGuess{Language: "zh", Confidence: share}
+	case "ar":
+		switch {
+		case urdu > 0 && urdu >= persian:
+			return languageGuess{Language: "ur", Confidence: share}
+		case persian > count/50:
+			return languageGuess{Language: "fa", Confidence: share}
+		}
+	}
+	return languageGuess{Language: script, Confidence: share}
+}
+
+// detectByStopwords scores the languages written in script by how many of the
+// text's words are among their stop words. share is the part of the text's
+// letters in that script, which bounds the confidence.
+func detectByStopwords(text, script string, share float64) languageGuess {
+	hits := map[string]int{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && r != '\''
+	}) {
+		for _, lang := range stopwordLanguages[word] {
+			hits[lang]++
+		}
+	}
+
+	type score struct {
+		lang string
+		hits int
+	}
+	var scores []score
+	for lang, n := range hits {
+		cyrillic := lang == "ru" || lang == "uk" || lang == "bg"
+		if cyrillic == (script == "cyrillic") {
+			scores = append(scores, score{lang, n})
+		}
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].hits != scores[j].hits {
+			return scores[i].hits > scores[j].hits
+		}
+		return scores[i].lang < scores[j].lang
+	})
+	if len(scores) == 0 || scores[0].hits < minDetectionHits {
+		return languageGuess{Language: "und"}
+	}
+
+	// Confidence grows with the lead over the runner-up
+	best, second := float64(scores[0].hits), 0.0
+	if len(scores) > 1 {
+		second = float64(scores[1].hits)
+	}
+	return languageGuess{Language: scores[0].lang, Confidence: round2(share * (best - second) / best)}
+}
+
+// round2 rounds f to two decimals.
+func round2(f float64) float64 {
+	return math.Round(f*100) / 100
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// tableLocale describes how numbers and dates are written in a locale. It is
+// used both to read such cells from text input, where "1.234,5" means 1234.5 in
+// German, and to lay them out in XLSX and PDF output.
+type tableLocale struct {
+	tag        string // BCP 47 language tag, empty when only separate options were given
+	decimal    rune
+	group      rune
+	dateFormat string // Pattern such as "DD.MM.YYYY" (see parseDateFormat)
+	rtl        bool   // Sheets and pages read right to left
+
+	parseLayout  string // Go layout that reads dates in dateFormat
+	formatLayout string // Go layout that writes dates in dateFormat
+	excelFormat  string // Excel number format that displays dates in dateFormat
+}
+
+// locales lists the conventions of the supported locales. A tag that is not
+// listed falls back to its language, so "de-AT" is read as "de".
+var locales = map[string]tableLocale{
+	"en":    {decimal: '.', group: ',', dateFormat: "M/D/YYYY"},
+	"en-us": {decimal: '.', group: ',', dateFormat: "M/D/YYYY"},
+	"en-gb": {decimal: '.', group: ',', dateFormat: "DD/MM/YYYY"},
+	"en-au": {decimal: '.', group: ',', dateFormat: "DD/MM/YYYY"},
+	"en-in": {decimal: '.', group: ',', dateFormat: "DD/MM/YYYY"},
+	"en-ca": {decimal: '.', group: ',', dateFormat: "YYYY-MM-DD"},
+	"de":    {decimal: ',', group: '.', dateFormat: "DD.MM.YYYY"},
+	"de-ch": {decimal: '.', group: '\'', dateFormat: "DD.MM.YYYY"},
+	"fr":    {decimal: ',', group: ' ', dateFormat: "DD/MM/YYYY"},
+	"fr-ch": {decimal: '.', group: '\'', dateFormat: "DD.MM.YYYY"},
+	"es":    {decimal: ',', group: '.', dateFormat: "DD/MM/YYYY"},
+	"it":    {decimal: ',', group: '.', dateFormat: "DD/MM/YYYY"},
+	"pt":    {decimal: ',', group: ' ', dateFormat: "DD/MM/YYYY"},
+	"pt-br": {decimal: ',', group: '.', dateFormat: "DD/MM/YYYY"},
+	"nl":    {decimal: ',', group: '.', dateFormat: "DD-MM-YYYY"},
+	"da":    {decimal: ',', group: '.', dateFormat: "DD.MM.YYYY"},
+	"sv":    {decimal: ',', group: ' ', dateFormat: "YYYY-MM-DD"},
+	"nb":    {decimal: ',', group: ' ', dateFormat: "DD.MM.YYYY"},
+	"fi":    {decimal: ',', group: ' ', dateFormat: "D.M.YYYY"},
+	"pl":    {decimal: ',', group: ' ', dateFormat: "DD.MM.YYYY"},
+	"cs":    {decimal: ',', group: ' ', dateFormat: "DD.MM.YYYY"},
+	"ru":    {decimal: ',', group: ' ', dateFormat: "DD.MM.YYYY"},
+	"uk":    {decimal: ',', group: ' ', dateFormat: "DD.MM.YYYY"},
+	"tr":    {decimal: ',', group: '.', dateFormat: "DD.MM.YYYY"},
+	"ja":    {decimal: '.', group: ',', dateFormat: "YYYY/MM/DD"},
+	"zh":    {decimal: '.', group: ',', dateFormat: "YYYY/MM/DD"},
+	"ko":    {decimal: '.', group: ',', dateFormat: "YYYY-MM-DD"},
+	"ar":    {decimal: '.', group: ',', dateFormat: "DD/MM/YYYY", rtl: true},
+	"he":    {decimal: '.', group: ',', dateFormat: "DD.MM.YYYY", rtl: true},
+	"fa":    {decimal: '.', group: ',', dateFormat: "YYYY/MM/DD", rtl: true},
+	"ur":    {decimal: '.', group: ',', dateFormat: "DD/MM/YYYY", rtl: true},
+}
+
+// lookupLocale returns the conventions of a language tag such as "de-CH".
+func lookupLocale(tag string) (tableLocale, bool) {
+	key := strings.ToLower(strings.ReplaceAll(tag, "_", "-"))
+	loc, ok := locales[key]
+	if !ok {
+		lang, _, _ := strings.Cut(key, "-")
+		loc, ok = locales[lang]
+	}
+	loc.tag = strings.ReplaceAll(tag, "_", "-")
+	return loc, ok
+}
+
+// parseLocaleOptions reads the charset, locale, decimalSeparator, dateFormat and
+// rtl form values into opts. The locale sets defaults for the other three.
+func parseLocaleOptions(r *http.Request, opts *ConversionOptions) error {
+	if v := strings.TrimSpace(r.FormValue("charset")); v != "" {
+		enc, err := htmlindex.Get(v)
+		if err != nil {
+			return fmt.Errorf("unknown charset %q", v)
+		}
+		opts.Charset = enc
+	}
+
+	tag := strings.TrimSpace(r.FormValue("locale"))
+	decimal := strings.TrimSpace(r.FormValue("decimalSeparator"))
+	dateFormat := strings.TrimSpace(r.FormValue("dateFormat"))
+	rtl := r.FormValue("rtl")
+	if tag == "" && decimal == "" && dateFormat == "" && rtl == "" {
+		return nil
+	}
+
+	loc := tableLocale{decimal: '.', group: ',', dateFormat: "YYYY-MM-DD"}
+	if tag != "" {
+		var ok bool
+		if loc, ok = lookupLocale(tag); !ok {
+			known := make([]string, 0, len(locales))
+			for k := range locales {
+				known = append(known, k)
+			}
+			sort.Strings(known)
+			return fmt.Errorf("unsupported locale %q (use one of %s)", tag, strings.Join(known, ", "))
+		}
+	}
+
+	switch decimal {
+	case "":
+	case ".", ",":
+		loc.decimal = rune(decimal[0])
+		if loc.group == loc.decimal {
+			loc.group = map[rune]rune{'.': ',', ',': '.'}[loc.decimal]
+		}
+	default:
+		return fmt.Errorf("invalid decimalSeparator %q: must be . or ,", decimal)
+	}
+
+	if dateFormat != "" {
+		loc.dateFormat = dateFormat
+	}
+	var err error
+	if loc.parseLayout, loc.formatLayout, loc.excelFormat, err = parseDateFormat(loc.dateFormat); err != nil {
+		return err
+	}
+
+	if rtl != "" {
+		if loc.rtl, err = strconv.ParseBool(rtl); err != nil {
+			return fmt.Errorf("invalid rtl %q: must be true or false", rtl)
+		}
+	}
+	opts.Locale = &loc
+	return nil
+}
+
+// parseDateFormat turns a date pattern made of YYYY or YY, MM or M and DD or D,
+// separated by spaces, dots, slashes or dashes, into the Go layouts that read
+// and write it and the equivalent Excel number format.
+func parseDateFormat(pattern string) (parse, format, excel string, err error) {
+	var p, f, x strings.Builder
+	seen := map[byte]bool{}
+	for i := 0; i < len(pattern); {
+		c := pattern[i] &^ 0x20 // Upper case
+		n := 1
+		for i+n < len(pattern) && pattern[i+n]&^0x20 == c {
+			n++
+		}
+		switch {
+		case c == 'Y' && (n == 2 || n == 4), c == 'M' && n <= 2, c == 'D' && n <= 2:
+			if seen[c] {
+				return "", "", "", fmt.Errorf("invalid dateFormat %q: %c appears twice", pattern, c)
+			}
+			seen[c] = true
+			layouts := map[string][3]string{
+				"YYYY": {"2006", "2006", "yyyy"}, "YY": {"06", "06", "yy"},
+				"MM": {"1", "01", "mm"}, "M": {"1", "1", "m"},
+				"DD": {"2", "02", "dd"}, "D": {"2", "2", "d"},
+			}[strings.Repeat(string(c), n)]
+			p.WriteString(layouts[0])
+			f.WriteString(layouts[1])
+			x.WriteString(layouts[2])
+		case strings.IndexByte(" ./-", pattern[i]) >= 0:
+			n = 1
+			p.WriteByte(pattern[i])
+			f.WriteByte(pattern[i])
+			x.WriteByte(pattern[i])
+		default:
+			return "", "", "", fmt.Errorf("invalid dateFormat %q: use YYYY, MM and DD separated by spaces, dots, slashes or dashes", pattern)
+		}
+		i += n
+	}
+	if !seen['Y'] || !seen['M'] || !seen['D'] {
+		return "", "", "", fmt.Errorf("invalid dateFormat %q: a year, month and day are needed", pattern)
+	}
+	return p.String(), f.String(), x.String(), nil
+}
+
+// isGroup reports whether r separates digit groups in the locale. Spaces stand
+// for their non-breaking forms too, and apostrophes for typographic ones.
+func (l *tableLocale) isGroup(r rune) bool {
+	switch l.group {
+	case ' ':
+		return r == ' ' || r == '\u00a0' || r == '\u202f'
+	case '\'':
+		return r == '\'' || r == '\u2019'
+	}
+	return r == l.group
+}
+
+// parseNumber reads a cell written like "-1.234,5" in the locale and returns it
+// in the canonical form "-1234.5". Cells that are not, but are canonical already,
+// are taken as they are. Numbers with leading zeros, like "007", are not numbers.
+func (l *tableLocale) parseNumber(cell string) (string, bool) {
+	s := strings.TrimSpace(cell)
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	whole, frac, hasFrac := strings.Cut(s, string(l.decimal))
+	valid := !hasFrac || frac != "" && strings.Trim(frac, "0123456789") == ""
+
+	var groups []string
+	start := 0
+	for i, r := range whole {
+		if l.isGroup(r) {
+			groups = append(groups, whole[start:i])
+			start = i + utf8.RuneLen(r)
+		}
+	}
+	groups = append(groups, whole[start:])
+	for i, g := range groups {
+		if g == "" || strings.Trim(g, "0123456789") != "" || i > 0 && len(g) != 3 || i == 0 && len(groups) > 1 && len(g) > 3 {
+			valid = false
+		}
+	}
+
+	canonical := sign + strings.Join(groups, "")
+	if hasFrac {
+		canonical += "." + frac
+	}
+	if valid && jsonNumberPattern.MatchString(canonical) {
+		return canonical, true
+	}
+	if s := strings.TrimSpace(cell); jsonNumberPattern.MatchString(s) {
+		return s, true
+	}
+	return "", false
+}
+
+// formatNumber writes a canonical number with the locale's decimal separator.
+// Digits are not grouped, as in a spreadsheet's General format, so that years
+// and identifiers read as they should.
+func (l *tableLocale) formatNumber(canonical string) string {
+	if l.decimal == '.' {
+		return canonical
+	}
+	return strings.Replace(canonical, ".", string(l.decimal), 1)
+}
+
+// parseDate reads a cell holding a date in the locale's format, or in ISO 8601.
+func (l *tableLocale) parseDate(cell string) (time.Time, bool) {
+	s := strings.TrimSpace(cell)
+	for _, layout := range []string{"2006-01-02", l.parseLayout} {
+		if d, err := time.Parse(layout, s); err == nil {
+			return d, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// dir returns the HTML text direction of the locale.
+func (l *tableLocale) dir() string {
+	if l.rtl {
+		return "rtl"
+	}
+	return "ltr"
+}
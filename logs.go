@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// maxLogLineLength is the longest log line accepted; longer lines fail the conversion.
+const maxLogLineLength = 1 << 20
+
+// logFormats are the built-in log line patterns. Each named group becomes a column.
+var logFormats = map[string]*regexp.Regexp{
+	// Apache/Nginx "combined" format: common plus referer and user agent
+	"combined": regexp.MustCompile(`^(?P<remote_addr>\S+) (?P<ident>\S+) (?P<remote_user>\S+) \[(?P<time>[^\]]+)\] "(?:(?P<method>[A-Z]+) (?P<path>\S+) (?P<protocol>[^"]*)|[^"]*)" (?P<status>\d{3}) (?P<bytes>\S+) "(?P<referer>[^"]*)" "(?P<user_agent>[^"]*)"`),
+	// Apache/Nginx "common" log format
+	"common": regexp.MustCompile(`^(?P<remote_addr>\S+) (?P<ident>\S+) (?P<remote_user>\S+) \[(?P<time>[^\]]+)\] "(?:(?P<method>[A-Z]+) (?P<path>\S+) (?P<protocol>[^"]*)|[^"]*)" (?P<status>\d{3}) (?P<bytes>\S+)`),
+	// BSD syslog (RFC 3164), e.g. "Oct 14 19:17:06 host sshd[42]: message"
+	"syslog": regexp.MustCompile(`^(?:<(?P<priority>\d{1,3})>)?(?P<timestamp>[A-Z][a-z]{2} [ \d]\d \d{2}:\d{2}:\d{2}) (?P<host>\S+) (?P<program>[^\s:\[]+)(?:\[(?P<pid>\d+)\])?: ?(?P<message>.*)$`),
+	// IETF syslog (RFC 5424), without parsing structured data elements
+	"rfc5424": regexp.MustCompile(`^<(?P<priority>\d{1,3})>1 (?P<timestamp>\S+) (?P<host>\S+) (?P<program>\S+) (?P<pid>\S+) (?P<msgid>\S+) (?P<structured_data>-|\[.*?\]) ?(?P<message>.*)$`),
+}
+
+// logDetectOrder is the order formats are tried in when the format is "auto";
+// combined comes before common because every combined line also matches common.
+var logDetectOrder = []string{"combined", "common", "rfc5424", "syslog"}
+
+// convertLog extracts fields from a log file into a CSV or JSON table. Lines are
+// parsed with opts.LogPattern if given, otherwise with the chosen (or detected)
+// built-in format; lines that don't match are skipped.
+func convertLog(ctx context.Context, inputFileBytes []byte, outputFilename, sourceExt, targetFormat string, opts ConversionOptions) ([]byte, string, error) {
+	format := opts.LogFormat
+	switch {
+	case opts.LogPattern != nil:
+		format = "custom"
+	case sourceExt == "jsonl" || sourceExt == "ndjson":
+		format = "jsonl"
+	}
+
+	sc := bufio.NewScanner(bytes.NewReader(inputFileBytes))
+	sc.Buffer(make([]byte, 64*1024), maxLogLineLength)
+
+	t := &table{}
+	var pattern *regexp.Regexp
+	var index map[string]int
+	var records []map[string]string
+	skipped := 0
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if opts.RowLimit > 0 && len(t.Rows)+len(records) >= opts.RowLimit {
+			break
+		}
+
+		// The first line decides the format when it's left to auto-detection.
+		if format == "auto" {
+			if format = detectLogFormat(line); format == "" {
+				return nil, "", fmt.Errorf("could not detect the log format; set logFormat or logPattern")
+			}
+		}
+
+		if format == "jsonl" {
+			if index == nil {
+				index = map[string]int{}
+			}
+			dec := json.NewDecoder(strings.NewReader(line))
+			dec.UseNumber()
+			record, err := readJSONObject(dec, t, index)
+			if err != nil {
+				skipped++
+				continue
+			}
+			records = append(records, record)
+			continue
+		}
+
+		if pattern == nil {
+			pattern = opts.LogPattern
+			if pattern == nil {
+				pattern = logFormats[format]
+			}
+			for _, name := range pattern.SubexpNames()[1:] {
+				if name != "" {
+					t.Columns = append(t.Columns, name)
+				}
+			}
+		}
+		m := pattern.FindStringSubmatch(line)
+		if m == nil {
+			skipped++
+			continue
+		}
+		row := make([]string, 0, len(t.Columns))
+		for i, name := range pattern.SubexpNames()[1:] {
+			if name != "" {
+				row = append(row, m[i+1])
+			}
+		}
+		t.Rows = append(t.Rows, row)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, "", fmt.Errorf("failed to read log: %w", err)
+	}
+	t.fillRows(records, index)
+
+	if skipped > 0 {
+		log.Printf("Skipped %d log lines that did not match the %s format", skipped, format)
+	}
+	if len(t.Rows) == 0 {
+		return nil, "", fmt.Errorf("no log lines matched the %s format", format)
+	}
+	if err := t.applyColumnOptions(opts); err != nil {
+		return nil, "", err
+	}
+	out, err := writeTable(t, targetFormat)
+	return out, outputFilename, err
+}
+
+// detectLogFormat guesses the format of a log line, returning "" if nothing matches.
+func detectLogFormat(line string) string {
+	if strings.HasPrefix(strings.TrimSpace(line), "{") {
+		return "jsonl"
+	}
+	for _, name := range logDetectOrder {
+		if logFormats[name].MatchString(line) {
+			return name
+		}
+	}
+	return ""
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
 	_ "image/gif"
 	_ "image/jpeg"
@@ -15,6 +17,8 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -22,7 +26,8 @@ import (
 )
 
 const (
-	// fileExpiryDuration is how long files are kept before being cleaned up.
+	// fileExpiryDuration is how long files are kept before being cleaned up, unless
+	// a retention policy says otherwise.
 	fileExpiryDuration = 10 * time.Minute
 	// ramLimitBytes is the approximate limit for storing files in RAM (16 GB).
 	ramLimitBytes = 16 * 1024 * 1024 * 1024
@@ -33,8 +38,18 @@ const (
 	// Example: "/dev/shm/fileconverter_temp"
 	// IMPORTANT: Ensure this directory exists and the server has write permissions.
 	defaultDiskPath = "temp_files" // Relative to where the app is run
+	// multipartMemory is how much of a multipart request is kept in memory; larger
+	// uploads are spooled to temporary files.
+	multipartMemory = 32 << 20
+	// maxStreamedRAMFile is the largest file written to disk by a conversion that
+	// is still moved into RAM storage.
+	maxStreamedRAMFile = 64 << 20
 )
 
+// maxUploadSize is the largest request accepted, to prevent abuse. It defaults
+// to 500 MB; FILECONVERTER_MAX_UPLOAD_MB raises it for e.g. multi-gigabyte archives.
+var maxUploadSize int64 = 500 << 20
+
 // FileMetadata stores information about an uploaded file.
 type FileMetadata struct {
 	ID            string    `json:"id"`
@@ -46,15 +61,69 @@ type FileMetadata struct {
 	IsInMemory    bool      `json:"isInMemory"`
 	Path          string    `json:"-"` // Path if stored on disk, not exposed in JSON
 	ContentType   string    `json:"contentType"`
+
+	Status   string         `json:"status"`          // jobCompleted or jobFailed
+	Error    string         `json:"error,omitempty"` // What kind of failure ended the job
+	Commands []CommandTrace `json:"commands,omitempty"`
+
+	Redactions []RedactionCount `json:"redactions,omitempty"` // What each redaction rule removed
+	Language   *LanguageReport  `json:"language,omitempty"`   // Set if the language was detected
+
+	Intermediates []IntermediateStep `json:"intermediates,omitempty"` // Formats a chained conversion passed through
+
+	Tags   map[string]string `json:"tags,omitempty"`   // Client-supplied key/value labels
+	APIKey string            `json:"apiKey,omitempty"` // Id of the API key that created the file
+	Hold   *legalHold        `json:"hold,omitempty"`   // Set while exempt from expiry
+
+	Workspace string `json:"workspace,omitempty"` // Id of the workspace the file was created in, if any
+
+	Moderation *moderationResult `json:"moderation,omitempty"` // Set if the upload was moderated
+	Receipt    string            `json:"receipt,omitempty"`    // Signed JWT describing the conversion, if requested
+
+	ShortCode      string            `json:"shortCode,omitempty"` // Optional code standing in for the ID
+	ShareToken     string            `json:"-"`                   // Grants downloads; embedded in download URLs
+	OwnerTokenHash [sha256.Size]byte `json:"-"`                   // Hash of the token that may also delete the file
+	ownerToken     string            // Only set on the copy returned when the file is created
+
+	torrent *torrentHash // Set once a torrent of the file has been asked for
 }
 
+// Job statuses. Failed conversions keep a content-less record so their error and
+// command traces can still be looked up by ID.
+const (
+	jobCompleted = "completed"
+	jobFailed    = "failed"
+)
+
 // FileStore manages the storage of files, either in RAM or on disk.
 type FileStore struct {
 	mu              sync.Mutex
 	files           map[string]*FileMetadata // fileID -> metadata
+	trash           map[string]*trashedFile  // fileID -> deleted file that can still be restored
+	undoWindow      time.Duration            // How long deleted files stay in the trash
 	ramStore        map[string][]byte        // fileID -> file content
 	currentRAMUsage int64
 	diskPath        string
+
+	idempotency       map[string]*idempotencyRecord // route + Idempotency-Key -> response, in memory only
+	idempotencyWindow time.Duration
+
+	retention retentionPolicy // Decides each new file's expiry time
+	audit     []auditEntry    // Administrative actions such as legal holds
+
+	maintenance maintenanceState // Read-only mode refusing new files
+	disk        diskReport       // Disk path checks from the startup preflight
+
+	limits     fileLimits // Caps on the number of stored files
+	diskFiles  int        // Number of stored files on disk
+	lastPurged time.Time  // When reserveFileSlot last purged expired files
+
+	shortCodes map[string]string // Short download code -> fileID
+
+	workspaces map[string]*workspace // workspaceID -> multi-step editing session
+
+	abuse     *abuseGuard       // Bans clients that keep failing
+	moderator *contentModerator // Classifies uploaded media; nil when disabled
 }
 
 // NewFileStore creates a new FileStore.
@@ -75,14 +144,31 @@ func NewFileStore(diskPath string) *FileStore {
 
 	fs := &FileStore{
 		files:           make(map[string]*FileMetadata),
+		trash:           make(map[string]*trashedFile),
+		undoWindow:      envDuration("FILECONVERTER_UNDO_WINDOW", defaultUndoWindow),
 		ramStore:        make(map[string][]byte),
 		currentRAMUsage: 0,
 		diskPath:        diskPath,
+
+		idempotency:       make(map[string]*idempotencyRecord),
+		idempotencyWindow: envDuration("FILECONVERTER_IDEMPOTENCY_WINDOW", defaultIdempotencyWindow),
+
+		shortCodes: make(map[string]string),
+		workspaces: make(map[string]*workspace),
+		limits:     loadFileLimits(),
+
+		retention: defaultRetention(),
+		abuse:     newAbuseGuard(),
 	}
-	go fs.cleanupRoutine()
 	return fs
 }
 
+// startBackgroundRoutines starts the routines that expire files and sweep the disk.
+func (fs *FileStore) startBackgroundRoutines() {
+	go fs.cleanupRoutine()
+	go fs.sweepRoutine()
+}
+
 // generateID creates a unique ID for a file.
 func generateID() (string, error) {
 	b := make([]byte, 16) // 128-bit random ID
@@ -92,51 +178,172 @@ func generateID() (string, error) {
 	return hex.EncodeToString(b), nil
 }
 
-// AddFile stores an uploaded file.
-func (fs *FileStore) AddFile(file multipart.File, header *multipart.FileHeader, targetFormat string) (*FileMetadata, error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-
-	fileID, err := generateID()
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate file ID: %w", err)
+// AddFile stores an uploaded file. If the conversion fails, a failed job record is
+// kept and returned along with the error so the caller can report its ID.
+func (fs *FileStore) AddFile(ctx context.Context, file multipart.File, header *multipart.FileHeader, targetFormat string, opts ConversionOptions, attrs jobAttributes) (*FileMetadata, error) {
+	// Archives and large tables can be far larger than memory and are converted
+	// file to file. Hooks are given the files on disk, and moderation classifies
+	// the images and videos inside archives.
+	if targetFormat != "" {
+		fileType, sourceExt := sniffFileType(file, header.Filename)
+		switch {
+		case fileType == FileTypeArchive:
+			attrs.Report = &ConversionReport{}
+			opts.Report = attrs.Report
+			return fs.addArchive(ctx, file, header.Filename, header.Size, sourceExt, targetFormat, opts, attrs)
+		case streamsTable(sourceExt, targetFormat):
+			attrs.Report = &ConversionReport{}
+			opts.Report = attrs.Report
+			return fs.addStreamedTable(ctx, file, header.Filename, header.Size, sourceExt, targetFormat, opts, attrs)
+		}
 	}
 
-	fileBytes, err := io.ReadAll(file)
+	fileBytes, release, err := readAllPooled(file)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read file content: %w", err)
 	}
-	fileSize := int64(len(fileBytes))
+	defer release()
+	input := fileBytes
 
-	meta := &FileMetadata{
-		ID:           fileID,
-		OriginalName: header.Filename,
-		// Default to original name, will be updated after conversion
-		ConvertedName: header.Filename,
-		Size:          fileSize,
-		UploadTime:    time.Now(),
-		ExpiryTime:    time.Now().Add(fileExpiryDuration),
-		ContentType:   header.Header.Get("Content-Type"),
+	// Default to original name, will be updated after conversion
+	convertedName := header.Filename
+	contentType := header.Header.Get("Content-Type")
+
+	attrs.Report = &ConversionReport{}
+	opts.Report = attrs.Report
+	if meta, err := fs.moderateUpload(ctx, header.Filename, fileBytes, &attrs); err != nil {
+		return meta, err
 	}
 
 	// Perform conversion if target format is specified
 	if targetFormat != "" {
-		var convertedFileName string
 		var convertedBytes []byte
-		convertedBytes, convertedFileName, err = performConversion(fileBytes, header.Filename, targetFormat)
+		convertedBytes, convertedName, err = performConversion(ctx, fileBytes, header.Filename, targetFormat, opts)
 		if err != nil {
-			return nil, fmt.Errorf("conversion failed: %w", err)
+			err = fmt.Errorf("conversion failed: %w", err)
+			meta, recErr := fs.recordFailure(header.Filename, err, attrs)
+			if recErr != nil {
+				log.Printf("Error recording failed job: %v", recErr)
+			}
+			return meta, err
 		}
-		meta.ConvertedName = convertedFileName
-		fileSize = int64(len(convertedBytes)) // Update size if conversion changes it
-		fileBytes = convertedBytes            // Use converted bytes for storage
+		fileBytes = convertedBytes // Use converted bytes for storage
+		attrs.postHooked = true
 
-		// Update content type based on the new format
-		meta.ContentType = getContentTypeForExtension(targetFormat)
+		// Update content type based on the new format. The converter may pick a
+		// different extension than requested (e.g. zipping multi-table exports).
+		contentType = getContentTypeForExtension(strings.TrimPrefix(filepath.Ext(convertedName), "."))
 	}
 
+	if sameStart(fileBytes, input) {
+		fileBytes = bytes.Clone(fileBytes) // Stored as uploaded, so it has to outlive the pooled buffer
+	}
+	return fs.storeFile(ctx, header.Filename, convertedName, contentType, fileBytes, attrs)
+}
+
+// newFileMetadata creates the metadata of a new job under a fresh ID, with its
+// expiry time set by the retention policy.
+func (fs *FileStore) newFileMetadata(originalName string, attrs jobAttributes) (*FileMetadata, error) {
+	fileID, err := generateID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate file ID: %w", err)
+	}
+	meta := &FileMetadata{
+		ID:            fileID,
+		OriginalName:  originalName,
+		UploadTime:    time.Now(),
+		Status:        jobCompleted,
+		Commands:      attrs.Report.Commands(),
+		Redactions:    attrs.Report.Redactions(),
+		Language:      attrs.Report.Language(),
+		Intermediates: attrs.Report.Intermediates(),
+		Tags:          attrs.Tags,
+		APIKey:        attrs.APIKey,
+		Moderation:    attrs.Moderation,
+		Workspace:     attrs.Workspace,
+	}
+	meta.ExpiryTime = meta.UploadTime.Add(fs.retention.keepFor(meta))
+	if meta.ShareToken, meta.ownerToken, err = fileTokens(); err != nil {
+		return nil, fmt.Errorf("failed to generate file tokens: %w", err)
+	}
+	meta.OwnerTokenHash = hashOwnerToken(meta.ownerToken)
+	return meta, nil
+}
+
+// addMetadata records a new job, in its workspace if it has one, and returns the
+// caller's copy, the only one that still knows the owner token.
+// This function expects the lock to be already held.
+func (fs *FileStore) addMetadata(meta *FileMetadata) *FileMetadata {
+	fs.joinWorkspace(meta)
+	stored := *meta
+	stored.ownerToken = ""
+	fs.files[meta.ID] = &stored
+	return meta
+}
+
+// recordFailure keeps a content-less record of a failed conversion. The record
+// only says what kind of failure it was; the error is logged.
+func (fs *FileStore) recordFailure(originalName string, convErr error, attrs jobAttributes) (*FileMetadata, error) {
+	meta, err := fs.newFileMetadata(originalName, attrs)
+	if err != nil {
+		return nil, err
+	}
+	meta.Status = jobFailed
+	meta.Error = failureMessage(convErr)
+	meta.IsInMemory = true // Nothing to delete from disk
+	log.Printf("Job %s (%s) failed: %v", meta.ID, originalName, convErr)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if err := fs.reserveFileSlot(false); err != nil { // Failure records count against the limits too
+		return nil, err
+	}
+	return fs.addMetadata(meta), nil
+}
+
+// storeFile stores already-processed file content under a new ID, in RAM if the
+// limit allows and on disk otherwise. The post hook is run on it first, unless
+// performConversion already ran it.
+func (fs *FileStore) storeFile(ctx context.Context, originalName, convertedName, contentType string, fileBytes []byte, attrs jobAttributes) (*FileMetadata, error) {
+	if !attrs.postHooked && conversionHooks.post != nil {
+		event := outputHookEvent(originalName, convertedName, fileBytes)
+		data, err := conversionHooks.runStage(ctx, conversionDeadlines.Hook, event, fileBytes, attrs.Report)
+		if err != nil {
+			return nil, err
+		}
+		fileBytes = data
+	}
+	meta, err := fs.newFileMetadata(originalName, attrs)
+	if err != nil {
+		return nil, err
+	}
+	fileID := meta.ID
+	fileSize := int64(len(fileBytes))
+	meta.ConvertedName = convertedName
+	meta.Size = fileSize
+	meta.ContentType = contentType
+	if attrs.Receipt != nil {
+		sum := sha256.Sum256(fileBytes)
+		if meta.Receipt, err = attrs.Receipt.issue(meta, hex.EncodeToString(sum[:])); err != nil {
+			return nil, err
+		}
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
 	// Decision: Store in RAM or on Disk
-	if fs.currentRAMUsage+fileSize <= ramLimitBytes {
+	inRAM := fs.currentRAMUsage+fileSize <= ramLimitBytes
+	if err := fs.reserveFileSlot(!inRAM); err != nil {
+		return nil, err
+	}
+	if attrs.ShortCode {
+		if err := fs.assignShortCode(meta); err != nil {
+			return nil, err
+		}
+	}
+
+	if inRAM {
 		fs.ramStore[fileID] = fileBytes
 		fs.currentRAMUsage += fileSize
 		meta.IsInMemory = true
@@ -146,16 +353,129 @@ func (fs *FileStore) AddFile(file multipart.File, header *multipart.FileHeader,
 		diskFilePath := filepath.Join(fs.diskPath, fileID+"_"+meta.ConvertedName)
 		err := os.WriteFile(diskFilePath, fileBytes, 0644)
 		if err != nil {
+			delete(fs.shortCodes, meta.ShortCode)
 			return nil, fmt.Errorf("failed to write file to disk: %w", err)
 		}
 		meta.IsInMemory = false
 		meta.Path = diskFilePath
+		fs.diskFiles++
 		log.Printf("Stored file %s (%s, %.2f MB) on Disk at %s. RAM limit exceeded.",
 			fileID, meta.OriginalName, float64(fileSize)/1024/1024, diskFilePath)
 	}
 
-	fs.files[fileID] = meta
-	return meta, nil
+	return fs.addMetadata(meta), nil
+}
+
+// storeFileFromPath stores a processed file that was written to disk, such as a
+// large converted archive. Files small enough are read into RAM as usual; larger
+// ones are moved into the disk path without passing through memory. The post
+// hook is run on the file where it lies.
+func (fs *FileStore) storeFileFromPath(ctx context.Context, originalName, convertedName, contentType, path string, attrs jobAttributes) (*FileMetadata, error) {
+	if !attrs.postHooked && conversionHooks.post != nil {
+		event := outputHookEvent(originalName, convertedName, fileHead(path))
+		if err := conversionHooks.runStageFile(ctx, conversionDeadlines.Hook, event, path, attrs.Report); err != nil {
+			return nil, err
+		}
+		attrs.postHooked = true
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat converted file: %w", err)
+	}
+	if info.Size() <= maxStreamedRAMFile {
+		fileBytes, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read converted file: %w", err)
+		}
+		return fs.storeFile(ctx, originalName, convertedName, contentType, fileBytes, attrs)
+	}
+
+	meta, err := fs.newFileMetadata(originalName, attrs)
+	if err != nil {
+		return nil, err
+	}
+	meta.ConvertedName = convertedName
+	meta.Size = info.Size()
+	meta.ContentType = contentType
+	if attrs.Receipt != nil {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read converted file: %w", err)
+		}
+		out, err := hashReceiptFile(f, convertedName)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if meta.Receipt, err = attrs.Receipt.issue(meta, out.SHA256); err != nil {
+			return nil, err
+		}
+	}
+
+	// Moving the file may mean copying it to another filesystem, so it is moved
+	// to a staging name next to its final one first, without holding the lock.
+	staged := fs.stagedFilePath(meta.ID)
+	if err := moveFile(path, staged); err != nil {
+		os.Remove(staged)
+		return nil, fmt.Errorf("failed to write file to disk: %w", err)
+	}
+	defer os.Remove(staged) // Fails harmlessly once the file is stored
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := fs.reserveFileSlot(true); err != nil {
+		return nil, err
+	}
+	diskFilePath := filepath.Join(fs.diskPath, meta.ID+"_"+meta.ConvertedName)
+	if err := os.Rename(staged, diskFilePath); err != nil {
+		return nil, fmt.Errorf("failed to write file to disk: %w", err)
+	}
+	if attrs.ShortCode {
+		if err := fs.assignShortCode(meta); err != nil {
+			os.Remove(diskFilePath)
+			return nil, err
+		}
+	}
+	meta.Path = diskFilePath
+	fs.diskFiles++
+	log.Printf("Stored file %s (%s, %.2f MB) on Disk at %s.",
+		meta.ID, meta.OriginalName, float64(meta.Size)/1024/1024, diskFilePath)
+
+	return fs.addMetadata(meta), nil
+}
+
+// stagedFilePath is where storeFileFromPath moves a file before storing it. The
+// orphan sweep leaves the name alone until the file is older than any move.
+func (fs *FileStore) stagedFilePath(fileID string) string {
+	return filepath.Join(fs.diskPath, "."+fileID+".partial")
+}
+
+// moveFile renames src to dst, copying when they are on different filesystems.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	os.Remove(src)
+	return nil
 }
 
 // getContentTypeForExtension returns the MIME type for a given file extension
@@ -218,6 +538,10 @@ func getContentTypeForExtension(ext string) string {
 		return "text/html"
 	case "md":
 		return "text/markdown"
+	case "diff":
+		return "text/x-diff"
+	case "srt":
+		return "application/x-subrip"
 	case "pptx":
 		return "application/vnd.openxmlformats-officedocument.presentationml.presentation"
 	case "ppt":
@@ -228,6 +552,14 @@ func getContentTypeForExtension(ext string) string {
 		return "application/vnd.ms-excel"
 	case "csv":
 		return "text/csv"
+	case "json":
+		return "application/json"
+	case "sqlite", "sqlite3", "db":
+		return "application/vnd.sqlite3"
+	case "parquet":
+		return "application/vnd.apache.parquet"
+	case "avro":
+		return "application/avro"
 
 	// Archive formats
 	case "zip":
@@ -236,6 +568,12 @@ func getContentTypeForExtension(ext string) string {
 		return "application/x-tar"
 	case "rar":
 		return "application/x-rar-compressed"
+	case "gz":
+		return "application/gzip"
+	case "zst":
+		return "application/zstd"
+	case "xz":
+		return "application/x-xz"
 
 	default:
 		return "application/octet-stream"
@@ -247,12 +585,9 @@ func (fs *FileStore) GetFile(fileID string) (*FileMetadata, []byte, error) {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
-	meta, exists := fs.files[fileID]
-	if !exists || time.Now().After(meta.ExpiryTime) {
-		if exists { // File expired, remove it
-			fs.deleteFileInternal(fileID)
-		}
-		return nil, nil, fmt.Errorf("file not found or expired")
+	meta, err := fs.downloadableLocked(fileID)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	if meta.IsInMemory {
@@ -271,6 +606,85 @@ func (fs *FileStore) GetFile(fileID string) (*FileMetadata, []byte, error) {
 	return meta, content, nil
 }
 
+// fileContent is a stored file's content opened for reading.
+type fileContent interface {
+	io.ReadSeekCloser
+	io.ReaderAt
+}
+
+// OpenFile opens a file for streaming, so files on disk, which may be larger than
+// memory, are not read in full. The caller must close the returned reader.
+func (fs *FileStore) OpenFile(fileID string) (*FileMetadata, fileContent, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	meta, err := fs.downloadableLocked(fileID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if meta.IsInMemory {
+		content, ok := fs.ramStore[fileID]
+		if !ok { // Should not happen if metadata is consistent
+			return nil, nil, fmt.Errorf("file metadata inconsistency: RAM file not found")
+		}
+		return meta, nopSeekCloser{bytes.NewReader(content)}, nil
+	}
+
+	// File is on disk. An open file stays readable even if it expires meanwhile.
+	f, err := os.Open(meta.Path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read file from disk: %w", err)
+	}
+	return meta, f, nil
+}
+
+// nopSeekCloser adds a no-op Close to an in-memory reader.
+type nopSeekCloser struct{ *bytes.Reader }
+
+func (nopSeekCloser) Close() error { return nil }
+
+// downloadableLocked returns the metadata of a file that may be downloaded.
+// This function expects the lock to be already held.
+func (fs *FileStore) downloadableLocked(fileID string) (*FileMetadata, error) {
+	meta, exists := fs.files[fileID]
+	if !exists || meta.expired(time.Now()) {
+		if exists { // File expired, remove it
+			fs.deleteFileInternal(fileID)
+		}
+		return nil, fmt.Errorf("file not found or expired")
+	}
+	if meta.Status == jobFailed {
+		return nil, fmt.Errorf("file not available: %s", meta.Error)
+	}
+	if meta.awaitingReview() {
+		return nil, errNotReviewed
+	}
+	return meta, nil
+}
+
+// sniffFileType detects the type of an uploaded file from its first bytes, which
+// is all content detection looks at, and rewinds it.
+func sniffFileType(file multipart.File, filename string) (FileType, string) {
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	file.Seek(0, io.SeekStart)
+	return DetectFileType(head[:n], filename)
+}
+
+// GetFileInfo returns the metadata of a stored file without reading its content.
+func (fs *FileStore) GetFileInfo(fileID string) (*FileMetadata, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	meta, exists := fs.files[fileID]
+	if !exists || meta.expired(time.Now()) {
+		return nil, fmt.Errorf("file not found or expired")
+	}
+	info := *meta
+	return &info, nil
+}
+
 // deleteFileInternal performs the actual deletion of a file and its metadata.
 // This function expects the lock to be already held.
 func (fs *FileStore) deleteFileInternal(fileID string) {
@@ -278,7 +692,15 @@ func (fs *FileStore) deleteFileInternal(fileID string) {
 	if !exists {
 		return
 	}
+	fs.removeContent(meta)
+	delete(fs.files, fileID)
+	log.Printf("Deleted file %s (%s). RAM usage: %.2f MB", fileID, meta.OriginalName, float64(fs.currentRAMUsage)/1024/1024)
+}
 
+// removeContent frees a file's content and short code.
+// This function expects the lock to be already held.
+func (fs *FileStore) removeContent(meta *FileMetadata) {
+	fileID := meta.ID
 	if meta.IsInMemory {
 		if data, ok := fs.ramStore[fileID]; ok {
 			fs.currentRAMUsage -= int64(len(data))
@@ -288,9 +710,9 @@ func (fs *FileStore) deleteFileInternal(fileID string) {
 		if err := os.Remove(meta.Path); err != nil {
 			log.Printf("Error deleting file %s from disk: %v", meta.Path, err)
 		}
+		fs.diskFiles--
 	}
-	delete(fs.files, fileID)
-	log.Printf("Deleted file %s (%s). RAM usage: %.2f MB", fileID, meta.OriginalName, float64(fs.currentRAMUsage)/1024/1024)
+	delete(fs.shortCodes, meta.ShortCode)
 }
 
 // cleanupRoutine periodically removes expired files.
@@ -301,13 +723,11 @@ func (fs *FileStore) cleanupRoutine() {
 	for range ticker.C {
 		fs.mu.Lock()
 		now := time.Now()
-		for id, meta := range fs.files {
-			if now.After(meta.ExpiryTime) {
-				log.Printf("Cleaning up expired file: %s (%s)", id, meta.OriginalName)
-				fs.deleteFileInternal(id)
-			}
-		}
+		fs.removeExpired(now)
+		fs.removeExpiredWorkspaces(now)
+		fs.cleanupIdempotencyKeys(now)
 		fs.mu.Unlock()
+		fs.abuse.cleanup(now)
 	}
 }
 
@@ -319,9 +739,13 @@ func handleUpload(fs *FileStore) http.HandlerFunc {
 			return
 		}
 
-		// Max upload size: e.g., 500MB. Adjust as needed.
-		// This is important to prevent abuse.
-		if err := r.ParseMultipartForm(500 << 20); err != nil {
+		releaseSpool, err := tempSpace.reserveSpooling(r)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		defer releaseSpool()
+		if err := r.ParseMultipartForm(multipartMemory); err != nil {
 			log.Printf("Error parsing multipart form: %v", err)
 			http.Error(w, fmt.Sprintf("Could not parse multipart form: %v", err), http.StatusBadRequest)
 			return
@@ -337,92 +761,221 @@ func handleUpload(fs *FileStore) http.HandlerFunc {
 
 		targetFormat := r.FormValue("targetFormat")
 
-		// Validate the conversion if a target format is specified
-		if targetFormat != "" {
-			// Create a temporary copy of the file to detect its type
-			tempFile, err := io.ReadAll(file)
-			if err != nil {
-				log.Printf("Error reading file for validation: %v", err)
-				http.Error(w, "Error reading file for validation", http.StatusBadRequest)
-				return
-			}
+		opts, err := parseConversionOptions(r)
+		if err != nil {
+			log.Printf("Invalid conversion options: %v", err)
+			http.Error(w, fmt.Sprintf("Invalid conversion options: %v", err), http.StatusBadRequest)
+			return
+		}
 
-			// Reset the file reader position
-			file.Seek(0, 0)
+		attrs, err := parseJobAttributes(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-			// Detect file type and check if conversion is supported
-			fileType, sourceExt := DetectFileType(tempFile, header.Filename)
-			supportedFormats := GetSupportedConversionFormats(fileType, sourceExt)
-
-			// Check if targetFormat is in the list of supported formats
-			isSupported := false
-			for _, format := range supportedFormats {
-				if format == targetFormat {
-					isSupported = true
-					break
-				}
-			}
+		// A multi-volume RAR set is uploaded as several "file" parts in one batch
+		if volumes := r.MultipartForm.File["file"]; len(volumes) > 1 && targetFormat != "" && isRarVolumeUpload(volumes) {
+			handleVolumeUpload(fs, w, r, volumes, targetFormat, opts, attrs)
+			return
+		}
 
-			if !isSupported {
+		// Validate the conversion if a target format is specified
+		if targetFormat != "" {
+			// Detect file type and check if conversion is supported
+			fileType, sourceExt := sniffFileType(file, header.Filename)
+			if !conversionSupported(fileType, sourceExt, targetFormat, opts) {
 				log.Printf("Unsupported conversion: %s to %s", sourceExt, targetFormat)
 				http.Error(w, fmt.Sprintf("Conversion from %s to %s is not supported", sourceExt, targetFormat), http.StatusBadRequest)
 				return
 			}
 		}
 
-		meta, err := fs.AddFile(file, header, targetFormat)
+		meta, err := fs.AddFile(r.Context(), file, header, targetFormat, opts, attrs)
+		if meta != nil {
+			setJobHeaders(w, meta) // Lets clients look up traces of failed jobs
+		}
+		if errors.Is(err, errModerationRejected) || errors.Is(err, errHookRejected) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
 		if err != nil {
 			log.Printf("Error adding file: %v", err)
-			http.Error(w, fmt.Sprintf("Error processing file: %v", err), http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("Error processing file: %v", err), errorStatus(err))
 			return
 		}
 
-		response := map[string]string{
-			"fileId":      meta.ID,
-			"fileName":    meta.ConvertedName, // Send the name of the "converted" file
-			"downloadUrl": "/download/" + meta.ID,
+		writeUploadResponse(w, r, meta)
+	}
+}
+
+// handleVolumeUpload converts a multi-volume RAR set sent as one upload.
+func handleVolumeUpload(fs *FileStore, w http.ResponseWriter, r *http.Request, volumes []*multipart.FileHeader, targetFormat string, opts ConversionOptions, attrs jobAttributes) {
+	if !slices.Contains(GetSupportedConversionFormats(FileTypeArchive, "rar"), targetFormat) {
+		http.Error(w, fmt.Sprintf("Conversion from rar to %s is not supported", targetFormat), http.StatusBadRequest)
+		return
+	}
+	names := make([]string, len(volumes))
+	for i, header := range volumes {
+		names[i] = header.Filename
+	}
+	first, base, err := rarVolumeSet(names)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid volume set: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	attrs.Report = &ConversionReport{}
+	opts.Report = attrs.Report
+	meta, err := fs.addArchiveVolumes(r.Context(), volumes, first, base, targetFormat, opts, attrs)
+	if meta != nil {
+		setJobHeaders(w, meta)
+	}
+	if err != nil {
+		log.Printf("Error adding volume set: %v", err)
+		http.Error(w, fmt.Sprintf("Error processing file: %v", err), errorStatus(err))
+		return
+	}
+	writeUploadResponse(w, r, meta)
+}
+
+// uploadedFile is one file read from a multi-file upload.
+type uploadedFile struct {
+	Name string
+	Data []byte
+}
+
+// readUploadedFiles reads every file sent under the given multipart form field
+// into pooled buffers, valid until the returned release is called. The multipart
+// form must already have been parsed.
+func readUploadedFiles(r *http.Request, field string) ([]uploadedFile, func(), error) {
+	if r.MultipartForm == nil || len(r.MultipartForm.File[field]) == 0 {
+		return nil, nil, fmt.Errorf("no files provided in form field %q", field)
+	}
+
+	var files []uploadedFile
+	var releases []func()
+	release := func() {
+		for _, fn := range releases {
+			fn()
+		}
+	}
+	for _, header := range r.MultipartForm.File[field] {
+		f, err := header.Open()
+		if err != nil {
+			release()
+			return nil, nil, fmt.Errorf("failed to open uploaded file %s: %w", header.Filename, err)
 		}
+		data, done, err := readAllPooled(f)
+		f.Close()
+		if err != nil {
+			release()
+			return nil, nil, fmt.Errorf("failed to read uploaded file %s: %w", header.Filename, err)
+		}
+		releases = append(releases, done)
+		files = append(files, uploadedFile{Name: header.Filename, Data: data})
+	}
+	return files, release, nil
+}
 
-		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(response); err != nil {
-			log.Printf("Error encoding response: %v", err)
-			// Client already received 200, too late to send error code
+// limitBody rejects bodies declared larger than maxUploadSize with 413 before
+// they are read, and cuts off those that turn out larger while being read.
+func limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > maxUploadSize {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
 		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeUploadResponse sends the standard JSON response describing a stored file,
+// including the tokens that grant access to it.
+func writeUploadResponse(w http.ResponseWriter, r *http.Request, meta *FileMetadata) {
+	body := map[string]any{
+		"fileId":      meta.ID,
+		"fileName":    meta.ConvertedName, // Send the name of the "converted" file
+		"downloadUrl": downloadURL(r, meta),
+		"shareToken":  meta.ShareToken, // Download only, safe to hand out
+		"ownerToken":  meta.ownerToken, // May delete or reconvert; only returned here
 	}
+	if meta.ShortCode != "" {
+		body["shortCode"] = meta.ShortCode
+		body["shortUrl"] = shortURL(meta.ShortCode)
+	}
+	if meta.Receipt != "" {
+		body["receipt"] = meta.Receipt
+	}
+	writeJSON(w, http.StatusOK, body)
 }
 
 // handleDownload handles file downloads.
 func handleDownload(fs *FileStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		fileID := filepath.Base(r.URL.Path) // Extract fileID from path like "/download/fileID"
-
-		meta, content, err := fs.GetFile(fileID)
-		if err != nil {
-			log.Printf("Error getting file %s for download: %v", fileID, err)
-			http.Error(w, err.Error(), http.StatusNotFound)
+		fileID := filepath.Base(r.URL.Path) // Extract fileID from path like "/download/fileID" or "/v1/files/fileID"
+		if err := verifyDownloadSignature(r, fileID); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
 			return
 		}
-
-		// Set headers for download
-		w.Header().Set("Content-Disposition", "attachment; filename=\""+meta.ConvertedName+"\"")
-		if meta.ContentType != "" {
-			w.Header().Set("Content-Type", meta.ContentType)
-		} else {
-			w.Header().Set("Content-Type", "application/octet-stream") // Generic binary
+		if _, ok := authorizeFile(fs, w, r, fileID, accessShare); !ok {
+			return
 		}
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", int64(len(content))))
+		serveFile(fs, w, r, fileID)
+	}
+}
+
+// serveFile sends a stored file whose access the caller has already checked.
+func serveFile(fs *FileStore, w http.ResponseWriter, r *http.Request, fileID string) {
+	meta, content, err := fs.OpenFile(fileID)
+	if errors.Is(err, errNotReviewed) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting file %s for download: %v", fileID, err)
+		notFound(w, err.Error())
+		return
+	}
 
-		_, err = io.Copy(w, bytes.NewReader(content))
+	defer content.Close()
+
+	// Large files may be fetched in parts (see handleFileParts)
+	name, body := meta.ConvertedName, io.ReadSeeker(content)
+	if p := r.URL.Query().Get("part"); p != "" {
+		part, err := downloadParts.parsePart(meta.Size, p)
 		if err != nil {
-			log.Printf("Error writing file %s to response: %v", fileID, err)
-			// Don't try to write an http.Error if headers already sent
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
+		name = fmt.Sprintf("%s.part%d", name, part.Index)
+		body = io.NewSectionReader(content, part.Offset, part.Length)
+	}
+
+	// Set headers for download
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+name+"\"")
+	if meta.ContentType != "" {
+		w.Header().Set("Content-Type", meta.ContentType)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream") // Generic binary
 	}
+
+	// ServeContent answers Range requests, so interrupted downloads can resume
+	http.ServeContent(w, r, name, meta.UploadTime, body)
 }
 
 // Note: The performConversion function has been moved to conversion.go
 
 func main() {
+	// "fileconverter convert ..." converts one file from the command line and exits
+	if len(os.Args) > 1 && os.Args[1] == "convert" {
+		if err := runConvertCommand(os.Args[2:]); err != nil {
+			log.Fatalf("Fatal: %v", err)
+		}
+		return
+	}
+
 	// You can get this path from an environment variable or config file
 	// For /dev/shm, ensure the directory exists and has correct permissions.
 	// E.g., export FILECONVERTER_DISK_PATH="/dev/shm/myconverter_temp"
@@ -431,36 +984,180 @@ func main() {
 		diskStoragePath = defaultDiskPath // Fallback to local "temp_files"
 	}
 
+	// The admin API is only served when a token is configured
+	adminToken = os.Getenv("FILECONVERTER_ADMIN_TOKEN")
+
+	// Optional API keys and URL signing secrets, e.g. FILECONVERTER_API_KEYS="team-a:s3cr3t...,team-b:..."
+	if err := keys.loadKeys(keyKindAPI, os.Getenv("FILECONVERTER_API_KEYS")); err != nil {
+		log.Fatalf("Fatal: %v", err)
+	}
+	if err := keys.loadKeys(keyKindSigning, os.Getenv("FILECONVERTER_SIGNING_KEYS")); err != nil {
+		log.Fatalf("Fatal: %v", err)
+	}
+
+	// Larger uploads for multi-gigabyte archives, e.g. FILECONVERTER_MAX_UPLOAD_MB=10240
+	maxUploadSize = int64(envInt("FILECONVERTER_MAX_UPLOAD_MB", int(maxUploadSize>>20))) << 20
+	downloadParts = loadMultipartConfig()
+	// Optional torrents of large outputs, web-seeded by this server, e.g.
+	// FILECONVERTER_TORRENT_THRESHOLD_MB=4096 FILECONVERTER_PUBLIC_URL=https://files.example.com
+	torrents, err := loadTorrentConfig()
+	if err != nil {
+		log.Fatalf("Fatal: %v", err)
+	}
+	torrentOutput = torrents
+	if torrentOutput.threshold > 0 {
+		log.Printf("Torrents offered for files larger than %d MB (%d trackers)", torrentOutput.threshold>>20, len(torrentOutput.trackers))
+	}
+
+	// Format images are handed to external encoders in, e.g. FILECONVERTER_IMAGE_INTERMEDIATE=tiff
+	im, err := loadImageIntermediate()
+	if err != nil {
+		log.Fatalf("Fatal: %v", err)
+	}
+	intermediateImage = im
+	if !intermediateImage.lossless {
+		log.Printf("Warning: chained image conversions use the lossy %s intermediate", intermediateImage.name)
+	}
+
+	// Origins allowed to embed the UI and downloads, e.g. FILECONVERTER_FRAME_ANCESTORS="https://app.example.com"
+	frameAncestors = parseFrameAncestors(os.Getenv("FILECONVERTER_FRAME_ANCESTORS"))
+
+	// Single-shot mode for serverless platforms handles one request per process
+	singleShot = os.Getenv("FILECONVERTER_SINGLE_SHOT") == "true"
+
 	fileStore := NewFileStore(diskStoragePath)
+	fileStore.preflight()
+	if !singleShot {
+		fileStore.startBackgroundRoutines()
+	}
 
-	mux := http.NewServeMux()
+	// Optional per-pair FFmpeg argument templates, e.g. FILECONVERTER_FFMPEG_TEMPLATES=/etc/fileconverter/ffmpeg.json
+	if path := os.Getenv("FILECONVERTER_FFMPEG_TEMPLATES"); path != "" {
+		templates, err := loadFFmpegTemplates(path)
+		if err != nil {
+			log.Fatalf("Fatal: %v", err)
+		}
+		ffmpegTemplates = templates
+		log.Printf("Loaded %d FFmpeg argument templates from %s", len(templates), path)
+	}
 
-	// Serve static HTML page
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path != "/" {
-			http.NotFound(w, r)
-			return
+	// Optional per-tag retention rules, e.g. FILECONVERTER_RETENTION_POLICY=/etc/fileconverter/retention.json
+	if path := os.Getenv("FILECONVERTER_RETENTION_POLICY"); path != "" {
+		policy, err := loadRetentionPolicy(path)
+		if err != nil {
+			log.Fatalf("Fatal: %v", err)
 		}
-		// This assumes the HTML file (from the first immersive block) is named index.html
-		// and is in the same directory as the Go executable, or you adjust the path.
-		// For simplicity in this example, I'm not embedding the HTML.
-		// You would typically serve it from a file.
-		// http.ServeFile(w, r, "index.html")
-		// For now, let's just send a simple message if index.html is not present.
-		// To make this runnable: save the HTML from the first block as 'index.html'
-		// in the same directory as this Go program.
-		http.ServeFile(w, r, "index.html")
-	})
+		fileStore.retention = policy
+		log.Printf("Loaded %d retention rules from %s", len(policy.Rules), path)
+	}
+
+	// Optional moderation of uploaded images and videos, e.g. FILECONVERTER_MODERATION_URL=http://classifier:8080/classify
+	moderator, err := loadModerator()
+	if err != nil {
+		log.Fatalf("Fatal: %v", err)
+	}
+	if moderator != nil {
+		fileStore.moderator = moderator
+		log.Printf("Content moderation enabled: flagging at score %.2f, rejecting at %.2f", moderator.flagScore, moderator.rejectScore)
+	}
+
+	// Optional signing of PDF output, e.g. FILECONVERTER_PDF_SIGN_CERT=/etc/fileconverter/signing.p12
+	if pdfSigning, err = loadPDFSigner(); err != nil {
+		log.Fatalf("Fatal: %v", err)
+	}
+	if pdfSigning != nil {
+		log.Printf("PDF signing enabled as %s", pdfSigning.cert.Subject)
+	}
+	if textTranslator, err = loadTranslator(); err != nil {
+		log.Fatalf("Fatal: %v", err)
+	}
+	if textTranslator != nil {
+		log.Printf("Translation enabled")
+	}
+
+	// Optional pre- and post-conversion hooks, e.g. FILECONVERTER_POST_HOOK_URL=http://notifier:8080/converted
+	if conversionHooks, err = loadHooks(); err != nil {
+		log.Fatalf("Fatal: %v", err)
+	}
+	if conversionHooks.enabled() {
+		log.Printf("Conversion hooks enabled (pre: %t, post: %t)", conversionHooks.pre != nil, conversionHooks.post != nil)
+	}
+	// Stage deadlines, e.g. FILECONVERTER_CONVERT_TIMEOUT=10m; conversions also
+	// stop when their client disconnects
+	conversionDeadlines = loadStageDeadlines()
+	if conversionDeadlines.Convert > 0 {
+		log.Printf("Conversions time out after %v", conversionDeadlines.Convert)
+	} else {
+		log.Printf("Warning: conversions have no time limit (FILECONVERTER_CONVERT_TIMEOUT=0)")
+	}
+	// Optional temporary disk budget, e.g. FILECONVERTER_TEMP_BUDGET_MB=20480;
+	// conversions always have to fit in the free space of the temp directory
+	tempSpace = loadTempSpaceBudget()
+	if tempSpace.Total > 0 {
+		log.Printf("Conversions may reserve %s of temporary disk space in total", megabytes(tempSpace.Total))
+	}
+	if tempSpace.Job > 0 {
+		log.Printf("Conversions may reserve %s of temporary disk space each", megabytes(tempSpace.Job))
+	}
+	// Archives may expand to FILECONVERTER_ARCHIVE_MAX_EXPANDED_MB and
+	// FILECONVERTER_ARCHIVE_MAX_RATIO times their size at most, against zip bombs
+	archiveExpansion = loadArchiveLimits()
+	// Optional signed receipts of conversions, e.g. FILECONVERTER_RECEIPT_KEY=/etc/fileconverter/receipt.pem
+	if receiptSigning, err = loadReceiptSigner(); err != nil {
+		log.Fatalf("Fatal: %v", err)
+	}
+	if receiptSigning != nil {
+		log.Printf("Conversion receipts enabled, signed with %s key %s", receiptSigning.alg, receiptSigning.kid)
+	}
+	if err := loadPDFTrustRoots(); err != nil {
+		log.Fatalf("Fatal: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	registerRoutes(mux, fileStore)
+
+	// The upload size limit applies to every request
+	handler := limitBody(mux)
 
-	mux.HandleFunc("/upload", handleUpload(fileStore))
-	mux.HandleFunc("/download/", handleDownload(fileStore)) // Note the trailing slash
+	// Banning of clients that keep failing, applied before any handler runs
+	if fileStore.abuse.enabled() {
+		handler = fileStore.abuse.middleware(handler)
+		log.Printf("Abuse detection enabled: %d failed requests within %v ban a client for %v",
+			fileStore.abuse.threshold, fileStore.abuse.window, fileStore.abuse.banFor)
+	}
+
+	// Optional client address and country filtering, applied first
+	proxies, err := parsePrefixes(os.Getenv("FILECONVERTER_TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatalf("Fatal: FILECONVERTER_TRUSTED_PROXIES: %v", err)
+	}
+	trustedProxies = proxies
+	filter, err := loadIPFilter()
+	if err != nil {
+		log.Fatalf("Fatal: %v", err)
+	}
+	if filter != nil {
+		handler = filter.middleware(handler)
+		log.Printf("Client filtering enabled: %d allowed and %d denied ranges", len(filter.allow), len(filter.deny))
+	}
 
 	port := "5005"
+	if singleShot {
+		if p := os.Getenv("PORT"); p != "" { // Set by Cloud Run and similar platforms
+			port = p
+		}
+		log.Printf("Single-shot server waiting for one request on port %s", port)
+		if err := serveSingleShot(":"+port, handler); err != nil {
+			log.Fatalf("Server failed: %v", err)
+		}
+		return
+	}
+
 	log.Printf("Server starting on port %s", port)
 	log.Printf("File storage: RAM (up to %.2f GB), fallback to disk at '%s'", float64(ramLimitBytes)/1024/1024/1024, fileStore.diskPath)
-	log.Printf("Uploaded files persist for %v", fileExpiryDuration)
+	log.Printf("Uploaded files persist for %v by default (at most %v)", fileStore.retention.defaultKeep, fileStore.retention.maxKeep)
 
-	err := http.ListenAndServe(":"+port, mux)
+	err = http.ListenAndServe(":"+port, handler)
 	if err != nil {
 		log.Fatalf("Server failed to start: %v", err)
 	}
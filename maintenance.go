@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultMaintenanceRetry is the Retry-After hint sent while in maintenance mode
+// when the admin didn't give one.
+const defaultMaintenanceRetry = 5 * time.Minute
+
+// maintenanceState describes read-only maintenance mode. While enabled, requests
+// that create files are refused and downloads keep working.
+type maintenanceState struct {
+	Enabled    bool       `json:"enabled"`
+	Message    string     `json:"message,omitempty"`
+	RetryAfter int        `json:"retryAfter,omitempty"` // Seconds clients should wait
+	Since      *time.Time `json:"since,omitempty"`
+}
+
+// Maintenance returns the current maintenance state.
+func (fs *FileStore) Maintenance() maintenanceState {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.maintenance
+}
+
+// SetMaintenance switches maintenance mode and records the change in the audit trail.
+func (fs *FileStore) SetMaintenance(state maintenanceState, remote string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	action := "maintenance off"
+	if state.Enabled {
+		action = "maintenance on"
+		now := time.Now()
+		state.Since = &now
+	}
+	fs.maintenance = state
+	fs.addAudit(auditEntry{Time: time.Now(), Action: action, Reason: state.Message, Remote: remote})
+}
+
+// acceptsWrites refuses requests with 503 while in maintenance mode, telling
+// clients when to retry.
+func acceptsWrites(fs *FileStore, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		state := fs.Maintenance()
+		if !state.Enabled {
+			next(w, r)
+			return
+		}
+
+		message := state.Message
+		if message == "" {
+			message = "The service is in maintenance mode and not accepting new files; existing files can still be downloaded"
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(state.RetryAfter))
+		http.Error(w, message, http.StatusServiceUnavailable)
+	}
+}
+
+// handleAdminMaintenance reports (GET), enables (POST) or disables (DELETE)
+// maintenance mode. POST takes optional "message" and "retryAfter" (seconds) form values.
+func handleAdminMaintenance(fs *FileStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			state := maintenanceState{
+				Enabled:    true,
+				Message:    r.FormValue("message"),
+				RetryAfter: int(defaultMaintenanceRetry / time.Second),
+			}
+			if v := r.FormValue("retryAfter"); v != "" {
+				seconds, err := strconv.Atoi(v)
+				if err != nil || seconds < 0 {
+					http.Error(w, fmt.Sprintf("Invalid retryAfter %q: must be a number of seconds", v), http.StatusBadRequest)
+					return
+				}
+				state.RetryAfter = seconds
+			}
+			fs.SetMaintenance(state, r.RemoteAddr)
+			log.Printf("Maintenance mode enabled, refusing new files")
+		case http.MethodDelete:
+			fs.SetMaintenance(maintenanceState{}, r.RemoteAddr)
+			log.Printf("Maintenance mode disabled")
+		default:
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"maintenance": fs.Maintenance()})
+	}
+}
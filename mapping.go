@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxMappingColumns caps the number of entries in a column mapping.
+const maxMappingColumns = 1000
+
+// columnMapping is one output column of a mapping: the source column it is taken
+// from, the name it is written under and the type its cells are coerced to.
+type columnMapping struct {
+	From string `json:"from"`
+	To   string `json:"to,omitempty"`
+	Type string `json:"type,omitempty"`
+}
+
+// Column types a mapping can coerce cells to.
+var columnTypes = map[string]bool{"string": true, "int": true, "float": true, "bool": true, "date": true}
+
+// dateLayouts are the date formats recognised when coercing to the date type.
+var dateLayouts = []string{
+	"2006-01-02", time.RFC3339, "2006-01-02 15:04:05", "2006/01/02",
+	"01/02/2006", "02.01.2006", "Jan 2, 2006", "2 Jan 2006", "January 2, 2006", "2 January 2006",
+}
+
+// parseColumnMapping parses the "mapping" form value: a JSON array such as
+// [{"from":"Customer ID","to":"customer_id","type":"int"},{"from":"Name"}].
+// The output has exactly the listed columns, in that order; "to" renames a column
+// and "type" (string, int, float, bool or date) coerces its cells.
+func parseColumnMapping(v string) ([]columnMapping, error) {
+	var mapping []columnMapping
+	if err := json.Unmarshal([]byte(v), &mapping); err != nil {
+		return nil, fmt.Errorf("invalid mapping: %w", err)
+	}
+	if len(mapping) == 0 {
+		return nil, fmt.Errorf("invalid mapping: no columns given")
+	}
+	if len(mapping) > maxMappingColumns {
+		return nil, fmt.Errorf("invalid mapping: at most %d columns are allowed", maxMappingColumns)
+	}
+	seen := map[string]bool{}
+	for i, m := range mapping {
+		if m.From == "" {
+			return nil, fmt.Errorf("invalid mapping: entry %d has no \"from\" column", i+1)
+		}
+		if m.To == "" {
+			mapping[i].To = m.From
+		}
+		if seen[mapping[i].To] {
+			return nil, fmt.Errorf("invalid mapping: column %q is written twice", mapping[i].To)
+		}
+		seen[mapping[i].To] = true
+		mapping[i].Type = strings.ToLower(m.Type)
+		if m.Type != "" && !columnTypes[mapping[i].Type] {
+			return nil, fmt.Errorf("invalid mapping: unknown type %q (use string, int, float, bool or date)", m.Type)
+		}
+	}
+	return mapping, nil
+}
+
+// rowShaper applies the columns option, then the mapping, to rows: it picks and
+// orders their cells, and coerces those the mapping gives a type.
+type rowShaper struct {
+	columns []string // Output column names
+	types   []string // Output column types, nil if untyped
+	from    []string // Source column of each output column, for errors
+	idx     []int    // Source index of each output column
+	same    bool     // Rows pass through unchanged
+	locale  *tableLocale
+}
+
+// newRowShaper prepares the shaping of rows with the given columns and types.
+func newRowShaper(columns, types []string, opts ConversionOptions) (*rowShaper, error) {
+	s := &rowShaper{columns: columns, types: types, from: columns, same: true, locale: opts.Locale}
+	s.idx = make([]int, len(columns))
+	for i := range s.idx {
+		s.idx[i] = i
+	}
+	index := func(name string) (int, error) {
+		for i, c := range s.columns {
+			if c == name {
+				return i, nil
+			}
+		}
+		return -1, fmt.Errorf("column %q not found", name)
+	}
+
+	if len(opts.Columns) > 0 {
+		idx := make([]int, len(opts.Columns))
+		var selTypes []string
+		if s.types != nil {
+			selTypes = make([]string, len(opts.Columns))
+		}
+		for i, name := range opts.Columns {
+			pos, err := index(name)
+			if err != nil {
+				return nil, err
+			}
+			idx[i] = s.idx[pos]
+			if selTypes != nil {
+				selTypes[i] = s.types[pos]
+			}
+		}
+		s.columns, s.from, s.types, s.idx, s.same = opts.Columns, opts.Columns, selTypes, idx, false
+	}
+
+	if len(opts.Mapping) > 0 {
+		idx := make([]int, len(opts.Mapping))
+		names := make([]string, len(opts.Mapping))
+		from := make([]string, len(opts.Mapping))
+		mapTypes := make([]string, len(opts.Mapping))
+		for i, m := range opts.Mapping {
+			pos, err := index(m.From)
+			if err != nil {
+				return nil, err
+			}
+			idx[i], names[i], from[i], mapTypes[i] = s.idx[pos], m.To, m.From, m.Type
+			if m.Type == "" && s.types != nil {
+				mapTypes[i] = s.types[pos]
+			}
+		}
+		s.columns, s.from, s.types, s.idx, s.same = names, from, mapTypes, idx, false
+	}
+	return s, nil
+}
+
+// shape reshapes row n (counted from 1 after the header). Cells that cannot be
+// coerced fail the conversion, naming the row, so bad data is not passed on.
+func (s *rowShaper) shape(n int, row []string) ([]string, error) {
+	if s.same {
+		return row, nil
+	}
+	shaped := make([]string, len(s.idx))
+	for i, src := range s.idx {
+		cell := row[src]
+		if i < len(s.types) && s.types[i] != "" {
+			var err error
+			if cell, err = coerceCell(cell, s.types[i], s.locale); err != nil {
+				return nil, fmt.Errorf("row %d, column %q: %w", n, s.from[i], err)
+			}
+		}
+		shaped[i] = cell
+	}
+	return shaped, nil
+}
+
+// coerceCell converts a cell to its canonical text for the given type, reading
+// numbers and dates as written in loc if it is set. Empty cells stay empty and
+// are written as nulls where the output has them.
+func coerceCell(cell, kind string, loc *tableLocale) (string, error) {
+	v := strings.TrimSpace(cell)
+	if kind == "" || kind == "string" {
+		return cell, nil
+	}
+	if v == "" {
+		return "", nil
+	}
+	if loc != nil {
+		switch kind {
+		case "int", "float":
+			if n, ok := loc.parseNumber(v); ok {
+				v = n
+			}
+		case "date":
+			if d, ok := loc.parseDate(v); ok {
+				return d.Format("2006-01-02"), nil
+			}
+		}
+	}
+	switch kind {
+	case "int":
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return strconv.FormatInt(n, 10), nil
+		}
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f == math.Trunc(f) && math.Abs(f) < 1<<63 {
+			return strconv.FormatInt(int64(f), 10), nil
+		}
+	case "float":
+		if f, err := strconv.ParseFloat(v, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+			return strconv.FormatFloat(f, 'f', -1, 64), nil
+		}
+	case "bool":
+		switch strings.ToLower(v) {
+		case "1", "t", "true", "y", "yes", "on":
+			return "true", nil
+		case "0", "f", "false", "n", "no", "off":
+			return "false", nil
+		}
+	case "date":
+		for _, layout := range dateLayouts {
+			if d, err := time.Parse(layout, v); err == nil {
+				return d.Format("2006-01-02"), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("cannot convert %q to %s", cell, kind)
+}
+
+// applyColumnOptions applies the columns option, then the mapping, to a table
+// read for conversion.
+func (t *table) applyColumnOptions(opts ConversionOptions) error {
+	shaper, err := newRowShaper(t.Columns, t.Types, opts)
+	if err != nil || shaper.same {
+		return err
+	}
+	for r, row := range t.Rows {
+		if t.Rows[r], err = shaper.shape(r+1, row); err != nil {
+			return err
+		}
+	}
+	t.Columns, t.Types = shaper.columns, shaper.types
+	return nil
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// moderationTimeout bounds one classifier call.
+	moderationTimeout = 60 * time.Second
+	// defaultModerationFlagScore and defaultModerationRejectScore are the highest
+	// label scores at which uploads are queued for review or refused; override with
+	// FILECONVERTER_MODERATION_FLAG_SCORE and FILECONVERTER_MODERATION_REJECT_SCORE.
+	defaultModerationFlagScore   = 0.5
+	defaultModerationRejectScore = 0.9
+)
+
+// Moderation verdicts.
+const (
+	moderationClean    = "clean"    // Stored and downloadable
+	moderationFlagged  = "flagged"  // Stored but withheld until an admin reviews it
+	moderationRejected = "rejected" // Refused, or removed after review
+	moderationApproved = "approved" // Flagged, then released by an admin
+)
+
+// errModerationRejected is returned when the classifier refuses an upload.
+var errModerationRejected = errors.New("upload was rejected by content moderation")
+
+// moderationResult is the outcome of classifying an upload, stored in its metadata.
+type moderationResult struct {
+	Verdict    string             `json:"verdict"`
+	Scores     map[string]float64 `json:"scores,omitempty"` // Label -> confidence in [0, 1]
+	Error      string             `json:"error,omitempty"`  // Why the classifier gave no scores
+	ReviewedAt *time.Time         `json:"reviewedAt,omitempty"`
+}
+
+// classifier scores media for moderation, returning a confidence per label such
+// as "nsfw" or "violence".
+type classifier interface {
+	classify(ctx context.Context, name string, data []byte, report *ConversionReport) (map[string]float64, error)
+}
+
+// classifierResponse is what classifiers answer with, e.g. {"scores":{"nsfw":0.97}}.
+type classifierResponse struct {
+	Scores map[string]float64 `json:"scores"`
+}
+
+// httpClassifier posts the file to an external classification service.
+type httpClassifier struct {
+	url    string
+	client *http.Client
+}
+
+func (c *httpClassifier) classify(ctx context.Context, name string, data []byte, _ *ConversionReport) (map[string]float64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", http.DetectContentType(data))
+	req.Header.Set("X-File-Name", name)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("classifier request failed: %w", timeoutError(err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("classifier answered %s", resp.Status)
+	}
+
+	var body classifierResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return nil, fmt.Errorf("invalid classifier response: %w", err)
+	}
+	return body.Scores, nil
+}
+
+// commandClassifier runs a local model, passing the file's path as the last
+// argument and reading the classifier response from its standard output.
+type commandClassifier struct {
+	binary string
+	args   []string
+}
+
+func (c *commandClassifier) classify(ctx context.Context, name string, data []byte, report *ConversionReport) (map[string]float64, error) {
+	wd, err := newJobWorkdir()
+	if err != nil {
+		return nil, err
+	}
+	defer wd.cleanup()
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(name)), ".")
+	if ext == "" {
+		ext = "bin"
+	}
+	input, err := wd.writeInput(ext, data)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, c.binary, append(append([]string(nil), c.args...), input)...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	timer := time.AfterFunc(moderationTimeout, func() { cmd.Process.Kill() })
+	start := time.Now()
+	err = cmd.Run()
+	timedOut := !timer.Stop()
+	report.addCommand(newCommandTrace(cmd, time.Since(start), stderr.Bytes(), err))
+	if timedOut {
+		return nil, fmt.Errorf("classifier command %w after %s", ErrTimeout, moderationTimeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("classifier command failed: %w", err)
+	}
+
+	var body classifierResponse
+	if err := json.Unmarshal(stdout.Bytes(), &body); err != nil {
+		return nil, fmt.Errorf("invalid classifier output: %w", err)
+	}
+	return body.Scores, nil
+}
+
+// contentModerator classifies uploaded images and videos before they are
+// converted and decides what happens to them.
+type contentModerator struct {
+	classifier  classifier
+	flagScore   float64
+	rejectScore float64
+}
+
+// loadModerator configures moderation from FILECONVERTER_MODERATION_URL (an
+// external classifier) or FILECONVERTER_MODERATION_COMMAND (a local model, e.g.
+// "/opt/nsfw/classify --json"). It returns nil when neither is set.
+func loadModerator() (*contentModerator, error) {
+	m := &contentModerator{
+		flagScore:   envFloat("FILECONVERTER_MODERATION_FLAG_SCORE", defaultModerationFlagScore),
+		rejectScore: envFloat("FILECONVERTER_MODERATION_REJECT_SCORE", defaultModerationRejectScore),
+	}
+	url, command := os.Getenv("FILECONVERTER_MODERATION_URL"), os.Getenv("FILECONVERTER_MODERATION_COMMAND")
+	switch {
+	case url != "" && command != "":
+		return nil, fmt.Errorf("set only one of FILECONVERTER_MODERATION_URL and FILECONVERTER_MODERATION_COMMAND")
+	case url != "":
+		m.classifier = &httpClassifier{url: url, client: &http.Client{Timeout: moderationTimeout}}
+	case command != "":
+		fields := strings.Fields(command)
+		m.classifier = &commandClassifier{binary: fields[0], args: fields[1:]}
+	default:
+		return nil, nil
+	}
+	if m.flagScore > m.rejectScore {
+		return nil, fmt.Errorf("moderation flag score %v exceeds reject score %v", m.flagScore, m.rejectScore)
+	}
+	return m, nil
+}
+
+// moderate classifies a file if it is an image or video and returns the result,
+// or nil for other media. Files the classifier can't score are flagged for review
+// rather than let through.
+func (m *contentModerator) moderate(ctx context.Context, name string, data []byte, report *ConversionReport) *moderationResult {
+	if fileType, _ := DetectFileType(data, name); fileType != FileTypeImage && fileType != FileTypeVideo {
+		return nil
+	}
+
+	scores, err := m.classifier.classify(ctx, name, data, report)
+	if err != nil {
+		log.Printf("Moderation of %s failed, flagging it for review: %v", name, err)
+		return &moderationResult{Verdict: moderationFlagged, Error: err.Error()}
+	}
+	result := &moderationResult{Verdict: moderationClean, Scores: scores}
+	top := 0.0
+	for _, score := range scores {
+		top = max(top, score)
+	}
+	switch {
+	case top >= m.rejectScore:
+		result.Verdict = moderationRejected
+	case top >= m.flagScore:
+		result.Verdict = moderationFlagged
+	}
+	if result.Verdict != moderationClean {
+		log.Printf("Moderation %s %s (top score %.2f)", result.Verdict, name, top)
+	}
+	return result
+}
+
+// moderateUpload runs the configured moderation on an uploaded file. A rejected
+// file is recorded as a failed job and errModerationRejected returned.
+func (fs *FileStore) moderateUpload(ctx context.Context, name string, data []byte, attrs *jobAttributes) (*FileMetadata, error) {
+	if fs.moderator == nil {
+		return nil, nil
+	}
+	result := fs.moderator.moderate(ctx, name, data, attrs.Report)
+	if result == nil {
+		return nil, nil
+	}
+	if attrs.Moderation == nil || result.Verdict == moderationRejected || attrs.Moderation.Verdict == moderationClean {
+		attrs.Moderation = result // Keep the strictest verdict across a multi-file upload
+	}
+	if result.Verdict != moderationRejected {
+		return nil, nil
+	}
+	meta, err := fs.recordFailure(name, errModerationRejected, *attrs)
+	if err != nil {
+		log.Printf("Error recording rejected upload: %v", err)
+	}
+	return meta, errModerationRejected
+}
+
+// moderateTree runs the configured moderation on every image and video below
+// dir, such as the members of an extracted archive, and stops at the first one
+// rejected.
+func (fs *FileStore) moderateTree(ctx context.Context, dir string, attrs *jobAttributes) (*FileMetadata, error) {
+	if fs.moderator == nil {
+		return nil, nil
+	}
+	var rejected *FileMetadata
+	err := walkEntries(dir, func(name string, p string, info os.FileInfo) error {
+		if info.IsDir() {
+			return nil
+		}
+		if fileType, _ := DetectFileType(fileHead(p), name); fileType != FileTypeImage && fileType != FileTypeVideo {
+			return nil
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if rejected, err = fs.moderateUpload(ctx, name, data, attrs); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		return nil
+	})
+	return rejected, err
+}
+
+// awaitingReview reports whether a file is withheld until an admin reviews it.
+// Such files don't expire, so they can't vanish before anyone has looked.
+func (meta *FileMetadata) awaitingReview() bool {
+	return meta.Moderation != nil && meta.Moderation.Verdict == moderationFlagged
+}
+
+// ReviewModeration approves a flagged file, making it downloadable, or rejects
+// it, deleting its content. The decision is recorded in the audit trail.
+func (fs *FileStore) ReviewModeration(fileID string, approve bool, reason, remote string) (*FileMetadata, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	meta, exists := fs.files[fileID]
+	if !exists || meta.expired(time.Now()) {
+		return nil, fmt.Errorf("file not found or expired")
+	}
+	if !meta.awaitingReview() {
+		return nil, errNotFlagged
+	}
+
+	now := time.Now()
+	reviewed := *meta.Moderation // Copies handed out earlier share the old result
+	reviewed.ReviewedAt = &now
+	entry := auditEntry{Time: now, FileID: fileID, Reason: reason, Remote: remote}
+	if approve {
+		entry.Action = "moderation approve"
+		reviewed.Verdict = moderationApproved
+		if meta.ExpiryTime.Before(now) { // Kept past its expiry for the review; give it its retention anew
+			meta.ExpiryTime = now.Add(fs.retention.keepFor(meta))
+		}
+	} else {
+		entry.Action = "moderation reject"
+		reviewed.Verdict = moderationRejected
+	}
+	meta.Moderation = &reviewed
+	fs.addAudit(entry)
+
+	info := *meta
+	if !approve {
+		fs.deleteFileInternal(fileID)
+	}
+	return &info, nil
+}
+
+// errNotReviewed is returned when downloading a file withheld for review.
+var errNotReviewed = errors.New("file is withheld until it has been reviewed")
+
+// errNotFlagged is returned when reviewing a file that isn't awaiting review.
+var errNotFlagged = errors.New("file is not awaiting moderation review")
+
+// handleAdminModerationQueue lists the files awaiting review, oldest first.
+func handleAdminModerationQueue(fs *FileStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		files := fs.ListFiles((*FileMetadata).awaitingReview)
+		list := make([]map[string]any, 0, len(files))
+		for i := range files {
+			list = append(list, fileInfo(r, &files[i]))
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"files": list, "count": len(list)})
+	}
+}
+
+// handleAdminModerationReview approves or rejects a flagged file. It takes a
+// "decision" form value of approve or reject and an optional "reason".
+func handleAdminModerationReview(fs *FileStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		decision := r.FormValue("decision")
+		if decision != "approve" && decision != "reject" {
+			http.Error(w, "decision must be approve or reject", http.StatusBadRequest)
+			return
+		}
+		meta, err := fs.ReviewModeration(r.PathValue("id"), decision == "approve", r.FormValue("reason"), r.RemoteAddr)
+		if errors.Is(err, errNotFlagged) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"fileId": meta.ID, "moderation": meta.Moderation})
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	// maxMontageImages caps how many images one montage request may combine.
+	maxMontageImages = 100
+	// defaultMontageTileSize is the edge length of a grid cell when none is given.
+	defaultMontageTileSize = 300
+	// maxMontageTileSize keeps the output canvas at a sane size.
+	maxMontageTileSize = 2000
+	// maxMontagePixels caps the area of the canvas, which is held in memory
+	// uncompressed at four bytes a pixel.
+	maxMontagePixels = 40_000_000
+)
+
+// montageOptions describes the grid layout of a contact sheet.
+type montageOptions struct {
+	Rows, Cols int
+	TileSize   int
+	Padding    int
+	Background color.NRGBA
+	Format     string // png, jpg or pdf
+}
+
+// parseMontageOptions reads montage layout settings from the request's form values.
+func parseMontageOptions(r *http.Request) (montageOptions, error) {
+	opts := montageOptions{
+		TileSize:   defaultMontageTileSize,
+		Padding:    10,
+		Background: color.NRGBA{255, 255, 255, 255},
+		Format:     strings.ToLower(r.FormValue("format")),
+	}
+	if opts.Format == "" {
+		opts.Format = "png"
+	}
+	if opts.Format == "jpeg" {
+		opts.Format = "jpg"
+	}
+	if opts.Format != "png" && opts.Format != "jpg" && opts.Format != "pdf" {
+		return opts, fmt.Errorf("unsupported montage format %q (use png, jpg or pdf)", opts.Format)
+	}
+
+	ints := []struct {
+		field    string
+		dst      *int
+		min, max int
+	}{
+		{"rows", &opts.Rows, 0, maxMontageImages},
+		{"cols", &opts.Cols, 0, maxMontageImages},
+		{"tileSize", &opts.TileSize, 16, maxMontageTileSize},
+		{"padding", &opts.Padding, 0, 500},
+	}
+	for _, f := range ints {
+		v := r.FormValue(f.field)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < f.min || n > f.max {
+			return opts, fmt.Errorf("invalid %s %q: must be an integer between %d and %d", f.field, v, f.min, f.max)
+		}
+		*f.dst = n
+	}
+
+	if v := r.FormValue("background"); v != "" {
+		bg, err := parseColor(v)
+		if err != nil {
+			return opts, err
+		}
+		opts.Background = bg
+	}
+	return opts, nil
+}
+
+// parseColor parses "#rrggbb", "#rrggbbaa" (leading # optional) or "transparent".
+func parseColor(v string) (color.NRGBA, error) {
+	if strings.EqualFold(v, "transparent") {
+		return color.NRGBA{}, nil
+	}
+	raw, err := hex.DecodeString(strings.TrimPrefix(v, "#"))
+	if err != nil || (len(raw) != 3 && len(raw) != 4) {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q: expected #rrggbb or #rrggbbaa", v)
+	}
+	c := color.NRGBA{raw[0], raw[1], raw[2], 255}
+	if len(raw) == 4 {
+		c.A = raw[3]
+	}
+	return c, nil
+}
+
+// grid returns the layout of a montage of n images: the rows and columns asked
+// for, filled in or trimmed so that no row or column stays empty, and the size
+// of the canvas.
+func (opts montageOptions) grid(n int) (rows, cols, width, height int) {
+	n = max(n, 1)
+	rows, cols = min(opts.Rows, n), min(opts.Cols, n)
+	switch {
+	case cols == 0 && rows == 0:
+		cols = int(math.Ceil(math.Sqrt(float64(n))))
+		rows = (n + cols - 1) / cols
+	case cols == 0:
+		cols = (n + rows - 1) / rows
+	case rows == 0:
+		rows = (n + cols - 1) / cols
+	default:
+		rows = min(rows, (n+cols-1)/cols)
+	}
+	width = cols*opts.TileSize + (cols+1)*opts.Padding
+	height = rows*opts.TileSize + (rows+1)*opts.Padding
+	return rows, cols, width, height
+}
+
+// buildMontage lays the images out on a grid, each scaled to fit and centered in its cell.
+func buildMontage(images []image.Image, opts montageOptions) image.Image {
+	rows, cols, width, height := opts.grid(len(images))
+	tile, pad := opts.TileSize, opts.Padding
+	canvas := imaging.New(width, height, opts.Background)
+
+	for i, img := range images {
+		if i >= rows*cols {
+			break // Grid is smaller than the number of images; extra images are dropped
+		}
+		thumb := imaging.Fit(img, tile, tile, imaging.Lanczos)
+		col, row := i%cols, i/cols
+		x := pad + col*(tile+pad) + (tile-thumb.Bounds().Dx())/2
+		y := pad + row*(tile+pad) + (tile-thumb.Bounds().Dy())/2
+		canvas = imaging.Overlay(canvas, thumb, image.Pt(x, y), 1.0)
+	}
+	return canvas
+}
+
+// encodeMontage encodes the montage canvas in the requested output format.
+func encodeMontage(img image.Image, format string) ([]byte, error) {
+	if format == "pdf" {
+		return encodeImagesPDF(img)
+	}
+
+	imgFormat := imaging.PNG
+	if format == "jpg" {
+		imgFormat = imaging.JPEG
+	}
+	data, err := encodeImagePooled(img, imgFormat)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode montage: %w", err)
+	}
+	return data, nil
+}
+
+// handleMontage combines several uploaded images into a single grid image (contact sheet).
+func handleMontage(fs *FileStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		releaseSpool, err := tempSpace.reserveSpooling(r)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		defer releaseSpool()
+		if err := r.ParseMultipartForm(multipartMemory); err != nil {
+			log.Printf("Error parsing multipart form: %v", err)
+			http.Error(w, fmt.Sprintf("Could not parse multipart form: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		opts, err := parseMontageOptions(r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid montage options: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		attrs, err := parseJobAttributes(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		files, release, err := readUploadedFiles(r, "files")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer release()
+		if len(files) > maxMontageImages {
+			http.Error(w, fmt.Sprintf("Too many images: at most %d are allowed", maxMontageImages), http.StatusBadRequest)
+			return
+		}
+		if _, _, width, height := opts.grid(len(files)); width*height > maxMontagePixels {
+			http.Error(w, fmt.Sprintf("Montage of %dx%d pixels is too large: at most %d pixels are allowed, use a smaller tileSize or padding", width, height, maxMontagePixels), http.StatusBadRequest)
+			return
+		}
+
+		for i, f := range files {
+			if meta, err := fs.moderateUpload(r.Context(), f.Name, f.Data, &attrs); err != nil {
+				if meta != nil {
+					setJobHeaders(w, meta)
+				}
+				http.Error(w, fmt.Sprintf("Image %s: %v", f.Name, err), http.StatusUnprocessableEntity)
+				return
+			}
+			if files[i].Data, err = hookInput(r.Context(), f.Name, opts.Format, f.Data, attrs.Report); err != nil {
+				http.Error(w, fmt.Sprintf("Image %s: %v", f.Name, err), errorStatus(err))
+				return
+			}
+		}
+
+		images := make([]image.Image, 0, len(files))
+		for _, f := range files {
+			img, err := decodeAnyImage(f.Data)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Could not read image %s: %v", f.Name, err), http.StatusBadRequest)
+				return
+			}
+			images = append(images, img)
+		}
+
+		data, err := encodeMontage(buildMontage(images, opts), opts.Format)
+		if err != nil {
+			log.Printf("Error building montage: %v", err)
+			http.Error(w, fmt.Sprintf("Error building montage: %v", err), errorStatus(err))
+			return
+		}
+
+		meta, err := fs.storeFile(r.Context(), fmt.Sprintf("%d images", len(images)), "montage."+opts.Format, getContentTypeForExtension(opts.Format), data, attrs)
+		if err != nil {
+			log.Printf("Error storing montage: %v", err)
+			http.Error(w, fmt.Sprintf("Error processing file: %v", err), errorStatus(err))
+			return
+		}
+
+		writeUploadResponse(w, r, meta)
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/encoding"
+)
+
+// ConversionOptions holds optional, per-request settings that tune a conversion.
+// The zero value means "convert with defaults".
+type ConversionOptions struct {
+	// Report, when set, receives a record of the work done for the job, such as the
+	// external commands that were run. It is filled in rather than parsed.
+	Report *ConversionReport
+	// Deadlines bound the stages of the conversion.
+	Deadlines StageDeadlines
+
+	// Crop is an exact pixel rectangle to cut out of an image before anything else.
+	Crop *image.Rectangle
+	// AspectW and AspectH describe a target aspect ratio (e.g. 16:9) images are cropped to.
+	AspectW, AspectH int
+	// Gravity decides which part of the image is kept by an aspect-ratio crop.
+	Gravity string
+
+	// Caption is text drawn onto converted images and videos.
+	Caption string
+	// CaptionFont names one of the bundled fonts (see captionFonts).
+	CaptionFont string
+	// CaptionSize is the font size in pixels; 0 picks a size relative to the frame height.
+	CaptionSize int
+	// CaptionPosition is where the caption is placed: top, center or bottom.
+	CaptionPosition string
+	// CaptionColor is the text colour; the caption is always outlined in black for legibility.
+	CaptionColor color.NRGBA
+
+	// ChartType selects the chart drawn from tabular data: line, bar or pie.
+	ChartType string
+	// ChartX is the column used for labels / the x axis; defaults to the first column.
+	ChartX string
+	// ChartY lists the value columns to plot; defaults to every numeric column.
+	ChartY []string
+	// ChartTitle is an optional title drawn above the chart.
+	ChartTitle string
+	// ChartWidth and ChartHeight are the output size in pixels.
+	ChartWidth, ChartHeight int
+
+	// ViewportWidth and ViewportHeight size the browser window HTML is rendered in.
+	ViewportWidth, ViewportHeight int
+	// ScaleFactor is the device pixel ratio used for screenshots (2 for "retina" output).
+	ScaleFactor float64
+	// FullPage captures the whole scrollable page instead of just the viewport.
+	FullPage bool
+
+	// Table names the database table to export, or the table created on import.
+	Table string
+	// RowLimit caps the number of rows exported from tabular data; 0 means all rows.
+	RowLimit int
+	// Columns selects (and orders) the columns exported from tabular data; empty means all.
+	Columns []string
+	// Mapping renames, reorders, drops and coerces the columns of tabular data after
+	// Columns is applied (see parseColumnMapping).
+	Mapping []columnMapping
+
+	// LogFormat is the built-in log format to parse (see logFormats), jsonl, or auto.
+	LogFormat string
+	// LogPattern is a custom regular expression whose named groups become columns;
+	// it takes precedence over LogFormat.
+	LogPattern *regexp.Regexp
+
+	// TextWidth wraps plain text output at this many characters; 0 disables wrapping.
+	TextWidth int
+	// OmitLinks drops link URLs from plain text output instead of appending them in parentheses.
+	OmitLinks bool
+
+	// ArchiveMethod is the compression of archive outputs: deflate or zstd for zip,
+	// gzip, zstd or xz (lzma) for tar; empty picks deflate for zip and none for tar.
+	ArchiveMethod string
+	// ArchiveLevel is one of archiveLevels; "store" turns compression off.
+	ArchiveLevel string
+	// ArchiveSolid asks for a solid archive, compressed as one stream.
+	ArchiveSolid bool
+
+	// Charset is the character set of CSV input; nil means UTF-8. A byte order
+	// mark overrides it.
+	Charset encoding.Encoding
+	// Locale sets how numbers and dates are read from text tables and written to
+	// XLSX and PDF output, and their reading direction; nil keeps cells as they are.
+	Locale *tableLocale
+
+	// Sign signs PDF output with the configured certificate (see pdfSigning).
+	Sign bool
+	// SignReason and SignLocation are recorded in the signature.
+	SignReason, SignLocation string
+
+	// DetectLanguage reports the language of txt, md, html and srt documents.
+	DetectLanguage bool
+	// TranslateTo translates txt, md, html and srt documents into this language
+	// with the configured translator (see textTranslator) before converting them.
+	TranslateTo string
+	// TranslateFrom is the documents' language; empty detects it.
+	TranslateFrom string
+
+	// AudioTrack is muxed into video output as an extra track, such as an audio
+	// description; nil adds none.
+	AudioTrack *audioTrack
+
+	// Redact lists terms, patterns and boxes removed from documents printed to
+	// PDF; nil redacts nothing.
+	Redact *redaction
+}
+
+// validGravities lists the accepted values for the gravity option.
+var validGravities = map[string]bool{
+	"center": true, "north": true, "south": true, "east": true, "west": true,
+	"northeast": true, "northwest": true, "southeast": true, "southwest": true,
+	"entropy": true, "attention": true,
+}
+
+// parseConversionOptions reads conversion options from the request's form values.
+func parseConversionOptions(r *http.Request) (ConversionOptions, error) {
+	opts := ConversionOptions{Deadlines: conversionDeadlines}
+
+	if v := strings.TrimSpace(r.FormValue("crop")); v != "" {
+		rect, err := parseCropRect(v)
+		if err != nil {
+			return opts, err
+		}
+		opts.Crop = &rect
+	}
+
+	if v := strings.TrimSpace(r.FormValue("aspect")); v != "" {
+		w, h, err := parseAspectRatio(v)
+		if err != nil {
+			return opts, err
+		}
+		opts.AspectW, opts.AspectH = w, h
+	}
+
+	opts.Gravity = strings.ToLower(strings.TrimSpace(r.FormValue("gravity")))
+	if opts.Gravity == "" {
+		opts.Gravity = "center"
+	}
+	if !validGravities[opts.Gravity] {
+		return opts, fmt.Errorf("invalid gravity %q", opts.Gravity)
+	}
+
+	if err := parseCaptionOptions(r, &opts); err != nil {
+		return opts, err
+	}
+
+	if err := parseChartOptions(r, &opts); err != nil {
+		return opts, err
+	}
+
+	if err := parseRenderOptions(r, &opts); err != nil {
+		return opts, err
+	}
+
+	opts.Table = strings.TrimSpace(r.FormValue("table"))
+
+	if v := r.FormValue("rowLimit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return opts, fmt.Errorf("invalid rowLimit %q: must be a non-negative integer", v)
+		}
+		opts.RowLimit = n
+	}
+	for _, col := range strings.Split(r.FormValue("columns"), ",") {
+		if col = strings.TrimSpace(col); col != "" {
+			opts.Columns = append(opts.Columns, col)
+		}
+	}
+
+	if v := strings.TrimSpace(r.FormValue("mapping")); v != "" {
+		mapping, err := parseColumnMapping(v)
+		if err != nil {
+			return opts, err
+		}
+		opts.Mapping = mapping
+	}
+
+	if err := parseLogOptions(r, &opts); err != nil {
+		return opts, err
+	}
+
+	if v := r.FormValue("textWidth"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || (n != 0 && (n < 20 || n > 1000)) {
+			return opts, fmt.Errorf("invalid textWidth %q: must be 0 or between 20 and 1000", v)
+		}
+		opts.TextWidth = n
+	}
+	if v := r.FormValue("omitLinks"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid omitLinks %q: must be true or false", v)
+		}
+		opts.OmitLinks = b
+	}
+
+	if err := parseArchiveOptions(r, &opts); err != nil {
+		return opts, err
+	}
+
+	if err := parseLocaleOptions(r, &opts); err != nil {
+		return opts, err
+	}
+
+	if err := parseSigningOptions(r, &opts); err != nil {
+		return opts, err
+	}
+
+	if err := parseRedactionOptions(r, &opts); err != nil {
+		return opts, err
+	}
+
+	if err := parseLanguageOptions(r, &opts); err != nil {
+		return opts, err
+	}
+
+	if err := parseAudioTrackOptions(r, &opts); err != nil {
+		return opts, err
+	}
+
+	return opts, nil
+}
+
+// parseLogOptions reads the logFormat and logPattern form values into opts.
+func parseLogOptions(r *http.Request, opts *ConversionOptions) error {
+	opts.LogFormat = strings.ToLower(strings.TrimSpace(r.FormValue("logFormat")))
+	if opts.LogFormat == "" {
+		opts.LogFormat = "auto"
+	}
+	if _, ok := logFormats[opts.LogFormat]; !ok && opts.LogFormat != "auto" && opts.LogFormat != "jsonl" {
+		return fmt.Errorf("unknown log format %q", opts.LogFormat)
+	}
+
+	v := r.FormValue("logPattern")
+	if v == "" {
+		return nil
+	}
+	if len(v) > 2000 {
+		return fmt.Errorf("logPattern is too long")
+	}
+	re, err := regexp.Compile(v)
+	if err != nil {
+		return fmt.Errorf("invalid logPattern: %w", err)
+	}
+	named := false
+	for _, name := range re.SubexpNames() {
+		named = named || name != ""
+	}
+	if !named {
+		return fmt.Errorf("logPattern must contain at least one named group, e.g. (?P<level>\\w+)")
+	}
+	opts.LogPattern = re
+	return nil
+}
+
+// parseCaptionOptions reads the caption* form values into opts.
+func parseCaptionOptions(r *http.Request, opts *ConversionOptions) error {
+	opts.Caption = strings.TrimSpace(r.FormValue("caption"))
+	if len(opts.Caption) > maxCaptionLength {
+		return fmt.Errorf("caption is too long: at most %d characters are allowed", maxCaptionLength)
+	}
+
+	opts.CaptionFont = strings.ToLower(r.FormValue("captionFont"))
+	if opts.CaptionFont == "" {
+		opts.CaptionFont = "regular"
+	}
+	if _, ok := captionFonts[opts.CaptionFont]; !ok {
+		return fmt.Errorf("unknown caption font %q", opts.CaptionFont)
+	}
+
+	if v := r.FormValue("captionSize"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil || size < 6 || size > 500 {
+			return fmt.Errorf("invalid caption size %q: must be between 6 and 500", v)
+		}
+		opts.CaptionSize = size
+	}
+
+	opts.CaptionPosition = strings.ToLower(r.FormValue("captionPosition"))
+	switch opts.CaptionPosition {
+	case "":
+		opts.CaptionPosition = "bottom"
+	case "top", "center", "bottom":
+	default:
+		return fmt.Errorf("invalid caption position %q (use top, center or bottom)", opts.CaptionPosition)
+	}
+
+	opts.CaptionColor = color.NRGBA{255, 255, 255, 255}
+	if v := r.FormValue("captionColor"); v != "" {
+		c, err := parseColor(v)
+		if err != nil {
+			return err
+		}
+		opts.CaptionColor = c
+	}
+	return nil
+}
+
+// parseChartOptions reads the chart* form values into opts.
+func parseChartOptions(r *http.Request, opts *ConversionOptions) error {
+	opts.ChartType = strings.ToLower(r.FormValue("chartType"))
+	switch opts.ChartType {
+	case "":
+		opts.ChartType = "line"
+	case "line", "bar", "pie":
+	default:
+		return fmt.Errorf("invalid chart type %q (use line, bar or pie)", opts.ChartType)
+	}
+
+	opts.ChartX = strings.TrimSpace(r.FormValue("chartX"))
+	for _, col := range strings.Split(r.FormValue("chartY"), ",") {
+		if col = strings.TrimSpace(col); col != "" {
+			opts.ChartY = append(opts.ChartY, col)
+		}
+	}
+	opts.ChartTitle = r.FormValue("chartTitle")
+
+	opts.ChartWidth, opts.ChartHeight = 1024, 640
+	for field, dst := range map[string]*int{"chartWidth": &opts.ChartWidth, "chartHeight": &opts.ChartHeight} {
+		v := r.FormValue(field)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 100 || n > 4096 {
+			return fmt.Errorf("invalid %s %q: must be between 100 and 4096", field, v)
+		}
+		*dst = n
+	}
+	return nil
+}
+
+// parseRenderOptions reads the browser rendering form values into opts.
+func parseRenderOptions(r *http.Request, opts *ConversionOptions) error {
+	opts.ViewportWidth, opts.ViewportHeight = 1280, 800
+	for field, dst := range map[string]*int{"viewportWidth": &opts.ViewportWidth, "viewportHeight": &opts.ViewportHeight} {
+		v := r.FormValue(field)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 200 || n > 3840 {
+			return fmt.Errorf("invalid %s %q: must be between 200 and 3840", field, v)
+		}
+		*dst = n
+	}
+
+	opts.ScaleFactor = 1
+	if v := r.FormValue("scale"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0.5 || f > 4 {
+			return fmt.Errorf("invalid scale %q: must be between 0.5 and 4", v)
+		}
+		opts.ScaleFactor = f
+	}
+
+	opts.FullPage = true
+	if v := r.FormValue("fullPage"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid fullPage %q: must be true or false", v)
+		}
+		opts.FullPage = b
+	}
+	return nil
+}
+
+// parseCropRect parses a crop rectangle given as "x,y,width,height" in pixels.
+func parseCropRect(v string) (image.Rectangle, error) {
+	parts := strings.Split(v, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, fmt.Errorf("invalid crop %q: expected x,y,width,height", v)
+	}
+	var n [4]int
+	for i, p := range parts {
+		val, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil || val < 0 {
+			return image.Rectangle{}, fmt.Errorf("invalid crop %q: values must be non-negative integers", v)
+		}
+		n[i] = val
+	}
+	if n[2] == 0 || n[3] == 0 {
+		return image.Rectangle{}, fmt.Errorf("invalid crop %q: width and height must be positive", v)
+	}
+	return image.Rect(n[0], n[1], n[0]+n[2], n[1]+n[3]), nil
+}
+
+// parseAspectRatio parses an aspect ratio given as "W:H" (e.g. "16:9").
+func parseAspectRatio(v string) (int, int, error) {
+	w, h, ok := strings.Cut(v, ":")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid aspect ratio %q: expected W:H", v)
+	}
+	aw, err1 := strconv.Atoi(strings.TrimSpace(w))
+	ah, err2 := strconv.Atoi(strings.TrimSpace(h))
+	if err1 != nil || err2 != nil || aw <= 0 || ah <= 0 {
+		return 0, 0, fmt.Errorf("invalid aspect ratio %q: both sides must be positive integers", v)
+	}
+	return aw, ah, nil
+}
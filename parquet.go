@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/parquet-go/parquet-go"
+)
+
+// parquetReadBatch is how many rows are read from a row group at a time.
+const parquetReadBatch = 1024
+
+// convertParquet exports a parquet file as csv or json. Nested columns are
+// flattened to their dotted path; repeated values become a JSON array.
+func convertParquet(ctx context.Context, inputFileBytes []byte, outputFilename, targetFormat string, opts ConversionOptions) ([]byte, string, error) {
+	f, err := parquet.OpenFile(bytes.NewReader(inputFileBytes), int64(len(inputFileBytes)))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: failed to open parquet file: %w", ErrInputCorrupt, err)
+	}
+
+	schema := f.Schema()
+	paths := schema.Columns()
+	t := &table{Columns: make([]string, len(paths))}
+	leaves := make([]parquet.LeafColumn, len(paths))
+	for i, path := range paths {
+		t.Columns[i] = strings.Join(path, ".")
+		leaves[i], _ = schema.Lookup(path...)
+	}
+
+	// Stop reading as soon as the row limit is reached so previews of large files stay cheap.
+	limit := f.NumRows()
+	if opts.RowLimit > 0 && int64(opts.RowLimit) < limit {
+		limit = int64(opts.RowLimit)
+	}
+
+	buf := make([]parquet.Row, parquetReadBatch)
+	for _, rg := range f.RowGroups() {
+		if int64(len(t.Rows)) >= limit {
+			break
+		}
+		rows := rg.Rows()
+		for int64(len(t.Rows)) < limit {
+			if err := ctx.Err(); err != nil {
+				rows.Close()
+				return nil, "", err
+			}
+			n, err := rows.ReadRows(buf)
+			for _, row := range buf[:n] {
+				if int64(len(t.Rows)) >= limit {
+					break
+				}
+				t.Rows = append(t.Rows, parquetRowCells(row, leaves))
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				rows.Close()
+				return nil, "", fmt.Errorf("%w: failed to read parquet rows: %w", ErrInputCorrupt, err)
+			}
+		}
+		rows.Close()
+	}
+
+	if err := t.applyColumnOptions(opts); err != nil {
+		return nil, "", err
+	}
+	out, err := writeTable(t, targetFormat)
+	return out, outputFilename, err
+}
+
+// parquetRowCells turns a parquet row into table cells, one per leaf column.
+func parquetRowCells(row parquet.Row, leaves []parquet.LeafColumn) []string {
+	values := make([][]string, len(leaves))
+	nulls := make([]bool, len(leaves))
+	for _, v := range row {
+		col := v.Column()
+		if col < 0 || col >= len(leaves) {
+			continue
+		}
+		if v.IsNull() {
+			nulls[col] = true
+			continue
+		}
+		values[col] = append(values[col], parquetValueString(v, leaves[col].Node))
+	}
+
+	cells := make([]string, len(leaves))
+	for i, vals := range values {
+		switch {
+		case leaves[i].MaxRepetitionLevel > 0 && (len(vals) > 0 || !nulls[i]):
+			encoded, _ := json.Marshal(vals)
+			cells[i] = string(encoded)
+		case len(vals) > 0:
+			cells[i] = vals[0]
+		}
+	}
+	return cells
+}
+
+// parquetValueString formats a parquet value, honouring the date and timestamp logical types.
+func parquetValueString(v parquet.Value, node parquet.Node) string {
+	if lt := node.Type().LogicalType(); lt != nil {
+		switch {
+		case lt.Date != nil:
+			return time.Unix(int64(v.Int32())*86400, 0).UTC().Format("2006-01-02")
+		case lt.Timestamp != nil:
+			n := v.Int64()
+			var ts time.Time
+			switch {
+			case lt.Timestamp.Unit.Millis != nil:
+				ts = time.UnixMilli(n)
+			case lt.Timestamp.Unit.Micros != nil:
+				ts = time.UnixMicro(n)
+			default:
+				ts = time.Unix(0, n)
+			}
+			return ts.UTC().Format(time.RFC3339Nano)
+		}
+	}
+
+	switch v.Kind() {
+	case parquet.Float:
+		return strconv.FormatFloat(float64(v.Float()), 'f', -1, 32)
+	case parquet.Double:
+		return strconv.FormatFloat(v.Double(), 'f', -1, 64)
+	default:
+		return v.String()
+	}
+}
+
+// convertTableToParquet writes CSV or JSON records as a parquet file. Every column
+// is optional; INTEGER and REAL columns (inferred as for SQLite imports) are stored
+// as int64 and double, everything else as UTF-8 strings. Parquet groups order their
+// fields by name, so columns come out sorted alphabetically.
+func convertTableToParquet(ctx context.Context, inputFileBytes []byte, outputFilename, sourceExt string, opts ConversionOptions) ([]byte, string, error) {
+	t, err := readTable(inputFileBytes, sourceExt, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := t.applyColumnOptions(opts); err != nil {
+		return nil, "", err
+	}
+	t.limitRows(opts.RowLimit)
+	if len(t.Columns) == 0 {
+		return nil, "", fmt.Errorf("input has no columns")
+	}
+
+	group := parquet.Group{}
+	types := make(map[string]string, len(t.Columns))
+	for i, col := range t.Columns {
+		if _, dup := group[col]; dup {
+			return nil, "", fmt.Errorf("duplicate column name %q", col)
+		}
+		types[col] = inferSQLiteType(t, i)
+		switch types[col] {
+		case "INTEGER":
+			group[col] = parquet.Optional(parquet.Int(64))
+		case "REAL":
+			group[col] = parquet.Optional(parquet.Leaf(parquet.DoubleType))
+		default:
+			group[col] = parquet.Optional(parquet.String())
+		}
+	}
+	schema := parquet.NewSchema("data", group)
+
+	// Map each schema column (sorted by name) back to its position in the table.
+	paths := schema.Columns()
+	source := make([]int, len(paths))
+	for i, path := range paths {
+		source[i] = t.columnIndex(path[0])
+	}
+
+	var buf bytes.Buffer
+	w := parquet.NewWriter(&buf, schema)
+	rows := make([]parquet.Row, 0, len(t.Rows))
+	for _, cells := range t.Rows {
+		row := make(parquet.Row, len(paths))
+		for i, src := range source {
+			switch val := sqliteValue(cells[src], types[t.Columns[src]]).(type) {
+			case nil:
+				row[i] = parquet.NullValue().Level(0, 0, i)
+			case string:
+				row[i] = parquet.ByteArrayValue([]byte(val)).Level(0, 1, i)
+			default:
+				row[i] = parquet.ValueOf(val).Level(0, 1, i)
+			}
+		}
+		rows = append(rows, row)
+	}
+	if _, err := w.WriteRows(rows); err != nil {
+		return nil, "", fmt.Errorf("failed to write parquet rows: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", fmt.Errorf("failed to finish parquet file: %w", err)
+	}
+	return buf.Bytes(), outputFilename, nil
+}
+
+// convertAvro exports the records of an Avro object container file as JSON.
+func convertAvro(ctx context.Context, inputFileBytes []byte, outputFilename, targetFormat string, opts ConversionOptions) ([]byte, string, error) {
+	ocf, err := goavro.NewOCFReader(bytes.NewReader(inputFileBytes))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: failed to open Avro file: %w", ErrInputCorrupt, err)
+	}
+
+	// The writer schema gives the field order and tells which fields are unions,
+	// whose values goavro wraps as {"type": value}.
+	var schema struct {
+		Fields []struct {
+			Name string          `json:"name"`
+			Type json.RawMessage `json:"type"`
+		} `json:"fields"`
+	}
+	if err := json.Unmarshal([]byte(ocf.Codec().Schema()), &schema); err != nil || len(schema.Fields) == 0 {
+		return nil, "", fmt.Errorf("only Avro files with a record schema are supported")
+	}
+	t := &table{}
+	unions := make([]bool, len(schema.Fields))
+	for i, field := range schema.Fields {
+		t.Columns = append(t.Columns, field.Name)
+		unions[i] = bytes.HasPrefix(bytes.TrimSpace(field.Type), []byte("["))
+	}
+
+	for ocf.Scan() {
+		if opts.RowLimit > 0 && len(t.Rows) >= opts.RowLimit {
+			break
+		}
+		if len(t.Rows)%1000 == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, "", err
+			}
+		}
+		datum, err := ocf.Read()
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: failed to read Avro record: %w", ErrInputCorrupt, err)
+		}
+		record, ok := datum.(map[string]any)
+		if !ok {
+			return nil, "", fmt.Errorf("unexpected Avro record of type %T", datum)
+		}
+		row := make([]string, len(t.Columns))
+		for i, col := range t.Columns {
+			v := record[col]
+			if wrapped, ok := v.(map[string]any); ok && unions[i] && len(wrapped) == 1 {
+				for _, inner := range wrapped {
+					v = inner
+				}
+			}
+			row[i] = avroCellString(v)
+		}
+		t.Rows = append(t.Rows, row)
+	}
+	if err := ocf.Err(); err != nil {
+		return nil, "", fmt.Errorf("%w: failed to read Avro file: %w", ErrInputCorrupt, err)
+	}
+
+	if err := t.applyColumnOptions(opts); err != nil {
+		return nil, "", err
+	}
+	out, err := writeTable(t, targetFormat)
+	return out, outputFilename, err
+}
+
+// avroCellString formats a decoded Avro value as a table cell; nested values keep their JSON text.
+func avroCellString(v any) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case []byte:
+		return string(val)
+	case time.Time:
+		return val.UTC().Format(time.RFC3339Nano)
+	case float32:
+		return strconv.FormatFloat(float64(val), 'f', -1, 32)
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	default:
+		encoded, err := json.Marshal(val)
+		if err != nil {
+			return fmt.Sprint(val)
+		}
+		return string(encoded)
+	}
+}
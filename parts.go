@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// defaultMultipartThresholdMB is the output size above which a manifest of
+	// download parts is offered; override with FILECONVERTER_MULTIPART_THRESHOLD_MB.
+	defaultMultipartThresholdMB = 1024
+	// defaultPartSizeMB is the size of each download part; override with
+	// FILECONVERTER_PART_SIZE_MB.
+	defaultPartSizeMB = 64
+)
+
+// multipartConfig decides when and how large outputs are split into parts that
+// clients fetch in parallel and join in order.
+type multipartConfig struct {
+	threshold int64 // Files larger than this get a parts manifest
+	partSize  int64
+}
+
+// downloadParts is the configured splitting of large downloads.
+var downloadParts = multipartConfig{threshold: defaultMultipartThresholdMB << 20, partSize: defaultPartSizeMB << 20}
+
+// loadMultipartConfig reads the threshold and part size from the environment.
+func loadMultipartConfig() multipartConfig {
+	c := multipartConfig{
+		threshold: int64(envInt("FILECONVERTER_MULTIPART_THRESHOLD_MB", defaultMultipartThresholdMB)) << 20,
+		partSize:  int64(envInt("FILECONVERTER_PART_SIZE_MB", defaultPartSizeMB)) << 20,
+	}
+	if c.partSize <= 0 {
+		c.partSize = defaultPartSizeMB << 20
+	}
+	return c
+}
+
+// downloadPart is one byte range of a file.
+type downloadPart struct {
+	Index  int    `json:"index"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	Range  string `json:"range"` // As an HTTP Range header value
+	URL    string `json:"url"`   // Downloads only this part
+}
+
+// offered reports whether a file of the given size gets a parts manifest.
+func (c multipartConfig) offered(size int64) bool {
+	return size > c.threshold
+}
+
+// count returns the number of parts a file of the given size splits into.
+func (c multipartConfig) count(size int64) int {
+	return int((size + c.partSize - 1) / c.partSize)
+}
+
+// part returns the byte range of part index of a file of the given size.
+func (c multipartConfig) part(size int64, index int) downloadPart {
+	offset := int64(index) * c.partSize
+	length := min(c.partSize, size-offset)
+	return downloadPart{
+		Index:  index,
+		Offset: offset,
+		Length: length,
+		Range:  fmt.Sprintf("bytes=%d-%d", offset, offset+length-1),
+	}
+}
+
+// parsePart reads the "part" query parameter of a download, which must name one
+// of the file's parts.
+func (c multipartConfig) parsePart(size int64, value string) (downloadPart, error) {
+	index, err := strconv.Atoi(value)
+	if err != nil || index < 0 || index >= c.count(size) {
+		return downloadPart{}, fmt.Errorf("part must be between 0 and %d", c.count(size)-1)
+	}
+	return c.part(size, index), nil
+}
+
+// handleFileParts lists the parts of a large file, each with its byte range and
+// a download URL, so clients can fetch them in parallel over several
+// connections. Parts are served by the download route with ?part=N, or can be
+// requested from the whole file with the given Range header.
+func handleFileParts(fs *FileStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		meta, ok := authorizeFile(fs, w, r, r.PathValue("id"), accessShare)
+		if !ok {
+			return
+		}
+		if meta.Status != jobCompleted {
+			http.Error(w, "Job has no output to download", http.StatusNotFound)
+			return
+		}
+		if !downloadParts.offered(meta.Size) {
+			http.Error(w, fmt.Sprintf("File is not larger than %d MB; download it in one request", downloadParts.threshold>>20), http.StatusBadRequest)
+			return
+		}
+
+		base := downloadURL(r, meta)
+		parts := make([]downloadPart, downloadParts.count(meta.Size))
+		for i := range parts {
+			parts[i] = downloadParts.part(meta.Size, i)
+			parts[i].URL = base + "&part=" + strconv.Itoa(i)
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"fileId":      meta.ID,
+			"fileName":    meta.ConvertedName,
+			"contentType": meta.ContentType,
+			"size":        meta.Size,
+			"partSize":    downloadParts.partSize,
+			"downloadUrl": base,
+			"parts":       parts,
+		})
+	}
+}
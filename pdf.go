@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+)
+
+// pdfDocument is a minimal PDF writer: it collects numbered objects and
+// serializes them with a classic cross-reference table. It only covers what
+// the converters generate (image pages), not the PDF spec at large.
+type pdfDocument struct {
+	objects [][]byte // objects[i] is the body of object number i+1
+	pages   []int    // object numbers of page objects, in order
+}
+
+// add appends an object body and returns its object number.
+func (d *pdfDocument) add(body []byte) int {
+	d.objects = append(d.objects, body)
+	return len(d.objects)
+}
+
+// reserve allocates an object number whose body is set later.
+func (d *pdfDocument) reserve() int {
+	return d.add(nil)
+}
+
+// set fills in the body of a previously reserved object.
+func (d *pdfDocument) set(num int, body []byte) {
+	d.objects[num-1] = body
+}
+
+// addStream adds a stream object with the given extra dictionary entries.
+func (d *pdfDocument) addStream(dict string, data []byte) int {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<< %s /Length %d >>\nstream\n", dict, len(data))
+	b.Write(data)
+	b.WriteString("\nendstream")
+	return d.add(b.Bytes())
+}
+
+// addImagePage adds a page showing img at 72 DPI, so one pixel maps to one point.
+func (d *pdfDocument) addImagePage(img image.Image) error {
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, img, &jpeg.Options{Quality: 90}); err != nil {
+		return fmt.Errorf("failed to encode page image: %w", err)
+	}
+
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	imageObj := d.addStream(fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /DCTDecode", w, h), jpg.Bytes())
+	content := fmt.Sprintf("q %d 0 0 %d 0 0 cm /Im0 Do Q", w, h)
+	contentObj := d.addStream("", []byte(content))
+
+	d.addPage(w, h, fmt.Sprintf("/XObject << /Im0 %d 0 R >>", imageObj), contentObj)
+	return nil
+}
+
+// addPage adds a page of the given size in points with the given resources and content stream.
+func (d *pdfDocument) addPage(width, height int, resources string, contentObj int) {
+	// The parent reference is patched in by bytes() once the page tree exists.
+	page := d.add([]byte(fmt.Sprintf("<< /Type /Page /Parent %%PARENT%% /MediaBox [0 0 %d %d] /Resources << %s >> /Contents %d 0 R >>", width, height, resources, contentObj)))
+	d.pages = append(d.pages, page)
+}
+
+// bytes serializes the document.
+func (d *pdfDocument) bytes() []byte {
+	pagesObj := d.reserve()
+	var kids bytes.Buffer
+	for _, p := range d.pages {
+		fmt.Fprintf(&kids, "%d 0 R ", p)
+		d.set(p, bytes.Replace(d.objects[p-1], []byte("%PARENT%"), []byte(fmt.Sprintf("%d 0 R", pagesObj)), 1))
+	}
+	d.set(pagesObj, []byte(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", kids.String(), len(d.pages))))
+	catalogObj := d.add([]byte(fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pagesObj)))
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	offsets := make([]int, len(d.objects))
+	for i, body := range d.objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n", i+1)
+		out.Write(body)
+		out.WriteString("\nendobj\n")
+	}
+
+	xrefOffset := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(d.objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(d.objects)+1, catalogObj, xrefOffset)
+	return out.Bytes()
+}
+
+// encodeImagesPDF renders each image as its own page of a PDF document.
+func encodeImagesPDF(images ...image.Image) ([]byte, error) {
+	var doc pdfDocument
+	for _, img := range images {
+		if err := doc.addImagePage(img); err != nil {
+			return nil, err
+		}
+	}
+	return doc.bytes(), nil
+}
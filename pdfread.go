@@ -0,0 +1,776 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// pdfFile reads the objects of an existing PDF through its cross-reference
+// data. Like pdfDocument it covers only what the service needs, amending files
+// with incremental updates, not the PDF spec at large: encrypted files and
+// streams with filters other than Flate are not supported.
+type pdfFile struct {
+	data       []byte
+	xref       map[int]pdfXrefEntry // The newest entry of every object number
+	trailer    pdfDict              // The newest trailer, or cross-reference stream dictionary
+	startxref  int                  // Offset of the newest cross-reference section
+	xrefStream bool                 // The newest section is a cross-reference stream
+	objStreams map[int]pdfObjStream // Decoded object streams, by object number
+	resolving  map[int]bool         // Objects being read, to catch references looping back to them
+}
+
+// pdfObjStream is a decoded object stream: a header of object numbers and
+// offsets, followed at first by the objects.
+type pdfObjStream struct {
+	first int
+	data  []byte
+}
+
+// pdfXrefEntry locates an object: at an offset in the file, or as the index-th
+// object of an object stream.
+type pdfXrefEntry struct {
+	offset int
+	gen    int
+	stream int // Object stream number; 0 if the object is not compressed
+	index  int
+	free   bool
+}
+
+// PDF object types. Integers are int, reals float64, booleans bool and null nil.
+type (
+	pdfName   string
+	pdfString []byte
+	pdfArray  []any
+	pdfDict   map[pdfName]any
+	pdfRef    struct{ num, gen int }
+	pdfStream struct {
+		dict pdfDict
+		data []byte // Encoded, as in the file
+	}
+)
+
+// readPDF indexes a PDF's objects by following its cross-reference sections from
+// the last one back.
+func readPDF(data []byte) (*pdfFile, error) {
+	tail := data[max(0, len(data)-2048):]
+	i := bytes.LastIndex(tail, []byte("startxref"))
+	if i < 0 {
+		return nil, fmt.Errorf("%w: not a PDF file: startxref not found", ErrInputCorrupt)
+	}
+	p := &pdfParser{data: tail, pos: i + len("startxref")}
+	v, err := p.value()
+	offset, ok := v.(int)
+	if err != nil || !ok || offset <= 0 || offset >= len(data) {
+		return nil, fmt.Errorf("%w: invalid PDF file: bad startxref", ErrInputCorrupt)
+	}
+
+	f := &pdfFile{data: data, xref: map[int]pdfXrefEntry{}, startxref: offset, objStreams: map[int]pdfObjStream{}, resolving: map[int]bool{}}
+	if err := f.loadXref(offset, map[int]bool{}); err != nil {
+		return nil, fmt.Errorf("%w: invalid PDF file: %w", ErrInputCorrupt, err)
+	}
+	if _, ok := f.trailer["Encrypt"]; ok {
+		return nil, fmt.Errorf("%w: encrypted PDF files are not supported", ErrUnsupportedConversion)
+	}
+	if _, ok := f.trailer["Root"].(pdfRef); !ok {
+		return nil, fmt.Errorf("%w: invalid PDF file: the trailer has no document catalog", ErrInputCorrupt)
+	}
+	return f, nil
+}
+
+// loadXref reads the cross-reference section at offset and the older ones it
+// points to. Entries read first win, as newer sections come first.
+func (f *pdfFile) loadXref(offset int, seen map[int]bool) error {
+	if seen[offset] || offset <= 0 || offset >= len(f.data) {
+		return nil
+	}
+	seen[offset] = true
+	p := &pdfParser{data: f.data, pos: offset}
+	p.skipSpace()
+
+	var trailer pdfDict
+	if bytes.HasPrefix(f.data[p.pos:], []byte("xref")) {
+		p.pos += len("xref")
+		for {
+			p.skipSpace()
+			if bytes.HasPrefix(f.data[p.pos:], []byte("trailer")) {
+				p.pos += len("trailer")
+				break
+			}
+			start, err1 := p.int()
+			count, err2 := p.int()
+			if err1 != nil || err2 != nil {
+				return fmt.Errorf("bad cross-reference table at %d", offset)
+			}
+			for n := start; n < start+count; n++ {
+				off, err1 := p.int()
+				gen, err2 := p.int()
+				kind := p.keyword()
+				if err1 != nil || err2 != nil || kind != "n" && kind != "f" {
+					return fmt.Errorf("bad cross-reference entry for object %d", n)
+				}
+				if _, ok := f.xref[n]; !ok {
+					f.xref[n] = pdfXrefEntry{offset: off, gen: gen, free: kind == "f"}
+				}
+			}
+		}
+		v, err := p.value()
+		if trailer, _ = v.(pdfDict); err != nil || trailer == nil {
+			return fmt.Errorf("bad trailer at %d", offset)
+		}
+		if f.trailer == nil {
+			f.trailer = trailer
+		}
+		// Hybrid files list compressed objects in a stream besides the table
+		if stm, ok := trailer["XRefStm"].(int); ok {
+			if err := f.loadXref(stm, seen); err != nil {
+				return err
+			}
+		}
+	} else {
+		_, _, v, err := f.readIndirect(offset)
+		if err != nil {
+			return err
+		}
+		s, ok := v.(pdfStream)
+		if !ok || s.dict["Type"] != pdfName("XRef") {
+			return fmt.Errorf("no cross-reference section at %d", offset)
+		}
+		if f.trailer == nil {
+			f.trailer, f.xrefStream = s.dict, true
+		}
+		trailer = s.dict
+		if err := f.loadXrefStream(s); err != nil {
+			return err
+		}
+	}
+
+	if prev, ok := trailer["Prev"].(int); ok {
+		return f.loadXref(prev, seen)
+	}
+	return nil
+}
+
+// loadXrefStream reads the entries of a cross-reference stream.
+func (f *pdfFile) loadXrefStream(s pdfStream) error {
+	data, err := f.decode(s)
+	if err != nil {
+		return err
+	}
+	w, _ := s.dict["W"].(pdfArray)
+	var widths [3]int
+	for i := range widths {
+		if i < len(w) {
+			widths[i], _ = w[i].(int)
+		}
+		// Fields wider than an int can't hold offsets this parser could use
+		if widths[i] < 0 || widths[i] > 8 {
+			return fmt.Errorf("invalid cross-reference stream field width %d", widths[i])
+		}
+	}
+	rowSize := widths[0] + widths[1] + widths[2]
+	index, _ := s.dict["Index"].(pdfArray)
+	if index == nil {
+		size, _ := s.dict["Size"].(int)
+		index = pdfArray{0, size}
+	}
+	field := func(row []byte, i int) int {
+		start := 0
+		for _, w := range widths[:i] {
+			start += w
+		}
+		if widths[i] == 0 {
+			return map[int]int{0: 1}[i] // The type defaults to 1, the others to 0
+		}
+		n := 0
+		for _, b := range row[start : start+widths[i]] {
+			n = n<<8 | int(b)
+		}
+		return n
+	}
+	for i := 0; i+1 < len(index); i += 2 {
+		start, _ := index[i].(int)
+		count, _ := index[i+1].(int)
+		for n := start; n < start+count; n++ {
+			if rowSize == 0 || len(data) < rowSize {
+				return fmt.Errorf("truncated cross-reference stream")
+			}
+			row := data[:rowSize]
+			data = data[rowSize:]
+			if _, ok := f.xref[n]; ok {
+				continue
+			}
+			switch field(row, 0) {
+			case 0:
+				f.xref[n] = pdfXrefEntry{free: true}
+			case 1:
+				f.xref[n] = pdfXrefEntry{offset: field(row, 1), gen: field(row, 2)}
+			case 2:
+				f.xref[n] = pdfXrefEntry{stream: field(row, 1), index: field(row, 2)}
+			}
+		}
+	}
+	return nil
+}
+
+// size returns the number of the next free object number.
+func (f *pdfFile) size() int {
+	n, _ := f.trailer["Size"].(int)
+	for num := range f.xref {
+		n = max(n, num+1)
+	}
+	return n
+}
+
+// object returns the value of an object, or nil if it does not exist. Objects
+// whose reading needs themselves, such as a stream whose length refers to the
+// stream, are an error rather than endless recursion.
+func (f *pdfFile) object(ref pdfRef) (any, error) {
+	e, ok := f.xref[ref.num]
+	if !ok || e.free {
+		return nil, nil
+	}
+	if f.resolving[ref.num] {
+		return nil, fmt.Errorf("object %d refers back to itself", ref.num)
+	}
+	f.resolving[ref.num] = true
+	defer delete(f.resolving, ref.num)
+	if e.stream == 0 {
+		_, _, v, err := f.readIndirect(e.offset)
+		return v, err
+	}
+
+	objs, ok := f.objStreams[e.stream]
+	if !ok {
+		v, err := f.object(pdfRef{num: e.stream})
+		if err != nil {
+			return nil, err
+		}
+		s, ok := v.(pdfStream)
+		if !ok {
+			return nil, fmt.Errorf("object stream %d not found", e.stream)
+		}
+		if objs.data, err = f.decode(s); err != nil {
+			return nil, err
+		}
+		objs.first, _ = s.dict["First"].(int)
+		f.objStreams[e.stream] = objs
+	}
+	p := &pdfParser{data: objs.data}
+	for i := 0; i <= e.index; i++ {
+		num, err1 := p.int()
+		off, err2 := p.int()
+		if err1 != nil || err2 != nil || i == e.index && num != ref.num {
+			return nil, fmt.Errorf("object %d not found in object stream %d", ref.num, e.stream)
+		}
+		if i == e.index {
+			if objs.first < 0 || off < 0 || objs.first+off >= len(objs.data) {
+				return nil, fmt.Errorf("object %d lies outside object stream %d", ref.num, e.stream)
+			}
+			p.pos = objs.first + off
+		}
+	}
+	return p.value()
+}
+
+// resolve follows a reference to the object it names; other values are
+// returned as they are.
+func (f *pdfFile) resolve(v any) (any, error) {
+	if ref, ok := v.(pdfRef); ok {
+		return f.object(ref)
+	}
+	return v, nil
+}
+
+// readIndirect reads the indirect object "num gen obj ... endobj" at offset.
+func (f *pdfFile) readIndirect(offset int) (num, gen int, v any, err error) {
+	if offset <= 0 || offset >= len(f.data) {
+		return 0, 0, nil, fmt.Errorf("object offset %d out of range", offset)
+	}
+	p := &pdfParser{data: f.data, pos: offset}
+	num, err1 := p.int()
+	gen, err2 := p.int()
+	if err1 != nil || err2 != nil || p.keyword() != "obj" {
+		return 0, 0, nil, fmt.Errorf("no object at offset %d", offset)
+	}
+	if v, err = p.value(); err != nil {
+		return 0, 0, nil, err
+	}
+	dict, ok := v.(pdfDict)
+	save := p.pos
+	if !ok || p.keyword() != "stream" {
+		p.pos = save
+		return num, gen, v, nil
+	}
+
+	// The data starts after the end of line following the keyword
+	if bytes.HasPrefix(f.data[p.pos:], []byte("\r\n")) {
+		p.pos += 2
+	} else if p.pos < len(f.data) && (f.data[p.pos] == '\n' || f.data[p.pos] == '\r') {
+		p.pos++
+	}
+	lv, err := f.resolve(dict["Length"])
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	length, ok := lv.(int)
+	if !ok || length < 0 || p.pos+length > len(f.data) {
+		// Fall back on the endstream keyword when the length is wrong
+		end := bytes.Index(f.data[p.pos:], []byte("endstream"))
+		if end < 0 {
+			return 0, 0, nil, fmt.Errorf("stream of object %d is not terminated", num)
+		}
+		length = len(bytes.TrimRight(f.data[p.pos:p.pos+end], "\r\n"))
+	}
+	return num, gen, pdfStream{dict: dict, data: f.data[p.pos : p.pos+length]}, nil
+}
+
+// decode returns the decoded data of a stream.
+func (f *pdfFile) decode(s pdfStream) ([]byte, error) {
+	filter := s.dict["Filter"]
+	params, _ := s.dict["DecodeParms"].(pdfDict)
+	if a, ok := filter.(pdfArray); ok {
+		if len(a) > 1 {
+			return nil, fmt.Errorf("chained stream filters are not supported")
+		}
+		filter = nil
+		if len(a) == 1 {
+			filter = a[0]
+		}
+	}
+	if a, ok := s.dict["DecodeParms"].(pdfArray); ok && len(a) == 1 {
+		params, _ = a[0].(pdfDict)
+	}
+	switch filter {
+	case nil:
+		return s.data, nil
+	case pdfName("FlateDecode"):
+		zr, err := zlib.NewReader(bytes.NewReader(s.data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode stream: %w", err)
+		}
+		data, err := io.ReadAll(zr)
+		if err != nil && len(data) == 0 {
+			return nil, fmt.Errorf("failed to decode stream: %w", err)
+		}
+		if predictor, _ := params["Predictor"].(int); predictor >= 10 {
+			columns, ok := params["Columns"].(int)
+			if !ok {
+				columns = 1
+			}
+			if columns < 1 || columns > len(data) {
+				return nil, fmt.Errorf("invalid predictor columns %d", columns)
+			}
+			return unpredictPNG(data, columns)
+		}
+		return data, nil
+	default:
+		return nil, fmt.Errorf("stream filter %v is not supported", filter)
+	}
+}
+
+// unpredictPNG undoes the PNG row filters cross-reference streams are often
+// encoded with, for rows of columns bytes.
+func unpredictPNG(data []byte, columns int) ([]byte, error) {
+	var out []byte
+	prev := make([]byte, columns)
+	for len(data) > 0 {
+		if len(data) < columns+1 {
+			return nil, fmt.Errorf("truncated predicted stream")
+		}
+		kind, row := data[0], append([]byte(nil), data[1:columns+1]...)
+		data = data[columns+1:]
+		for i := range row {
+			var left, upLeft byte
+			if i > 0 {
+				left, upLeft = row[i-1], prev[i-1]
+			}
+			up := prev[i]
+			switch kind {
+			case 1:
+				row[i] += left
+			case 2:
+				row[i] += up
+			case 3:
+				row[i] += byte((int(left) + int(up)) / 2)
+			case 4:
+				p := int(left) + int(up) - int(upLeft)
+				pa, pb, pc := abs(p-int(left)), abs(p-int(up)), abs(p-int(upLeft))
+				switch {
+				case pa <= pb && pa <= pc:
+					row[i] += left
+				case pb <= pc:
+					row[i] += up
+				default:
+					row[i] += upLeft
+				}
+			}
+		}
+		out = append(out, row...)
+		prev = row
+	}
+	return out, nil
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// maxPDFNesting bounds how deeply arrays and dictionaries may nest, so crafted
+// input can't exhaust the stack.
+const maxPDFNesting = 256
+
+// pdfParser reads PDF objects from data, starting at pos.
+type pdfParser struct {
+	data  []byte
+	pos   int
+	depth int // Arrays and dictionaries being read
+}
+
+// nest enters an array or dictionary; callers defer the returned func to leave it.
+func (p *pdfParser) nest() (func(), error) {
+	if p.depth >= maxPDFNesting {
+		return nil, fmt.Errorf("PDF objects nested deeper than %d levels", maxPDFNesting)
+	}
+	p.depth++
+	return func() { p.depth-- }, nil
+}
+
+func isPDFSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0
+}
+
+func isPDFDelimiter(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) >= 0
+}
+
+// skipSpace moves past white space and comments.
+func (p *pdfParser) skipSpace() {
+	for p.pos < len(p.data) {
+		switch c := p.data[p.pos]; {
+		case isPDFSpace(c):
+			p.pos++
+		case c == '%':
+			for p.pos < len(p.data) && p.data[p.pos] != '\n' && p.data[p.pos] != '\r' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// keyword reads a run of regular characters, such as "obj" or "123".
+func (p *pdfParser) keyword() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.data) && !isPDFSpace(p.data[p.pos]) && !isPDFDelimiter(p.data[p.pos]) {
+		p.pos++
+	}
+	return string(p.data[start:p.pos])
+}
+
+// int reads an integer.
+func (p *pdfParser) int() (int, error) {
+	return strconv.Atoi(p.keyword())
+}
+
+// value reads the next object.
+func (p *pdfParser) value() (any, error) {
+	p.skipSpace()
+	if p.pos >= len(p.data) {
+		return nil, fmt.Errorf("unexpected end of PDF data")
+	}
+	switch c := p.data[p.pos]; {
+	case c == '/':
+		p.pos++
+		start := p.pos
+		for p.pos < len(p.data) && !isPDFSpace(p.data[p.pos]) && !isPDFDelimiter(p.data[p.pos]) {
+			p.pos++
+		}
+		return pdfName(unescapePDFName(string(p.data[start:p.pos]))), nil
+	case c == '(':
+		return p.literalString()
+	case c == '<' && p.pos+1 < len(p.data) && p.data[p.pos+1] == '<':
+		p.pos += 2
+		leave, err := p.nest()
+		if err != nil {
+			return nil, err
+		}
+		defer leave()
+		dict := pdfDict{}
+		for {
+			p.skipSpace()
+			if bytes.HasPrefix(p.data[p.pos:], []byte(">>")) {
+				p.pos += 2
+				return dict, nil
+			}
+			key, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			name, ok := key.(pdfName)
+			if !ok {
+				return nil, fmt.Errorf("dictionary key is not a name at %d", p.pos)
+			}
+			if dict[name], err = p.value(); err != nil {
+				return nil, err
+			}
+		}
+	case c == '<':
+		end := bytes.IndexByte(p.data[p.pos:], '>')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated hex string")
+		}
+		hex := strings.Map(func(r rune) rune {
+			if isPDFSpace(byte(r)) {
+				return -1
+			}
+			return r
+		}, string(p.data[p.pos+1:p.pos+end]))
+		p.pos += end + 1
+		if len(hex)%2 == 1 {
+			hex += "0"
+		}
+		s := make(pdfString, len(hex)/2)
+		for i := range s {
+			b, err := strconv.ParseUint(hex[2*i:2*i+2], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid hex string")
+			}
+			s[i] = byte(b)
+		}
+		return s, nil
+	case c == '[':
+		p.pos++
+		leave, err := p.nest()
+		if err != nil {
+			return nil, err
+		}
+		defer leave()
+		var arr pdfArray
+		for {
+			p.skipSpace()
+			if p.pos < len(p.data) && p.data[p.pos] == ']' {
+				p.pos++
+				return arr, nil
+			}
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+	}
+
+	word := p.keyword()
+	switch word {
+	case "":
+		return nil, fmt.Errorf("unexpected %q in PDF data at %d", p.data[p.pos], p.pos)
+	case "true", "false":
+		return word == "true", nil
+	case "null":
+		return nil, nil
+	}
+	n, err := strconv.Atoi(word)
+	if err != nil {
+		f, err := strconv.ParseFloat(word, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected %q in PDF data", word)
+		}
+		return f, nil
+	}
+	// "num gen R" is a reference
+	save := p.pos
+	if gen, err := p.int(); err == nil && p.keyword() == "R" {
+		return pdfRef{num: n, gen: gen}, nil
+	}
+	p.pos = save
+	return n, nil
+}
+
+// literalString reads a string in parentheses, which may nest.
+func (p *pdfParser) literalString() (pdfString, error) {
+	p.pos++ // (
+	var s pdfString
+	depth := 1
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		p.pos++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			if depth--; depth == 0 {
+				return s, nil
+			}
+		case '\\':
+			if p.pos >= len(p.data) {
+				break
+			}
+			e := p.data[p.pos]
+			p.pos++
+			switch e {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				if p.pos < len(p.data) && p.data[p.pos] == '\n' {
+					p.pos++
+				}
+				continue
+			case '\n':
+				continue
+			case '0', '1', '2', '3', '4', '5', '6', '7':
+				n := int(e - '0')
+				for i := 0; i < 2 && p.pos < len(p.data) && p.data[p.pos] >= '0' && p.data[p.pos] <= '7'; i++ {
+					n = n*8 + int(p.data[p.pos]-'0')
+					p.pos++
+				}
+				c = byte(n)
+			default:
+				c = e
+			}
+		}
+		s = append(s, c)
+	}
+	return nil, fmt.Errorf("unterminated string")
+}
+
+// unescapePDFName decodes #xx escapes in a name.
+func unescapePDFName(s string) string {
+	if !strings.Contains(s, "#") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '#' && i+2 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// writePDFValue serializes a value in PDF syntax.
+func writePDFValue(b *bytes.Buffer, v any) {
+	switch v := v.(type) {
+	case nil:
+		b.WriteString("null")
+	case bool:
+		b.WriteString(strconv.FormatBool(v))
+	case int:
+		b.WriteString(strconv.Itoa(v))
+	case float64:
+		b.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+	case pdfName:
+		b.WriteByte('/')
+		for i := 0; i < len(v); i++ {
+			if c := v[i]; c < '!' || c > '~' || c == '#' || isPDFDelimiter(c) {
+				fmt.Fprintf(b, "#%02X", c)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	case pdfString:
+		b.WriteByte('(')
+		for _, c := range v {
+			switch c {
+			case '(', ')', '\\':
+				b.WriteByte('\\')
+				b.WriteByte(c)
+			case '\r':
+				b.WriteString(`\r`)
+			case '\n':
+				b.WriteString(`\n`)
+			default:
+				b.WriteByte(c)
+			}
+		}
+		b.WriteByte(')')
+	case pdfRef:
+		fmt.Fprintf(b, "%d %d R", v.num, v.gen)
+	case pdfArray:
+		b.WriteByte('[')
+		for i, e := range v {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			writePDFValue(b, e)
+		}
+		b.WriteByte(']')
+	case pdfDict:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, string(k))
+		}
+		sort.Strings(keys)
+		b.WriteString("<<")
+		for _, k := range keys {
+			b.WriteByte(' ')
+			writePDFValue(b, pdfName(k))
+			b.WriteByte(' ')
+			writePDFValue(b, v[pdfName(k)])
+		}
+		b.WriteString(" >>")
+	case pdfStream:
+		v.dict["Length"] = len(v.data)
+		writePDFValue(b, v.dict)
+		b.WriteString("\nstream\n")
+		b.Write(v.data)
+		b.WriteString("\nendstream")
+	}
+}
+
+// pdfTextString encodes text for a PDF string: as is if it is ASCII, otherwise
+// as UTF-16 with a byte order mark.
+func pdfTextString(s string) pdfString {
+	ascii := true
+	for i := 0; i < len(s); i++ {
+		ascii = ascii && s[i] < 0x80
+	}
+	if ascii {
+		return pdfString(s)
+	}
+	out := pdfString{0xfe, 0xff}
+	for _, u := range utf16.Encode([]rune(s)) {
+		out = append(out, byte(u>>8), byte(u))
+	}
+	return out
+}
+
+// text decodes a PDF text string, UTF-16 if it starts with a byte order mark and
+// PDFDocEncoding, read as Latin-1, otherwise.
+func (s pdfString) text() string {
+	if len(s) >= 2 && s[0] == 0xfe && s[1] == 0xff {
+		u := make([]uint16, (len(s)-2)/2)
+		for i := range u {
+			u[i] = uint16(s[2+2*i])<<8 | uint16(s[3+2*i])
+		}
+		return string(utf16.Decode(u))
+	}
+	r := make([]rune, len(s))
+	for i, c := range s {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
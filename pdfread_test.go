@@ -0,0 +1,39 @@
+package main
+
+import (
+	"image"
+	"testing"
+)
+
+// FuzzReadPDF feeds arbitrary bytes to the PDF reader and everything the verify
+// and sign paths do with a file it accepts. Any input may fail, none may panic
+// or recurse without bound.
+func FuzzReadPDF(f *testing.F) {
+	valid, err := encodeImagesPDF(image.NewGray(image.Rect(0, 0, 2, 2)))
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(valid)
+	// A stream whose length refers to the stream itself
+	f.Add([]byte("%PDF-1.7\n1 0 obj << /Length 1 0 R >> stream\nxx\nendstream endobj\nxref\n0 2\n0000000000 65535 f \n0000000009 00000 n \ntrailer << /Root 1 0 R /Size 2 >>\nstartxref\n64\n%%EOF\n"))
+	// A cross-reference stream with a negative field width
+	f.Add([]byte("%PDF-1.7\n1 0 obj << /Type /XRef /W [1 -1 2] /Size 2 /Root 1 0 R /Length 6 >> stream\n\x01\x00\x00\x00\x00\x00\nendstream endobj\nstartxref\n9\n%%EOF\n"))
+	// Predictor parameters with negative columns
+	f.Add([]byte("%PDF-1.7\n1 0 obj << /Type /XRef /W [1 2 1] /Size 1 /Root 1 0 R /Filter /FlateDecode /DecodeParms << /Predictor 12 /Columns -4 >> /Length 8 >> stream\nx\x9c\x03\x00\x00\x00\x00\x01\nendstream endobj\nstartxref\n9\n%%EOF\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		file, err := readPDF(data)
+		if err != nil {
+			return
+		}
+		for num := range file.xref {
+			file.object(pdfRef{num: num})
+		}
+		if root, ok := file.trailer["Root"].(pdfRef); ok {
+			if catalog, err := file.dict(root); err == nil {
+				file.firstPage(catalog)
+			}
+		}
+		verifyPDFSignatures(data)
+	})
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+// PDFs are signed with an invisible signature field holding a detached CMS
+// signature (adbe.pkcs7.detached) over the whole file, appended as an
+// incremental update so the original bytes stay as they are.
+
+// maxSignatureText caps the length of the signReason and signLocation options.
+const maxSignatureText = 200
+
+// pdfSigner holds the key and certificates PDFs are signed with.
+type pdfSigner struct {
+	key   crypto.Signer
+	cert  *x509.Certificate
+	chain []*x509.Certificate // Issuers of cert, sent along for verification
+}
+
+// pdfSigning is the configured signer, or nil if PDF signing is not set up.
+var pdfSigning *pdfSigner
+
+// CMS and algorithm object identifiers (RFC 5652, RFC 5754, RFC 5758).
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidSHA1          = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	oidRSA           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSASHA256   = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+)
+
+// loadPDFSigner reads the PKCS#12 file named by FILECONVERTER_PDF_SIGN_CERT,
+// unlocked with FILECONVERTER_PDF_SIGN_PASSWORD. It returns nil if none is set.
+func loadPDFSigner() (*pdfSigner, error) {
+	path := os.Getenv("FILECONVERTER_PDF_SIGN_CERT")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PDF signing certificate: %w", err)
+	}
+	// Only the legacy PKCS#12 encryption (3DES, SHA-1 MAC) can be read; OpenSSL 3
+	// writes it with "openssl pkcs12 -export -legacy".
+	blocks, err := pkcs12.ToPEM(data, os.Getenv("FILECONVERTER_PDF_SIGN_PASSWORD"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PDF signing certificate %s (export it with legacy encryption): %w", path, err)
+	}
+
+	s := &pdfSigner{}
+	var certs []*x509.Certificate
+	for _, b := range blocks {
+		switch b.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(b.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("invalid certificate in %s: %w", path, err)
+			}
+			certs = append(certs, cert)
+		case "PRIVATE KEY":
+			if key, err := x509.ParsePKCS1PrivateKey(b.Bytes); err == nil {
+				s.key = key
+			} else if key, err := x509.ParseECPrivateKey(b.Bytes); err == nil {
+				s.key = key
+			}
+		}
+	}
+	if s.key == nil {
+		return nil, fmt.Errorf("no RSA or ECDSA private key in %s", path)
+	}
+	for _, cert := range certs {
+		if pub, ok := cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); ok && pub.Equal(s.key.Public()) {
+			s.cert = cert
+		} else {
+			s.chain = append(s.chain, cert)
+		}
+	}
+	if s.cert == nil {
+		return nil, fmt.Errorf("no certificate for the private key in %s", path)
+	}
+	return s, nil
+}
+
+// parseSigningOptions reads the sign, signReason and signLocation form values
+// into opts.
+func parseSigningOptions(r *http.Request, opts *ConversionOptions) error {
+	if v := r.FormValue("sign"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid sign %q: must be true or false", v)
+		}
+		opts.Sign = b
+	}
+	if opts.Sign && pdfSigning == nil {
+		return fmt.Errorf("PDF signing is not configured on this server")
+	}
+	opts.SignReason = strings.TrimSpace(r.FormValue("signReason"))
+	opts.SignLocation = strings.TrimSpace(r.FormValue("signLocation"))
+	if len(opts.SignReason) > maxSignatureText || len(opts.SignLocation) > maxSignatureText {
+		return fmt.Errorf("signReason and signLocation may be at most %d characters", maxSignatureText)
+	}
+	return nil
+}
+
+// sign appends a signature over the whole of a PDF to it.
+func (s *pdfSigner) sign(data []byte, opts ConversionOptions) ([]byte, error) {
+	f, err := readPDF(data)
+	if err != nil {
+		return nil, err
+	}
+	rootRef := f.trailer["Root"].(pdfRef)
+	catalog, err := f.dict(rootRef)
+	if err != nil {
+		return nil, err
+	}
+	pageRef, page, err := f.firstPage(catalog)
+	if err != nil {
+		return nil, err
+	}
+
+	next := f.size()
+	sigRef, widgetRef := pdfRef{num: next}, pdfRef{num: next + 1}
+	updated := map[int]any{}
+
+	// The signature field goes in the form of the document, as a widget on the
+	// first page with an empty rectangle, so it is not drawn.
+	formRef, formIsRef := catalog["AcroForm"].(pdfRef)
+	form := pdfDict{}
+	if v, err := f.resolve(catalog["AcroForm"]); err != nil {
+		return nil, err
+	} else if d, ok := v.(pdfDict); ok {
+		form = d
+	}
+	fields, err := f.array(form["Fields"])
+	if err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("Signature%d", len(fields)+1)
+	form["Fields"] = append(fields, widgetRef)
+	form["SigFlags"] = 3 // Signatures exist; the file may only be appended to
+	if formIsRef {
+		updated[formRef.num] = form
+	} else {
+		catalog["AcroForm"] = form
+		updated[rootRef.num] = catalog
+	}
+
+	annots, err := f.array(page["Annots"])
+	if err != nil {
+		return nil, err
+	}
+	page["Annots"] = append(annots, widgetRef)
+	updated[pageRef.num] = page
+
+	updated[widgetRef.num] = pdfDict{
+		"Type": pdfName("Annot"), "Subtype": pdfName("Widget"), "FT": pdfName("Sig"),
+		"T": pdfTextString(name), "V": sigRef, "P": pageRef,
+		"Rect": pdfArray{0, 0, 0, 0}, "F": 132, // Print and Locked
+	}
+
+	sig := pdfDict{
+		"Type": pdfName("Sig"), "Filter": pdfName("Adobe.PPKLite"), "SubFilter": pdfName("adbe.pkcs7.detached"),
+		"M": pdfString("D:" + time.Now().UTC().Format("20060102150405") + "Z"),
+	}
+	if cn := s.cert.Subject.CommonName; cn != "" {
+		sig["Name"] = pdfTextString(cn)
+	}
+	if opts.SignReason != "" {
+		sig["Reason"] = pdfTextString(opts.SignReason)
+	}
+	if opts.SignLocation != "" {
+		sig["Location"] = pdfTextString(opts.SignLocation)
+	}
+	updated[sigRef.num] = sig
+
+	// The signature covers everything but its own /Contents, which is reserved
+	// with room for the CMS structure and filled in once the offsets are known.
+	reserve := 4096
+	for _, cert := range append([]*x509.Certificate{s.cert}, s.chain...) {
+		reserve += len(cert.Raw)
+	}
+	const byteRangeHolder = "[0 0000000000 0000000000 0000000000]"
+	placeholders := map[int]string{sigRef.num: " /ByteRange " + byteRangeHolder + " /Contents <" + strings.Repeat("0", 2*reserve) + ">"}
+
+	out := f.appendUpdate(updated, placeholders)
+	sigStart := bytes.Index(out[len(data):], []byte(" /ByteRange "+byteRangeHolder)) + len(data)
+	contentsStart := sigStart + len(" /ByteRange "+byteRangeHolder+" /Contents ")
+	contentsEnd := contentsStart + 2*reserve + 2
+	byteRange := fmt.Sprintf("[0 %d %d %d]", contentsStart, contentsEnd, len(out)-contentsEnd)
+	if len(byteRange) > len(byteRangeHolder) {
+		return nil, fmt.Errorf("PDF is too large to sign")
+	}
+	copy(out[sigStart+len(" /ByteRange "):], byteRange+strings.Repeat(" ", len(byteRangeHolder)-len(byteRange)))
+
+	digest := sha256.New()
+	digest.Write(out[:contentsStart])
+	digest.Write(out[contentsEnd:])
+	cms, err := s.signDigest(digest.Sum(nil), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if len(cms) > reserve {
+		return nil, fmt.Errorf("signature is larger than the space reserved for it")
+	}
+	hex.Encode(out[contentsStart+1:], cms)
+	return out, nil
+}
+
+// appendUpdate returns the file with the given objects appended as an
+// incremental update, in a cross-reference section of the same kind as the
+// file's newest one. Placeholders are raw dictionary entries written into the
+// objects with those numbers.
+func (f *pdfFile) appendUpdate(objects map[int]any, placeholders map[int]string) []byte {
+	var b bytes.Buffer
+	b.Write(f.data)
+	if !bytes.HasSuffix(f.data, []byte("\n")) {
+		b.WriteByte('\n')
+	}
+
+	nums := make([]int, 0, len(objects)+1)
+	for num := range objects {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+	offsets := map[int]int{}
+	gens := map[int]int{}
+	for _, num := range nums {
+		offsets[num] = b.Len()
+		gens[num] = f.xref[num].gen
+		fmt.Fprintf(&b, "%d %d obj\n", num, gens[num])
+		var obj bytes.Buffer
+		writePDFValue(&obj, objects[num])
+		if extra, ok := placeholders[num]; ok {
+			obj.Truncate(obj.Len() - len(" >>"))
+			obj.WriteString(extra + " >>")
+		}
+		b.Write(obj.Bytes())
+		b.WriteString("\nendobj\n")
+	}
+
+	trailer := pdfDict{"Root": f.trailer["Root"], "Prev": f.startxref}
+	for _, key := range []pdfName{"Info", "ID"} {
+		if v, ok := f.trailer[key]; ok {
+			trailer[key] = v
+		}
+	}
+	xrefOffset := b.Len()
+	size := max(f.size(), nums[len(nums)-1]+1)
+
+	if f.xrefStream {
+		// The stream lists itself too
+		xrefNum := size
+		offsets[xrefNum] = xrefOffset
+		nums = append(nums, xrefNum)
+		var rows []byte
+		var index pdfArray
+		for _, num := range nums {
+			index = append(index, num, 1)
+			off := offsets[num]
+			rows = append(rows, 1, byte(off>>24), byte(off>>16), byte(off>>8), byte(off), byte(gens[num]>>8), byte(gens[num]))
+		}
+		trailer["Type"] = pdfName("XRef")
+		trailer["Size"] = xrefNum + 1
+		trailer["W"] = pdfArray{1, 4, 2}
+		trailer["Index"] = index
+		fmt.Fprintf(&b, "%d 0 obj\n", xrefNum)
+		writePDFValue(&b, pdfStream{dict: trailer, data: rows})
+		b.WriteString("\nendobj\n")
+	} else {
+		b.WriteString("xref\n")
+		for _, num := range nums {
+			fmt.Fprintf(&b, "%d 1\n%010d %05d n\r\n", num, offsets[num], gens[num])
+		}
+		trailer["Size"] = size
+		b.WriteString("trailer\n")
+		writePDFValue(&b, trailer)
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "startxref\n%d\n%%%%EOF\n", xrefOffset)
+	return b.Bytes()
+}
+
+// dict returns a copy of the dictionary an object holds.
+func (f *pdfFile) dict(ref pdfRef) (pdfDict, error) {
+	v, err := f.object(ref)
+	if err != nil {
+		return nil, err
+	}
+	d, ok := v.(pdfDict)
+	if !ok {
+		return nil, fmt.Errorf("invalid PDF file: object %d is not a dictionary", ref.num)
+	}
+	c := make(pdfDict, len(d))
+	for k, v := range d {
+		c[k] = v
+	}
+	return c, nil
+}
+
+// array returns a copy of an array, following a reference to it; a missing
+// array is empty.
+func (f *pdfFile) array(v any) (pdfArray, error) {
+	v, err := f.resolve(v)
+	if err != nil {
+		return nil, err
+	}
+	a, _ := v.(pdfArray)
+	return append(pdfArray(nil), a...), nil
+}
+
+// firstPage walks the page tree down to the first page.
+func (f *pdfFile) firstPage(catalog pdfDict) (pdfRef, pdfDict, error) {
+	ref, ok := catalog["Pages"].(pdfRef)
+	for depth := 0; ok && depth < 64; depth++ {
+		node, err := f.dict(ref)
+		if err != nil {
+			return pdfRef{}, nil, err
+		}
+		if node["Type"] == pdfName("Page") {
+			return ref, node, nil
+		}
+		kids, _ := node["Kids"].(pdfArray)
+		if len(kids) == 0 {
+			break
+		}
+		ref, ok = kids[0].(pdfRef)
+	}
+	return pdfRef{}, nil, fmt.Errorf("invalid PDF file: no pages found")
+}
+
+// signDigest builds a detached CMS SignedData structure signing the SHA-256
+// digest of a document.
+func (s *pdfSigner) signDigest(digest []byte, at time.Time) ([]byte, error) {
+	digestAlg := derSequence(derMust(asn1.Marshal(oidSHA256)))
+
+	// Signed attributes are a DER SET OF, sorted by their encoding
+	attrs := [][]byte{
+		derSequence(derMust(asn1.Marshal(oidContentType)), derSet(derMust(asn1.Marshal(oidData)))),
+		derSequence(derMust(asn1.Marshal(oidSigningTime)), derSet(derMust(asn1.Marshal(at.UTC())))),
+		derSequence(derMust(asn1.Marshal(oidMessageDigest)), derSet(derMust(asn1.Marshal(digest)))),
+	}
+	sort.Slice(attrs, func(i, j int) bool { return bytes.Compare(attrs[i], attrs[j]) < 0 })
+	signedAttrs := derSet(attrs...)
+
+	// The signature is over the attributes encoded as a SET, but they are stored
+	// with an implicit [0] tag
+	h := sha256.Sum256(signedAttrs)
+	signature, err := s.key.Sign(rand.Reader, h[:], crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign PDF: %w", err)
+	}
+	var sigAlg []byte
+	switch s.key.(type) {
+	case *rsa.PrivateKey:
+		sigAlg = derSequence(derMust(asn1.Marshal(oidRSA)), asn1.NullBytes)
+	case *ecdsa.PrivateKey:
+		sigAlg = derSequence(derMust(asn1.Marshal(oidECDSASHA256)))
+	}
+	taggedAttrs := append([]byte{0xa0}, signedAttrs[1:]...)
+
+	signerInfo := derSequence(
+		derMust(asn1.Marshal(1)),
+		derSequence(s.cert.RawIssuer, derMust(asn1.Marshal(s.cert.SerialNumber))),
+		digestAlg,
+		taggedAttrs,
+		sigAlg,
+		derMust(asn1.Marshal(signature)),
+	)
+	var certs [][]byte
+	for _, cert := range append([]*x509.Certificate{s.cert}, s.chain...) {
+		certs = append(certs, cert.Raw)
+	}
+	signedData := derSequence(
+		derMust(asn1.Marshal(1)),
+		derSet(digestAlg),
+		derSequence(derMust(asn1.Marshal(oidData))),
+		derTagged(0, certs...),
+		derSet(signerInfo),
+	)
+	return derSequence(derMust(asn1.Marshal(oidSignedData)), derTagged(0, signedData)), nil
+}
+
+// derSequence, derSet and derTagged wrap DER encoded values in a SEQUENCE, a SET
+// or a constructed context-specific tag.
+func derSequence(parts ...[]byte) []byte {
+	return derWrap(asn1.ClassUniversal, asn1.TagSequence, parts)
+}
+func derSet(parts ...[]byte) []byte { return derWrap(asn1.ClassUniversal, asn1.TagSet, parts) }
+func derTagged(tag int, parts ...[]byte) []byte {
+	return derWrap(asn1.ClassContextSpecific, tag, parts)
+}
+
+func derWrap(class, tag int, parts [][]byte) []byte {
+	return derMust(asn1.Marshal(asn1.RawValue{Class: class, Tag: tag, IsCompound: true, Bytes: bytes.Join(parts, nil)}))
+}
+
+// derMust returns an encoding of values that always encode.
+func derMust(b []byte, err error) []byte {
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
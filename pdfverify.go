@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"time"
+)
+
+// pdfTrustRoots are the certificate authorities signatures are checked against:
+// only those in FILECONVERTER_PDF_TRUST_CERTS. The system pool is not used, as
+// it holds the web's TLS authorities, which vouch for domains, not documents.
+// To verify documents this server signed, add the root of its signing
+// certificate to the file.
+var pdfTrustRoots = x509.NewCertPool()
+
+// loadPDFTrustRoots builds pdfTrustRoots.
+func loadPDFTrustRoots() error {
+	pool := x509.NewCertPool()
+	if path := os.Getenv("FILECONVERTER_PDF_TRUST_CERTS"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read PDF trust certificates: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in %s", path)
+		}
+	}
+	pdfTrustRoots = pool
+	return nil
+}
+
+// documentSigningEKUs are the extended key usages, besides emailProtection,
+// that let a certificate sign documents.
+var documentSigningEKUs = []asn1.ObjectIdentifier{
+	{1, 3, 6, 1, 5, 5, 7, 3, 36},       // id-kp-documentSigning (RFC 9336)
+	{1, 3, 6, 1, 4, 1, 311, 10, 3, 12}, // Microsoft Document Signing
+	{1, 2, 840, 113583, 1, 1, 5},       // Adobe Authentic Documents Trust
+}
+
+// signsDocuments reports whether a certificate's extended key usages allow
+// signing documents. A signer's certificate must name such a usage; authorities
+// may also leave their usages unrestricted.
+func signsDocuments(c *x509.Certificate, authority bool) bool {
+	if authority && len(c.ExtKeyUsage) == 0 && len(c.UnknownExtKeyUsage) == 0 {
+		return true
+	}
+	for _, u := range c.ExtKeyUsage {
+		if u == x509.ExtKeyUsageEmailProtection || authority && u == x509.ExtKeyUsageAny {
+			return true
+		}
+	}
+	for _, u := range c.UnknownExtKeyUsage {
+		for _, doc := range documentSigningEKUs {
+			if u.Equal(doc) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pdfSignatureReport describes one signature of a PDF and whether it holds.
+type pdfSignatureReport struct {
+	Field       string     `json:"field,omitempty"`
+	SubFilter   string     `json:"subFilter"`
+	Signer      string     `json:"signer,omitempty"`
+	Issuer      string     `json:"issuer,omitempty"`
+	SigningTime *time.Time `json:"signingTime,omitempty"`
+	Reason      string     `json:"reason,omitempty"`
+	Location    string     `json:"location,omitempty"`
+	// CoversWholeDocument is false when the file was changed after signing;
+	// the signature then only vouches for the revision it signed.
+	CoversWholeDocument bool `json:"coversWholeDocument"`
+	// DigestValid means the signed bytes are unchanged, SignatureValid that the
+	// certificate's key signed them, and CertificateTrusted that the certificate
+	// chains to a trusted root.
+	DigestValid        bool   `json:"digestValid"`
+	SignatureValid     bool   `json:"signatureValid"`
+	CertificateTrusted bool   `json:"certificateTrusted"`
+	Valid              bool   `json:"valid"`
+	Error              string `json:"error,omitempty"`
+}
+
+// verifyPDFSignatures checks every signature of a PDF.
+func verifyPDFSignatures(data []byte) ([]pdfSignatureReport, error) {
+	f, err := readPDF(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Signature dictionaries have to be plain objects, as their byte ranges are
+	// file offsets; fields point at them by their /V entry.
+	var sigs []int
+	fieldNames := map[int]string{}
+	for num, e := range f.xref {
+		if e.free || e.stream != 0 {
+			continue
+		}
+		v, err := f.object(pdfRef{num: num})
+		d, ok := v.(pdfDict)
+		if err != nil || !ok {
+			continue
+		}
+		if _, ok := d["ByteRange"].(pdfArray); ok {
+			if _, ok := d["Contents"].(pdfString); ok {
+				sigs = append(sigs, num)
+			}
+		}
+		if ref, ok := d["V"].(pdfRef); ok && d["FT"] == pdfName("Sig") {
+			if t, ok := d["T"].(pdfString); ok {
+				fieldNames[ref.num] = t.text()
+			}
+		}
+	}
+	sort.Ints(sigs)
+
+	reports := make([]pdfSignatureReport, 0, len(sigs))
+	for _, num := range sigs {
+		d, _ := f.dict(pdfRef{num: num})
+		report := pdfSignatureReport{Field: fieldNames[num]}
+		if err := report.check(data, d); err != nil {
+			report.Error = err.Error()
+		}
+		report.Valid = report.DigestValid && report.SignatureValid && report.CertificateTrusted
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// check verifies the signature in dictionary d, filling in the report as it
+// goes, and returns why it does not hold.
+func (report *pdfSignatureReport) check(data []byte, d pdfDict) error {
+	subFilter, _ := d["SubFilter"].(pdfName)
+	report.SubFilter = string(subFilter)
+	if s, ok := d["Reason"].(pdfString); ok {
+		report.Reason = s.text()
+	}
+	if s, ok := d["Location"].(pdfString); ok {
+		report.Location = s.text()
+	}
+	if subFilter != "adbe.pkcs7.detached" && subFilter != "ETSI.CAdES.detached" {
+		return fmt.Errorf("signature format %s is not supported", subFilter)
+	}
+
+	br, _ := d["ByteRange"].(pdfArray)
+	var r [4]int
+	for i := range r {
+		if i < len(br) {
+			r[i], _ = br[i].(int)
+		}
+	}
+	if len(br) != 4 || r[0] != 0 || r[1] <= 0 || r[2] < r[1] || r[3] < 0 || r[2]+r[3] > len(data) {
+		return fmt.Errorf("invalid byte range")
+	}
+	report.CoversWholeDocument = r[2]+r[3] == len(data)
+	signed := append(append([]byte(nil), data[:r[1]]...), data[r[2]:r[2]+r[3]]...)
+
+	// The only bytes left unsigned must be the signature itself, or content
+	// could hide in the gap
+	contents, _ := d["Contents"].(pdfString)
+	if !isHexStringOf(data[r[1]:r[2]], contents) {
+		return fmt.Errorf("the byte range leaves more than the signature unsigned")
+	}
+	sd, err := parseSignedData(contents)
+	if err != nil {
+		return err
+	}
+	cert := sd.signer
+	report.Signer = cert.Subject.String()
+	report.Issuer = cert.Issuer.String()
+	if sd.signingTime != nil {
+		report.SigningTime = sd.signingTime
+	}
+
+	h := sd.hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	if sd.signedAttrs == nil {
+		// Without signed attributes the signature is over the data itself
+		report.DigestValid = true
+		if err := cert.CheckSignature(sd.algorithm, signed, sd.signature); err != nil {
+			return fmt.Errorf("signature does not match: %w", err)
+		}
+	} else {
+		if report.DigestValid = bytes.Equal(digest, sd.messageDigest); !report.DigestValid {
+			return fmt.Errorf("the document was changed after it was signed")
+		}
+		if err := cert.CheckSignature(sd.algorithm, sd.signedAttrs, sd.signature); err != nil {
+			return fmt.Errorf("signature does not match: %w", err)
+		}
+	}
+	report.SignatureValid = true
+
+	intermediates := x509.NewCertPool()
+	for _, c := range sd.certs {
+		intermediates.AddCert(c)
+	}
+	verifyAt := time.Now()
+	if sd.signingTime != nil {
+		verifyAt = *sd.signingTime // Certificates may have expired since
+	}
+	if !signsDocuments(cert, false) {
+		return fmt.Errorf("certificate is not trusted: it is not meant for signing documents")
+	}
+	// Document signing usages are unknown to x509, so chains are checked for
+	// them here rather than by Verify
+	chains, err := cert.Verify(x509.VerifyOptions{
+		Roots: pdfTrustRoots, Intermediates: intermediates, CurrentTime: verifyAt,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("certificate is not trusted: %w", err)
+	}
+	for _, chain := range chains {
+		if !slices.ContainsFunc(chain[1:], func(c *x509.Certificate) bool { return !signsDocuments(c, true) }) {
+			report.CertificateTrusted = true
+			return nil
+		}
+	}
+	return fmt.Errorf("certificate is not trusted: its authority may not issue document signing certificates")
+}
+
+// isHexStringOf reports whether b is exactly a PDF hex string, "<...>",
+// holding contents.
+func isHexStringOf(b []byte, contents pdfString) bool {
+	if len(b) < 2 || b[0] != '<' || b[len(b)-1] != '>' || len(b)%2 != 0 {
+		return false
+	}
+	decoded := make([]byte, (len(b)-2)/2)
+	if _, err := hex.Decode(decoded, b[1:len(b)-1]); err != nil {
+		return false
+	}
+	return bytes.Equal(decoded, contents)
+}
+
+// cmsSignedData holds what verification needs from a CMS SignedData structure
+// with a single signer.
+type cmsSignedData struct {
+	certs         []*x509.Certificate
+	signer        *x509.Certificate
+	hash          crypto.Hash
+	algorithm     x509.SignatureAlgorithm
+	signedAttrs   []byte // DER encoded as a SET, as signed; nil if there are none
+	messageDigest []byte
+	signingTime   *time.Time
+	signature     []byte
+}
+
+// derChildren splits the contents of a constructed DER value into its elements.
+func derChildren(v asn1.RawValue) ([]asn1.RawValue, error) {
+	var children []asn1.RawValue
+	rest := v.Bytes
+	for len(rest) > 0 {
+		var child asn1.RawValue
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &child); err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+	return children, nil
+}
+
+// parseSignedData reads a detached CMS signature (RFC 5652). Signatures are
+// padded with zeros to the space reserved for them, which is ignored.
+func parseSignedData(der []byte) (*cmsSignedData, error) {
+	invalid := errors.New("invalid CMS signature")
+	var ci asn1.RawValue
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		return nil, invalid
+	}
+	parts, err := derChildren(ci)
+	var oid asn1.ObjectIdentifier
+	if err != nil || len(parts) != 2 {
+		return nil, invalid
+	}
+	if _, err := asn1.Unmarshal(parts[0].FullBytes, &oid); err != nil || !oid.Equal(oidSignedData) {
+		return nil, invalid
+	}
+	var signedData asn1.RawValue
+	if _, err := asn1.Unmarshal(parts[1].Bytes, &signedData); err != nil {
+		return nil, invalid
+	}
+	fields, err := derChildren(signedData)
+	if err != nil || len(fields) < 4 {
+		return nil, invalid
+	}
+
+	sd := &cmsSignedData{}
+	var signerInfos asn1.RawValue
+	for _, field := range fields[3:] {
+		switch {
+		case field.Class == asn1.ClassContextSpecific && field.Tag == 0:
+			certs, err := derChildren(field)
+			if err != nil {
+				return nil, invalid
+			}
+			for _, c := range certs {
+				if cert, err := x509.ParseCertificate(c.FullBytes); err == nil {
+					sd.certs = append(sd.certs, cert)
+				}
+			}
+		case field.Class == asn1.ClassUniversal && field.Tag == asn1.TagSet:
+			signerInfos = field
+		}
+	}
+	infos, err := derChildren(signerInfos)
+	if err != nil || len(infos) != 1 {
+		return nil, fmt.Errorf("CMS signature must have exactly one signer")
+	}
+	si, err := derChildren(infos[0])
+	if err != nil || len(si) < 5 {
+		return nil, invalid
+	}
+
+	// The signer is named by issuer and serial number, or by key identifier
+	sid := si[1]
+	for _, cert := range sd.certs {
+		if sid.Class == asn1.ClassContextSpecific {
+			if bytes.Equal(sid.Bytes, cert.SubjectKeyId) {
+				sd.signer = cert
+			}
+			continue
+		}
+		var ias struct {
+			Issuer asn1.RawValue
+			Serial *big.Int
+		}
+		if _, err := asn1.Unmarshal(sid.FullBytes, &ias); err == nil && bytes.Equal(ias.Issuer.FullBytes, cert.RawIssuer) && ias.Serial.Cmp(cert.SerialNumber) == 0 {
+			sd.signer = cert
+		}
+	}
+	if sd.signer == nil {
+		return nil, fmt.Errorf("the signer's certificate is not included in the signature")
+	}
+
+	var digestAlg, sigAlg struct {
+		Algorithm asn1.ObjectIdentifier
+		Params    asn1.RawValue `asn1:"optional"`
+	}
+	if _, err := asn1.Unmarshal(si[2].FullBytes, &digestAlg); err != nil {
+		return nil, invalid
+	}
+	rest := si[3:]
+	if rest[0].Class == asn1.ClassContextSpecific && rest[0].Tag == 0 {
+		sd.signedAttrs = append([]byte{0x31}, rest[0].FullBytes[1:]...)
+		if err := sd.readSignedAttrs(rest[0]); err != nil {
+			return nil, err
+		}
+		rest = rest[1:]
+	}
+	if len(rest) < 2 {
+		return nil, invalid
+	}
+	if _, err := asn1.Unmarshal(rest[0].FullBytes, &sigAlg); err != nil {
+		return nil, invalid
+	}
+	if _, err := asn1.Unmarshal(rest[1].FullBytes, &sd.signature); err != nil {
+		return nil, invalid
+	}
+	if sd.hash, sd.algorithm, err = cmsAlgorithms(digestAlg.Algorithm, sigAlg.Algorithm); err != nil {
+		return nil, err
+	}
+	return sd, nil
+}
+
+// readSignedAttrs picks the message digest and signing time out of the signed
+// attributes.
+func (sd *cmsSignedData) readSignedAttrs(attrs asn1.RawValue) error {
+	list, err := derChildren(attrs)
+	if err != nil {
+		return errors.New("invalid CMS signed attributes")
+	}
+	for _, a := range list {
+		var attr struct {
+			Type   asn1.ObjectIdentifier
+			Values asn1.RawValue
+		}
+		if _, err := asn1.Unmarshal(a.FullBytes, &attr); err != nil {
+			return errors.New("invalid CMS signed attributes")
+		}
+		values, err := derChildren(attr.Values)
+		if err != nil || len(values) == 0 {
+			continue
+		}
+		switch {
+		case attr.Type.Equal(oidMessageDigest):
+			asn1.Unmarshal(values[0].FullBytes, &sd.messageDigest)
+		case attr.Type.Equal(oidSigningTime):
+			var t time.Time
+			if _, err := asn1.Unmarshal(values[0].FullBytes, &t); err == nil {
+				sd.signingTime = &t
+			}
+		}
+	}
+	if sd.messageDigest == nil {
+		return errors.New("CMS signature has no message digest")
+	}
+	return nil
+}
+
+// cmsAlgorithms maps a CMS digest and signature algorithm to the hash and the
+// x509 signature algorithm they stand for.
+func cmsAlgorithms(digest, sig asn1.ObjectIdentifier) (crypto.Hash, x509.SignatureAlgorithm, error) {
+	var hash crypto.Hash
+	switch {
+	case digest.Equal(oidSHA1):
+		hash = crypto.SHA1
+	case digest.Equal(oidSHA256):
+		hash = crypto.SHA256
+	case digest.Equal(oidSHA384):
+		hash = crypto.SHA384
+	case digest.Equal(oidSHA512):
+		hash = crypto.SHA512
+	default:
+		return 0, 0, fmt.Errorf("digest algorithm %v is not supported", digest)
+	}
+
+	// RSA signatures name either the key type or the combined algorithm, and
+	// ECDSA ones the combined algorithm; the digest decides either way.
+	rsa := map[crypto.Hash]x509.SignatureAlgorithm{crypto.SHA1: x509.SHA1WithRSA, crypto.SHA256: x509.SHA256WithRSA, crypto.SHA384: x509.SHA384WithRSA, crypto.SHA512: x509.SHA512WithRSA}
+	ec := map[crypto.Hash]x509.SignatureAlgorithm{crypto.SHA1: x509.ECDSAWithSHA1, crypto.SHA256: x509.ECDSAWithSHA256, crypto.SHA384: x509.ECDSAWithSHA384, crypto.SHA512: x509.ECDSAWithSHA512}
+	switch {
+	case sig.Equal(oidRSA), len(sig) == 7 && sig[:6].Equal(oidRSA[:6]) && sig[6] >= 5 && sig[6] <= 13 && sig[6] != 10:
+		return hash, rsa[hash], nil
+	case len(sig) >= 6 && sig[:5].Equal(asn1.ObjectIdentifier{1, 2, 840, 10045, 4}), sig.Equal(asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}):
+		return hash, ec[hash], nil
+	default:
+		return 0, 0, fmt.Errorf("signature algorithm %v is not supported", sig)
+	}
+}
+
+// handleVerifyPDF reports on the signatures of an uploaded PDF, sent as the
+// "file" form value.
+func handleVerifyPDF() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		releaseSpool, err := tempSpace.reserveSpooling(r)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		defer releaseSpool()
+		if err := r.ParseMultipartForm(multipartMemory); err != nil {
+			http.Error(w, fmt.Sprintf("Could not parse multipart form: %v", err), http.StatusBadRequest)
+			return
+		}
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "Error retrieving file from form-data", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		data, err := io.ReadAll(file)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error reading file: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		reports, err := verifyPDFSignatures(data)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Cannot read %s: %v", header.Filename, err), http.StatusUnprocessableEntity)
+			return
+		}
+		// Earlier signatures of an incrementally signed file cover only the
+		// revisions before them, but a file whose last change no signature
+		// covers was changed after signing
+		valid, covered := len(reports) > 0, false
+		for _, report := range reports {
+			valid = valid && report.Valid
+			covered = covered || report.CoversWholeDocument
+		}
+		valid = valid && covered
+		log.Printf("Verified %d signatures of %s: valid=%v", len(reports), header.Filename, valid)
+		writeJSON(w, http.StatusOK, map[string]any{
+			"signed":     len(reports) > 0,
+			"valid":      valid,
+			"signatures": reports,
+		})
+	}
+}
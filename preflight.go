@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// preflightProbeSize is how much data the startup write test writes and syncs.
+	preflightProbeSize = 32 << 20
+	// defaultMinDiskFreeMB and defaultMinDiskWriteMBps are the levels below which
+	// the disk path is reported as degraded; override with
+	// FILECONVERTER_MIN_DISK_FREE_MB and FILECONVERTER_MIN_DISK_WRITE_MBPS.
+	defaultMinDiskFreeMB    = 1024
+	defaultMinDiskWriteMBps = 100
+)
+
+// diskReport describes the disk path's free space and write throughput.
+type diskReport struct {
+	Path       string    `json:"path"`
+	FreeBytes  int64     `json:"freeBytes"`            // -1 if unknown on this platform
+	WriteMBps  float64   `json:"writeMBps,omitempty"`  // Measured once, at startup
+	MeasuredAt time.Time `json:"measuredAt,omitempty"` // When throughput was measured
+	Warnings   []string  `json:"warnings,omitempty"`
+}
+
+// measureWriteThroughput writes and syncs a probe file in dir and returns the
+// throughput in MB/s. Syncing matters: without it the page cache hides slow disks.
+func measureWriteThroughput(dir string) (float64, error) {
+	f, err := os.CreateTemp(dir, "preflight-*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create probe file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	chunk := make([]byte, 1<<20)
+	rand.Read(chunk) // Incompressible, in case the filesystem compresses
+	start := time.Now()
+	for written := 0; written < preflightProbeSize; written += len(chunk) {
+		if _, err := f.Write(chunk); err != nil {
+			return 0, fmt.Errorf("failed to write probe file: %w", err)
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return 0, fmt.Errorf("failed to sync probe file: %w", err)
+	}
+	elapsed := time.Since(start).Seconds()
+	return float64(preflightProbeSize) / (1 << 20) / max(elapsed, 1e-6), nil
+}
+
+// checkDiskPath reports the disk path's free space and, when measureWrites is
+// set, its write throughput, with warnings for values below the thresholds.
+func checkDiskPath(dir string, measureWrites bool, writeMBps float64, measuredAt time.Time) diskReport {
+	report := diskReport{Path: dir, FreeBytes: -1, WriteMBps: writeMBps, MeasuredAt: measuredAt}
+	if abs, err := filepath.Abs(dir); err == nil {
+		report.Path = abs
+	}
+
+	if free, err := diskFreeBytes(dir); err != nil {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("could not determine free space: %v", err))
+	} else {
+		report.FreeBytes = free
+		if minFree := int64(envInt("FILECONVERTER_MIN_DISK_FREE_MB", defaultMinDiskFreeMB)) << 20; free < minFree {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("only %d MB free, below the %d MB minimum", free>>20, minFree>>20))
+		}
+	}
+
+	if measureWrites {
+		mbps, err := measureWriteThroughput(dir)
+		if err != nil {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("write test failed: %v", err))
+		} else {
+			report.WriteMBps, report.MeasuredAt = mbps, time.Now()
+		}
+	}
+	if minMBps := envInt("FILECONVERTER_MIN_DISK_WRITE_MBPS", defaultMinDiskWriteMBps); report.WriteMBps > 0 && report.WriteMBps < float64(minMBps) {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("writes at %.0f MB/s, below the %d MB/s minimum; video conversions will be slow", report.WriteMBps, minMBps))
+	}
+	return report
+}
+
+// preflight checks the disk path at startup and logs its numbers and any
+// warnings. The write test is skipped in single-shot mode to keep cold starts fast.
+func (fs *FileStore) preflight() {
+	report := checkDiskPath(fs.diskPath, !singleShot, 0, time.Time{})
+	log.Printf("Disk path %s: %d MB free, writes at %.0f MB/s", report.Path, report.FreeBytes>>20, report.WriteMBps)
+	for _, w := range report.Warnings {
+		log.Printf("Warning: disk path %s: %s", report.Path, w)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.disk = report
+}
+
+// handleHealthz reports that the server is up along with the state of the disk
+// path and the number of stored files; free space is measured afresh, throughput
+// is the startup measurement.
+func handleHealthz(fs *FileStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fs.mu.Lock()
+		startup := fs.disk
+		files := map[string]any{"stored": len(fs.files), "onDisk": fs.diskFiles, "limits": fs.limits}
+		fs.mu.Unlock()
+
+		disk := checkDiskPath(fs.diskPath, false, startup.WriteMBps, startup.MeasuredAt)
+		status := "ok"
+		if len(disk.Warnings) > 0 {
+			status = "degraded"
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"status": status, "disk": disk, "files": files})
+	}
+}
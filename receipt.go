@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Receipts are JSON Web Tokens (RFC 7519) signed with the server's receipt key.
+// A client asks for one with receipt=true; it records the hashes of the uploaded
+// and converted files, the request's options and when the job ran, so a
+// downstream system holding the public key from /v1/receipts/keys can check what
+// transformation was applied without trusting whoever handed it the file.
+
+// defaultReceiptIssuer is the "iss" claim when FILECONVERTER_RECEIPT_ISSUER is unset.
+const defaultReceiptIssuer = "fileconverter"
+
+// receiptSigner holds the key receipts are signed with.
+type receiptSigner struct {
+	key    crypto.Signer
+	alg    string // JWS algorithm: EdDSA, ES256 or RS256
+	kid    string // Key id, derived from the public key
+	issuer string
+}
+
+// receiptSigning is the configured signer, or nil if receipts are not set up.
+var receiptSigning *receiptSigner
+
+// loadReceiptSigner reads the PEM private key named by FILECONVERTER_RECEIPT_KEY.
+// Ed25519, ECDSA P-256 and RSA keys are accepted. It returns nil if none is set.
+func loadReceiptSigner() (*receiptSigner, error) {
+	path := os.Getenv("FILECONVERTER_RECEIPT_KEY")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read receipt key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block in receipt key %s", path)
+	}
+
+	var key any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid receipt key %s: %w", path, err)
+	}
+
+	s := &receiptSigner{issuer: os.Getenv("FILECONVERTER_RECEIPT_ISSUER")}
+	if s.issuer == "" {
+		s.issuer = defaultReceiptIssuer
+	}
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		s.key, s.alg = k, "EdDSA"
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("receipt key %s must use the P-256 curve", path)
+		}
+		s.key, s.alg = k, "ES256"
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("receipt key %s must have at least 2048 bits", path)
+		}
+		s.key, s.alg = k, "RS256"
+	default:
+		return nil, fmt.Errorf("receipt key %s is not an Ed25519, ECDSA or RSA key", path)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(s.key.Public())
+	if err != nil {
+		return nil, fmt.Errorf("invalid receipt key %s: %w", path, err)
+	}
+	sum := sha256.Sum256(der)
+	s.kid = hex.EncodeToString(sum[:8])
+	return s, nil
+}
+
+// sign encodes claims as a compact JWS.
+func (s *receiptSigner) sign(claims any) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": s.alg, "typ": "JWT", "kid": s.kid})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var sig []byte
+	switch key := s.key.(type) {
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(key, []byte(signingInput))
+	case *ecdsa.PrivateKey:
+		// JWS wants the two integers side by side rather than ASN.1 (RFC 7518 3.4)
+		h := sha256.Sum256([]byte(signingInput))
+		er, es, err := ecdsa.Sign(rand.Reader, key, h[:])
+		if err != nil {
+			return "", err
+		}
+		sig = make([]byte, 64)
+		er.FillBytes(sig[:32])
+		es.FillBytes(sig[32:])
+	case *rsa.PrivateKey:
+		h := sha256.Sum256([]byte(signingInput))
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:]); err != nil {
+			return "", err
+		}
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// jwk returns the public key as a JSON Web Key (RFC 7517).
+func (s *receiptSigner) jwk() map[string]string {
+	k := map[string]string{"kid": s.kid, "alg": s.alg, "use": "sig"}
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch pub := s.key.Public().(type) {
+	case ed25519.PublicKey:
+		k["kty"], k["crv"], k["x"] = "OKP", "Ed25519", b64(pub)
+	case *ecdsa.PublicKey:
+		x, y := make([]byte, 32), make([]byte, 32)
+		pub.X.FillBytes(x)
+		pub.Y.FillBytes(y)
+		k["kty"], k["crv"], k["x"], k["y"] = "EC", "P-256", b64(x), b64(y)
+	case *rsa.PublicKey:
+		k["kty"], k["n"], k["e"] = "RSA", b64(pub.N.Bytes()), b64(big.NewInt(int64(pub.E)).Bytes())
+	}
+	return k
+}
+
+// handleReceiptKeys publishes the receipt signing key as a JWK Set, so receipts
+// can be verified with any JWT library.
+func handleReceiptKeys() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if receiptSigning == nil {
+			http.Error(w, "Receipts are not enabled on this server", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"keys": []map[string]string{receiptSigning.jwk()}})
+	}
+}
+
+// ReceiptFile describes a file a receipt vouches for.
+type ReceiptFile struct {
+	Field       string `json:"field,omitempty"` // Form field an input was uploaded in
+	Name        string `json:"name"`
+	Format      string `json:"format,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"` // Hex-encoded
+}
+
+// receiptClaims is the payload of a receipt.
+type receiptClaims struct {
+	Issuer      string              `json:"iss"`
+	Subject     string              `json:"sub"` // ID of the converted file
+	ID          string              `json:"jti"`
+	IssuedAt    int64               `json:"iat"`
+	Inputs      []ReceiptFile       `json:"inputs"`
+	Output      ReceiptFile         `json:"output"`
+	Options     map[string][]string `json:"options,omitempty"` // Form values of the request
+	ReceivedAt  time.Time           `json:"receivedAt"`
+	CompletedAt time.Time           `json:"completedAt"`
+}
+
+// receiptRequest is what a job that asked for a receipt knows about its request
+// before the conversion runs.
+type receiptRequest struct {
+	inputs     []ReceiptFile
+	options    map[string][]string
+	receivedAt time.Time
+}
+
+// receiptExcludedFields are form values left out of receipts: the CSRF token is a
+// credential and the receipt flag says nothing about the conversion.
+var receiptExcludedFields = map[string]bool{csrfField: true, "receipt": true}
+
+// parseReceiptRequest reads the receipt form value and, if a receipt is wanted,
+// hashes the uploaded files. It returns nil if none is. The form must already be
+// parsed.
+func parseReceiptRequest(r *http.Request) (*receiptRequest, error) {
+	switch r.FormValue("receipt") {
+	case "", "false":
+		return nil, nil
+	case "true":
+	default:
+		return nil, fmt.Errorf("receipt must be true or false")
+	}
+	if receiptSigning == nil {
+		return nil, fmt.Errorf("receipts are not enabled on this server")
+	}
+
+	req := &receiptRequest{options: map[string][]string{}, receivedAt: time.Now()}
+	values := r.PostForm
+	if r.MultipartForm != nil {
+		values = r.MultipartForm.Value
+		for field, headers := range r.MultipartForm.File {
+			for _, h := range headers {
+				f, err := h.Open()
+				if err != nil {
+					return nil, fmt.Errorf("failed to read %s for the receipt: %w", h.Filename, err)
+				}
+				in, err := hashReceiptFile(f, h.Filename)
+				f.Close()
+				if err != nil {
+					return nil, err
+				}
+				in.Field = field
+				req.inputs = append(req.inputs, in)
+			}
+		}
+	}
+	for name, v := range values {
+		if !receiptExcludedFields[name] {
+			req.options[name] = v
+		}
+	}
+	return req, nil
+}
+
+// addInput records an input read from r that was not uploaded with the request,
+// such as the stored file a reconversion reads.
+func (req *receiptRequest) addInput(name string, r io.Reader) error {
+	if req == nil {
+		return nil
+	}
+	in, err := hashReceiptFile(r, name)
+	if err != nil {
+		return err
+	}
+	req.inputs = append(req.inputs, in)
+	return nil
+}
+
+// hashReceiptFile describes a file read from r for a receipt.
+func hashReceiptFile(r io.Reader, name string) (ReceiptFile, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return ReceiptFile{}, fmt.Errorf("failed to hash %s for the receipt: %w", name, err)
+	}
+	return ReceiptFile{Name: name, Format: fileFormat(name), Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// fileFormat returns a file name's extension without the dot.
+func fileFormat(name string) string {
+	return strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+}
+
+// issue signs the receipt of a stored file, given the hex-encoded SHA-256 of its
+// content. A nil request issues none.
+func (req *receiptRequest) issue(meta *FileMetadata, digest string) (string, error) {
+	if req == nil || receiptSigning == nil {
+		return "", nil
+	}
+	jti, err := generateID()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate receipt ID: %w", err)
+	}
+	now := time.Now()
+	receipt, err := receiptSigning.sign(receiptClaims{
+		Issuer:   receiptSigning.issuer,
+		Subject:  meta.ID,
+		ID:       jti,
+		IssuedAt: now.Unix(),
+		Inputs:   req.inputs,
+		Output: ReceiptFile{
+			Name:        meta.ConvertedName,
+			Format:      fileFormat(meta.ConvertedName),
+			ContentType: meta.ContentType,
+			Size:        meta.Size,
+			SHA256:      digest,
+		},
+		Options:     req.options,
+		ReceivedAt:  req.receivedAt.UTC(),
+		CompletedAt: now.UTC(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to sign receipt: %w", err)
+	}
+	return receipt, nil
+}
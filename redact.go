@@ -0,0 +1,463 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Limits on the redaction options of one request.
+const (
+	maxRedactionRules   = 100
+	maxRedactionPattern = 500
+	maxRedactionBoxes   = 50
+)
+
+// redactionMark replaces each redacted character, so the text is gone from the
+// PDF while the place it held shows as a solid bar.
+const redactionMark = "█"
+
+// redaction lists what to remove from a document before it is printed to PDF.
+// Terms and patterns are matched against the document's text; boxes remove
+// whatever is laid out under them.
+type redaction struct {
+	rules []redactionRule
+	boxes []redactionBox
+}
+
+// redactionRule is a term, matched literally and ignoring case, or a pattern.
+type redactionRule struct {
+	spec string
+	kind string // term or pattern
+	re   *regexp.Regexp
+}
+
+// redactionBox is a rectangle in CSS pixels of the rendered document, the
+// coordinates of a full-page png render at the same viewportWidth.
+type redactionBox struct {
+	spec string
+	rect image.Rectangle
+}
+
+// RedactionCount is how much one redaction rule removed from a document.
+type RedactionCount struct {
+	Rule    string `json:"rule"`    // The term, pattern or box as given
+	Kind    string `json:"kind"`    // term, pattern or box
+	Matches int    `json:"matches"` // Text matches, or characters and images under a box
+}
+
+// redactedAttributes are the attributes whose values end up in a printed PDF,
+// as alternative text or link targets, and are redacted like text. The values of
+// form fields are redacted whether they come from the attribute or not.
+var redactedAttributes = map[string]bool{
+	"alt": true, "title": true, "href": true, "aria-label": true,
+	"value": true, "placeholder": true, "content": true,
+}
+
+// parseRedactionOptions reads the redact, redactPattern and redactBox form
+// values into opts. Each may be repeated, and terms may also be given one per
+// line.
+func parseRedactionOptions(r *http.Request, opts *ConversionOptions) error {
+	rd := &redaction{}
+	for _, v := range r.Form["redact"] {
+		for _, term := range strings.Split(v, "\n") {
+			if term = strings.TrimSpace(term); term != "" {
+				rd.rules = append(rd.rules, redactionRule{spec: term, kind: "term", re: termPattern(term)})
+			}
+		}
+	}
+	for _, v := range r.Form["redactPattern"] {
+		if v == "" {
+			continue
+		}
+		if len(v) > maxRedactionPattern {
+			return fmt.Errorf("redactPattern is too long: at most %d characters are allowed", maxRedactionPattern)
+		}
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return fmt.Errorf("invalid redactPattern: %w", err)
+		}
+		if re.MatchString("") {
+			return fmt.Errorf("invalid redactPattern %q: it matches empty text", v)
+		}
+		rd.rules = append(rd.rules, redactionRule{spec: v, kind: "pattern", re: re})
+	}
+	for _, v := range r.Form["redactBox"] {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		rect, err := parseCropRect(v)
+		if err != nil {
+			return fmt.Errorf("invalid redactBox %q: expected x,y,width,height in pixels", v)
+		}
+		rd.boxes = append(rd.boxes, redactionBox{spec: v, rect: rect})
+	}
+
+	if len(rd.rules) > maxRedactionRules {
+		return fmt.Errorf("too many redaction terms and patterns: at most %d are allowed", maxRedactionRules)
+	}
+	if len(rd.boxes) > maxRedactionBoxes {
+		return fmt.Errorf("too many redaction boxes: at most %d are allowed", maxRedactionBoxes)
+	}
+	if len(rd.rules) > 0 || len(rd.boxes) > 0 {
+		opts.Redact = rd
+	}
+	return nil
+}
+
+// termPattern matches a term literally, ignoring case and however much
+// whitespace separates its words.
+func termPattern(term string) *regexp.Regexp {
+	words := strings.Fields(term)
+	for i, w := range words {
+		words[i] = regexp.QuoteMeta(w)
+	}
+	return regexp.MustCompile(`(?i)` + strings.Join(words, `\s+`))
+}
+
+// redactString replaces every match of the rules in s, adding to counts.
+func (rd *redaction) redactString(s string, counts []int) string {
+	for i, rule := range rd.rules {
+		s = rule.re.ReplaceAllStringFunc(s, func(m string) string {
+			counts[i]++
+			return strings.Repeat(redactionMark, utf8.RuneCountInString(m))
+		})
+	}
+	return s
+}
+
+// redactText redacts plain text and records the matches in report.
+func (rd *redaction) redactText(data []byte, report *ConversionReport) []byte {
+	counts := make([]int, len(rd.rules))
+	redacted := rd.redactString(string(data), counts)
+	report.addRedactions(rd.ruleCounts(counts)...)
+	return []byte(redacted)
+}
+
+// matchRanges finds the matches of the rules in text as redactString does, each
+// rule in the text the rules before it redacted, and returns the runs of
+// characters to redact as ranges of UTF-16 code units, the way JavaScript
+// indexes strings.
+func (rd *redaction) matchRanges(text string, counts []int) [][2]int {
+	runes := []rune(text)
+	redacted := make([]bool, len(runes))
+	current := make([]rune, len(runes))
+	for i, rule := range rd.rules {
+		for r, c := range runes {
+			current[r] = c
+			if redacted[r] {
+				current[r] = []rune(redactionMark)[0]
+			}
+		}
+		s := string(current)
+		runeAt := make([]int, len(s)+1) // Byte offset of each rune -> its index
+		r := 0
+		for b := range s {
+			runeAt[b] = r
+			r++
+		}
+		runeAt[len(s)] = r
+		for _, m := range rule.re.FindAllStringIndex(s, -1) {
+			counts[i]++
+			for r := runeAt[m[0]]; r < runeAt[m[1]]; r++ {
+				redacted[r] = true
+			}
+		}
+	}
+
+	ranges := [][2]int{}
+	unit := 0
+	for r, c := range runes {
+		n := utf16.RuneLen(c)
+		if redacted[r] {
+			if last := len(ranges) - 1; last >= 0 && ranges[last][1] == unit {
+				ranges[last][1] += n
+			} else {
+				ranges = append(ranges, [2]int{unit, unit + n})
+			}
+		}
+		unit += n
+	}
+	return ranges
+}
+
+// ruleCounts pairs the rules with their match counts.
+func (rd *redaction) ruleCounts(counts []int) []RedactionCount {
+	out := make([]RedactionCount, len(rd.rules))
+	for i, rule := range rd.rules {
+		out[i] = RedactionCount{Rule: rule.spec, Kind: rule.kind, Matches: counts[i]}
+	}
+	return out
+}
+
+// redact removes what the redaction asks for from the loaded page before it is
+// printed. The page's scripts are stopped first, so whatever text they wrote is
+// redacted as rendered and they can't put anything back afterwards. Boxes go
+// first, as their coordinates refer to the page before any text is replaced.
+func (s *chromiumSession) redact(rd *redaction, report *ConversionReport) error {
+	if err := s.call("Emulation.setScriptExecutionDisabled", map[string]any{"value": true}, nil); err != nil {
+		return fmt.Errorf("redaction failed: %w", err)
+	}
+	if len(rd.boxes) > 0 {
+		if err := s.redactBoxes(rd.boxes, report); err != nil {
+			return err
+		}
+	}
+	if len(rd.rules) > 0 {
+		return s.redactRules(rd, report)
+	}
+	return nil
+}
+
+// collectTextScript gathers the text of the page as a reader sees it, with
+// runs of whitespace collapsed to one space and a space between blocks, so
+// terms are found across markup, as in "John <b>Smith</b>", and across line
+// breaks. It also gathers the values of the attributes it is given and of form
+// fields. The nodes every character came from are kept for applyRedactionScript.
+const collectTextScript = `(attrNames) => {
+	const skip = new Set(['SCRIPT', 'STYLE', 'NOSCRIPT', 'TEMPLATE', 'TEXTAREA']);
+	const blockOf = (node) => {
+		for (let el = node.parentElement; el; el = el.parentElement) {
+			const display = getComputedStyle(el).display;
+			if (!display.startsWith('inline') && display !== 'contents') return el;
+		}
+		return null;
+	};
+
+	const nodes = [], map = [];
+	let text = '', block = null;
+	const walker = document.createTreeWalker(document.documentElement, NodeFilter.SHOW_TEXT);
+	while (walker.nextNode()) {
+		const node = walker.currentNode;
+		if (node.parentElement && skip.has(node.parentElement.tagName.toUpperCase())) continue;
+		const n = nodes.push(node) - 1;
+		const b = blockOf(node);
+		if (b !== block && text !== '' && !text.endsWith(' ')) {
+			text += ' ';
+			map.push(null);
+		}
+		block = b;
+		const data = node.data;
+		for (let i = 0; i < data.length; i++) {
+			if (/\s/.test(data[i])) {
+				if (text === '' || text.endsWith(' ')) continue;
+				text += ' ';
+			} else {
+				text += data[i];
+			}
+			map.push([n, i]);
+		}
+	}
+
+	const attrs = [];
+	for (const el of document.querySelectorAll('*')) {
+		for (const a of el.attributes) {
+			if (attrNames.includes(a.name.toLowerCase())) attrs.push({el, name: a.name, value: a.value});
+		}
+		if ((el.tagName === 'INPUT' || el.tagName === 'TEXTAREA') && el.value) attrs.push({el, prop: 'value', value: el.value});
+	}
+	window.__fileconverterRedaction = {nodes, map, attrs};
+	return {text, attrs: attrs.map(a => a.value)};
+}`
+
+// applyRedactionScript replaces the characters of the text collectTextScript
+// gathered that fall in the given ranges with the mark, one per character, and
+// sets the given attribute values. It returns how many nodes it changed.
+const applyRedactionScript = `(ranges, values, mark) => {
+	const {nodes, map, attrs} = window.__fileconverterRedaction;
+	delete window.__fileconverterRedaction;
+	const marked = nodes.map(() => new Set());
+	for (const [start, end] of ranges) {
+		for (let i = start; i < end; i++) {
+			if (map[i]) marked[map[i][0]].add(map[i][1]);
+		}
+	}
+
+	let changed = 0;
+	nodes.forEach((node, n) => {
+		if (marked[n].size === 0) return;
+		const data = node.data;
+		let out = '';
+		for (let i = 0; i < data.length; ) {
+			const k = data.codePointAt(i) > 0xffff ? 2 : 1;
+			out += marked[n].has(i) ? mark : data.slice(i, i + k);
+			i += k;
+		}
+		node.data = out;
+		changed++;
+	});
+	for (const [i, value] of values) {
+		const a = attrs[i];
+		if (a.prop) a.el[a.prop] = value;
+		else a.el.setAttribute(a.name, value);
+		changed++;
+	}
+	return changed;
+}`
+
+// redactRules redacts the terms and patterns in the text of the loaded page and
+// in the attributes that carry text into a PDF, and records the matches in
+// report.
+func (s *chromiumSession) redactRules(rd *redaction, report *ConversionReport) error {
+	attrNames := make([]string, 0, len(redactedAttributes))
+	for name := range redactedAttributes {
+		attrNames = append(attrNames, name)
+	}
+	slices.Sort(attrNames)
+	encoded, err := json.Marshal(attrNames)
+	if err != nil {
+		return err
+	}
+	var page struct {
+		Text  string   `json:"text"`
+		Attrs []string `json:"attrs"`
+	}
+	if err := s.evaluate("("+collectTextScript+")("+string(encoded)+")", &page); err != nil {
+		return fmt.Errorf("redaction failed: %w", err)
+	}
+
+	counts := make([]int, len(rd.rules))
+	ranges := rd.matchRanges(page.Text, counts)
+	values := [][]any{}
+	for i, v := range page.Attrs {
+		if redacted := rd.redactString(v, counts); redacted != v {
+			values = append(values, []any{i, redacted})
+		}
+	}
+	args, err := json.Marshal([]any{ranges, values, redactionMark})
+	if err != nil {
+		return err
+	}
+	var changed int
+	if err := s.evaluate("("+applyRedactionScript+")(..."+string(args)+")", &changed); err != nil {
+		return fmt.Errorf("redaction failed: %w", err)
+	}
+	report.addRedactions(rd.ruleCounts(counts)...)
+	return nil
+}
+
+// redactBoxesScript removes what is laid out under the boxes it is given, before
+// the page is printed: images, media and form fields are replaced by black
+// blocks of their size, characters of text by black blocks covering them, and
+// background images of elements reaching under a box, their ::before and
+// ::after included, are cleared. Everything is measured before the page is
+// changed. It returns the number of characters, elements and backgrounds
+// removed per box.
+const redactBoxesScript = `(boxes) => {
+	const counts = boxes.map(() => 0);
+	const sx = window.scrollX, sy = window.scrollY;
+	const boxOf = (r) => r.width <= 0 || r.height <= 0 ? -1 : boxes.findIndex(b =>
+		r.right + sx > b.x && r.left + sx < b.x + b.w && r.bottom + sy > b.y && r.top + sy < b.y + b.h);
+	const block = (w, h, display) => {
+		const d = document.createElement('span');
+		d.style.cssText = 'display:' + display + ';vertical-align:text-bottom;background:#000;width:' + w + 'px;height:' + h + 'px';
+		return d;
+	};
+
+	const elements = [];
+	for (const el of document.querySelectorAll('img,svg,canvas,video,picture,iframe,object,embed,input,textarea,select')) {
+		const r = el.getBoundingClientRect();
+		const i = boxOf(r);
+		if (i >= 0 && !elements.some(e => e.el.contains(el))) {
+			counts[i]++;
+			elements.push({el, w: r.width, h: r.height, display: getComputedStyle(el).display === 'block' ? 'block' : 'inline-block'});
+		}
+	}
+
+	const hasBackground = (el, pseudo) => getComputedStyle(el, pseudo).backgroundImage !== 'none';
+	const backgrounds = [];
+	for (const el of document.querySelectorAll('*')) {
+		if (!hasBackground(el, null) && !hasBackground(el, '::before') && !hasBackground(el, '::after')) continue;
+		const i = boxOf(el.getBoundingClientRect());
+		if (i >= 0) {
+			counts[i]++;
+			backgrounds.push(el);
+		}
+	}
+
+	const root = document.body || document.documentElement;
+	const walker = document.createTreeWalker(root, NodeFilter.SHOW_TEXT);
+	const range = document.createRange();
+	const runs = [];
+	while (walker.nextNode()) {
+		const node = walker.currentNode;
+		range.selectNodeContents(node);
+		if (![...range.getClientRects()].some(r => boxOf(r) >= 0)) continue;
+		const text = node.data;
+		let run = null;
+		for (let i = 0; i < text.length; ) {
+			const n = text.codePointAt(i) > 0xffff ? 2 : 1;
+			range.setStart(node, i);
+			range.setEnd(node, i + n);
+			const r = range.getBoundingClientRect();
+			const box = /\s/.test(text[i]) ? -1 : boxOf(r);
+			if (box < 0) {
+				run = null;
+			} else if (run && run.top === r.top) {
+				counts[box]++;
+				run.end = i + n;
+				run.left = Math.min(run.left, r.left);
+				run.right = Math.max(run.right, r.right);
+			} else {
+				counts[box]++;
+				run = {node, start: i, end: i + n, left: r.left, right: r.right, top: r.top, bottom: r.bottom};
+				runs.push(run);
+			}
+			i += n;
+		}
+	}
+
+	if (backgrounds.length > 0) {
+		const style = document.createElement('style');
+		style.textContent = '.fileconverter-redacted, .fileconverter-redacted::before, .fileconverter-redacted::after { background-image: none !important; }';
+		document.documentElement.appendChild(style);
+		for (const el of backgrounds) el.classList.add('fileconverter-redacted');
+	}
+	for (const e of elements) {
+		e.el.replaceWith(block(e.w, e.h, e.display));
+	}
+	for (const run of runs.reverse()) {
+		run.node.splitText(run.end);
+		run.node.splitText(run.start).replaceWith(block(run.right - run.left, run.bottom - run.top, 'inline-block'));
+	}
+	return counts;
+}`
+
+// redactBoxes runs redactBoxesScript on the loaded page and records what each
+// box removed in report.
+func (s *chromiumSession) redactBoxes(boxes []redactionBox, report *ConversionReport) error {
+	type box struct {
+		X int `json:"x"`
+		Y int `json:"y"`
+		W int `json:"w"`
+		H int `json:"h"`
+	}
+	arg := make([]box, len(boxes))
+	for i, b := range boxes {
+		arg[i] = box{b.rect.Min.X, b.rect.Min.Y, b.rect.Dx(), b.rect.Dy()}
+	}
+	encoded, err := json.Marshal(arg)
+	if err != nil {
+		return err
+	}
+
+	var counts []int
+	if err := s.evaluate("("+redactBoxesScript+")("+string(encoded)+")", &counts); err != nil {
+		return fmt.Errorf("redaction failed: %w", err)
+	}
+	if len(counts) != len(boxes) {
+		return fmt.Errorf("redaction failed: got %d counts for %d boxes", len(counts), len(boxes))
+	}
+	out := make([]RedactionCount, len(boxes))
+	for i, b := range boxes {
+		out[i] = RedactionCount{Rule: b.spec, Kind: "box", Matches: counts[i]}
+	}
+	report.addRedactions(out...)
+	return nil
+}
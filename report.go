@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxTracedStderr is how much of a command's stderr is kept in its trace.
+const maxTracedStderr = 4096
+
+// ConversionReport collects what happened while converting one file, so it can be
+// returned with the job's metadata. It is safe for concurrent use.
+type ConversionReport struct {
+	mu            sync.Mutex
+	commands      []CommandTrace
+	redactions    []RedactionCount
+	language      *LanguageReport
+	intermediates []IntermediateStep
+}
+
+// CommandTrace is the auditable record of one external command run for a job.
+type CommandTrace struct {
+	Binary     string   `json:"binary"`
+	Args       []string `json:"args"` // With paths to job files redacted
+	ExitCode   int      `json:"exitCode"`
+	DurationMs int64    `json:"durationMs"`
+	Stderr     string   `json:"stderr,omitempty"` // Truncated to maxTracedStderr
+	Error      string   `json:"error,omitempty"`  // Set when the command could not be started
+}
+
+// addCommand appends a command trace; a nil report discards it.
+func (r *ConversionReport) addCommand(trace CommandTrace) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.commands = append(r.commands, trace)
+}
+
+// Commands returns a copy of the traced commands.
+func (r *ConversionReport) Commands() []CommandTrace {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]CommandTrace(nil), r.commands...)
+}
+
+// addRedactions records what redaction rules removed; a nil report discards it.
+func (r *ConversionReport) addRedactions(counts ...RedactionCount) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.redactions = append(r.redactions, counts...)
+}
+
+// Redactions returns a copy of the recorded redaction counts.
+func (r *ConversionReport) Redactions() []RedactionCount {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]RedactionCount(nil), r.redactions...)
+}
+
+// setLanguage records the language of the converted document; a nil report
+// discards it.
+func (r *ConversionReport) setLanguage(language *LanguageReport) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.language = language
+}
+
+// Language returns the recorded language of the document, if any.
+func (r *ConversionReport) Language() *LanguageReport {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.language
+}
+
+// addIntermediate records a format the conversion passed through; a nil report
+// discards it.
+func (r *ConversionReport) addIntermediate(step IntermediateStep) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.intermediates = append(r.intermediates, step)
+}
+
+// Intermediates returns a copy of the recorded intermediate steps.
+func (r *ConversionReport) Intermediates() []IntermediateStep {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]IntermediateStep(nil), r.intermediates...)
+}
+
+// runCommand runs cmd like CombinedOutput does and records its trace in report.
+func runCommand(report *ConversionReport, cmd *exec.Cmd) ([]byte, error) {
+	var combined, stderr bytes.Buffer
+	cmd.Stdout = &combined
+	cmd.Stderr = io.MultiWriter(&combined, &stderr)
+
+	start := time.Now()
+	err := cmd.Run()
+	report.addCommand(newCommandTrace(cmd, time.Since(start), stderr.Bytes(), err))
+	if errors.Is(err, exec.ErrNotFound) {
+		err = &ToolMissingError{Tool: cmd.Args[0]}
+	}
+	return combined.Bytes(), err
+}
+
+// newCommandTrace builds the trace of a finished command.
+func newCommandTrace(cmd *exec.Cmd, elapsed time.Duration, stderr []byte, err error) CommandTrace {
+	trace := CommandTrace{
+		Binary:     filepath.Base(cmd.Path),
+		Args:       make([]string, 0, len(cmd.Args)-1),
+		DurationMs: elapsed.Milliseconds(),
+	}
+	var paths []string
+	for _, arg := range cmd.Args[1:] {
+		redacted, found := redactCommandArg(arg)
+		trace.Args = append(trace.Args, redacted)
+		paths = append(paths, found...)
+	}
+
+	// Tools echo their input and output paths in diagnostics; hide those too.
+	text := truncateTrace(stderr)
+	for _, p := range paths {
+		text = strings.ReplaceAll(text, p, "<path>"+filepath.Ext(p))
+	}
+	trace.Stderr = text
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+	case errors.As(err, &exitErr):
+		trace.ExitCode = exitErr.ExitCode()
+	default:
+		trace.ExitCode = -1
+		trace.Error = err.Error()
+	}
+	return trace
+}
+
+// truncateTrace keeps the end of a command's stderr, where errors are usually reported.
+func truncateTrace(b []byte) string {
+	if len(b) <= maxTracedStderr {
+		return string(b)
+	}
+	return "…" + string(b[len(b)-maxTracedStderr:])
+}
+
+// commandPathPattern matches absolute paths in an argument: the whole argument,
+// the value of a "--flag=" style option, or a quoted path inside a filter string.
+var commandPathPattern = regexp.MustCompile(`(^|[='"])/[^'":,]*`)
+
+// redactCommandArg hides file paths in a command argument, since they embed temp
+// directories and user-supplied file names, and returns the paths it replaced.
+// The extension is kept for debugging.
+func redactCommandArg(arg string) (string, []string) {
+	var paths []string
+	redacted := commandPathPattern.ReplaceAllStringFunc(arg, func(m string) string {
+		prefix := ""
+		if m[0] != '/' {
+			prefix, m = m[:1], m[1:]
+		}
+		paths = append(paths, m)
+		return prefix + "<path>" + filepath.Ext(m)
+	})
+	return redacted, paths
+}
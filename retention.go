@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// defaultMaxRetention caps how long any rule may keep a file unless the policy
+// file sets its own maximum.
+const defaultMaxRetention = 7 * 24 * time.Hour
+
+// retentionRule keeps files carrying a tag, or created with an API key, for a
+// different time than the default. Exactly one of Tag and APIKey is set.
+type retentionRule struct {
+	Tag    string `json:"tag,omitempty"`
+	Value  string `json:"value,omitempty"` // Empty matches any value of the tag
+	APIKey string `json:"apiKey,omitempty"`
+	Keep   string `json:"keep"` // A duration such as "24h"
+
+	keep time.Duration
+}
+
+// retentionPolicy decides how long a file is kept after it is stored.
+type retentionPolicy struct {
+	Default string          `json:"default,omitempty"`
+	Max     string          `json:"max,omitempty"`
+	Rules   []retentionRule `json:"rules"`
+
+	defaultKeep time.Duration
+	maxKeep     time.Duration
+}
+
+// defaultRetention keeps every file for fileExpiryDuration.
+func defaultRetention() retentionPolicy {
+	return retentionPolicy{defaultKeep: fileExpiryDuration, maxKeep: defaultMaxRetention}
+}
+
+// loadRetentionPolicy reads retention rules from a JSON file of the form
+//
+//	{"default": "10m", "max": "72h",
+//	 "rules": [{"tag": "legal", "keep": "24h"}, {"tag": "team", "value": "qa", "keep": "1h"},
+//	           {"apiKey": "archive-team", "keep": "48h"}]}
+//
+// Rules are tried in order and the first matching the file wins.
+// No rule, nor the default, may exceed the maximum.
+func loadRetentionPolicy(path string) (retentionPolicy, error) {
+	policy := defaultRetention()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return policy, fmt.Errorf("failed to read retention policy: %w", err)
+	}
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return policy, fmt.Errorf("failed to parse retention policy: %w", err)
+	}
+
+	if err := parseRetention(policy.Max, &policy.maxKeep); err != nil {
+		return policy, fmt.Errorf("invalid retention maximum: %w", err)
+	}
+	if err := parseRetention(policy.Default, &policy.defaultKeep); err != nil {
+		return policy, fmt.Errorf("invalid default retention: %w", err)
+	}
+	if policy.defaultKeep > policy.maxKeep {
+		return policy, fmt.Errorf("default retention %v exceeds the maximum %v", policy.defaultKeep, policy.maxKeep)
+	}
+	for i := range policy.Rules {
+		rule := &policy.Rules[i]
+		if (rule.Tag == "") == (rule.APIKey == "") {
+			return policy, fmt.Errorf("retention rule %d must set exactly one of tag and apiKey", i+1)
+		}
+		if rule.Tag != "" && !tagKeyPattern.MatchString(rule.Tag) {
+			return policy, fmt.Errorf("retention rule %d has an invalid tag %q", i+1, rule.Tag)
+		}
+		if rule.Keep == "" {
+			return policy, fmt.Errorf("retention rule %d must set keep", i+1)
+		}
+		if err := parseRetention(rule.Keep, &rule.keep); err != nil {
+			return policy, fmt.Errorf("retention rule %d: %w", i+1, err)
+		}
+		if rule.keep > policy.maxKeep {
+			return policy, fmt.Errorf("retention rule %d keeps files for %v, more than the maximum %v", i+1, rule.keep, policy.maxKeep)
+		}
+	}
+	return policy, nil
+}
+
+// parseRetention parses a positive duration into d, leaving d alone if s is empty.
+func parseRetention(s string, d *time.Duration) error {
+	if s == "" {
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	if v <= 0 {
+		return fmt.Errorf("duration %q must be positive", s)
+	}
+	*d = v
+	return nil
+}
+
+// keepFor returns how long a file is kept: that of the first matching rule, or
+// the default.
+func (p retentionPolicy) keepFor(meta *FileMetadata) time.Duration {
+	for _, rule := range p.Rules {
+		if rule.APIKey != "" {
+			if rule.APIKey == meta.APIKey {
+				return rule.keep
+			}
+			continue
+		}
+		value, ok := meta.Tags[rule.Tag]
+		if ok && (rule.Value == "" || rule.Value == value) {
+			return rule.keep
+		}
+	}
+	return p.defaultKeep
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// internalPrefixes are the address ranges, besides loopback, private,
+// link-local, multicast and unspecified addresses, that the browser is kept
+// away from: carrier-grade NAT, "this network", IETF protocol assignments,
+// benchmarking, reserved space and NAT64, which can reach any IPv4 host.
+var internalPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+}
+
+// privateURLsAllowed reports whether FILECONVERTER_ALLOW_PRIVATE_URLS lifts the
+// restriction on internal addresses, for deployments capturing intranet pages.
+func privateURLsAllowed() bool {
+	return os.Getenv("FILECONVERTER_ALLOW_PRIVATE_URLS") != ""
+}
+
+// internalAddress reports whether ip is not a public unicast address.
+func internalAddress(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return !ip.IsValid() || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || inPrefixes(ip, internalPrefixes)
+}
+
+// checkPublicHost resolves host and fails if any of its addresses is internal,
+// unless private URLs are allowed.
+func checkPublicHost(ctx context.Context, host string) error {
+	if privateURLsAllowed() {
+		return nil
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("could not resolve %s: %w", host, err)
+	}
+	for _, ip := range ips {
+		if internalAddress(ip) {
+			return fmt.Errorf("URLs resolving to internal addresses cannot be captured")
+		}
+	}
+	return nil
+}
+
+// validateScreenshotURL checks that a URL is safe to hand to the browser: only
+// http(s), and unless FILECONVERTER_ALLOW_PRIVATE_URLS is set, not pointing at
+// internal addresses (to avoid turning the service into an SSRF proxy into its
+// own network). This only refuses bad URLs early; the browser checks every
+// request it makes again, which catches redirects and hosts that resolve
+// differently the second time.
+func validateScreenshotURL(ctx context.Context, raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid URL %q", raw)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("only http and https URLs can be captured")
+	}
+	if err := checkPublicHost(ctx, u.Hostname()); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// handleScreenshot captures a web page by URL as png, jpg or pdf.
+func handleScreenshot(fs *FileStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		u, err := validateScreenshotURL(r.Context(), strings.TrimSpace(r.FormValue("url")))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		format := strings.ToLower(r.FormValue("format"))
+		switch format {
+		case "":
+			format = "png"
+		case "jpeg":
+			format = "jpg"
+		case "png", "jpg", "pdf":
+		default:
+			http.Error(w, fmt.Sprintf("Unsupported screenshot format %q (use png, jpg or pdf)", format), http.StatusBadRequest)
+			return
+		}
+
+		opts, err := parseConversionOptions(r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid conversion options: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		attrs, err := parseJobAttributes(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		attrs.Report = &ConversionReport{}
+		opts.Report = attrs.Report
+
+		release, err := tempSpace.reserve(chromiumTempSpace)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		defer release()
+
+		log.Printf("Capturing %s as %s", u, format)
+		var data []byte
+		err = runConvertStage(r.Context(), opts, func(ctx context.Context) (err error) {
+			data, err = renderPage(ctx, u.String(), format, opts)
+			return err
+		})
+		if err != nil {
+			log.Printf("Error capturing %s: %v", u, err)
+			if meta, recErr := fs.recordFailure(u.String(), err, attrs); recErr == nil {
+				setJobHeaders(w, meta)
+			}
+			http.Error(w, fmt.Sprintf("Error capturing page: %v", err), errorStatus(err))
+			return
+		}
+
+		name := strings.ReplaceAll(u.Hostname(), ".", "_")
+		if meta, err := fs.moderateUpload(r.Context(), name+"."+format, data, &attrs); err != nil {
+			if meta != nil {
+				setJobHeaders(w, meta)
+			}
+			http.Error(w, fmt.Sprintf("Error capturing page: %v", err), errorStatus(err))
+			return
+		}
+		meta, err := fs.storeFile(r.Context(), u.String(), name+"."+format, getContentTypeForExtension(format), data, attrs)
+		if err != nil {
+			log.Printf("Error storing screenshot: %v", err)
+			http.Error(w, fmt.Sprintf("Error processing file: %v", err), errorStatus(err))
+			return
+		}
+
+		writeUploadResponse(w, r, meta)
+	}
+}
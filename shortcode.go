@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// shortCodeLength is the number of characters in a short download code; with
+	// Crockford base32 that is 60 bits, too many codes to find a live one by
+	// guessing, the more so as every miss counts against the client as abuse.
+	shortCodeLength = 12
+	// shortCodeAlphabet is Crockford's base32, which leaves out I, L, O and U so
+	// codes survive being read aloud or typed from a printout.
+	shortCodeAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+	// maxShortCodeAttempts bounds the retries when a new code collides.
+	maxShortCodeAttempts = 10
+)
+
+// shortCodeReplacer normalises typed codes: lower case and the letters people
+// confuse with digits are accepted.
+var shortCodeReplacer = strings.NewReplacer("O", "0", "I", "1", "L", "1", "-", "", " ", "")
+
+// newShortCode returns a random short code.
+func newShortCode() (string, error) {
+	b := make([]byte, shortCodeLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = shortCodeAlphabet[int(b[i])%len(shortCodeAlphabet)] // 256 is a multiple of 32, so this is unbiased
+	}
+	return string(b), nil
+}
+
+// normalizeShortCode turns a code as typed by a person into its canonical form.
+func normalizeShortCode(code string) string {
+	return shortCodeReplacer.Replace(strings.ToUpper(code))
+}
+
+// assignShortCode gives a file a short code no live file uses.
+// This function expects the lock to be already held.
+func (fs *FileStore) assignShortCode(meta *FileMetadata) error {
+	for range maxShortCodeAttempts {
+		code, err := newShortCode()
+		if err != nil {
+			return fmt.Errorf("failed to generate short code: %w", err)
+		}
+		if _, taken := fs.shortCodes[code]; taken {
+			continue
+		}
+		fs.shortCodes[code] = meta.ID
+		meta.ShortCode = code
+		return nil
+	}
+	return fmt.Errorf("failed to find a free short code")
+}
+
+// ResolveShortCode returns the metadata of the live file a short code stands for.
+func (fs *FileStore) ResolveShortCode(code string) (*FileMetadata, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fileID, ok := fs.shortCodes[normalizeShortCode(code)]
+	if !ok {
+		return nil, fmt.Errorf("unknown or expired code")
+	}
+	meta, exists := fs.files[fileID]
+	if !exists || meta.expired(time.Now()) {
+		return nil, fmt.Errorf("unknown or expired code")
+	}
+	info := *meta
+	return &info, nil
+}
+
+// shortURL returns the path that redirects a short code to its download.
+func shortURL(code string) string {
+	return apiPrefix + "/c/" + code
+}
+
+// handleShortCode downloads the file a short code stands for. The file is served
+// in place rather than by redirecting to its download URL, which would hand the
+// share token to whoever has the code. Anyone who knows the code can download
+// the file, so codes are only issued when asked for.
+func handleShortCode(fs *FileStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		meta, err := fs.ResolveShortCode(r.PathValue("code"))
+		if err != nil {
+			notFound(w, err.Error())
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		serveFile(fs, w, r, meta.ID)
+	}
+}
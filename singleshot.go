@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// singleShot is set by FILECONVERTER_SINGLE_SHOT=true for serverless platforms
+// that start a process per request. The server then handles one request and
+// exits, runs no cleanup or sweep routines, and hands results back in the
+// response (or pushes them to object storage) since nothing outlives the process.
+// External tools are only looked up when a conversion needs them, so cold starts
+// don't pay for probing.
+var singleShot bool
+
+// resultStore pushes single-shot results to object storage with a PUT to
+// FILECONVERTER_RESULT_URL, a URL template where {id} and {name} are replaced by
+// the file ID and name. FILECONVERTER_RESULT_AUTHORIZATION, if set, is sent as
+// the Authorization header.
+type resultStore struct {
+	urlTemplate   string
+	authorization string
+}
+
+// loadResultStore configures the result store; it returns nil when results are
+// returned in the response instead.
+func loadResultStore() *resultStore {
+	tmpl := os.Getenv("FILECONVERTER_RESULT_URL")
+	if tmpl == "" {
+		return nil
+	}
+	return &resultStore{urlTemplate: tmpl, authorization: os.Getenv("FILECONVERTER_RESULT_AUTHORIZATION")}
+}
+
+// put uploads a result and returns its URL.
+func (s *resultStore) put(meta *FileMetadata, content []byte) (string, error) {
+	location := strings.NewReplacer("{id}", meta.ID, "{name}", url.PathEscape(meta.ConvertedName)).Replace(s.urlTemplate)
+	req, err := http.NewRequest(http.MethodPut, location, bytes.NewReader(content))
+	if err != nil {
+		return "", fmt.Errorf("invalid result URL: %w", err)
+	}
+	req.Header.Set("Content-Type", meta.ContentType)
+	if s.authorization != "" {
+		req.Header.Set("Authorization", s.authorization)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload result: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("result store answered %s", resp.Status)
+	}
+	return location, nil
+}
+
+// bufferedResponse holds back a handler's response so it can be replaced.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+// deliverResult makes a file-creating handler hand its result to the client in
+// single-shot mode: pushed to the result store with its location in the JSON
+// response, or as the response body itself. Error responses pass through.
+func deliverResult(fs *FileStore, results *resultStore, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		buf := &bufferedResponse{header: make(http.Header)}
+		next(buf, r)
+
+		var created struct {
+			FileID string `json:"fileId"`
+		}
+		if buf.status != http.StatusOK || json.Unmarshal(buf.body.Bytes(), &created) != nil || created.FileID == "" {
+			for k, v := range buf.header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(max(buf.status, http.StatusOK))
+			w.Write(buf.body.Bytes())
+			return
+		}
+
+		meta, content, err := fs.GetFile(created.FileID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if results != nil {
+			location, err := results.put(meta, content)
+			if err != nil {
+				log.Printf("Error storing result %s: %v", meta.ID, err)
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"fileId": meta.ID, "fileName": meta.ConvertedName, "location": location})
+			return
+		}
+
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+meta.ConvertedName+"\"")
+		w.Header().Set("Content-Type", meta.ContentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Header().Set("X-Job-Id", meta.ID)
+		w.Write(content)
+	}
+}
+
+// serveSingleShot serves exactly one request on addr and returns once it has
+// been answered.
+func serveSingleShot(addr string, handler http.Handler) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{}
+	srv.SetKeepAlivesEnabled(false)
+
+	var once sync.Once
+	done := make(chan struct{})
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+		once.Do(func() { close(done) })
+	})
+
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+	select {
+	case err := <-served:
+		return err
+	case <-done:
+	}
+	// Let the response, and anything that raced in with it, finish.
+	if err := srv.Shutdown(context.Background()); err != nil {
+		return err
+	}
+	log.Printf("Single-shot request handled, exiting")
+	return nil
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite" // Pure-Go SQLite driver, registered as "sqlite"
+)
+
+// convertSQLite exports the tables of a SQLite database as csv, json or xlsx.
+// A single table (the only one, or the one named by the table option) is written
+// directly; several tables become one xlsx sheet each, or a zip of csv/json files.
+func convertSQLite(ctx context.Context, inputFileBytes []byte, outputFilename, targetFormat string, opts ConversionOptions) ([]byte, string, error) {
+	dir, err := os.MkdirTemp("", "fileconverter-sqlite-")
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbPath := filepath.Join(dir, "input.db")
+	if err := os.WriteFile(dbPath, inputFileBytes, 0644); err != nil {
+		return nil, "", fmt.Errorf("failed to write temporary input file: %w", err)
+	}
+
+	db, err := sql.Open("sqlite", "file:"+dbPath+"?mode=ro")
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to open SQLite database: %w", err)
+	}
+	defer db.Close()
+
+	names, err := sqliteTableNames(db)
+	if err != nil {
+		return nil, "", err
+	}
+	if opts.Table != "" {
+		found := false
+		for _, n := range names {
+			if n == opts.Table {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, "", fmt.Errorf("table %q not found in database", opts.Table)
+		}
+		names = []string{opts.Table}
+	}
+	if len(names) == 0 {
+		return nil, "", fmt.Errorf("database contains no tables")
+	}
+
+	tables := make([]*table, 0, len(names))
+	for _, name := range names {
+		t, err := readSQLiteTable(ctx, db, name)
+		if err != nil {
+			return nil, "", err
+		}
+		if err := t.applyColumnOptions(opts); err != nil {
+			return nil, "", fmt.Errorf("table %s: %w", name, err)
+		}
+		tables = append(tables, t)
+	}
+
+	if targetFormat == "xlsx" {
+		out, err := writeXLSXTables(tables)
+		return out, outputFilename, err
+	}
+	if len(tables) == 1 {
+		out, err := writeTable(tables[0], targetFormat)
+		return out, outputFilename, err
+	}
+
+	// Several tables: one file per table, zipped together
+	files := make([]string, len(tables))
+	contents := make([][]byte, len(tables))
+	taken := make(map[string]bool, len(tables))
+	for i, t := range tables {
+		if contents[i], err = writeTable(t, targetFormat); err != nil {
+			return nil, "", err
+		}
+		name := uniqueName(tableFileName(t.Name, i), 0, func(n string) bool { return taken[strings.ToLower(n)] })
+		taken[strings.ToLower(name)] = true
+		files[i] = name + "." + targetFormat
+	}
+	out, err := zipFiles(files, contents)
+	if err != nil {
+		return nil, "", err
+	}
+	return out, strings.TrimSuffix(outputFilename, filepath.Ext(outputFilename)) + ".zip", nil
+}
+
+// tableFileName turns a table name into the name of its file in a zip, a single
+// local path element, so that a table named like "../x" can't place its file
+// outside the directory the zip is extracted to.
+func tableFileName(name string, index int) string {
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	if !filepath.IsLocal(name) || name == "." || name == "/" {
+		return fmt.Sprintf("table%d", index+1)
+	}
+	return name
+}
+
+// sqliteTableNames lists the user tables of a database in name order.
+func sqliteTableNames(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read SQLite database (is it a valid SQLite file?): %w", ErrInputCorrupt, err)
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("failed to list tables: %w", err)
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// readSQLiteTable loads every row of a table, formatting values as strings.
+func readSQLiteTable(ctx context.Context, db *sql.DB, name string) (*table, error) {
+	rows, err := db.QueryContext(ctx, "SELECT * FROM "+quoteSQLiteIdent(name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read table %s: %w", name, err)
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read columns of %s: %w", name, err)
+	}
+	t := &table{Name: name, Columns: cols}
+
+	values := make([]any, len(cols))
+	ptrs := make([]any, len(cols))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, fmt.Errorf("failed to read row of %s: %w", name, err)
+		}
+		row := make([]string, len(cols))
+		for i, v := range values {
+			row[i] = sqliteCellString(v)
+		}
+		t.Rows = append(t.Rows, row)
+	}
+	return t, rows.Err()
+}
+
+// sqliteCellString formats a scanned SQLite value as a table cell.
+func sqliteCellString(v any) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(val)
+	case time.Time:
+		return val.Format(time.RFC3339)
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+// quoteSQLiteIdent quotes an identifier (table or column name) for SQLite.
+func quoteSQLiteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// sqliteTableNamePattern matches characters replaced when deriving a table name from a file name.
+var sqliteTableNamePattern = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+
+// convertCSVToSQLite imports a CSV file into a new SQLite database with a single table.
+// Column types are inferred: INTEGER or REAL if every non-empty value parses as such, TEXT otherwise.
+func convertCSVToSQLite(ctx context.Context, inputFileBytes []byte, outputFilename string, opts ConversionOptions) ([]byte, string, error) {
+	t, err := readCSVTable(inputFileBytes, opts.Charset)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := t.applyColumnOptions(opts); err != nil {
+		return nil, "", err
+	}
+
+	name := opts.Table
+	if name == "" {
+		name = sqliteTableNamePattern.ReplaceAllString(strings.TrimSuffix(outputFilename, filepath.Ext(outputFilename)), "_")
+		if name == "" || name == "_" {
+			name = "data"
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "fileconverter-sqlite-")
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbPath := filepath.Join(dir, "output.db")
+	db, err := sql.Open("sqlite", "file:"+dbPath)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create SQLite database: %w", err)
+	}
+	defer db.Close()
+
+	colDefs := make([]string, len(t.Columns))
+	placeholders := make([]string, len(t.Columns))
+	types := make([]string, len(t.Columns))
+	for i, col := range t.Columns {
+		types[i] = inferSQLiteType(t, i)
+		colDefs[i] = quoteSQLiteIdent(col) + " " + types[i]
+		placeholders[i] = "?"
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(fmt.Sprintf("CREATE TABLE %s (%s)", quoteSQLiteIdent(name), strings.Join(colDefs, ", "))); err != nil {
+		return nil, "", fmt.Errorf("failed to create table: %w", err)
+	}
+	stmt, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s VALUES (%s)", quoteSQLiteIdent(name), strings.Join(placeholders, ", ")))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to prepare insert: %w", err)
+	}
+	defer stmt.Close()
+
+	args := make([]any, len(t.Columns))
+	for _, row := range t.Rows {
+		for i, cell := range row {
+			args[i] = sqliteValue(cell, types[i])
+		}
+		if _, err := stmt.Exec(args...); err != nil {
+			return nil, "", fmt.Errorf("failed to insert row: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, "", fmt.Errorf("failed to commit rows: %w", err)
+	}
+	if err := db.Close(); err != nil {
+		return nil, "", fmt.Errorf("failed to close database: %w", err)
+	}
+
+	out, err := os.ReadFile(dbPath)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read converted database: %w", err)
+	}
+	return out, outputFilename, nil
+}
+
+// inferSQLiteType picks a column affinity from the values of column col, or from
+// the type a mapping gave it.
+func inferSQLiteType(t *table, col int) string {
+	switch t.columnType(col) {
+	case "int":
+		return "INTEGER"
+	case "float":
+		return "REAL"
+	case "string", "bool", "date":
+		return "TEXT"
+	}
+	kind := "INTEGER"
+	seen := false
+	for _, row := range t.Rows {
+		cell := row[col]
+		if cell == "" {
+			continue
+		}
+		seen = true
+		if _, err := strconv.ParseInt(cell, 10, 64); err == nil {
+			continue
+		}
+		if _, err := strconv.ParseFloat(cell, 64); err == nil {
+			kind = "REAL"
+			continue
+		}
+		return "TEXT"
+	}
+	if !seen {
+		return "TEXT"
+	}
+	return kind
+}
+
+// sqliteValue converts a cell to the Go value inserted for a column of the given type.
+func sqliteValue(cell, kind string) any {
+	if cell == "" {
+		return nil
+	}
+	switch kind {
+	case "INTEGER":
+		if n, err := strconv.ParseInt(cell, 10, 64); err == nil {
+			return n
+		}
+	case "REAL":
+		if f, err := strconv.ParseFloat(cell, 64); err == nil {
+			return f
+		}
+	}
+	return cell
+}
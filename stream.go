@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+)
+
+// streamMuxers are the FFmpeg output formats that can be written to a pipe, by
+// target format. MP4 and MOV are fragmented, since their index would otherwise
+// be written at the end by seeking back.
+var streamMuxers = map[string][]string{
+	"mp3":  {"-f", "mp3"},
+	"wav":  {"-f", "wav"},
+	"ogg":  {"-f", "ogg"},
+	"flac": {"-f", "flac"},
+	"aac":  {"-f", "adts"},
+	"wma":  {"-f", "asf"},
+	"webm": {"-f", "webm"},
+	"mkv":  {"-f", "matroska"},
+	"flv":  {"-f", "flv"},
+	"mp4":  {"-f", "mp4", "-movflags", "frag_keyframe+empty_moov"},
+	"mov":  {"-f", "mov", "-movflags", "frag_keyframe+empty_moov"},
+}
+
+// defaultMaxStreams caps how many stream transcodes run at once, each holding an
+// FFmpeg process for as long as its client keeps sending; override with
+// FILECONVERTER_MAX_STREAMS.
+const defaultMaxStreams = 4
+
+// streamWriter passes FFmpeg's output on to the client as it is produced.
+type streamWriter struct {
+	w           http.ResponseWriter
+	rc          *http.ResponseController
+	contentType string
+	started     bool // Whether the response status has been sent
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	if !sw.started {
+		sw.w.Header().Set("Content-Type", sw.contentType)
+		sw.w.Header().Set("Cache-Control", "no-store")
+		sw.w.WriteHeader(http.StatusOK)
+		sw.started = true
+	}
+	n, err := sw.w.Write(p)
+	if err == nil {
+		err = sw.rc.Flush()
+	}
+	return n, err
+}
+
+// handleTranscodeStream transcodes the request body on the fly and streams the
+// result back, without storing anything. It is experimental: the source and
+// target formats are given as the "from" and "to" query parameters, and only
+// inputs FFmpeg can read from a pipe work, so MP4 and MOV sources need their
+// index at the start ("faststart"). The body is still bound by the upload size
+// limit. Once output has started, a failure can only be signalled by cutting
+// the response short. Hooks need the whole file, so streaming is refused where
+// they are configured. Streams are bound by the conversion deadline.
+func handleTranscodeStream() http.HandlerFunc {
+	slots := make(chan struct{}, max(envInt("FILECONVERTER_MAX_STREAMS", defaultMaxStreams), 1))
+	return func(w http.ResponseWriter, r *http.Request) {
+		if conversionHooks.enabled() {
+			http.Error(w, "Streaming transcodes are not available on this server", http.StatusNotImplemented)
+			return
+		}
+		from := strings.ToLower(r.URL.Query().Get("from"))
+		to := strings.ToLower(r.URL.Query().Get("to"))
+		if from == "" || to == "" {
+			http.Error(w, "The from and to query parameters are required", http.StatusBadRequest)
+			return
+		}
+		_, isAudio := ConversionMap[FileTypeAudio][from]
+		_, isVideo := ConversionMap[FileTypeVideo][from]
+		if !isAudio && !isVideo {
+			http.Error(w, fmt.Sprintf("Only audio and video can be streamed, not %s", from), http.StatusBadRequest)
+			return
+		}
+		fileType := FileTypeAudio
+		if isVideo {
+			fileType = FileTypeVideo
+		}
+		muxer, ok := streamMuxers[to]
+		if !ok || !slices.Contains(GetSupportedConversionFormats(fileType, from), to) {
+			http.Error(w, fmt.Sprintf("Streaming from %s to %s is not supported", from, to), http.StatusBadRequest)
+			return
+		}
+		if _, err := exec.LookPath("ffmpeg"); err != nil {
+			err := &ToolMissingError{Tool: "FFmpeg"}
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+		default:
+			w.Header().Set("Retry-After", "30")
+			http.Error(w, "Too many streams are running; try again later", http.StatusServiceUnavailable)
+			return
+		}
+
+		mediaType := "video"
+		if _, ok := ConversionMap[FileTypeAudio][to]; ok {
+			mediaType = "audio"
+		}
+		args := ffmpegArgs(from, to, "pipe:0", "pipe:1", nil, mediaBaseArgs(from, mediaType), muxer)
+
+		// Keep reading the body while the response is written; HTTP/1.1 servers
+		// otherwise stop reading once the handler starts answering.
+		rc := http.NewResponseController(w)
+		if err := rc.EnableFullDuplex(); err != nil && r.ProtoMajor == 1 {
+			log.Printf("Warning: full duplex unavailable for stream transcode: %v", err)
+		}
+		out := &streamWriter{w: w, rc: rc, contentType: getContentTypeForExtension(to)}
+		var trace CommandTrace
+		err := runConvertStage(r.Context(), ConversionOptions{Deadlines: conversionDeadlines}, func(ctx context.Context) error {
+			cmd := exec.CommandContext(ctx, "ffmpeg", append([]string{"-hide_banner", "-loglevel", "error"}, args...)...)
+			var stderr bytes.Buffer
+			cmd.Stdin = r.Body
+			cmd.Stdout = out
+			cmd.Stderr = &stderr
+
+			start := time.Now()
+			err := cmd.Run()
+			trace = newCommandTrace(cmd, time.Since(start), stderr.Bytes(), err)
+			return err
+		})
+		if err == nil {
+			return
+		}
+		log.Printf("Stream transcode from %s to %s failed after %d ms (exit %d): %v: %s", from, to, trace.DurationMs, trace.ExitCode, err, trace.Stderr)
+		if !out.started {
+			if errors.Is(err, ErrTimeout) {
+				http.Error(w, fmt.Sprintf("Stream transcode failed: %v", err), errorStatus(err))
+				return
+			}
+			http.Error(w, fmt.Sprintf("FFmpeg transcode failed: %s", strings.TrimSpace(trace.Stderr)), http.StatusUnprocessableEntity)
+			return
+		}
+		// Abort the connection so the client can't mistake the output for complete
+		panic(http.ErrAbortHandler)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// srtTimingPattern matches the timing line of a SubRip cue.
+var srtTimingPattern = regexp.MustCompile(`^\d+:\d{2}:\d{2}[,.]\d{3}\s*-->\s*\d+:\d{2}:\d{2}[,.]\d{3}`)
+
+// srtTagPattern matches the formatting tags subtitles may carry, such as <i> or
+// {\an8}.
+var srtTagPattern = regexp.MustCompile(`</?[a-zA-Z][^>]*>|\{\\[^}]*\}`)
+
+// srtCueSeparator matches the blank lines between cues.
+var srtCueSeparator = regexp.MustCompile(`\n\s*\n`)
+
+// srtCue is one subtitle: its number, timing line and text lines.
+type srtCue struct {
+	index  string
+	timing string
+	text   string
+}
+
+// srtDocument is a SubRip subtitle file.
+type srtDocument struct {
+	cues []srtCue
+}
+
+// parseSRT reads a SubRip file. Cues are separated by blank lines and start with
+// their number and timing.
+func parseSRT(data []byte) (*srtDocument, error) {
+	text := strings.ReplaceAll(string(bytes.TrimPrefix(data, []byte("\ufeff"))), "\r\n", "\n")
+	d := &srtDocument{}
+	for _, block := range srtCueSeparator.Split(strings.TrimSpace(text), -1) {
+		lines := strings.Split(strings.TrimSpace(block), "\n")
+		if len(lines) == 1 && lines[0] == "" {
+			continue
+		}
+		if len(lines) < 2 || !srtTimingPattern.MatchString(strings.TrimSpace(lines[1])) {
+			return nil, fmt.Errorf("%w: invalid SubRip cue %d: expected a number and a timing line", ErrInputCorrupt, len(d.cues)+1)
+		}
+		d.cues = append(d.cues, srtCue{index: strings.TrimSpace(lines[0]), timing: strings.TrimSpace(lines[1]), text: strings.Join(lines[2:], "\n")})
+	}
+	return d, nil
+}
+
+func (d *srtDocument) texts() []string {
+	out := make([]string, len(d.cues))
+	for i, c := range d.cues {
+		out[i] = c.text
+	}
+	return out
+}
+
+func (d *srtDocument) render(translated []string, _ string) ([]byte, error) {
+	var b bytes.Buffer
+	for i, c := range d.cues {
+		fmt.Fprintf(&b, "%s\n%s\n%s\n\n", c.index, c.timing, translated[i])
+	}
+	return b.Bytes(), nil
+}
+
+// convertSubtitlesToText extracts the text of a SubRip file, one cue per
+// paragraph, without timings or formatting tags.
+func convertSubtitlesToText(ctx context.Context, inputFileBytes []byte, outputFilename string) ([]byte, string, error) {
+	d, err := parseSRT(inputFileBytes)
+	if err != nil {
+		return nil, "", err
+	}
+	var b bytes.Buffer
+	for i, c := range d.cues {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString(srtTagPattern.ReplaceAllString(c.text, "") + "\n")
+	}
+	return b.Bytes(), outputFilename, nil
+}
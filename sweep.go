@@ -0,0 +1,129 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// orphanSweepInterval is how often leftovers of crashed runs are looked for.
+	orphanSweepInterval = 1 * time.Hour
+	// defaultTempMaxAge is how old a conversion temp directory must be before the
+	// sweep removes it; override with FILECONVERTER_TEMP_MAX_AGE. It has to exceed
+	// the longest conversion, or the sweep would pull files from under it.
+	defaultTempMaxAge = 6 * time.Hour
+	// tempDirPrefix starts the name of every temp directory the converter creates.
+	tempDirPrefix = "fileconverter-"
+)
+
+// storedFilePattern matches the names storeFile gives files in the disk path.
+var storedFilePattern = regexp.MustCompile(`^[0-9a-f]{32}_`)
+
+// stagedFilePattern matches the names storeFileFromPath copies files to before
+// storing them; see stagedFilePath.
+var stagedFilePattern = regexp.MustCompile(`^\.[0-9a-f]{32}\.partial$`)
+
+// sweepOrphans removes stored files that no metadata refers to, and staged
+// files older than maxAge, such as files left behind when the server crashed.
+// Other files in the disk path are left alone.
+func (fs *FileStore) sweepOrphans(maxAge time.Duration) {
+	// List before snapshotting the live paths: storeFile writes a file and records
+	// it under one lock, so anything listed here is either live or an orphan.
+	entries, err := os.ReadDir(fs.diskPath)
+	if err != nil {
+		log.Printf("Error listing disk storage path %s: %v", fs.diskPath, err)
+		return
+	}
+
+	fs.mu.Lock()
+	live := make(map[string]bool, len(fs.files))
+	for _, meta := range fs.files {
+		if !meta.IsInMemory {
+			live[meta.Path] = true
+		}
+	}
+	for _, t := range fs.trash {
+		if !t.meta.IsInMemory {
+			live[t.meta.Path] = true
+		}
+	}
+	fs.mu.Unlock()
+
+	cutoff := time.Now().Add(-maxAge)
+	removed := 0
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		p := filepath.Join(fs.diskPath, entry.Name())
+		switch {
+		case storedFilePattern.MatchString(entry.Name()):
+			if live[p] {
+				continue
+			}
+		case stagedFilePattern.MatchString(entry.Name()):
+			if info, err := entry.Info(); err != nil || info.ModTime().After(cutoff) {
+				continue
+			}
+		default:
+			continue
+		}
+		if err := os.Remove(p); err != nil {
+			log.Printf("Error removing orphaned file %s: %v", p, err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		log.Printf("Removed %d orphaned files from %s", removed, fs.diskPath)
+	}
+}
+
+// sweepTempDirs removes conversion temp directories older than maxAge, which a
+// crash mid-conversion leaves behind in the system temp directory.
+func sweepTempDirs(maxAge time.Duration) {
+	tempDir := os.TempDir()
+	entries, err := os.ReadDir(tempDir)
+	if err != nil {
+		log.Printf("Error listing temp directory %s: %v", tempDir, err)
+		return
+	}
+
+	cutoff := time.Now().Add(-maxAge)
+	removed := 0
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), tempDirPrefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		p := filepath.Join(tempDir, entry.Name())
+		if err := os.RemoveAll(p); err != nil {
+			log.Printf("Error removing stale temp directory %s: %v", p, err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		log.Printf("Removed %d stale temp directories from %s", removed, tempDir)
+	}
+}
+
+// sweepRoutine reconciles the disk with the store at startup and then periodically.
+func (fs *FileStore) sweepRoutine() {
+	maxAge := envDuration("FILECONVERTER_TEMP_MAX_AGE", defaultTempMaxAge)
+	ticker := time.NewTicker(orphanSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		fs.sweepOrphans(maxAge)
+		sweepTempDirs(maxAge)
+		<-ticker.C
+	}
+}
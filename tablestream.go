@@ -0,0 +1,673 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// Tabular conversions run one row at a time from a rowReader through a rowShaper
+// into a rowWriter, so CSV input never has to fit in memory as a whole: its live
+// heap grows little with its length when converted to CSV or JSON (see
+// BenchmarkTableStream). XLSX output grows more, as excelize's stream writer
+// spills rows to a temporary file but keeps the shared workbook parts in memory,
+// and is bound by Excel's limit of xlsxMaxRows rows per sheet. Other inputs are
+// held whole: excelize reads an XLSX workbook into memory before its rows can be
+// read, though it spills large worksheets to temporary files, and JSON has to be
+// seen whole before its columns are known.
+
+// xlsxMaxRows is the number of rows an Excel worksheet holds, header included.
+const xlsxMaxRows = 1048576
+
+// rowReader yields the rows of a table after its header.
+type rowReader interface {
+	columns() []string
+	// next returns the next row, padded or cut to the number of columns, or
+	// io.EOF after the last one.
+	next() ([]string, error)
+	close() error
+}
+
+// rowWriter encodes rows as they come.
+type rowWriter interface {
+	writeHeader(columns, types []string) error
+	writeRow(row []string) error
+	// close finishes the output; it must be called even after an error.
+	close() error
+}
+
+// csvRowReader reads CSV, treating the first record as the header.
+type csvRowReader struct {
+	r    *csv.Reader
+	cols []string
+}
+
+// newCSVRowReader reads CSV in the given charset, UTF-8 if nil, or as its byte
+// order mark says.
+func newCSVRowReader(in io.Reader, charset encoding.Encoding) (*csvRowReader, error) {
+	if charset == nil {
+		charset = encoding.Nop
+	}
+	in = transform.NewReader(in, unicode.BOMOverride(charset.NewDecoder()))
+	r := csv.NewReader(bufio.NewReaderSize(in, 64<<10))
+	r.FieldsPerRecord = -1 // Tolerate ragged rows; they are padded in next
+	r.ReuseRecord = true
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("CSV file is empty")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to parse CSV: %w", ErrInputCorrupt, err)
+	}
+	return &csvRowReader{r: r, cols: append([]string(nil), header...)}, nil
+}
+
+func (c *csvRowReader) columns() []string { return c.cols }
+
+func (c *csvRowReader) next() ([]string, error) {
+	rec, err := c.r.Read()
+	if err == io.EOF {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to parse CSV: %w", ErrInputCorrupt, err)
+	}
+	row := make([]string, len(c.cols))
+	copy(row, rec)
+	return row, nil
+}
+
+func (c *csvRowReader) close() error { return nil }
+
+// xlsxRowReader reads a worksheet row by row, treating its first row as the
+// header. Cells are read as Excel displays them.
+type xlsxRowReader struct {
+	f     *excelize.File
+	rows  *excelize.Rows
+	sheet string
+	cols  []string
+}
+
+// newXLSXRowReader opens the named worksheet of a workbook, or the first one.
+func newXLSXRowReader(in io.Reader, sheet string) (*xlsxRowReader, error) {
+	f, err := excelize.OpenReader(in)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to open XLSX workbook: %w", ErrInputCorrupt, err)
+	}
+	if sheet == "" {
+		sheet = f.GetSheetName(0)
+	}
+	rows, err := f.Rows(sheet)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to read sheet %q: %w", sheet, err)
+	}
+	x := &xlsxRowReader{f: f, rows: rows, sheet: sheet}
+	header, err := x.read()
+	if err == io.EOF {
+		err = fmt.Errorf("sheet %q is empty", sheet)
+	}
+	if err != nil {
+		x.close()
+		return nil, err
+	}
+	x.cols = header
+	return x, nil
+}
+
+// read returns the cells of the next row as they are.
+func (x *xlsxRowReader) read() ([]string, error) {
+	if !x.rows.Next() {
+		if err := x.rows.Error(); err != nil {
+			return nil, fmt.Errorf("%w: failed to read sheet %q: %w", ErrInputCorrupt, x.sheet, err)
+		}
+		return nil, io.EOF
+	}
+	cells, err := x.rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read sheet %q: %w", ErrInputCorrupt, x.sheet, err)
+	}
+	return cells, nil
+}
+
+func (x *xlsxRowReader) columns() []string { return x.cols }
+
+func (x *xlsxRowReader) next() ([]string, error) {
+	cells, err := x.read()
+	if err != nil {
+		return nil, err
+	}
+	row := make([]string, len(x.cols))
+	copy(row, cells) // Trailing empty cells are left out
+	return row, nil
+}
+
+func (x *xlsxRowReader) close() error {
+	x.rows.Close()
+	return x.f.Close()
+}
+
+// tableRowReader reads the rows of a table in memory.
+type tableRowReader struct {
+	t *table
+	i int
+}
+
+func (t *tableRowReader) columns() []string { return t.t.Columns }
+
+func (t *tableRowReader) next() ([]string, error) {
+	if t.i >= len(t.t.Rows) {
+		return nil, io.EOF
+	}
+	t.i++
+	return t.t.Rows[t.i-1], nil
+}
+
+func (t *tableRowReader) close() error { return nil }
+
+// openRowReader starts reading a table in the given format. CSV is read in
+// opts.Charset; for XLSX, opts.Table names the worksheet to read.
+func openRowReader(in io.Reader, ext string, opts ConversionOptions) (rowReader, error) {
+	switch ext {
+	case "csv":
+		return newCSVRowReader(in, opts.Charset)
+	case "xlsx":
+		return newXLSXRowReader(in, opts.Table)
+	case "json":
+		data, err := io.ReadAll(in)
+		if err != nil {
+			return nil, err
+		}
+		t, err := readJSONTable(data)
+		if err != nil {
+			return nil, err
+		}
+		return &tableRowReader{t: t}, nil
+	default:
+		return nil, fmt.Errorf("cannot read %s as a table", ext)
+	}
+}
+
+// csvRowWriter writes CSV with a header row.
+type csvRowWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvRowWriter) writeHeader(columns, _ []string) error { return c.writeRow(columns) }
+
+func (c *csvRowWriter) writeRow(row []string) error {
+	if err := c.w.Write(row); err != nil {
+		return fmt.Errorf("failed to write CSV: %w", err)
+	}
+	return nil
+}
+
+func (c *csvRowWriter) close() error {
+	c.w.Flush()
+	if err := c.w.Error(); err != nil {
+		return fmt.Errorf("failed to write CSV: %w", err)
+	}
+	return nil
+}
+
+// jsonRowWriter writes a JSON array of objects, keeping column order. Cells of
+// typed columns are written as their type, empty ones as null; untyped cells
+// that look like numbers are written as numbers.
+type jsonRowWriter struct {
+	w     *bufio.Writer
+	keys  [][]byte
+	types []string
+	rows  int
+}
+
+func (j *jsonRowWriter) writeHeader(columns, types []string) error {
+	j.keys = make([][]byte, len(columns))
+	for i, col := range columns {
+		j.keys[i], _ = json.Marshal(col)
+	}
+	j.types = types
+	_, err := j.w.WriteString("[")
+	return err
+}
+
+func (j *jsonRowWriter) writeRow(row []string) error {
+	if j.rows > 0 {
+		j.w.WriteString(",")
+	}
+	j.rows++
+	j.w.WriteString("\n  {")
+	for i, cell := range row {
+		if i > 0 {
+			j.w.WriteString(", ")
+		}
+		j.w.Write(j.keys[i])
+		j.w.WriteString(": ")
+		kind := ""
+		if i < len(j.types) {
+			kind = j.types[i]
+		}
+		switch {
+		case kind != "" && kind != "string" && kind != "date" && cell == "":
+			j.w.WriteString("null")
+		case kind == "int" || kind == "float" || kind == "bool":
+			j.w.WriteString(cell)
+		case kind == "" && jsonNumberPattern.MatchString(cell):
+			j.w.WriteString(cell)
+		default:
+			val, _ := json.Marshal(cell)
+			j.w.Write(val)
+		}
+	}
+	_, err := j.w.WriteString("}")
+	return err
+}
+
+func (j *jsonRowWriter) close() error {
+	j.w.WriteString("\n]\n")
+	return j.w.Flush()
+}
+
+// xlsxRowWriter writes worksheets with excelize's stream writer, which keeps
+// only a bounded buffer of rows in memory. Numeric cells are written as numbers
+// so spreadsheet formulas work on them. With a locale, numbers and dates are
+// read as written in it, dates become date cells shown in its format, and
+// sheets follow its reading direction.
+type xlsxRowWriter struct {
+	out       io.Writer
+	f         *excelize.File
+	sw        *excelize.StreamWriter
+	sheets    int
+	row       int
+	types     []string
+	locale    *tableLocale
+	dateStyle int
+}
+
+// newXLSXRowWriter starts a workbook; loc may be nil.
+func newXLSXRowWriter(out io.Writer, loc *tableLocale) (*xlsxRowWriter, error) {
+	x := &xlsxRowWriter{out: out, f: excelize.NewFile(), locale: loc}
+	if loc != nil {
+		style, err := x.f.NewStyle(&excelize.Style{CustomNumFmt: &loc.excelFormat})
+		if err != nil {
+			x.f.Close()
+			return nil, fmt.Errorf("failed to create date style: %w", err)
+		}
+		x.dateStyle = style
+	}
+	return x, nil
+}
+
+// addSheet starts a new worksheet; rows written from then on go to it.
+func (x *xlsxRowWriter) addSheet(name string) error {
+	if x.sw != nil {
+		if err := x.sw.Flush(); err != nil {
+			return fmt.Errorf("failed to write sheet: %w", err)
+		}
+	}
+	if x.sheets == 0 {
+		if err := x.f.SetSheetName("Sheet1", name); err != nil {
+			return fmt.Errorf("failed to name sheet: %w", err)
+		}
+	} else if _, err := x.f.NewSheet(name); err != nil {
+		return fmt.Errorf("failed to create sheet: %w", err)
+	}
+	x.sheets++
+	if x.locale != nil && x.locale.rtl {
+		// Sheet views are written with the first row, so this goes first
+		rtl := true
+		if err := x.f.SetSheetView(name, 0, &excelize.ViewOptions{RightToLeft: &rtl}); err != nil {
+			return fmt.Errorf("failed to set sheet direction: %w", err)
+		}
+	}
+	sw, err := x.f.NewStreamWriter(name)
+	if err != nil {
+		return fmt.Errorf("failed to create sheet: %w", err)
+	}
+	x.sw, x.row, x.types = sw, 0, nil
+	return nil
+}
+
+func (x *xlsxRowWriter) writeHeader(columns, types []string) error {
+	header := make([]any, len(columns))
+	for i, c := range columns {
+		header[i] = c
+	}
+	x.types = types
+	return x.setRow(header)
+}
+
+func (x *xlsxRowWriter) writeRow(row []string) error {
+	cells := make([]any, len(row))
+	for i, cell := range row {
+		kind := ""
+		if i < len(x.types) {
+			kind = x.types[i]
+		}
+		if x.locale != nil && kind == "" {
+			cells[i] = x.localeCell(cell)
+		} else if v, ok := parseCellFloat(cell); ok && (kind == "int" || kind == "float" || kind == "" && jsonNumberPattern.MatchString(cell)) {
+			cells[i] = v
+		} else if kind == "bool" && cell != "" {
+			cells[i] = cell == "true"
+		} else if d, err := time.Parse("2006-01-02", cell); err == nil && kind == "date" && x.locale != nil {
+			cells[i] = excelize.Cell{StyleID: x.dateStyle, Value: d}
+		} else {
+			cells[i] = cell
+		}
+	}
+	return x.setRow(cells)
+}
+
+// localeCell returns the value of an untyped cell written in the locale.
+func (x *xlsxRowWriter) localeCell(cell string) any {
+	if n, ok := x.locale.parseNumber(cell); ok {
+		v, _ := parseCellFloat(n)
+		return v
+	}
+	if d, ok := x.locale.parseDate(cell); ok {
+		return excelize.Cell{StyleID: x.dateStyle, Value: d}
+	}
+	return cell
+}
+
+func (x *xlsxRowWriter) setRow(cells []any) error {
+	if x.row >= xlsxMaxRows {
+		return fmt.Errorf("too many rows for an XLSX sheet: at most %d are allowed", xlsxMaxRows-1)
+	}
+	x.row++
+	addr, _ := excelize.CoordinatesToCellName(1, x.row)
+	if err := x.sw.SetRow(addr, cells); err != nil {
+		return fmt.Errorf("failed to write sheet row: %w", err)
+	}
+	return nil
+}
+
+func (x *xlsxRowWriter) close() error {
+	defer x.f.Close() // Removes the stream writer's temporary files
+	if x.sw != nil {
+		if err := x.sw.Flush(); err != nil {
+			return fmt.Errorf("failed to write sheet: %w", err)
+		}
+	}
+	if err := x.f.Write(x.out); err != nil {
+		return fmt.Errorf("failed to write XLSX: %w", err)
+	}
+	return nil
+}
+
+// tablePageStyle lays out HTML tables for printing, repeating the header row on
+// every page.
+const tablePageStyle = `@page { margin: 12mm }
+body { font: 9pt sans-serif; margin: 0 }
+table { border-collapse: collapse; width: 100% }
+thead { display: table-header-group }
+th, td { border: 1px solid #bbb; padding: 2px 6px; text-align: start; vertical-align: top }
+th { background: #eee }
+td.n { text-align: end; font-variant-numeric: tabular-nums; white-space: nowrap }`
+
+// htmlRowWriter writes a table as an HTML page to be printed. With a locale,
+// numbers and dates are read and shown as written in it, and the page follows
+// its language and reading direction.
+type htmlRowWriter struct {
+	w      *bufio.Writer
+	name   string
+	locale *tableLocale
+	types  []string
+}
+
+func (h *htmlRowWriter) writeHeader(columns, types []string) error {
+	h.types = types
+	lang, dir := "", "ltr"
+	if h.locale != nil {
+		lang, dir = h.locale.tag, h.locale.dir()
+	}
+	fmt.Fprintf(h.w, "<!DOCTYPE html>\n<html lang=\"%s\" dir=\"%s\"><head><meta charset=\"utf-8\"><title>%s</title>\n<style>\n%s\n</style></head>\n<body><table><thead><tr>",
+		html.EscapeString(lang), dir, html.EscapeString(h.name), tablePageStyle)
+	for _, col := range columns {
+		h.w.WriteString("<th>" + html.EscapeString(col) + "</th>")
+	}
+	_, err := h.w.WriteString("</tr></thead>\n<tbody>\n")
+	return err
+}
+
+func (h *htmlRowWriter) writeRow(row []string) error {
+	h.w.WriteString("<tr>")
+	for i, cell := range row {
+		kind := ""
+		if i < len(h.types) {
+			kind = h.types[i]
+		}
+		text, numeric := h.display(cell, kind)
+		if numeric {
+			h.w.WriteString(`<td class="n">`)
+		} else {
+			h.w.WriteString("<td>")
+		}
+		h.w.WriteString(html.EscapeString(text) + "</td>")
+	}
+	_, err := h.w.WriteString("</tr>\n")
+	return err
+}
+
+// display returns how a cell is shown and whether it is a number.
+func (h *htmlRowWriter) display(cell, kind string) (string, bool) {
+	switch {
+	case kind == "" || kind == "int" || kind == "float":
+		if h.locale == nil {
+			return cell, jsonNumberPattern.MatchString(cell)
+		}
+		if n, ok := h.locale.parseNumber(cell); ok {
+			return h.locale.formatNumber(n), true
+		}
+		if d, ok := h.locale.parseDate(cell); ok && kind == "" {
+			return d.Format(h.locale.formatLayout), false
+		}
+	case kind == "date" && h.locale != nil:
+		if d, err := time.Parse("2006-01-02", cell); err == nil {
+			return d.Format(h.locale.formatLayout), false
+		}
+	}
+	return cell, false
+}
+
+func (h *htmlRowWriter) close() error {
+	h.w.WriteString("</tbody></table></body></html>\n")
+	return h.w.Flush()
+}
+
+// newRowWriter starts writing a table in the given format. For XLSX and HTML,
+// name is the table's name, which becomes the sheet name or page title, and loc,
+// which may be nil, the locale numbers and dates are laid out in.
+func newRowWriter(out io.Writer, format, name string, loc *tableLocale) (rowWriter, error) {
+	switch format {
+	case "csv":
+		return &csvRowWriter{w: csv.NewWriter(out)}, nil
+	case "json":
+		return &jsonRowWriter{w: bufio.NewWriterSize(out, 64<<10)}, nil
+	case "html":
+		return &htmlRowWriter{w: bufio.NewWriterSize(out, 64<<10), name: name, locale: loc}, nil
+	case "xlsx":
+		x, err := newXLSXRowWriter(out, loc)
+		if err != nil {
+			return nil, err
+		}
+		if err := x.addSheet(xlsxSheetName(name, 0, nil)); err != nil {
+			x.close()
+			return nil, err
+		}
+		return x, nil
+	default:
+		return nil, fmt.Errorf("cannot write a table as %s", format)
+	}
+}
+
+// copyRows writes the header and then every row of r, reshaped, to w, stopping
+// after limit rows if limit is positive, or early when ctx ends. It does not
+// close w.
+func copyRows(ctx context.Context, r rowReader, w rowWriter, shaper *rowShaper, limit int) error {
+	if err := w.writeHeader(shaper.columns, shaper.types); err != nil {
+		return err
+	}
+	for n := 1; limit <= 0 || n <= limit; n++ {
+		if n%1000 == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		row, err := r.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if row, err = shaper.shape(n, row); err != nil {
+			return err
+		}
+		if err := w.writeRow(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// convertTableStream converts a CSV, JSON or XLSX table read from in to
+// targetFormat, applying the columns, mapping and rowLimit options, and writes
+// it to out as it goes.
+func convertTableStream(ctx context.Context, in io.Reader, out io.Writer, sourceExt, targetFormat string, opts ConversionOptions) error {
+	r, err := openRowReader(in, sourceExt, opts)
+	if err != nil {
+		return err
+	}
+	defer r.close()
+	shaper, err := newRowShaper(r.columns(), nil, opts)
+	if err != nil {
+		return err
+	}
+	name := opts.Table
+	if x, ok := r.(*xlsxRowReader); ok {
+		name = x.sheet
+	}
+	w, err := newRowWriter(out, targetFormat, name, opts.Locale)
+	if err != nil {
+		return err
+	}
+	if err := copyRows(ctx, r, w, shaper, opts.RowLimit); err != nil {
+		w.close()
+		return err
+	}
+	return w.close()
+}
+
+// convertTableToPDF lays out a CSV, JSON or XLSX table as an HTML page and
+// prints it with headless Chromium.
+func convertTableToPDF(ctx context.Context, inputFileBytes []byte, outputFilename, sourceExt string, opts ConversionOptions) ([]byte, string, error) {
+	wd, err := newJobWorkdir()
+	if err != nil {
+		return nil, "", err
+	}
+	defer wd.cleanup()
+
+	page := wd.artifact("html")
+	f, err := os.Create(page)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create page: %w", err)
+	}
+	err = convertTableStream(ctx, bytes.NewReader(inputFileBytes), f, sourceExt, "html", opts)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	stages := []conversionStage{chromiumStage("pdf", opts)}
+	opts.Report.addIntermediate(IntermediateStep{Format: "html", Lossless: true, Into: stages[0].name})
+	outputPath, err := wd.runPipeline(ctx, opts.Report, page, stages...)
+	if err != nil {
+		return nil, "", err
+	}
+	outputBytes, err := wd.readOutput(outputPath)
+	if err != nil {
+		return nil, "", err
+	}
+	return outputBytes, outputFilename, nil
+}
+
+// streamsTable reports whether a conversion runs through convertTableStream
+// and can be streamed from an upload without reading it into memory.
+func streamsTable(sourceExt, targetFormat string) bool {
+	return (sourceExt == "csv" || sourceExt == "xlsx") && (targetFormat == "csv" || targetFormat == "json" || targetFormat == "xlsx")
+}
+
+// addStreamedTable converts a table of the given name and size, uploaded or
+// stored, straight from file into a file in the job's working directory, and
+// moves the result into storage. With a pre hook, the table is written to the
+// working directory for it first.
+func (fs *FileStore) addStreamedTable(ctx context.Context, file io.Reader, name string, size int64, sourceExt, targetFormat string, opts ConversionOptions, attrs jobAttributes) (*FileMetadata, error) {
+	release, err := tempSpace.reserve(estimateTempSpace(FileTypeData, targetFormat, int(size)))
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	wd, err := newJobWorkdir()
+	if err != nil {
+		return nil, err
+	}
+	defer wd.cleanup()
+
+	var in io.Reader = file
+	if conversionHooks.pre != nil {
+		input := wd.artifact(sourceExt)
+		if err := writeUploadTo(input, file); err != nil {
+			return nil, err
+		}
+		if err = hookInputFile(ctx, name, targetFormat, input, opts.Report); err == nil {
+			f, err := os.Open(input)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read temporary input file: %w", err)
+			}
+			defer f.Close()
+			in = f
+		}
+	}
+
+	outputFilename := strings.TrimSuffix(name, filepath.Ext(name)) + "." + targetFormat
+	output := wd.path(outputFilename)
+	if err == nil {
+		var out *os.File
+		if out, err = os.Create(output); err != nil {
+			return nil, fmt.Errorf("failed to create output file: %w", err)
+		}
+		err = runConvertStage(ctx, opts, func(ctx context.Context) error {
+			return convertTableStream(ctx, in, out, sourceExt, targetFormat, opts)
+		})
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("conversion failed: %w", err)
+		meta, recErr := fs.recordFailure(name, err, attrs)
+		if recErr != nil {
+			log.Printf("Error recording failed job: %v", recErr)
+		}
+		return meta, err
+	}
+	return fs.storeFileFromPath(ctx, name, outputFilename, getContentTypeForExtension(targetFormat), output, attrs)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime/metrics"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// csvRows generates a CSV table of n rows as it is read, so the input of a
+// benchmark takes no memory however large it is.
+type csvRows struct {
+	n, i int
+	line []byte
+}
+
+func (c *csvRows) Read(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		if len(c.line) == 0 {
+			switch {
+			case c.i > c.n:
+				if written == 0 {
+					return 0, io.EOF
+				}
+				return written, nil
+			case c.i == 0:
+				c.line = []byte("id,name,amount,date\n")
+			default:
+				c.line = fmt.Appendf(c.line[:0], "%d,customer %d,%d.%02d,2024-01-%02d\n", c.i, c.i%5000, c.i%100000, c.i%100, c.i%28+1)
+			}
+			c.i++
+		}
+		n := copy(p[written:], c.line)
+		c.line = c.line[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// peakHeap samples the live heap until stop is called, which returns the
+// largest sample in bytes.
+func peakHeap() (stop func() uint64) {
+	var peak atomic.Uint64
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		for {
+			metrics.Read(sample)
+			if v := sample[0].Value.Uint64(); v > peak.Load() {
+				peak.Store(v)
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() uint64 {
+		close(done)
+		<-finished
+		return peak.Load()
+	}
+}
+
+// BenchmarkTableStream converts generated CSV tables of growing length and
+// reports the peak live heap of each conversion, which for CSV and JSON output
+// grows little with the number of rows.
+func BenchmarkTableStream(b *testing.B) {
+	for _, format := range []string{"csv", "json", "xlsx"} {
+		for _, rows := range []int{10_000, 100_000, 1_000_000} {
+			b.Run(format+"/"+strconv.Itoa(rows), func(b *testing.B) {
+				var peak uint64
+				b.ReportAllocs()
+				for range b.N {
+					stop := peakHeap()
+					err := convertTableStream(context.Background(), &csvRows{n: rows}, io.Discard, "csv", format, ConversionOptions{})
+					peak = max(peak, stop())
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MB")
+			})
+		}
+	}
+}
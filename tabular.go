@@ -0,0 +1,335 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/encoding"
+)
+
+// table is a simple in-memory representation of tabular data (CSV, JSON records, ...)
+// shared by the data-oriented converters. All cells are kept as strings.
+type table struct {
+	Name    string // Table or sheet name, when the source has one
+	Columns []string
+	Rows    [][]string
+	Types   []string // Column types set by a mapping (see columnTypes); nil or "" means untyped
+}
+
+// columnType returns the type a mapping gave column i, or "" if it has none.
+func (t *table) columnType(i int) string {
+	if i < len(t.Types) {
+		return t.Types[i]
+	}
+	return ""
+}
+
+// columnIndex returns the index of the named column, or -1.
+func (t *table) columnIndex(name string) int {
+	for i, c := range t.Columns {
+		if c == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// limitRows truncates the table to at most n rows; n <= 0 means no limit.
+func (t *table) limitRows(n int) {
+	if n > 0 && len(t.Rows) > n {
+		t.Rows = t.Rows[:n]
+	}
+}
+
+// readTable parses CSV, JSON or XLSX content into a table based on the source
+// extension. CSV is decoded from opts.Charset, and with opts.Locale the numbers
+// and dates of CSV and JSON are read as the locale writes them.
+func readTable(data []byte, ext string, opts ConversionOptions) (*table, error) {
+	var t *table
+	var err error
+	switch ext {
+	case "csv":
+		t, err = readCSVTable(data, opts.Charset)
+	case "json":
+		t, err = readJSONTable(data)
+	case "xlsx":
+		return readXLSXTable(data, "")
+	default:
+		return nil, fmt.Errorf("cannot read %s as a table", ext)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if opts.Locale != nil {
+		t.readLocale(opts.Locale)
+	}
+	return t, nil
+}
+
+// readLocale rewrites the untyped cells holding numbers or dates written in loc
+// in canonical form, so "1.234,5" becomes "1234.5" and "31.12.2024" becomes
+// "2024-12-31" in German.
+func (t *table) readLocale(loc *tableLocale) {
+	for _, row := range t.Rows {
+		for i, cell := range row {
+			if t.columnType(i) != "" {
+				continue
+			}
+			if n, ok := loc.parseNumber(cell); ok {
+				row[i] = n
+			} else if d, ok := loc.parseDate(cell); ok {
+				row[i] = d.Format("2006-01-02")
+			}
+		}
+	}
+}
+
+// readCSVTable parses CSV content in the given charset, treating the first
+// record as the header.
+func readCSVTable(data []byte, charset encoding.Encoding) (*table, error) {
+	r, err := newCSVRowReader(bytes.NewReader(data), charset)
+	if err != nil {
+		return nil, err
+	}
+	return readRows(r)
+}
+
+// readRows reads every row of r into a table.
+func readRows(r rowReader) (*table, error) {
+	defer r.close()
+	t := &table{Columns: r.columns()}
+	if x, ok := r.(*xlsxRowReader); ok {
+		t.Name = x.sheet
+	}
+	for {
+		row, err := r.next()
+		if err == io.EOF {
+			return t, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		t.Rows = append(t.Rows, row)
+	}
+}
+
+// readJSONTable parses a JSON array of objects. Columns are taken from the keys of
+// the objects in first-seen order, which a plain map decode would lose.
+func readJSONTable(data []byte) (*table, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return nil, fmt.Errorf("JSON input must be an array of objects")
+	}
+
+	t := &table{}
+	index := map[string]int{}
+	var records []map[string]string
+	for dec.More() {
+		record, err := readJSONObject(dec, t, index)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	if _, err := dec.Token(); err != nil && err != io.EOF { // closing ']'
+		return nil, fmt.Errorf("%w: failed to parse JSON: %w", ErrInputCorrupt, err)
+	}
+
+	t.fillRows(records, index)
+	return t, nil
+}
+
+// readXLSXTable reads a worksheet of an XLSX workbook, the first one unless a
+// sheet is named, treating its first row as the header.
+func readXLSXTable(data []byte, sheet string) (*table, error) {
+	r, err := newXLSXRowReader(bytes.NewReader(data), sheet)
+	if err != nil {
+		return nil, err
+	}
+	return readRows(r)
+}
+
+// convertTable converts between CSV, JSON and XLSX in memory; see
+// convertTableStream.
+func convertTable(ctx context.Context, inputFileBytes []byte, outputFilename, sourceExt, targetFormat string, opts ConversionOptions) ([]byte, string, error) {
+	var buf bytes.Buffer
+	if err := convertTableStream(ctx, bytes.NewReader(inputFileBytes), &buf, sourceExt, targetFormat, opts); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), outputFilename, nil
+}
+
+// readJSONObject decodes the next JSON object from dec into a record of cells,
+// registering keys not seen before as new columns of t.
+func readJSONObject(dec *json.Decoder, t *table, index map[string]int) (map[string]string, error) {
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, fmt.Errorf("JSON input must be an array of objects")
+	}
+	record := map[string]string{}
+	for dec.More() {
+		keyTok, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to parse JSON: %w", ErrInputCorrupt, err)
+		}
+		key := keyTok.(string)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, fmt.Errorf("%w: failed to parse JSON: %w", ErrInputCorrupt, err)
+		}
+		if _, ok := index[key]; !ok {
+			index[key] = len(t.Columns)
+			t.Columns = append(t.Columns, key)
+		}
+		record[key] = jsonCellString(value)
+	}
+	if _, err := dec.Token(); err != nil { // closing '}'
+		return nil, fmt.Errorf("%w: failed to parse JSON: %w", ErrInputCorrupt, err)
+	}
+	return record, nil
+}
+
+// fillRows appends records to t as rows, placing each cell in its column's position.
+func (t *table) fillRows(records []map[string]string, index map[string]int) {
+	for _, record := range records {
+		row := make([]string, len(t.Columns))
+		for key, value := range record {
+			row[index[key]] = value
+		}
+		t.Rows = append(t.Rows, row)
+	}
+}
+
+// jsonCellString flattens a JSON value into a cell: strings are unquoted, null is
+// empty and anything else (numbers, bools, nested values) keeps its JSON text.
+func jsonCellString(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	if string(raw) == "null" {
+		return ""
+	}
+	return string(raw)
+}
+
+// parseCellFloat parses a numeric cell, returning false for empty or non-numeric values.
+func parseCellFloat(cell string) (float64, bool) {
+	f, err := strconv.ParseFloat(cell, 64)
+	return f, err == nil
+}
+
+// jsonNumberPattern matches cells that can be written to JSON as bare numbers
+// without changing their meaning (so "007" or "1e" stay strings).
+var jsonNumberPattern = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// writeTable encodes a table as CSV, JSON or XLSX.
+func writeTable(t *table, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := newRowWriter(&buf, format, t.Name, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeRows(w, t); err != nil {
+		w.close()
+		return nil, err
+	}
+	if err := w.close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeRows writes the header and rows of a table to w.
+func writeRows(w rowWriter, t *table) error {
+	return copyRows(context.Background(), &tableRowReader{t: t}, w, &rowShaper{columns: t.Columns, types: t.Types, same: true}, 0)
+}
+
+// writeXLSXTables encodes tables as an XLSX workbook with one sheet per table.
+func writeXLSXTables(tables []*table) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := newXLSXRowWriter(&buf, nil)
+	if err != nil {
+		return nil, err
+	}
+	taken := make(map[string]bool, len(tables))
+	for i, t := range tables {
+		err := w.addSheet(xlsxSheetName(t.Name, i, taken))
+		if err == nil {
+			err = writeRows(w, t)
+		}
+		if err != nil {
+			w.close()
+			return nil, err
+		}
+	}
+	if err := w.close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// xlsxInvalidSheetChars are characters Excel does not allow in sheet names.
+var xlsxInvalidSheetChars = regexp.MustCompile(`[\[\]:*?/\\]`)
+
+// xlsxSheetName turns a table name into a valid sheet name: at most 31
+// characters, none of the characters Excel forbids, and none of the names in
+// taken, which Excel compares regardless of case. The name is added to taken,
+// which may be nil for a single sheet.
+func xlsxSheetName(name string, index int, taken map[string]bool) string {
+	name = xlsxInvalidSheetChars.ReplaceAllString(name, "_")
+	if name == "" {
+		name = fmt.Sprintf("Sheet%d", index+1)
+	}
+	name = uniqueName(name, 31, func(n string) bool { return taken[strings.ToLower(n)] })
+	if taken != nil {
+		taken[strings.ToLower(name)] = true
+	}
+	return name
+}
+
+// uniqueName shortens name to at most maxRunes characters, unless maxRunes is
+// 0, and numbers it like "name (2)" until taken reports it free.
+func uniqueName(name string, maxRunes int, taken func(string) bool) string {
+	runes := []rune(name)
+	for i := 1; ; i++ {
+		suffix := ""
+		if i > 1 {
+			suffix = fmt.Sprintf(" (%d)", i)
+		}
+		base := runes
+		if n := maxRunes - len(suffix); maxRunes > 0 && len(base) > n {
+			base = base[:n]
+		}
+		if candidate := string(base) + suffix; !taken(candidate) {
+			return candidate
+		}
+	}
+}
+
+// zipFiles bundles named files into an in-memory zip archive.
+func zipFiles(names []string, contents [][]byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for i, name := range names {
+		w, err := zw.Create(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to add %s to zip: %w", name, err)
+		}
+		if _, err := w.Write(contents[i]); err != nil {
+			return nil, fmt.Errorf("failed to add %s to zip: %w", name, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finish zip: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	// maxTags bounds how many tags a client may attach to one file.
+	maxTags = 20
+	// maxTagValueLength bounds the length of a tag value in bytes.
+	maxTagValueLength = 256
+)
+
+// tagKeyPattern restricts tag keys to identifier-like strings that are safe in
+// query strings and logs.
+var tagKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,64}$`)
+
+// jobAttributes are the client- and request-supplied details stored with a job
+// besides its content.
+type jobAttributes struct {
+	Report *ConversionReport // Traces of the commands run; may be nil
+	Tags   map[string]string // User tags for correlating files with external records
+	APIKey string            // Id of the API key that created the job, if any
+
+	Workspace string // Id of the workspace the job runs in, if any
+
+	Moderation *moderationResult // Verdict on the uploaded media, if it was moderated
+	ShortCode  bool              // Whether to issue a short download code
+	Receipt    *receiptRequest   // Set if the client asked for a signed receipt
+
+	postHooked bool // Whether the post hook already ran on the output
+	moderated  bool // Whether Moderation is already settled, as for a stored file
+}
+
+// parseJobAttributes collects the attributes of a job created by the request.
+// The form must already be parsed.
+func parseJobAttributes(r *http.Request) (jobAttributes, error) {
+	tags, err := parseTags(r)
+	if err != nil {
+		return jobAttributes{}, fmt.Errorf("invalid tags: %w", err)
+	}
+	receipt, err := parseReceiptRequest(r)
+	if err != nil {
+		return jobAttributes{}, err
+	}
+	return jobAttributes{Tags: tags, APIKey: apiKeyID(r), Workspace: r.PathValue("ws"), ShortCode: r.FormValue("shortCode") == "true", Receipt: receipt}, nil
+}
+
+// parseTags reads the "tag" form fields, each of the form key=value, so clients
+// can label a file with e.g. tag=ticket=4711 and find it again later. The form
+// must already be parsed.
+func parseTags(r *http.Request) (map[string]string, error) {
+	fields := r.Form["tag"]
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	if len(fields) > maxTags {
+		return nil, fmt.Errorf("at most %d tags are allowed", maxTags)
+	}
+
+	tags := make(map[string]string, len(fields))
+	for _, field := range fields {
+		key, value, err := parseTag(field)
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := tags[key]; dup {
+			return nil, fmt.Errorf("tag %q is given more than once", key)
+		}
+		tags[key] = value
+	}
+	return tags, nil
+}
+
+// parseTag splits and validates a single key=value tag.
+func parseTag(field string) (string, string, error) {
+	key, value, ok := strings.Cut(field, "=")
+	if !ok {
+		return "", "", fmt.Errorf("tag %q must look like key=value", field)
+	}
+	if !tagKeyPattern.MatchString(key) {
+		return "", "", fmt.Errorf("tag key %q must be 1-64 letters, digits or _.:-", key)
+	}
+	if len(value) > maxTagValueLength {
+		return "", "", fmt.Errorf("value of tag %q is longer than %d bytes", key, maxTagValueLength)
+	}
+	return key, value, nil
+}
+
+// hasTags reports whether the file carries every one of the wanted tags.
+func (meta *FileMetadata) hasTags(want map[string]string) bool {
+	for key, value := range want {
+		if got, ok := meta.Tags[key]; !ok || got != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// Conversions write their input, intermediates and output to job working
+// directories in the system temp directory. A job that runs out of room there
+// only finds out when a write fails, which for a long encode can be many
+// minutes in, and it takes concurrent jobs down with it. So each conversion
+// reserves an estimate of the space it needs before it starts, and is refused
+// at once when that doesn't fit.
+
+// tempGrowth is how many times the size of its input a conversion is assumed to
+// write, counting the input itself, its output and any intermediates. The
+// factors are generous: a refused job can be retried, one that fills the disk
+// can't.
+var tempGrowth = map[FileType]float64{
+	FileTypeImage:   3,
+	FileTypeAudio:   3,
+	FileTypeVideo:   3,
+	FileTypeDoc:     4, // Documents are converted in chains, e.g. Markdown to HTML to PDF
+	FileTypeArchive: 6, // Archives are extracted before being repacked
+	FileTypeData:    4,
+}
+
+// uncompressedAudio are formats decoding compressed audio into grows it about
+// tenfold: a 128 kbit/s MP3 becomes 1411 kbit/s of CD-quality WAV.
+var uncompressedAudio = map[string]bool{"wav": true, "flac": true}
+
+// estimateTempSpace returns the temporary disk space converting size bytes of
+// fileType to targetFormat is expected to take.
+func estimateTempSpace(fileType FileType, targetFormat string, size int) int64 {
+	growth, ok := tempGrowth[fileType]
+	if !ok {
+		growth = 3
+	}
+	if (fileType == FileTypeAudio || fileType == FileTypeVideo) && uncompressedAudio[targetFormat] {
+		growth += 10
+	}
+	return int64(float64(size) * growth)
+}
+
+// chromiumTempSpace is what a headless Chromium session is assumed to write to
+// its profile directory, whatever the page.
+const chromiumTempSpace = 100 << 20
+
+// uploadsSize returns the total size of a batch of uploads.
+func uploadsSize(headers []*multipart.FileHeader) int {
+	var n int64
+	for _, h := range headers {
+		n += h.Size
+	}
+	return int(n)
+}
+
+// tempSpaceBudget keeps running jobs from reserving more temporary disk space
+// together than there is, or than the operator allows.
+type tempSpaceBudget struct {
+	Total int64 // Bytes all running jobs may reserve; 0 leaves free space as the only bound
+	Job   int64 // Bytes a single job may reserve; 0 means no per-job quota
+
+	mu       sync.Mutex
+	reserved int64
+}
+
+// tempSpace is the budget conversions reserve their temporary space from.
+var tempSpace = &tempSpaceBudget{}
+
+// loadTempSpaceBudget reads the budget from FILECONVERTER_TEMP_BUDGET_MB and the
+// per-job quota from FILECONVERTER_JOB_TEMP_QUOTA_MB.
+func loadTempSpaceBudget() *tempSpaceBudget {
+	return &tempSpaceBudget{
+		Total: int64(envInt("FILECONVERTER_TEMP_BUDGET_MB", 0)) << 20,
+		Job:   int64(envInt("FILECONVERTER_JOB_TEMP_QUOTA_MB", 0)) << 20,
+	}
+}
+
+// reserve sets n bytes of temporary space aside for a job, failing with
+// ErrInsufficientSpace if the job's quota, the budget or the free space on the
+// temp filesystem can't take it. Free space already lacks whatever running jobs
+// have written, so only n is checked against it; a budget, where one is set, is
+// what keeps the reservations of jobs yet to write from adding up to more than
+// there is. Callers must call the returned release when the job is done.
+func (b *tempSpaceBudget) reserve(n int64) (release func(), err error) {
+	if b.Job > 0 && n > b.Job {
+		return nil, fmt.Errorf("%w: the job needs an estimated %s, more than the per-job quota of %s", ErrInsufficientSpace, megabytes(n), megabytes(b.Job))
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.Total > 0 && b.reserved+n > b.Total {
+		return nil, fmt.Errorf("%w: the job needs an estimated %s but only %s of the %s budget is left", ErrInsufficientSpace, megabytes(n), megabytes(max(b.Total-b.reserved, 0)), megabytes(b.Total))
+	}
+	if free, err := diskFreeBytes(os.TempDir()); err == nil && n > free {
+		return nil, fmt.Errorf("%w: the job needs an estimated %s but only %s is free", ErrInsufficientSpace, megabytes(n), megabytes(free))
+	}
+	b.reserved += n
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.reserved -= n
+		})
+	}, nil
+}
+
+// reserveSpooling reserves the space parsing the multipart body of r takes in
+// the temp directory, where everything past the first multipartMemory bytes is
+// spooled until the request ends. A body of unknown length may be as large as
+// any upload.
+func (b *tempSpaceBudget) reserveSpooling(r *http.Request) (release func(), err error) {
+	size := r.ContentLength
+	if size < 0 {
+		size = maxUploadSize
+	}
+	return b.reserve(max(size-multipartMemory, 0))
+}
+
+// megabytes formats a byte count for messages.
+func megabytes(n int64) string {
+	return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+}
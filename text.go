@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jaytaylor/html2text"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// textSpace stands in for spaces that must survive html2text's whitespace
+// collapsing (list indentation); it is replaced with a real space afterwards.
+const textSpace = "\uE000"
+
+// convertMarkdownToText renders Markdown to HTML and extracts its text, so
+// emphasis, link and heading syntax disappear while structure is kept.
+func convertMarkdownToText(ctx context.Context, inputFileBytes []byte, outputFilename string, opts ConversionOptions) ([]byte, string, error) {
+	var buf bytes.Buffer
+	md := goldmark.New(goldmark.WithExtensions(extension.GFM))
+	if err := md.Convert(inputFileBytes, &buf); err != nil {
+		return nil, "", fmt.Errorf("failed to render markdown: %w", err)
+	}
+	return convertHTMLToText(ctx, buf.Bytes(), outputFilename, opts)
+}
+
+// convertHTMLToText extracts readable plain text from an HTML document. Lists keep
+// their bullets, numbering and nesting, link URLs follow the link text in
+// parentheses (unless omitLinks is set) and tables are drawn as ASCII grids.
+func convertHTMLToText(ctx context.Context, inputFileBytes []byte, outputFilename string, opts ConversionOptions) ([]byte, string, error) {
+	doc, err := html.Parse(bytes.NewReader(inputFileBytes))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse HTML: %w", err)
+	}
+	prepareTextTree(doc, 0, opts)
+
+	tables := html2text.NewPrettyTablesOptions()
+	tables.AutoFormatHeader = false
+	text, err := html2text.FromHTMLNode(doc, html2text.Options{PrettyTables: true, PrettyTablesOptions: tables, OmitLinks: true})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to extract text: %w", err)
+	}
+	text = tidyQuoteLines(strings.ReplaceAll(text, textSpace, " "))
+	if opts.TextWidth > 0 {
+		text = wrapText(text, opts.TextWidth)
+	}
+	return []byte(text + "\n"), outputFilename, nil
+}
+
+// prepareTextTree rewrites the parts of the tree html2text renders poorly: list
+// items become lines with an explicit indented marker, bold text loses its
+// asterisks and links get their URL appended as text. depth is the current list
+// nesting level.
+func prepareTextTree(n *html.Node, depth int, opts ConversionOptions) {
+	switch n.DataAtom {
+	case atom.Ul, atom.Ol:
+		number := 1
+		if start, err := strconv.Atoi(getHTMLAttr(n, "start")); err == nil {
+			number = start
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.DataAtom != atom.Li {
+				continue
+			}
+			marker := "-"
+			if n.DataAtom == atom.Ol {
+				marker = strconv.Itoa(number) + "."
+				number++
+			}
+			// html2text separates the marker from the item text with a space itself.
+			prefix := strings.Repeat(textSpace, depth*2) + marker
+			c.InsertBefore(&html.Node{Type: html.TextNode, Data: prefix}, c.FirstChild)
+			c.DataAtom, c.Data = atom.Div, "div"
+			prepareTextTree(c, depth+1, opts)
+		}
+		// A div keeps nested lists on their own lines without blank lines around them.
+		n.DataAtom, n.Data = atom.Div, "div"
+		return
+
+	case atom.B, atom.Strong:
+		// html2text would wrap bold text in asterisks; plain text shouldn't carry markup.
+		n.DataAtom, n.Data = atom.Span, "span"
+
+	case atom.A:
+		href := strings.TrimPrefix(strings.TrimSpace(getHTMLAttr(n, "href")), "mailto:")
+		if href != "" && !strings.HasPrefix(href, "#") && !opts.OmitLinks && htmlText(n) != href {
+			n.AppendChild(&html.Node{Type: html.TextNode, Data: " (" + href + ")"})
+		}
+	}
+
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		prepareTextTree(c, depth, opts)
+	}
+}
+
+// getHTMLAttr returns the value of an element's attribute, or "".
+func getHTMLAttr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// htmlText returns the concatenated, trimmed text content of a node.
+func htmlText(n *html.Node) string {
+	var sb strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			sb.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return strings.TrimSpace(sb.String())
+}
+
+// emptyQuotePattern matches blockquote lines without any text.
+var emptyQuotePattern = regexp.MustCompile(`^>+ *$`)
+
+// tidyQuoteLines drops the empty "> " lines html2text emits around blockquote
+// content, keeping a single one only where it separates two quoted paragraphs.
+func tidyQuoteLines(text string) string {
+	lines := strings.Split(text, "\n")
+	kept := make([]string, 0, len(lines))
+	for i, line := range lines {
+		if !emptyQuotePattern.MatchString(line) {
+			kept = append(kept, line)
+			continue
+		}
+		prevQuoted := len(kept) > 0 && strings.HasPrefix(kept[len(kept)-1], ">") && !emptyQuotePattern.MatchString(kept[len(kept)-1])
+		next := i + 1
+		for next < len(lines) && emptyQuotePattern.MatchString(lines[next]) {
+			next++
+		}
+		if prevQuoted && next < len(lines) && strings.HasPrefix(lines[next], ">") {
+			kept = append(kept, strings.TrimRight(line, " "))
+		}
+	}
+	return strings.Join(kept, "\n")
+}
+
+// textHangPattern matches the part of a line continuation lines are indented past:
+// leading indentation plus a list marker, or a blockquote prefix.
+var textHangPattern = regexp.MustCompile(`^(?:>+ )?\s*(?:(?:[-*]|\d+\.) )?`)
+
+// wrapText wraps lines longer than width at spaces. Continuations of list items
+// are indented under the item text, and quoted lines keep their "> " prefix.
+func wrapText(text string, width int) string {
+	var out strings.Builder
+	for i, line := range strings.Split(text, "\n") {
+		if i > 0 {
+			out.WriteByte('\n')
+		}
+		if len([]rune(line)) <= width || strings.HasPrefix(line, "+-") || strings.HasPrefix(line, "|") {
+			out.WriteString(line) // Short lines and table rows are left alone
+			continue
+		}
+
+		hang := textHangPattern.FindString(line)
+		quote := ""
+		if strings.HasPrefix(hang, ">") {
+			quote = hang[:strings.Index(hang, " ")+1]
+		}
+		indent := quote + strings.Repeat(" ", len([]rune(hang))-len(quote))
+
+		words := strings.Fields(line[len(hang):])
+		cur := hang
+		curLen := len([]rune(hang))
+		atStart := true
+		for _, w := range words {
+			wl := len([]rune(w))
+			if !atStart && curLen+1+wl > width {
+				out.WriteString(cur)
+				out.WriteByte('\n')
+				cur, curLen, atStart = indent, len([]rune(indent)), true
+			}
+			if !atStart {
+				cur += " "
+				curLen++
+			}
+			cur += w
+			curLen += wl
+			atStart = false
+		}
+		out.WriteString(cur)
+	}
+	return out.String()
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// torrentTargetPieces is about how many pieces a torrent is split into;
+	// piece sizes are powers of two between torrentMinPiece and torrentMaxPiece.
+	torrentTargetPieces = 1500
+	torrentMinPiece     = 256 << 10
+	torrentMaxPiece     = 16 << 20
+)
+
+// torrentConfig decides when large outputs are offered as torrents, so that
+// recipients fetch pieces from each other instead of all from the server. The
+// server takes part as a web seed (BEP 19): clients download from its download
+// URL whatever no peer has.
+type torrentConfig struct {
+	threshold int64    // Files larger than this get a torrent; 0 disables torrents
+	trackers  []string // Announce URLs; without any, peers find each other over DHT
+	publicURL string   // Scheme and host the web seed URL starts with; taken from the request if empty
+}
+
+// torrentOutput is the configured torrent offer.
+var torrentOutput torrentConfig
+
+// loadTorrentConfig reads FILECONVERTER_TORRENT_THRESHOLD_MB, the comma-separated
+// FILECONVERTER_TORRENT_TRACKERS and FILECONVERTER_PUBLIC_URL, e.g.
+// https://files.example.com, which clients must be able to reach the server at.
+func loadTorrentConfig() (torrentConfig, error) {
+	c := torrentConfig{
+		threshold: int64(envInt("FILECONVERTER_TORRENT_THRESHOLD_MB", 0)) << 20,
+		publicURL: strings.TrimSuffix(os.Getenv("FILECONVERTER_PUBLIC_URL"), "/"),
+	}
+	for _, t := range strings.Split(os.Getenv("FILECONVERTER_TORRENT_TRACKERS"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			c.trackers = append(c.trackers, t)
+		}
+	}
+	if c.publicURL != "" {
+		if u, err := url.Parse(c.publicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return torrentConfig{}, fmt.Errorf("FILECONVERTER_PUBLIC_URL must be an http or https URL, not %q", c.publicURL)
+		}
+	}
+	return c, nil
+}
+
+// offered reports whether a file of the given size gets a torrent.
+func (c torrentConfig) offered(size int64) bool {
+	return c.threshold > 0 && size > c.threshold
+}
+
+// webSeedURL returns the absolute download URL of a file for clients to seed from.
+func (c torrentConfig) webSeedURL(r *http.Request, meta *FileMetadata) string {
+	base := c.publicURL
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host
+	}
+	return base + downloadURL(r, meta)
+}
+
+// torrentPieces are the piece hashes of a file, which take a full read of the
+// file to compute and so are kept with its metadata once computed.
+type torrentPieces struct {
+	pieceLength int64
+	hashes      []byte // The SHA-1 of every piece, concatenated
+}
+
+// torrentPieceLength picks the piece length for a file of the given size.
+func torrentPieceLength(size int64) int64 {
+	length := int64(torrentMinPiece)
+	for length < torrentMaxPiece && size/length > torrentTargetPieces {
+		length *= 2
+	}
+	return length
+}
+
+// errTorrentHash means a stored file could not be read to hash it.
+var errTorrentHash = errors.New("failed to hash file for its torrent")
+
+// statusClientClosedRequest is the status logged for requests whose client went
+// away before they were answered, as nginx does.
+const statusClientClosedRequest = 499
+
+// torrentHash is the hashing of a file for its torrent, which the requests that
+// ask for the torrent while it runs wait for together.
+type torrentHash struct {
+	done   chan struct{} // Closed once pieces or err is set
+	pieces *torrentPieces
+	err    error
+}
+
+// hashTorrentPieces reads r to the end and hashes it in pieces of the given length.
+func hashTorrentPieces(r io.Reader, pieceLength int64) (*torrentPieces, error) {
+	p := &torrentPieces{pieceLength: pieceLength}
+	buf := make([]byte, pieceLength)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			sum := sha1.Sum(buf[:n])
+			p.hashes = append(p.hashes, sum[:]...)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return p, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file: %w", err)
+		}
+	}
+}
+
+// torrentPiecesFor returns the piece hashes of a stored file, hashing it the
+// first time. Requests arriving while the file is hashed wait for that hashing
+// rather than start their own, and it carries on if they give up, since the
+// next request would need it anyway. A failed hashing is tried again by the
+// next request.
+func (fs *FileStore) torrentPiecesFor(ctx context.Context, fileID string) (*FileMetadata, *torrentPieces, error) {
+	meta, content, err := fs.OpenFile(fileID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fs.mu.Lock()
+	job := meta.torrent
+	if job == nil {
+		job = &torrentHash{done: make(chan struct{})}
+		meta.torrent = job
+		go fs.hashForTorrent(meta, job, content)
+	} else {
+		content.Close()
+	}
+	fs.mu.Unlock()
+
+	select {
+	case <-job.done:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+	if job.err != nil {
+		return nil, nil, job.err
+	}
+	return meta, job.pieces, nil
+}
+
+// hashForTorrent runs job on the content of a file and closes the content.
+func (fs *FileStore) hashForTorrent(meta *FileMetadata, job *torrentHash, content fileContent) {
+	defer content.Close()
+	job.pieces, job.err = hashTorrentPieces(content, torrentPieceLength(meta.Size))
+	if job.err != nil {
+		job.err = fmt.Errorf("%w: %w", errTorrentHash, job.err)
+		fs.mu.Lock()
+		meta.torrent = nil
+		fs.mu.Unlock()
+	}
+	close(job.done)
+}
+
+// torrentInfo is the info dictionary of a single-file torrent; its SHA-1 is the
+// torrent's info hash.
+func torrentInfo(meta *FileMetadata, pieces *torrentPieces) map[string]any {
+	return map[string]any{
+		"name":         meta.ConvertedName,
+		"length":       meta.Size,
+		"piece length": pieces.pieceLength,
+		"pieces":       pieces.hashes,
+	}
+}
+
+// torrentFile builds the metainfo of a file, web-seeded from seedURL.
+func (c torrentConfig) torrentFile(meta *FileMetadata, pieces *torrentPieces, seedURL string) []byte {
+	torrent := map[string]any{
+		"info":          torrentInfo(meta, pieces),
+		"url-list":      []any{seedURL},
+		"created by":    "go-file-conversion",
+		"creation date": meta.UploadTime.Unix(),
+	}
+	if len(c.trackers) > 0 {
+		torrent["announce"] = c.trackers[0]
+		tiers := make([]any, len(c.trackers))
+		for i, t := range c.trackers {
+			tiers[i] = []any{t}
+		}
+		torrent["announce-list"] = tiers
+	}
+	var buf bytes.Buffer
+	bencode(&buf, torrent)
+	return buf.Bytes()
+}
+
+// magnetLink returns a magnet link for a file, carrying its web seed and trackers.
+func (c torrentConfig) magnetLink(meta *FileMetadata, infoHash, seedURL string) string {
+	q := url.Values{}
+	q.Set("dn", meta.ConvertedName)
+	q.Set("xl", strconv.FormatInt(meta.Size, 10))
+	q.Set("ws", seedURL)
+	q["tr"] = c.trackers
+	// xt is not escaped: clients expect the colons of the URN as they are
+	return "magnet:?xt=urn:btih:" + infoHash + "&" + q.Encode()
+}
+
+// bencode writes v in BitTorrent's encoding. It handles the types torrent
+// metainfo is made of: strings, byte strings, integers, lists and dictionaries.
+func bencode(w *bytes.Buffer, v any) {
+	switch v := v.(type) {
+	case string:
+		fmt.Fprintf(w, "%d:%s", len(v), v)
+	case []byte:
+		fmt.Fprintf(w, "%d:", len(v))
+		w.Write(v)
+	case int64:
+		fmt.Fprintf(w, "i%de", v)
+	case []any:
+		w.WriteByte('l')
+		for _, item := range v {
+			bencode(w, item)
+		}
+		w.WriteByte('e')
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys) // Dictionaries must be sorted by key
+		w.WriteByte('d')
+		for _, k := range keys {
+			bencode(w, k)
+			bencode(w, v[k])
+		}
+		w.WriteByte('e')
+	default:
+		panic(fmt.Sprintf("bencode: unsupported type %T", v))
+	}
+}
+
+// handleFileTorrent serves a .torrent of a large file, web-seeded from its
+// download URL, so sending it to many recipients doesn't multiply the server's
+// egress. With ?format=magnet it returns a magnet link instead. Either embeds the
+// share token, so like any download link it lets its holder download the file.
+// The file is hashed the first time its torrent is asked for.
+func handleFileTorrent(fs *FileStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		meta, ok := authorizeFile(fs, w, r, r.PathValue("id"), accessShare)
+		if !ok {
+			return
+		}
+		if meta.Status != jobCompleted {
+			http.Error(w, "Job has no output to download", http.StatusNotFound)
+			return
+		}
+		if !torrentOutput.offered(meta.Size) {
+			http.Error(w, "Torrents are not offered for this file; download it directly", http.StatusBadRequest)
+			return
+		}
+
+		meta, pieces, err := fs.torrentPiecesFor(r.Context(), meta.ID)
+		switch {
+		case err == nil:
+		case errors.Is(err, context.Canceled):
+			w.WriteHeader(statusClientClosedRequest) // Only for the logs; the client is gone
+			return
+		case errors.Is(err, errTorrentHash):
+			log.Printf("Error hashing file %s for its torrent: %v", r.PathValue("id"), err)
+			http.Error(w, "Error preparing the torrent", http.StatusInternalServerError)
+			return
+		default:
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		seedURL := torrentOutput.webSeedURL(r, meta)
+
+		if r.URL.Query().Get("format") == "magnet" {
+			var info bytes.Buffer
+			bencode(&info, torrentInfo(meta, pieces))
+			sum := sha1.Sum(info.Bytes())
+			infoHash := hex.EncodeToString(sum[:])
+			writeJSON(w, http.StatusOK, map[string]any{
+				"fileId":    meta.ID,
+				"infoHash":  infoHash,
+				"magnetUrl": torrentOutput.magnetLink(meta, infoHash, seedURL),
+			})
+			return
+		}
+
+		name := strings.TrimSuffix(meta.ConvertedName, ".torrent") + ".torrent"
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+name+"\"")
+		w.Header().Set("Content-Type", "application/x-bittorrent")
+		http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(torrentOutput.torrentFile(meta, pieces, seedURL)))
+	}
+}
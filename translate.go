@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	// translationTimeout bounds one translator call.
+	translationTimeout = 120 * time.Second
+	// maxTranslationBatch and maxTranslationBatchBytes cap the texts sent in one
+	// translator call; longer documents take several.
+	maxTranslationBatch      = 100
+	maxTranslationBatchBytes = 32 << 10
+)
+
+// textTranslator is the configured translation service; nil disables translation.
+var textTranslator translator
+
+// languageTagPattern matches the language tags accepted by translateTo and
+// translateFrom, such as "de" or "pt-BR".
+var languageTagPattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// translatableFormats are the text formats that can be translated, and have
+// their language detected, as they are converted.
+var translatableFormats = map[string]bool{"txt": true, "md": true, "html": true, "srt": true}
+
+// translator translates texts, keeping their number and order.
+type translator interface {
+	translate(ctx context.Context, req translationRequest, report *ConversionReport) ([]string, error)
+}
+
+// translationRequest is what translators are asked, e.g.
+// {"source":"en","target":"de","texts":["Hello"]}. Each text is a paragraph, a
+// run of HTML text or a subtitle.
+type translationRequest struct {
+	Source string   `json:"source,omitempty"` // Empty when the language is unknown
+	Target string   `json:"target"`
+	Texts  []string `json:"texts"`
+}
+
+// translationResponse is what translators answer with, e.g. {"texts":["Hallo"]}.
+type translationResponse struct {
+	Texts []string `json:"texts"`
+}
+
+// httpTranslator posts requests to an external translation service.
+type httpTranslator struct {
+	url    string
+	client *http.Client
+}
+
+func (t *httpTranslator) translate(ctx context.Context, req translationRequest, _ *ConversionReport) ([]string, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("translator request failed: %w", timeoutError(err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("translator answered %s", resp.Status)
+	}
+
+	var out translationResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 16*maxTranslationBatchBytes)).Decode(&out); err != nil {
+		return nil, fmt.Errorf("invalid translator response: %w", err)
+	}
+	return out.Texts, nil
+}
+
+// commandTranslator runs a local program, writing the request to its standard
+// input and reading the response from its standard output.
+type commandTranslator struct {
+	binary string
+	args   []string
+}
+
+func (t *commandTranslator) translate(ctx context.Context, req translationRequest, report *ConversionReport) ([]string, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, t.binary, t.args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = bytes.NewReader(body), &stdout, &stderr
+	timer := time.AfterFunc(translationTimeout, func() { cmd.Process.Kill() })
+	start := time.Now()
+	err = cmd.Run()
+	timedOut := !timer.Stop()
+	report.addCommand(newCommandTrace(cmd, time.Since(start), stderr.Bytes(), err))
+	if timedOut {
+		return nil, fmt.Errorf("translator command %w after %s", ErrTimeout, translationTimeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("translator command failed: %w", err)
+	}
+
+	var out translationResponse
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return nil, fmt.Errorf("invalid translator output: %w", err)
+	}
+	return out.Texts, nil
+}
+
+// loadTranslator configures translation from FILECONVERTER_TRANSLATE_URL (an
+// external service) or FILECONVERTER_TRANSLATE_COMMAND (a local program, e.g.
+// "/opt/mt/translate --json"). It returns nil when neither is set.
+func loadTranslator() (translator, error) {
+	url, command := os.Getenv("FILECONVERTER_TRANSLATE_URL"), os.Getenv("FILECONVERTER_TRANSLATE_COMMAND")
+	switch {
+	case url != "" && command != "":
+		return nil, fmt.Errorf("set only one of FILECONVERTER_TRANSLATE_URL and FILECONVERTER_TRANSLATE_COMMAND")
+	case url != "":
+		return &httpTranslator{url: url, client: &http.Client{Timeout: translationTimeout}}, nil
+	case command != "":
+		fields := strings.Fields(command)
+		return &commandTranslator{binary: fields[0], args: fields[1:]}, nil
+	}
+	return nil, nil
+}
+
+// LanguageReport is the language detected in a document and what it was
+// translated to, stored in the job's metadata.
+type LanguageReport struct {
+	Detected     string  `json:"detected"`   // ISO 639-1 code, or "und" when undetermined
+	Confidence   float64 `json:"confidence"` // Between 0 and 1
+	TranslatedTo string  `json:"translatedTo,omitempty"`
+	Segments     int     `json:"segments,omitempty"` // Texts sent to the translator
+}
+
+// parseLanguageOptions reads the detectLanguage, translateTo and translateFrom
+// form values into opts. The redaction options must already be parsed.
+func parseLanguageOptions(r *http.Request, opts *ConversionOptions) error {
+	if v := r.FormValue("detectLanguage"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid detectLanguage %q: must be true or false", v)
+		}
+		opts.DetectLanguage = b
+	}
+	for field, dst := range map[string]*string{"translateTo": &opts.TranslateTo, "translateFrom": &opts.TranslateFrom} {
+		v := strings.TrimSpace(r.FormValue(field))
+		if v != "" && !languageTagPattern.MatchString(v) {
+			return fmt.Errorf("invalid %s %q: expected a language code such as de or pt-BR", field, v)
+		}
+		*dst = v
+	}
+	if opts.TranslateFrom != "" && opts.TranslateTo == "" {
+		return fmt.Errorf("translateFrom needs translateTo")
+	}
+	if opts.TranslateTo != "" && textTranslator == nil {
+		return fmt.Errorf("translation is not configured on this server")
+	}
+	// Redaction applies to the rendered document, after translation, by which
+	// time the translator has been sent the text it would have removed
+	if opts.TranslateTo != "" && opts.Redact != nil {
+		return fmt.Errorf("translateTo can't be combined with redaction")
+	}
+	return nil
+}
+
+// processLanguage detects the language of a txt, md, html or srt document and,
+// if asked to, translates it, recording both in the report. It returns the
+// document in its original format.
+func processLanguage(ctx context.Context, data []byte, sourceExt string, opts ConversionOptions) ([]byte, error) {
+	doc, err := newTranslatableDocument(data, sourceExt)
+	if err != nil {
+		return nil, err
+	}
+	guess := detectLanguage(strings.Join(doc.texts(), "\n"))
+	report := &LanguageReport{Detected: guess.Language, Confidence: guess.Confidence}
+	if opts.TranslateTo == "" {
+		opts.Report.setLanguage(report)
+		return data, nil
+	}
+
+	source := opts.TranslateFrom
+	if source == "" && guess.Language != "und" {
+		source = guess.Language
+	}
+	texts := doc.texts()
+	translated, err := translateTexts(ctx, texts, source, opts.TranslateTo, opts.Report)
+	if err != nil {
+		return nil, err
+	}
+	report.TranslatedTo, report.Segments = opts.TranslateTo, len(texts)
+	opts.Report.setLanguage(report)
+	return doc.render(translated, opts.TranslateTo)
+}
+
+// translateTexts sends texts to the translator in batches.
+func translateTexts(ctx context.Context, texts []string, source, target string, report *ConversionReport) ([]string, error) {
+	out := make([]string, 0, len(texts))
+	for start := 0; start < len(texts); {
+		end, size := start, 0
+		for end < len(texts) && end-start < maxTranslationBatch && (end == start || size+len(texts[end]) <= maxTranslationBatchBytes) {
+			size += len(texts[end])
+			end++
+		}
+		batch, err := textTranslator.translate(ctx, translationRequest{Source: source, Target: target, Texts: texts[start:end]}, report)
+		if err != nil {
+			return nil, fmt.Errorf("translation failed: %w", err)
+		}
+		if len(batch) != end-start {
+			return nil, fmt.Errorf("translation failed: sent %d texts, got %d back", end-start, len(batch))
+		}
+		out = append(out, batch...)
+		start = end
+	}
+	return out, nil
+}
+
+// translatableDocument is a document split into the texts to translate and the
+// parts kept as they are, such as markup, code and subtitle timings.
+type translatableDocument interface {
+	texts() []string
+	render(translated []string, lang string) ([]byte, error)
+}
+
+func newTranslatableDocument(data []byte, sourceExt string) (translatableDocument, error) {
+	switch sourceExt {
+	case "txt":
+		return newParagraphDocument(string(data), false), nil
+	case "md":
+		return newParagraphDocument(string(data), true), nil
+	case "html":
+		return newHTMLDocument(data)
+	case "srt":
+		return parseSRT(data)
+	default:
+		return nil, fmt.Errorf("language detection and translation only apply to txt, md, html and srt files")
+	}
+}
+
+// paragraphDocument is plain text or Markdown split at blank lines. Markdown
+// code blocks are kept as they are.
+type paragraphDocument struct {
+	blocks    []string
+	translate []bool // Whether each block is text to translate
+}
+
+func newParagraphDocument(text string, markdown bool) *paragraphDocument {
+	d := &paragraphDocument{}
+	var block []string
+	inCode := false
+	flush := func(translate bool) {
+		if len(block) > 0 {
+			d.blocks = append(d.blocks, strings.Join(block, "\n"))
+			d.translate = append(d.translate, translate)
+			block = nil
+		}
+	}
+	for _, line := range strings.Split(text, "\n") {
+		fence := markdown && (strings.HasPrefix(strings.TrimSpace(line), "```") || strings.HasPrefix(strings.TrimSpace(line), "~~~"))
+		switch {
+		case fence && !inCode:
+			flush(true)
+			inCode = true
+			block = append(block, line)
+		case fence && inCode:
+			block = append(block, line)
+			flush(false)
+			inCode = false
+		case inCode:
+			block = append(block, line)
+		case strings.TrimSpace(line) == "":
+			flush(true)
+			d.blocks = append(d.blocks, line)
+			d.translate = append(d.translate, false)
+		default:
+			block = append(block, line)
+		}
+	}
+	flush(!inCode)
+	return d
+}
+
+func (d *paragraphDocument) texts() []string {
+	var out []string
+	for i, b := range d.blocks {
+		if d.translate[i] {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+func (d *paragraphDocument) render(translated []string, _ string) ([]byte, error) {
+	var b strings.Builder
+	for i, block := range d.blocks {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		if d.translate[i] {
+			block, translated = translated[0], translated[1:]
+		}
+		b.WriteString(block)
+	}
+	return []byte(b.String()), nil
+}
+
+// htmlDocument is an HTML page whose text nodes are translated one by one,
+// except in scripts, styles and code.
+type htmlDocument struct {
+	doc   *html.Node
+	nodes []*html.Node
+}
+
+func newHTMLDocument(data []byte) (*htmlDocument, error) {
+	doc, err := html.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse HTML: %w", err)
+	}
+	d := &htmlDocument{doc: doc}
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		switch n.DataAtom {
+		case atom.Script, atom.Style, atom.Code, atom.Pre, atom.Textarea:
+			return
+		}
+		if n.Type == html.TextNode && strings.TrimSpace(n.Data) != "" {
+			d.nodes = append(d.nodes, n)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	return d, nil
+}
+
+func (d *htmlDocument) texts() []string {
+	out := make([]string, len(d.nodes))
+	for i, n := range d.nodes {
+		out[i] = strings.TrimSpace(n.Data)
+	}
+	return out
+}
+
+// render puts the translations in place, keeping the white space around each
+// text, and sets the page's language.
+func (d *htmlDocument) render(translated []string, lang string) ([]byte, error) {
+	for i, n := range d.nodes {
+		lead := n.Data[:len(n.Data)-len(strings.TrimLeft(n.Data, " \t\r\n"))]
+		trail := n.Data[len(strings.TrimRight(n.Data, " \t\r\n")):]
+		n.Data = lead + translated[i] + trail
+	}
+	for c := d.doc.FirstChild; c != nil; c = c.NextSibling {
+		if c.DataAtom == atom.Html {
+			setAttr(c, "lang", lang)
+		}
+	}
+	var buf bytes.Buffer
+	if err := html.Render(&buf, d.doc); err != nil {
+		return nil, fmt.Errorf("failed to write HTML: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// setAttr sets an attribute of an element, replacing any it has.
+func setAttr(n *html.Node, key, val string) {
+	for i, a := range n.Attr {
+		if a.Key == key {
+			n.Attr[i].Val = val
+			return
+		}
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: key, Val: val})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// defaultUndoWindow is how long a file deleted through the API can be restored;
+// override with FILECONVERTER_UNDO_WINDOW, or set it to 0 to delete at once.
+const defaultUndoWindow = 5 * time.Minute
+
+// errNotRestorable is returned when restoring a file that was not deleted or
+// whose undo window has passed.
+var errNotRestorable = errors.New("file not found or no longer restorable")
+
+// trashedFile is a deleted file whose content is kept until purgeAt, so the
+// deletion can be undone.
+type trashedFile struct {
+	meta    *FileMetadata
+	purgeAt time.Time
+}
+
+// trashFile moves a file to the trash, out of reach of downloads and lookups, and
+// returns when it will be purged.
+// This function expects the lock to be already held.
+func (fs *FileStore) trashFile(meta *FileMetadata, now time.Time) time.Time {
+	purgeAt := now.Add(fs.undoWindow)
+	fs.trash[meta.ID] = &trashedFile{meta: meta, purgeAt: purgeAt}
+	delete(fs.files, meta.ID)
+	log.Printf("Moved file %s (%s) to the trash until %s", meta.ID, meta.OriginalName, purgeAt.Format(time.RFC3339))
+	return purgeAt
+}
+
+// purgeTrash permanently removes trashed files whose undo window has passed.
+// This function expects the lock to be already held.
+func (fs *FileStore) purgeTrash(now time.Time) {
+	for id, t := range fs.trash {
+		if now.After(t.purgeAt) {
+			fs.removeContent(t.meta)
+			delete(fs.trash, id)
+			log.Printf("Purged deleted file %s (%s)", id, t.meta.OriginalName)
+		}
+	}
+}
+
+// RestoreFile undoes the deletion of a file within its undo window, on behalf of
+// the holder of its owner token. A file that expired while in the trash is purged
+// instead.
+func (fs *FileStore) RestoreFile(fileID, token string) (*FileMetadata, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	now := time.Now()
+	t, ok := fs.trash[fileID]
+	if !ok || now.After(t.purgeAt) || t.meta.access(token) < accessOwner {
+		return nil, errNotRestorable
+	}
+	delete(fs.trash, fileID)
+	if t.meta.expired(now) {
+		fs.removeContent(t.meta)
+		return nil, errNotRestorable
+	}
+	fs.files[fileID] = t.meta
+	log.Printf("Restored deleted file %s (%s)", fileID, t.meta.OriginalName)
+	info := *t.meta
+	return &info, nil
+}
+
+// handleRestoreFile undoes a deletion on behalf of the file's owner. Unknown
+// files and wrong tokens get the same answer, so the trash can't be probed.
+func handleRestoreFile(fs *FileStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		meta, err := fs.RestoreFile(r.PathValue("id"), requestFileToken(r))
+		if err != nil {
+			notFound(w, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"restored":    meta.ID,
+			"fileName":    meta.ConvertedName,
+			"downloadUrl": downloadURL(r, meta),
+			"expiresAt":   meta.ExpiryTime,
+		})
+	}
+}
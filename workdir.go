@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// jobWorkdir is a private temporary directory holding the artifacts of one
+// conversion job: its input, the intermediate output of every pipeline stage and
+// the final output. Using a directory per job keeps concurrent jobs from
+// clobbering each other's files, and cleanup removes everything in one go.
+type jobWorkdir struct {
+	dir string
+	seq int // Numbers artifacts so stages never overwrite each other
+}
+
+// newJobWorkdir creates a fresh working directory; callers must defer cleanup.
+func newJobWorkdir() (*jobWorkdir, error) {
+	dir, err := os.MkdirTemp("", "fileconverter-job-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	return &jobWorkdir{dir: dir}, nil
+}
+
+// path returns the path of a named file in the working directory.
+func (wd *jobWorkdir) path(name string) string {
+	return filepath.Join(wd.dir, name)
+}
+
+// artifact returns a new, unused path for an intermediate file with the given extension.
+func (wd *jobWorkdir) artifact(ext string) string {
+	wd.seq++
+	return wd.path("stage" + strconv.Itoa(wd.seq) + "." + ext)
+}
+
+// writeInput stores the job's input bytes as "input.<ext>" and returns its path.
+func (wd *jobWorkdir) writeInput(ext string, data []byte) (string, error) {
+	p := wd.path("input." + ext)
+	if err := os.WriteFile(p, data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write temporary input file: %w", err)
+	}
+	return p, nil
+}
+
+// readOutput reads a finished artifact back into memory.
+func (wd *jobWorkdir) readOutput(p string) ([]byte, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read converted file: %w", err)
+	}
+	return data, nil
+}
+
+// cleanup removes the working directory and every artifact in it.
+func (wd *jobWorkdir) cleanup() {
+	os.RemoveAll(wd.dir)
+}
+
+// conversionStage is one step of a chained conversion: it reads the artifact at
+// in and writes its result to out.
+type conversionStage struct {
+	name string // Used in error messages
+	ext  string // Extension of the stage's output
+	run  func(ctx context.Context, in, out string) error
+}
+
+// runPipeline feeds input through the stages in order, each writing a new artifact
+// the next one reads, and returns the path of the last one. Intermediate artifacts
+// are removed as soon as the following stage has consumed them so long chains
+// don't hold every stage on disk at once. The stages stop when ctx ends.
+// Artifacts handed between stages are recorded in report as intermediates; they
+// are documents, such as HTML, which carry their content over in full.
+func (wd *jobWorkdir) runPipeline(ctx context.Context, report *ConversionReport, input string, stages ...conversionStage) (string, error) {
+	current := input
+	for i, stage := range stages {
+		if i > 0 {
+			report.addIntermediate(IntermediateStep{Format: stages[i-1].ext, Lossless: true, Into: stage.name})
+		}
+		out := wd.artifact(stage.ext)
+		if err := stage.run(ctx, current, out); err != nil {
+			return "", fmt.Errorf("%s failed: %w", stage.name, err)
+		}
+		if i > 0 {
+			os.Remove(current)
+		}
+		current = out
+	}
+	return current, nil
+}
+
+// runCommandWithInput runs cmd with src streamed to its standard input, letting a
+// stage hand its output to a tool that reads from a pipe instead of a temp file.
+// write produces the stream; a write error aborts the command.
+func runCommandWithInput(report *ConversionReport, cmd *exec.Cmd, write func(w io.Writer) error) ([]byte, error) {
+	pr, pw := io.Pipe()
+	cmd.Stdin = pr
+	writeErr := make(chan error, 1)
+	go func() {
+		err := write(pw)
+		pw.CloseWithError(err)
+		writeErr <- err
+	}()
+
+	output, err := runCommand(report, cmd)
+	pr.Close() // Unblock the writer if the command exited without reading everything
+	if werr := <-writeErr; werr != nil && err == nil {
+		err = fmt.Errorf("failed to stream input: %w", werr)
+	}
+	return output, err
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// workspace groups the files of a multi-step editing session: a client uploads
+// files into it, converts them and their outputs further by ID, and downloads the
+// artifacts it wants at the end. Its files share one expiry time, which every new
+// file pushes back, so a session's early inputs don't expire while it is still
+// working on them; files the retention policy keeps for less expire sooner. The workspace token grants owner access to all of its files.
+type workspace struct {
+	ID         string
+	TokenHash  [sha256.Size]byte
+	Created    time.Time
+	ExpiryTime time.Time
+	Files      []string // IDs of the files added to it, oldest first
+}
+
+// CreateWorkspace starts an empty workspace and returns it with its token, which
+// is not kept. It fails with errTooManyWorkspaces at the limit on live ones.
+func (fs *FileStore) CreateWorkspace() (*workspace, string, error) {
+	id, err := generateID()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate workspace ID: %w", err)
+	}
+	token, err := generateID()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate workspace token: %w", err)
+	}
+	now := time.Now()
+	ws := &workspace{ID: id, TokenHash: hashOwnerToken(token), Created: now, ExpiryTime: now.Add(fs.retention.defaultKeep)}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.limits.Workspaces > 0 && len(fs.workspaces) >= fs.limits.Workspaces {
+		fs.removeExpiredWorkspaces(now)
+		if len(fs.workspaces) >= fs.limits.Workspaces {
+			return nil, "", errTooManyWorkspaces
+		}
+	}
+	fs.workspaces[id] = ws
+	return ws, token, nil
+}
+
+// workspaceLocked returns a live workspace whose token the request carries.
+// This function expects the lock to be already held.
+func (fs *FileStore) workspaceLocked(id, token string) (*workspace, bool) {
+	ws, exists := fs.workspaces[id]
+	if !exists || time.Now().After(ws.ExpiryTime) || token == "" {
+		return nil, false
+	}
+	hash := hashOwnerToken(token)
+	return ws, subtle.ConstantTimeCompare(hash[:], ws.TokenHash[:]) == 1
+}
+
+// workspaceGrants reports whether token is the token of the workspace a file
+// belongs to.
+func (fs *FileStore) workspaceGrants(meta *FileMetadata, token string) bool {
+	if meta.Workspace == "" {
+		return false
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	_, ok := fs.workspaceLocked(meta.Workspace, token)
+	return ok
+}
+
+// joinWorkspace adds a new file to the workspace its job was started in,
+// pushing the expiry of the workspace back by the default retention, up to the
+// maximum retention after the workspace was created, and its files' with it.
+// Files whose workspace has meanwhile expired are stored on their own.
+// This function expects the lock to be already held.
+func (fs *FileStore) joinWorkspace(meta *FileMetadata) {
+	if meta.Workspace == "" {
+		return
+	}
+	ws, exists := fs.workspaces[meta.Workspace]
+	if !exists || time.Now().After(ws.ExpiryTime) {
+		meta.Workspace = ""
+		return
+	}
+	now := meta.UploadTime
+	ws.ExpiryTime = now.Add(fs.retention.defaultKeep)
+	if latest := ws.Created.Add(fs.retention.maxKeep); ws.ExpiryTime.After(latest) {
+		ws.ExpiryTime = latest
+	}
+	ws.Files = append(ws.Files, meta.ID)
+	meta.ExpiryTime = fs.memberExpiry(ws, meta, now)
+	for _, id := range ws.Files {
+		if f, ok := fs.files[id]; ok {
+			f.ExpiryTime = fs.memberExpiry(ws, f, now)
+		}
+	}
+}
+
+// memberExpiry is when a workspace's file expires after the workspace's expiry
+// was pushed back at now: with the workspace, unless the retention policy keeps
+// the file for less, counted from now.
+func (fs *FileStore) memberExpiry(ws *workspace, meta *FileMetadata, now time.Time) time.Time {
+	if own := now.Add(fs.retention.keepFor(meta)); own.Before(ws.ExpiryTime) {
+		return own
+	}
+	return ws.ExpiryTime
+}
+
+// workspaceFiles returns copies of the metadata of a workspace's live files,
+// oldest first.
+// This function expects the lock to be already held.
+func (fs *FileStore) workspaceFiles(ws *workspace) []*FileMetadata {
+	now := time.Now()
+	var files []*FileMetadata
+	for _, id := range ws.Files {
+		if meta, ok := fs.files[id]; ok && !meta.expired(now) {
+			info := *meta
+			files = append(files, &info)
+		}
+	}
+	return files
+}
+
+// removeExpiredWorkspaces forgets workspaces past their expiry time; their files
+// expire with them.
+// This function expects the lock to be already held.
+func (fs *FileStore) removeExpiredWorkspaces(now time.Time) {
+	for id, ws := range fs.workspaces {
+		if now.After(ws.ExpiryTime) {
+			delete(fs.workspaces, id)
+		}
+	}
+}
+
+// DeleteWorkspace removes a workspace and deletes its files like DeleteFile,
+// except those under legal hold, which are kept on their own. It returns how
+// many files were deleted and, with an undo window, when the trash is purged of
+// them; each can be restored with its owner token until then.
+func (fs *FileStore) DeleteWorkspace(id, token string) (int, time.Time, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	ws, ok := fs.workspaceLocked(id, token)
+	if !ok {
+		return 0, time.Time{}, fmt.Errorf("workspace not found or expired")
+	}
+	now := time.Now()
+	deleted := 0
+	var purgeAt time.Time
+	for _, fileID := range ws.Files {
+		meta, exists := fs.files[fileID]
+		if !exists || meta.expired(now) {
+			continue
+		}
+		meta.Workspace = ""
+		if meta.Hold != nil {
+			continue
+		}
+		if fs.undoWindow > 0 {
+			purgeAt = fs.trashFile(meta, now)
+		} else {
+			fs.deleteFileInternal(fileID)
+		}
+		deleted++
+	}
+	delete(fs.workspaces, id)
+	return deleted, purgeAt, nil
+}
+
+// authorizeWorkspace looks up the workspace a request names by its "ws" path
+// value, answering the request itself if the request's token doesn't open it.
+func authorizeWorkspace(fs *FileStore, w http.ResponseWriter, r *http.Request) (*workspace, []*FileMetadata, bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	ws, ok := fs.workspaceLocked(r.PathValue("ws"), requestFileToken(r))
+	if !ok {
+		notFound(w, "Workspace not found or expired, or the token does not open it")
+		return nil, nil, false
+	}
+	info := *ws
+	return &info, fs.workspaceFiles(ws), true
+}
+
+// inWorkspace guards the routes that act inside a workspace, such as uploading
+// into it, which take the workspace from the "ws" path value.
+func inWorkspace(fs *FileStore, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := authorizeWorkspace(fs, w, r); ok {
+			next(w, r)
+		}
+	}
+}
+
+// workspaceInfo describes a workspace and its files for JSON responses.
+func workspaceInfo(r *http.Request, ws *workspace, files []*FileMetadata) map[string]any {
+	infos := make([]map[string]any, len(files))
+	for i, meta := range files {
+		infos[i] = fileInfo(r, meta)
+	}
+	return map[string]any{
+		"workspaceId": ws.ID,
+		"createdAt":   ws.Created.Format(time.RFC3339),
+		"expiryTime":  ws.ExpiryTime.Format(time.RFC3339),
+		"files":       infos,
+	}
+}
+
+// handleCreateWorkspace starts a workspace. The token in the response is the only
+// copy; it goes in the X-File-Token header or "token" query parameter of every
+// request in the workspace, and opens each file in it like its owner token.
+func handleCreateWorkspace(fs *FileStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ws, token, err := fs.CreateWorkspace()
+		if errors.Is(err, errTooManyWorkspaces) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(cleanupInterval/time.Second)))
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		body := workspaceInfo(r, ws, nil)
+		body["workspaceToken"] = token
+		writeJSON(w, http.StatusCreated, body)
+	}
+}
+
+// handleWorkspaceInfo lists a workspace's files with their info.
+func handleWorkspaceInfo(fs *FileStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ws, files, ok := authorizeWorkspace(fs, w, r)
+		if !ok {
+			return
+		}
+		writeJSON(w, http.StatusOK, workspaceInfo(r, ws, files))
+	}
+}
+
+// handleDeleteWorkspace ends a workspace, deleting its files.
+func handleDeleteWorkspace(fs *FileStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("ws")
+		deleted, purgeAt, err := fs.DeleteWorkspace(id, requestFileToken(r))
+		if err != nil {
+			notFound(w, err.Error())
+			return
+		}
+		log.Printf("Workspace %s deleted with %d files", id, deleted)
+		body := map[string]any{"deleted": id, "filesDeleted": deleted}
+		if !purgeAt.IsZero() {
+			body["restorableUntil"] = purgeAt // Each file's owner token restores it until then
+		}
+		writeJSON(w, http.StatusOK, body)
+	}
+}
+
+// handleWorkspaceDownload bundles the completed files of a workspace into a zip
+// archive: those named in the comma-separated "files" query parameter, or all of
+// them.
+func handleWorkspaceDownload(fs *FileStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ws, files, ok := authorizeWorkspace(fs, w, r)
+		if !ok {
+			return
+		}
+
+		var ids []string
+		if selected := r.URL.Query().Get("files"); selected != "" {
+			ids = strings.Split(selected, ",")
+		} else {
+			for _, meta := range files {
+				if meta.Status == jobCompleted {
+					ids = append(ids, meta.ID)
+				}
+			}
+		}
+		if len(ids) == 0 {
+			http.Error(w, "Workspace has no files to download", http.StatusNotFound)
+			return
+		}
+
+		// Every file is opened before the response starts, so a missing one can
+		// still be reported; an open file stays readable even if it expires
+		type entry struct {
+			meta    *FileMetadata
+			content fileContent
+			name    string
+		}
+		var entries []entry
+		defer func() {
+			for _, e := range entries {
+				e.content.Close()
+			}
+		}()
+		taken := map[string]bool{}
+		for _, id := range ids {
+			meta, content, err := fs.OpenFile(strings.TrimSpace(id))
+			if err == nil && meta.Workspace != ws.ID {
+				content.Close()
+				err = fmt.Errorf("file not found in this workspace")
+			}
+			if err != nil {
+				notFound(w, fmt.Sprintf("File %s: %v", id, err))
+				return
+			}
+			entries = append(entries, entry{meta: meta, content: content, name: uniqueEntryName(meta.ConvertedName, taken)})
+		}
+
+		// The archive is streamed, so files larger than memory can be bundled;
+		// a failure part way can only cut the response short
+		w.Header().Set("Content-Disposition", "attachment; filename=\"workspace-"+ws.ID+".zip\"")
+		w.Header().Set("Content-Type", "application/zip")
+		zw := zip.NewWriter(w)
+		for _, e := range entries {
+			ew, err := zw.CreateHeader(&zip.FileHeader{Name: e.name, Method: zip.Deflate, Modified: e.meta.UploadTime})
+			if err == nil {
+				_, err = io.Copy(ew, e.content)
+			}
+			if err != nil {
+				log.Printf("Error streaming workspace %s download: %s: %v", ws.ID, e.name, err)
+				return
+			}
+		}
+		if err := zw.Close(); err != nil {
+			log.Printf("Error streaming workspace %s download: %v", ws.ID, err)
+		}
+	}
+}
+
+// uniqueEntryName returns name, or name numbered like "name (1).ext" if it is
+// already taken, and marks the result taken.
+func uniqueEntryName(name string, taken map[string]bool) string {
+	candidate := name
+	ext := filepath.Ext(name)
+	for i := 1; taken[candidate]; i++ {
+		candidate = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext)
+	}
+	taken[candidate] = true
+	return candidate
+}